@@ -0,0 +1,352 @@
+package api
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// smoothing factor of latency-EWMA balancer.
+	ewmaAlpha = 0.3
+	// latency sample of failed requests.
+	ewmaErrorPenalty = time.Second * 10
+	// virtual nodes of each server on the hash ring.
+	hashReplicas = 160
+)
+
+// Balancer chooses a storage server from the candidates,
+// implementations must be safe for concurrent use.
+type Balancer interface {
+	// Select chooses a server from the candidates,
+	// the key is the fileId for downloading and empty for uploading.
+	//
+	// The candidates are sorted by instance id.
+	Select(candidates []*common.Instance, key string) *common.Instance
+
+	// Done reports a finished request on the server chosen by Select,
+	// it must be called once for each Select.
+	Done(server *common.Server, elapsed time.Duration, err error)
+}
+
+// NewBalancer creates a Balancer by strategy name.
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", common.BALANCER_ROUND_ROBIN:
+		return NewRoundRobinBalancer(), nil
+	case common.BALANCER_LEAST_INFLIGHT:
+		return NewLeastInFlightBalancer(), nil
+	case common.BALANCER_LATENCY_EWMA:
+		return NewLatencyEWMABalancer(), nil
+	case common.BALANCER_CAPACITY_WEIGHTED:
+		return NewCapacityWeightedBalancer(), nil
+	case common.BALANCER_CONSISTENT_HASH:
+		return NewConsistentHashBalancer(), nil
+	}
+	return nil, errors.New("unknown balancer \"" + name + "\"")
+}
+
+// serverKey identifies a server in balancers,
+// static storage servers may have no instance id.
+func serverKey(s *common.Server) string {
+	if s.InstanceId != "" {
+		return s.InstanceId
+	}
+	return s.ConnectionString()
+}
+
+// selectMin chooses the candidate with the lowest score,
+// ties are broken in turn by next.
+func selectMin(candidates []*common.Instance, next int, score func(k string) float64) *common.Instance {
+	var ties []*common.Instance
+	min := 0.0
+	for _, c := range candidates {
+		v := score(serverKey(&c.Server))
+		if len(ties) == 0 || v < min {
+			ties = append(ties[:0], c)
+			min = v
+		} else if v == min {
+			ties = append(ties, c)
+		}
+	}
+	return ties[next%len(ties)]
+}
+
+// roundRobinBalancer chooses the candidates in turn.
+type roundRobinBalancer struct {
+	next uint64
+}
+
+// NewRoundRobinBalancer creates a round-robin Balancer.
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (b *roundRobinBalancer) Select(candidates []*common.Instance, key string) *common.Instance {
+	if len(candidates) == 0 {
+		return nil
+	}
+	i := atomic.AddUint64(&b.next, 1) - 1
+	return candidates[i%uint64(len(candidates))]
+}
+
+func (b *roundRobinBalancer) Done(server *common.Server, elapsed time.Duration, err error) {}
+
+// leastInFlightBalancer chooses the candidate with least in-flight requests.
+type leastInFlightBalancer struct {
+	lock     *sync.Mutex
+	inflight map[string]int
+	next     int // ties are broken in turn
+}
+
+// NewLeastInFlightBalancer creates a least-in-flight Balancer.
+func NewLeastInFlightBalancer() Balancer {
+	return &leastInFlightBalancer{
+		lock:     new(sync.Mutex),
+		inflight: make(map[string]int),
+	}
+}
+
+func (b *leastInFlightBalancer) Select(candidates []*common.Instance, key string) *common.Instance {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+	selected := selectMin(candidates, b.next, func(k string) float64 {
+		return float64(b.inflight[k])
+	})
+	b.next++
+	b.inflight[serverKey(&selected.Server)]++
+	return selected
+}
+
+func (b *leastInFlightBalancer) Done(server *common.Server, elapsed time.Duration, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	k := serverKey(server)
+	if b.inflight[k] <= 1 {
+		delete(b.inflight, k)
+		return
+	}
+	b.inflight[k]--
+}
+
+// latencyEWMABalancer chooses the candidate with the lowest
+// exponentially weighted moving average of latency,
+// which is multiplied by the in-flight requests.
+//
+// Servers without latency samples are preferred.
+type latencyEWMABalancer struct {
+	lock     *sync.Mutex
+	ewma     map[string]float64 // latency in milliseconds
+	inflight map[string]int
+	next     int
+}
+
+// NewLatencyEWMABalancer creates a latency-EWMA Balancer.
+func NewLatencyEWMABalancer() Balancer {
+	return &latencyEWMABalancer{
+		lock:     new(sync.Mutex),
+		ewma:     make(map[string]float64),
+		inflight: make(map[string]int),
+	}
+}
+
+func (b *latencyEWMABalancer) score(k string) float64 {
+	return b.ewma[k] * float64(b.inflight[k]+1)
+}
+
+func (b *latencyEWMABalancer) Select(candidates []*common.Instance, key string) *common.Instance {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+	selected := selectMin(candidates, b.next, b.score)
+	b.next++
+	b.inflight[serverKey(&selected.Server)]++
+	return selected
+}
+
+func (b *latencyEWMABalancer) Done(server *common.Server, elapsed time.Duration, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	k := serverKey(server)
+	if b.inflight[k] <= 1 {
+		delete(b.inflight, k)
+	} else {
+		b.inflight[k]--
+	}
+	if err != nil && elapsed < ewmaErrorPenalty {
+		elapsed = ewmaErrorPenalty
+	}
+	sample := float64(elapsed) / float64(time.Millisecond)
+	if v, ok := b.ewma[k]; ok {
+		b.ewma[k] = ewmaAlpha*sample + (1-ewmaAlpha)*v
+	} else {
+		b.ewma[k] = sample
+	}
+}
+
+// capacityWeightedBalancer chooses the candidates by smooth weighted round-robin,
+// the weights are free disk space reported by the storage servers.
+//
+// Servers which do not report free space have the average weight.
+type capacityWeightedBalancer struct {
+	lock    *sync.Mutex
+	current map[string]int64
+}
+
+// NewCapacityWeightedBalancer creates a capacity-weighted Balancer.
+func NewCapacityWeightedBalancer() Balancer {
+	return &capacityWeightedBalancer{
+		lock:    new(sync.Mutex),
+		current: make(map[string]int64),
+	}
+}
+
+// capacityWeight returns the free space in MB of the storage server,
+// it returns 0 if the server does not report it.
+func capacityWeight(ins *common.Instance) int64 {
+	v, err := convert.StrToInt64(ins.Attributes["freeSpace"])
+	if err != nil || v <= 0 {
+		return 0
+	}
+	if v>>20 == 0 {
+		return 1
+	}
+	return v >> 20
+}
+
+func (b *capacityWeightedBalancer) Select(candidates []*common.Instance, key string) *common.Instance {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+	weights := make([]int64, len(candidates))
+	var known, sum int64
+	for i, c := range candidates {
+		weights[i] = capacityWeight(c)
+		if weights[i] > 0 {
+			known++
+			sum += weights[i]
+		}
+	}
+	avg := int64(1)
+	if known > 0 {
+		avg = sum / known
+	}
+	var total int64
+	var selected *common.Instance
+	seen := make(map[string]bool)
+	for i, c := range candidates {
+		w := weights[i]
+		if w == 0 {
+			w = avg
+		}
+		k := serverKey(&c.Server)
+		seen[k] = true
+		b.current[k] += w
+		total += w
+		if selected == nil || b.current[k] > b.current[serverKey(&selected.Server)] {
+			selected = c
+		}
+	}
+	b.current[serverKey(&selected.Server)] -= total
+	// forget the servers which are gone.
+	if len(b.current) > len(candidates)*2 {
+		for k := range b.current {
+			if !seen[k] {
+				delete(b.current, k)
+			}
+		}
+	}
+	return selected
+}
+
+func (b *capacityWeightedBalancer) Done(server *common.Server, elapsed time.Duration, err error) {}
+
+// consistentHashBalancer maps the key to a candidate on a hash ring,
+// so that requests of the same file go to the same server as long as
+// the candidates do not change.
+//
+// Requests without key are chosen in turn.
+type consistentHashBalancer struct {
+	lock     *sync.Mutex
+	ringKey  string // candidates of the ring
+	hashes   []uint32
+	nodes    map[uint32]string
+	fallback Balancer
+}
+
+// NewConsistentHashBalancer creates a consistent-hash Balancer.
+func NewConsistentHashBalancer() Balancer {
+	return &consistentHashBalancer{
+		lock:     new(sync.Mutex),
+		fallback: NewRoundRobinBalancer(),
+	}
+}
+
+// buildRing rebuilds the hash ring if the candidates change.
+func (b *consistentHashBalancer) buildRing(candidates []*common.Instance) {
+	keys := make([]string, len(candidates))
+	for i, c := range candidates {
+		keys[i] = serverKey(&c.Server)
+	}
+	ringKey := strings.Join(keys, ",")
+	if ringKey == b.ringKey {
+		return
+	}
+	b.ringKey = ringKey
+	b.hashes = make([]uint32, 0, len(keys)*hashReplicas)
+	b.nodes = make(map[uint32]string)
+	for _, k := range keys {
+		for i := 0; i < hashReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(k + "#" + convert.IntToStr(i)))
+			if _, ok := b.nodes[h]; ok {
+				continue
+			}
+			b.nodes[h] = k
+			b.hashes = append(b.hashes, h)
+		}
+	}
+	sort.Slice(b.hashes, func(i, j int) bool {
+		return b.hashes[i] < b.hashes[j]
+	})
+}
+
+func (b *consistentHashBalancer) Select(candidates []*common.Instance, key string) *common.Instance {
+	if key == "" {
+		return b.fallback.Select(candidates, key)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(candidates) == 0 {
+		return nil
+	}
+	b.buildRing(candidates)
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(b.hashes), func(i int) bool {
+		return b.hashes[i] >= h
+	})
+	if i == len(b.hashes) {
+		i = 0
+	}
+	node := b.nodes[b.hashes[i]]
+	for _, c := range candidates {
+		if serverKey(&c.Server) == node {
+			return c
+		}
+	}
+	return nil
+}
+
+func (b *consistentHashBalancer) Done(server *common.Server, elapsed time.Duration, err error) {}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"testing"
+	"time"
+)
+
+func newTestCandidates(n int) []*common.Instance {
+	ret := make([]*common.Instance, n)
+	for i := range ret {
+		ret[i] = &common.Instance{
+			Server: common.Server{
+				Host:       "127.0.0.1",
+				Port:       uint16(10706 + i),
+				InstanceId: "storage" + convert.IntToStr(i),
+			},
+			Role:       common.ROLE_STORAGE,
+			Attributes: map[string]string{},
+		}
+	}
+	return ret
+}
+
+// distribution selects n times and counts the selections of each server,
+// done is called after each selection if it is not nil.
+func distribution(b Balancer, candidates []*common.Instance, n int,
+	key func(i int) string, done func(ins *common.Instance)) map[string]int {
+	ret := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ins := b.Select(candidates, key(i))
+		ret[ins.InstanceId]++
+		if done != nil {
+			done(ins)
+		}
+	}
+	return ret
+}
+
+func noKey(i int) string {
+	return ""
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	candidates := newTestCandidates(3)
+	d := distribution(NewRoundRobinBalancer(), candidates, 300, noKey, nil)
+	for _, c := range candidates {
+		if d[c.InstanceId] != 100 {
+			t.Fatal("unexpected distribution: ", d)
+		}
+	}
+	if NewRoundRobinBalancer().Select(nil, "") != nil {
+		t.Fatal("server selected from empty candidates")
+	}
+}
+
+func TestLeastInFlightBalancer(t *testing.T) {
+	candidates := newTestCandidates(3)
+	b := NewLeastInFlightBalancer()
+	// requests on storage0 never finish.
+	d := distribution(b, candidates, 300, noKey, func(ins *common.Instance) {
+		if ins.InstanceId != "storage0" {
+			b.Done(&ins.Server, time.Millisecond, nil)
+		}
+	})
+	if d["storage0"] != 1 || d["storage1"]+d["storage2"] != 299 || d["storage1"] < 140 {
+		t.Fatal("unexpected distribution: ", d)
+	}
+}
+
+func TestLatencyEWMABalancer(t *testing.T) {
+	candidates := newTestCandidates(3)
+	latency := map[string]time.Duration{
+		"storage0": time.Millisecond * 10,
+		"storage1": time.Millisecond * 100,
+		"storage2": time.Millisecond * 10,
+	}
+	b := NewLatencyEWMABalancer()
+	d := distribution(b, candidates, 300, noKey, func(ins *common.Instance) {
+		b.Done(&ins.Server, latency[ins.InstanceId], nil)
+	})
+	if d["storage1"] > 10 || d["storage0"] < 140 || d["storage2"] < 140 {
+		t.Fatal("unexpected distribution: ", d)
+	}
+
+	// failed servers are avoided.
+	b = NewLatencyEWMABalancer()
+	d = distribution(b, candidates, 300, noKey, func(ins *common.Instance) {
+		var err error
+		if ins.InstanceId == "storage0" {
+			err = errors.New("connection refused")
+		}
+		b.Done(&ins.Server, time.Millisecond*10, err)
+	})
+	if d["storage0"] > 10 {
+		t.Fatal("unexpected distribution: ", d)
+	}
+}
+
+func TestCapacityWeightedBalancer(t *testing.T) {
+	candidates := newTestCandidates(3)
+	candidates[0].Attributes["freeSpace"] = convert.Int64ToStr(300 << 20)
+	candidates[1].Attributes["freeSpace"] = convert.Int64ToStr(100 << 20)
+	// storage2 has the average weight.
+	d := distribution(NewCapacityWeightedBalancer(), candidates, 600, noKey, nil)
+	if d["storage0"] != 300 || d["storage1"] != 100 || d["storage2"] != 200 {
+		t.Fatal("unexpected distribution: ", d)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	candidates := newTestCandidates(4)
+	b := NewConsistentHashBalancer()
+	key := func(i int) string {
+		return "file" + convert.IntToStr(i)
+	}
+	d := distribution(b, candidates, 4000, key, nil)
+	for _, c := range candidates {
+		if d[c.InstanceId] < 600 {
+			t.Fatal("unexpected distribution: ", d)
+		}
+	}
+
+	// the same key goes to the same server,
+	// and only the keys of the removed server move.
+	selected := make([]string, 1000)
+	for i := range selected {
+		selected[i] = b.Select(candidates, key(i)).InstanceId
+	}
+	moved := 0
+	for i := range selected {
+		s := b.Select(candidates[1:], key(i)).InstanceId
+		if s != selected[i] {
+			moved++
+			if selected[i] != "storage0" {
+				t.Fatal("key moves to another server: ", key(i))
+			}
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Fatal("unexpected moved keys: ", moved)
+	}
+
+	// requests without key are chosen in turn.
+	d = distribution(b, candidates, 400, noKey, nil)
+	for _, c := range candidates {
+		if d[c.InstanceId] != 100 {
+			t.Fatal("unexpected distribution: ", d)
+		}
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	for _, name := range []string{"", common.BALANCER_ROUND_ROBIN, common.BALANCER_LEAST_INFLIGHT,
+		common.BALANCER_LATENCY_EWMA, common.BALANCER_CAPACITY_WEIGHTED, common.BALANCER_CONSISTENT_HASH} {
+		if _, err := NewBalancer(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewBalancer("random"); err == nil {
+		t.Fatal("unknown balancer created")
+	}
+}
@@ -12,7 +12,10 @@ import (
 	"github.com/hetianyi/gox/logger"
 	json "github.com/json-iterator/go"
 	"io"
+	"io/ioutil"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -24,6 +27,12 @@ const (
 
 var NoStorageServerErr = errors.New("no storage available")
 
+var (
+	// runtime attributes of this instance.
+	instanceAttributes    = make(map[string]string)
+	instanceAttributeLock = new(sync.Mutex)
+)
+
 // Config is the APIClient config
 type Config struct {
 	MaxConnectionsPerServer uint                    // limit max connection for each server
@@ -31,6 +40,21 @@ type Config struct {
 	SynchronizeOnce         bool                    // synchronize with each tracker server only once
 	SynchronizeOnceCallback chan int                // attached with `SynchronizeOnce`, for noticing client cli that whether all server is synced.
 	StaticStorageServers    []*common.StorageServer // storage servers
+	UploadBalancer          Balancer                // strategy of choosing storage server for uploading, round-robin by default
+	DownloadBalancer        Balancer                // strategy of choosing storage server for downloading, round-robin by default
+	Zone                    string                  // zone of this server, same-zone storage servers are preferred
+	Rack                    string                  // rack of this server, same-rack storage servers are preferred for downloading
+}
+
+// UploadOptions are the options of uploading a file.
+type UploadOptions struct {
+	IsPrivate   bool
+	TTL         time.Duration     // the file expires after TTL, 0 means never expire
+	ExpireAt    time.Time         // the file expires at the time if TTL is not set, zero means never expire
+	Name        string            // original file name, which is used when downloading the file
+	ContentType string            // mime type of the file, it is detected by the name and the content if empty
+	Attributes  map[string]string // custom attributes of the file, names consist of letters, digits, '_' and '-'
+	Identity    string            // identity the file is charged to for quotas, which is sent with the secret of the storage server
 }
 
 // ClientAPI is godfs APIClient interface.
@@ -43,6 +67,10 @@ type ClientAPI interface {
 	// If no group provided, it will upload file to a random server.
 	Upload(src io.Reader, length int64, group string, isPrivate bool) (*common.UploadResult, error)
 
+	// UploadWithOptions uploads file to specific group server with the options,
+	// such as the expire time of the file.
+	UploadWithOptions(src io.Reader, length int64, group string, options *UploadOptions) (*common.UploadResult, error)
+
 	// Download downloads a file from server.
 	//
 	// Return error can be common.NoStorageServerErr if there is no server available
@@ -54,7 +82,13 @@ type ClientAPI interface {
 	DownloadFrom(fileId string, offset int64, length int64, server *common.Server,
 		handler func(body io.Reader, bodyLength int64) error) error
 
-	// Query queries file's information by fileId.
+	// DownloadRaw downloads the stored form of a file from the storage server,
+	// such as a compressed blob, which is used for synchronization between storage servers.
+	DownloadRaw(fileId string, server *common.Server,
+		handler func(body io.Reader, bodyLength int64) error) error
+
+	// Query queries file's information by fileId, including the metadata,
+	// the stored state and the replicas on the group members.
 	//
 	// Parameter `fileId` must be the pattern of common.FILE_ID_PATTERN
 	Query(fileId string) (*common.FileInfo, error)
@@ -68,23 +102,92 @@ type ClientAPI interface {
 	// SyncBinlog synchronizes binlogs from other storage servers.
 	SyncBinlog(server *common.Server, clientState *common.BinlogQueryDTO) (*common.BinlogQueryResultDTO, error)
 
+	// FileIdDigest queries digests of fileId buckets under the prefix from storage server.
+	//
+	// Empty prefix returns digests bucketed by the first char of fileIds,
+	// a single char prefix returns digests bucketed by the first 2 chars.
+	FileIdDigest(server *common.Server, prefix string) (map[string]*common.FileIdDigestDTO, error)
+
+	// ListFileIds lists binlogs of fileIds which have one of the 2 chars prefixes from storage server.
+	ListFileIds(server *common.Server, prefixes []string) ([]common.BingLogDTO, error)
+
+	// SnapshotBegin queries the snapshot info of a storage server,
+	// which contains the binlog position where the snapshot ends.
+	SnapshotBegin(server *common.Server) (*common.SnapshotDTO, error)
+
+	// SnapshotData fetches a chunk of snapshot data from storage server
+	// beginning at the binlog position.
+	//
+	// The handler receives the binlog position of the next chunk and the chunk body.
+	SnapshotData(server *common.Server, position *common.BinlogQueryDTO,
+		handler func(next *common.BinlogQueryDTO, body io.Reader, bodyLength int64) error) error
+
+	// ReplicateFile asks the storage server to synchronize a file from this server.
+	//
+	// It returns after the file is stored on the server.
+	ReplicateFile(server *common.Server, binlog *common.BingLogDTO) error
+
+	// Decommission starts decommission of the storage server if start is true,
+	// and returns the decommission progress.
+	Decommission(server *common.Server, start bool) (*common.DecommissionStatus, error)
+
+	// GcReport returns the stale tmp files and orphan blobs of the storage server
+	// which the next garbage collection would delete.
+	GcReport(server *common.Server) (*common.GcReport, error)
+
+	// QueryUsage returns the usage of the groups and identities with their quotas
+	// aggregated by the tracker server.
+	QueryUsage(server *common.Server) ([]common.Usage, error)
+
+	// UpdateInstance sends the latest instance info of this server to tracker server.
+	UpdateInstance(server *common.Server) error
+
+	// Deregister removes this server from the registry of tracker server.
+	Deregister(server *common.Server) error
+
 	// SelectStorageServer selects proper storage server.
 	SelectStorageServer(group string, uploadable bool, exclude *list.List) *common.StorageServer
+
+	// SelectStorageServerByKey selects proper storage server by the key,
+	// which is the fileId for downloading.
+	//
+	// Each selected server must be released by ReleaseStorageServer.
+	SelectStorageServerByKey(group string, key string, uploadable bool, exclude *list.List) *common.StorageServer
+
+	// ReleaseStorageServer reports the result of a request
+	// on the storage server selected by SelectStorageServer.
+	ReleaseStorageServer(server *common.StorageServer, uploadable bool, elapsed time.Duration, err error)
+
+	// FileExists checks whether the fileId exists in the dataset of the tracker server.
+	FileExists(server *common.Server, fileId string) (bool, error)
+
+	// ProbeFile queries the state of the file stored on the storage server.
+	ProbeFile(server *common.Server, fileId string) (*common.FileReplica, error)
+
+	// List lists a page of the files on the storage server or tracker server in binlog order,
+	// the next page is listed by the cursor of the result.
+	//
+	// Cursors are only valid for the server which returns them.
+	List(server *common.Server, query *common.FileListQuery) (*common.FileListResult, error)
+
+	// UpdateTrackerServers replaces the tracker servers at runtime,
+	// synchronization with removed trackers stops and added trackers are tracked.
+	UpdateTrackerServers(servers []*common.Server)
 }
 
 // NewClient creates a new APIClient.
 func NewClient() *clientAPIImpl {
 	return &clientAPIImpl{
-		lock:    new(sync.Mutex),
-		weights: make(map[string]int64),
+		lock: new(sync.Mutex),
 	}
 }
 
 // clientAPIImpl is the implementation of APIClient.
 type clientAPIImpl struct {
-	config  *Config
-	lock    *sync.Mutex
-	weights map[string]int64 // server use weights
+	config           *Config
+	lock             *sync.Mutex
+	uploadBalancer   Balancer
+	downloadBalancer Balancer
 }
 
 func (c *clientAPIImpl) SetConfig(config *Config) {
@@ -98,6 +201,14 @@ func (c *clientAPIImpl) SetConfig(config *Config) {
 	if c.config.MaxConnectionsPerServer <= 0 {
 		c.config.MaxConnectionsPerServer = DefaultMaxConnectionsPerServer
 	}
+	c.uploadBalancer = c.config.UploadBalancer
+	if c.uploadBalancer == nil {
+		c.uploadBalancer = NewRoundRobinBalancer()
+	}
+	c.downloadBalancer = c.config.DownloadBalancer
+	if c.downloadBalancer == nil {
+		c.downloadBalancer = NewRoundRobinBalancer()
+	}
 	if (c.config.TrackerServers == nil || len(c.config.TrackerServers) == 0) &&
 		(c.config.StaticStorageServers == nil || len(c.config.StaticStorageServers) == 0) {
 		logger.Warn("client initialized but no server provided")
@@ -115,15 +226,74 @@ func (c *clientAPIImpl) SetConfig(config *Config) {
 	}
 }
 
+func (c *clientAPIImpl) UpdateTrackerServers(servers []*common.Server) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	current := make(map[string]*common.Server)
+	for _, s := range c.config.TrackerServers {
+		current[s.ConnectionString()] = s
+	}
+	for _, s := range servers {
+		if old := current[s.ConnectionString()]; old != nil {
+			// the new server takes over the instance id learned on authentication.
+			delete(current, s.ConnectionString())
+			s.InstanceId = old.InstanceId
+			untracks(old)
+		} else {
+			conn.InitServerSettings(s, c.config.MaxConnectionsPerServer, time.Minute*2)
+		}
+		tracks(c, s, false, nil)
+	}
+	for _, s := range current {
+		untracks(s)
+	}
+	c.config.TrackerServers = servers
+}
+
 func (c *clientAPIImpl) Upload(src io.Reader, length int64, group string, isPrivate bool) (*common.UploadResult, error) {
+	return c.UploadWithOptions(src, length, group, &UploadOptions{IsPrivate: isPrivate})
+}
+
+func (c *clientAPIImpl) UploadWithOptions(src io.Reader, length int64, group string, options *UploadOptions) (*common.UploadResult, error) {
 	logger.Debug("begin to upload file")
+	attributes := map[string]string{
+		"isPrivate": gox.TValue(options.IsPrivate, "1", "0").(string),
+	}
+	if options.TTL > 0 {
+		attributes["ttl"] = convert.Int64ToStr(int64(options.TTL / time.Second))
+	} else if !options.ExpireAt.IsZero() {
+		attributes["expireAt"] = convert.Int64ToStr(options.ExpireAt.Unix())
+	}
+	if options.Name != "" {
+		attributes["name"] = options.Name
+	}
+	if options.ContentType != "" {
+		attributes["contentType"] = options.ContentType
+	}
+	if options.Identity != "" {
+		attributes["identity"] = options.Identity
+	}
+	for k, v := range options.Attributes {
+		attributes[common.FILE_META_ATTRIBUTE_PREFIX+k] = v
+	}
 	var exclude = list.New()                  // excluded storage list
 	var selectedStorage *common.StorageServer // target server for file uploading.
 	var lastErr error
 	var lastConn *net.Conn
 	var ret *common.UploadResult
+	var release func(err error) // releases the selected server with the result
+	defer func() {
+		if release != nil {
+			release(lastErr)
+		}
+	}()
 	gox.Try(func() {
 		for {
+			if release != nil {
+				release(lastErr)
+				release = nil
+			}
 			// select storage server.
 			selectedStorage = c.SelectStorageServer(group, true, exclude)
 			if selectedStorage == nil {
@@ -132,6 +302,7 @@ func (c *clientAPIImpl) Upload(src io.Reader, length int64, group string, isPriv
 				}
 				break
 			}
+			release = c.releaser(selectedStorage, true)
 			// get connection of this server.
 			connection, authenticated, err := conn.GetConnection(selectedStorage)
 			if err != nil {
@@ -156,12 +327,14 @@ func (c *clientAPIImpl) Upload(src io.Reader, length int64, group string, isPriv
 				logger.Debug("authentication success with server ", selectedStorage.ConnectionString())
 			}
 			authenticated = true
+			// the identity is trusted only with the secret of the selected server.
+			if options.Identity != "" {
+				attributes["secret"] = selectedStorage.Secret
+			}
 			// send file body
 			err = pip.Send(&common.Header{
-				Operation: common.OPERATION_UPLOAD,
-				Attributes: map[string]string{
-					"isPrivate": gox.TValue(isPrivate, "1", "0").(string),
-				},
+				Operation:  common.OPERATION_UPLOAD,
+				Attributes: attributes,
 			}, src, length)
 			if err != nil {
 				lastErr = err
@@ -179,8 +352,15 @@ func (c *clientAPIImpl) Upload(src io.Reader, length int64, group string, isPriv
 							FileId:   header.Attributes["fid"],
 							Instance: header.Attributes["instance"],
 						}
+						if expireTime, ok := header.Attributes["expireTime"]; ok {
+							ret.ExpireTime, _ = convert.StrToInt64(expireTime)
+						}
 						return nil
 					}
+					if header.Result == common.QUOTA_EXCEEDED {
+						logger.Debug("upload rejected: ", header.Msg)
+						return common.QuotaExceededErr
+					}
 					return errors.New("upload failed: " + header.Msg)
 				}
 				return errors.New("upload failed: got empty response from server")
@@ -216,6 +396,16 @@ func (c *clientAPIImpl) Download(fileId string, offset int64, length int64,
 
 func (c *clientAPIImpl) DownloadFrom(fileId string, offset int64, length int64, server *common.Server,
 	handler func(body io.Reader, bodyLength int64) error) error {
+	return c.download(fileId, offset, length, server, false, handler)
+}
+
+func (c *clientAPIImpl) DownloadRaw(fileId string, server *common.Server,
+	handler func(body io.Reader, bodyLength int64) error) error {
+	return c.download(fileId, 0, -1, server, true, handler)
+}
+
+func (c *clientAPIImpl) download(fileId string, offset int64, length int64, server *common.Server, raw bool,
+	handler func(body io.Reader, bodyLength int64) error) error {
 
 	logger.Debug("begin to download file")
 
@@ -228,8 +418,18 @@ func (c *clientAPIImpl) DownloadFrom(fileId string, offset int64, length int64,
 	if err != nil {
 		return err
 	}
+	var release func(err error) // releases the selected server with the result
+	defer func() {
+		if release != nil {
+			release(lastErr)
+		}
+	}()
 	gox.Try(func() {
 		for {
+			if release != nil {
+				release(lastErr)
+				release = nil
+			}
 			if server != nil && lastErr != nil {
 				break
 			}
@@ -238,7 +438,10 @@ func (c *clientAPIImpl) DownloadFrom(fileId string, offset int64, length int64,
 					Server: *server,
 				}
 			} else {
-				selectedStorage = c.SelectStorageServer(fileInfo.Group, false, exclude)
+				selectedStorage = c.SelectStorageServerByKey(fileInfo.Group, fileId, false, exclude)
+				if selectedStorage != nil {
+					release = c.releaser(selectedStorage, false)
+				}
 			}
 			if selectedStorage == nil {
 				if lastErr == nil {
@@ -267,14 +470,18 @@ func (c *clientAPIImpl) DownloadFrom(fileId string, offset int64, length int64,
 				logger.Debug("authentication success with server ", selectedStorage.ConnectionString())
 			}
 			authenticated = true
+			attributes := map[string]string{
+				"fileId": fileId,
+				"offset": convert.Int64ToStr(offset),
+				"length": convert.Int64ToStr(length),
+			}
+			if raw {
+				attributes["raw"] = "true"
+			}
 			// send file body
 			err = pip.Send(&common.Header{
-				Operation: common.OPERATION_DOWNLOAD,
-				Attributes: map[string]string{
-					"fileId": fileId,
-					"offset": convert.Int64ToStr(offset),
-					"length": convert.Int64ToStr(length),
-				},
+				Operation:  common.OPERATION_DOWNLOAD,
+				Attributes: attributes,
 			}, nil, 0)
 			if err != nil {
 				lastErr = err
@@ -333,15 +540,26 @@ func (c *clientAPIImpl) Query(fileId string) (*common.FileInfo, error) {
 		return nil, err
 	}*/
 	// TODO offline function
+	var release func(err error) // releases the selected server with the result
+	defer func() {
+		if release != nil {
+			release(lastErr)
+		}
+	}()
 	gox.Try(func() {
 		for {
-			selectedStorage = c.SelectStorageServer("", false, exclude)
+			if release != nil {
+				release(lastErr)
+				release = nil
+			}
+			selectedStorage = c.SelectStorageServerByKey("", fileId, false, exclude)
 			if selectedStorage == nil {
 				if lastErr == nil {
 					lastErr = NoStorageServerErr
 				}
 				break
 			}
+			release = c.releaser(selectedStorage, false)
 			connection, authenticated, err := conn.GetConnection(selectedStorage)
 			if err != nil {
 				lastErr = err
@@ -570,17 +788,298 @@ func (c *clientAPIImpl) SyncBinlog(server *common.Server, clientState *common.Bi
 	return blr, err
 }
 
-// authenticate authenticates with server.
-func authenticate(p *gpip.Pip, server conn.Server) error {
-	logger.Debug("trying to authenticate with server ", server.ConnectionString())
-	secret := ""
-	if _, t := server.(*common.Server); t {
-		secret = server.(*common.Server).Secret
-	} else if _, t := server.(*common.StorageServer); t {
-		secret = server.(*common.StorageServer).Secret
+func (c *clientAPIImpl) FileIdDigest(server *common.Server, prefix string) (map[string]*common.FileIdDigestDTO, error) {
+	ret := make(map[string]*common.FileIdDigestDTO)
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_FILEID_DIGEST,
+		Attributes: map[string]string{
+			"prefix": prefix,
+		},
+	}, &ret)
+	return ret, err
+}
+
+func (c *clientAPIImpl) ListFileIds(server *common.Server, prefixes []string) ([]common.BingLogDTO, error) {
+	var ret []common.BingLogDTO
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_FILEID_LIST,
+		Attributes: map[string]string{
+			"prefixes": strings.Join(prefixes, ","),
+		},
+	}, &ret)
+	return ret, err
+}
+
+func (c *clientAPIImpl) SnapshotBegin(server *common.Server) (*common.SnapshotDTO, error) {
+	ret := &common.SnapshotDTO{}
+	err := c.snapshotRequest(server, map[string]string{
+		"action": "begin",
+	}, func(header *common.Header, body io.Reader, bodyLength int64) error {
+		return json.UnmarshalFromString(header.Attributes["snapshot"], ret)
+	})
+	return ret, err
+}
+
+func (c *clientAPIImpl) SnapshotData(server *common.Server, position *common.BinlogQueryDTO,
+	handler func(next *common.BinlogQueryDTO, body io.Reader, bodyLength int64) error) error {
+	data, err := json.MarshalToString(position)
+	if err != nil {
+		return err
 	}
+	return c.snapshotRequest(server, map[string]string{
+		"action":   "data",
+		"position": data,
+	}, func(header *common.Header, body io.Reader, bodyLength int64) error {
+		next := &common.BinlogQueryDTO{}
+		if err := json.UnmarshalFromString(header.Attributes["next"], next); err != nil {
+			return err
+		}
+		return handler(next, body, bodyLength)
+	})
+}
 
-	// validate with instance info
+func (c *clientAPIImpl) ReplicateFile(server *common.Server, binlog *common.BingLogDTO) error {
+	data, err := json.MarshalToString(binlog)
+	if err != nil {
+		return err
+	}
+	info, err := json.MarshalToString(currentInstance())
+	if err != nil {
+		return err
+	}
+	return c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_REPLICATE_FILE,
+		Attributes: map[string]string{
+			"binlog":   data,
+			"instance": info,
+		},
+	}, nil)
+}
+
+func (c *clientAPIImpl) Decommission(server *common.Server, start bool) (*common.DecommissionStatus, error) {
+	ret := &common.DecommissionStatus{}
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_DECOMMISSION,
+		Attributes: map[string]string{
+			"start": convert.BoolToStr(start),
+		},
+	}, ret)
+	return ret, err
+}
+
+func (c *clientAPIImpl) GcReport(server *common.Server) (*common.GcReport, error) {
+	ret := &common.GcReport{}
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_GC,
+	}, ret)
+	return ret, err
+}
+
+func (c *clientAPIImpl) QueryUsage(server *common.Server) ([]common.Usage, error) {
+	var ret []common.Usage
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_USAGE,
+	}, &ret)
+	return ret, err
+}
+
+func (c *clientAPIImpl) UpdateInstance(server *common.Server) error {
+	info, err := json.MarshalToString(currentInstance())
+	if err != nil {
+		return err
+	}
+	return c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_INSTANCE_INFO,
+		Attributes: map[string]string{
+			"instance": info,
+		},
+	}, nil)
+}
+
+func (c *clientAPIImpl) FileExists(server *common.Server, fileId string) (bool, error) {
+	exists := false
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_QUERY,
+		Attributes: map[string]string{
+			"fileId": fileId,
+		},
+	}, &exists)
+	return exists, err
+}
+
+func (c *clientAPIImpl) ProbeFile(server *common.Server, fileId string) (*common.FileReplica, error) {
+	ret := &common.FileReplica{}
+	err := c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_PROBE_FILE,
+		Attributes: map[string]string{
+			"fileId": fileId,
+		},
+	}, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) List(server *common.Server, query *common.FileListQuery) (*common.FileListResult, error) {
+	q, err := json.MarshalToString(query)
+	if err != nil {
+		return nil, err
+	}
+	ret := &common.FileListResult{}
+	err = c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_LIST_FILES,
+		Attributes: map[string]string{
+			"query": q,
+		},
+	}, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *clientAPIImpl) Deregister(server *common.Server) error {
+	return c.queryBody(server, &common.Header{
+		Operation: common.OPERATION_DEREGISTER,
+	}, nil)
+}
+
+// snapshotRequest sends a snapshot request to the server
+// and handles the successful response.
+func (c *clientAPIImpl) snapshotRequest(server *common.Server, attributes map[string]string,
+	handler func(header *common.Header, body io.Reader, bodyLength int64) error) error {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	if err = pip.Send(&common.Header{
+		Operation:  common.OPERATION_SNAPSHOT,
+		Attributes: attributes,
+	}, nil, 0); err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				if header.Attributes == nil {
+					return errors.New("snapshot failed: invalid response")
+				}
+				return handler(header, bodyReader, bodyLength)
+			}
+			return errors.New("snapshot failed: " + header.Msg)
+		}
+		return errors.New("snapshot failed: got empty response from server")
+	})
+	conn.ReturnConnection(server, connection, authenticated, err != nil)
+	return err
+}
+
+// queryBody sends a request to the server and
+// unmarshal the json response body to result.
+// CheckHealth checks the storage server by a new authenticated connection
+// and a synthetic read of its canary file.
+//
+// It fails if the server does not response in time.
+func CheckHealth(server *common.Server, timeout time.Duration) error {
+	connection, err := net.DialTimeout("tcp", server.ConnectionString(), timeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	if err = connection.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: connection,
+	}
+	if err = authenticate(pip, server); err != nil {
+		return err
+	}
+	if err = pip.Send(&common.Header{
+		Operation: common.OPERATION_HEALTH_CHECK,
+	}, nil, 0); err != nil {
+		return err
+	}
+	return pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header == nil {
+			return errors.New("health check failed: got empty response from server")
+		}
+		if header.Result != common.SUCCESS {
+			return errors.New("health check failed: " + header.Msg)
+		}
+		return nil
+	})
+}
+
+func (c *clientAPIImpl) queryBody(server *common.Server, request *common.Header, result interface{}) error {
+	connection, authenticated, err := conn.GetConnection(server)
+	if err != nil {
+		return err
+	}
+	pip := &gpip.Pip{
+		Conn: *connection,
+	}
+	if authenticated == nil || !authenticated.(bool) {
+		if err = authenticate(pip, server); err != nil {
+			conn.ReturnConnection(server, connection, nil, true)
+			return err
+		}
+		logger.Debug("authentication success with server ", server.ConnectionString())
+	}
+	authenticated = true
+	if err = pip.Send(request, nil, 0); err != nil {
+		conn.ReturnConnection(server, connection, nil, true)
+		return err
+	}
+	// receive response
+	err = pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
+		header := _header.(*common.Header)
+		if header != nil {
+			if header.Result == common.SUCCESS {
+				if bodyLength == 0 {
+					return nil
+				}
+				bs, err := ioutil.ReadAll(io.LimitReader(bodyReader, bodyLength))
+				if err != nil {
+					return err
+				}
+				return json.Unmarshal(bs, result)
+			}
+			return errors.New("query failed: " + header.Msg)
+		}
+		return errors.New("query failed: got empty response from server")
+	})
+	conn.ReturnConnection(server, connection, authenticated, err != nil)
+	return err
+}
+
+// SetInstanceAttribute sets a runtime attribute of this instance,
+// it overrides the attribute derived from config
+// and is sent to servers on authentication and instance updates.
+func SetInstanceAttribute(key, value string) {
+	instanceAttributeLock.Lock()
+	defer instanceAttributeLock.Unlock()
+	instanceAttributes[key] = value
+}
+
+// currentInstance builds the instance info of this server.
+func currentInstance() *common.Instance {
 	var instance *common.Instance
 	if common.BootAs == common.BOOT_TRACKER {
 		conf := common.InitializedTrackerConfiguration
@@ -595,6 +1094,10 @@ func authenticate(p *gpip.Pip, server conn.Server) error {
 				InstanceId: conf.InstanceId,
 			},
 			Role: common.ROLE_TRACKER,
+			Attributes: map[string]string{
+				"zone": conf.Zone,
+				"rack": conf.Rack,
+			},
 		}
 	} else if common.BootAs == common.BOOT_STORAGE {
 		conf := common.InitializedStorageConfiguration
@@ -613,9 +1116,39 @@ func authenticate(p *gpip.Pip, server conn.Server) error {
 			Attributes: map[string]string{
 				"group":    conf.Group,
 				"readonly": convert.BoolToStr(conf.Readonly),
+				"http":     convert.BoolToStr(conf.EnableHttp),
+				"zone":     conf.Zone,
+				"rack":     conf.Rack,
 			},
 		}
+		if len(conf.MirrorGroups) > 0 {
+			instance.Attributes["mirrorGroups"] = strings.Join(conf.MirrorGroups, ",")
+		}
+		// free space is used by capacity-weighted balancers.
+		if free, err := util.DataDirsFreeSpace(); err == nil {
+			instance.Attributes["freeSpace"] = convert.Int64ToStr(free)
+		}
+		instanceAttributeLock.Lock()
+		for k, v := range instanceAttributes {
+			instance.Attributes[k] = v
+		}
+		instanceAttributeLock.Unlock()
 	} /* else if common.BootAs == common.BOOT_PROXY {} */
+	return instance
+}
+
+// authenticate authenticates with server.
+func authenticate(p *gpip.Pip, server conn.Server) error {
+	logger.Debug("trying to authenticate with server ", server.ConnectionString())
+	secret := ""
+	if _, t := server.(*common.Server); t {
+		secret = server.(*common.Server).Secret
+	} else if _, t := server.(*common.StorageServer); t {
+		secret = server.(*common.StorageServer).Secret
+	}
+
+	// validate with instance info
+	instance := currentInstance()
 	info, err := json.Marshal(instance)
 	if err != nil {
 		return err
@@ -640,14 +1173,17 @@ func authenticate(p *gpip.Pip, server conn.Server) error {
 	})
 }
 
-// selectStorageServer selects proper storage server.
 func (c *clientAPIImpl) SelectStorageServer(group string, uploadable bool, exclude *list.List) *common.StorageServer {
+	return c.SelectStorageServerByKey(group, "", uploadable, exclude)
+}
+
+func (c *clientAPIImpl) SelectStorageServerByKey(group string, key string, uploadable bool, exclude *list.List) *common.StorageServer {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	logger.Debug("select storage server")
 
-	var candidates = list.New()
+	var candidates []*common.Instance
 	var syncStorages *list.List
 	// if registered storage server is not empty, use it first.
 	if uploadable {
@@ -655,52 +1191,92 @@ func (c *clientAPIImpl) SelectStorageServer(group string, uploadable bool, exclu
 	} else {
 		syncStorages = FilterInstances(common.ROLE_STORAGE)
 	}
-	if syncStorages.Len() > 0 {
+	for ele := syncStorages.Front(); ele != nil; ele = ele.Next() {
+		s := ele.Value.(*common.Instance)
+		if isExcluded(s.Server, exclude) || !isHealthy(s) {
+			continue
+		}
+		sg := ""
+		if s.Attributes != nil {
+			sg = s.Attributes["group"]
+		}
+		if group == "" || group == sg {
+			candidates = append(candidates, s)
+		}
+	}
+	// files of a group are downloaded from its mirrors if no member is alive.
+	if len(candidates) == 0 && group != "" && !uploadable {
 		for ele := syncStorages.Front(); ele != nil; ele = ele.Next() {
 			s := ele.Value.(*common.Instance)
-			if isExcluded(s.Server, exclude) {
-				continue
-			}
-			sg := ""
-			if s.Attributes != nil {
-				sg = s.Attributes["group"]
-			}
-			if group == "" || group == sg {
-				candidates.PushBack(&common.StorageServer{
-					Server: s.Server,
-					Group:  sg,
-				})
+			if !isExcluded(s.Server, exclude) && isHealthy(s) && IsMirrorOf(s, group) {
+				candidates = append(candidates, s)
 			}
 		}
 	}
 	// if no candidate server, choose from static storage servers.
 	// static server has no group configured, so here ignores the group.
-	if candidates.Len() == 0 {
+	if len(candidates) == 0 {
 		for _, s := range c.config.StaticStorageServers {
 			if isExcluded(s.Server, exclude) {
 				continue
 			}
-			candidates.PushBack(s)
+			candidates = append(candidates, &common.Instance{
+				Server:     s.Server,
+				Role:       common.ROLE_STORAGE,
+				Attributes: map[string]string{"group": s.Group},
+			})
 		}
 	}
-	// select smallest weights of storage server.
-	var selectedStorage *common.StorageServer
-	gox.WalkList(candidates, func(item interface{}) bool {
-		if selectedStorage == nil {
-			selectedStorage = item.(*common.StorageServer)
-			return false
-		}
-		if c.weights[item.(*common.StorageServer).InstanceId] < c.weights[selectedStorage.InstanceId] {
-			selectedStorage = item.(*common.StorageServer)
-			return false
+	// instances are synchronized in random order.
+	sort.Slice(candidates, func(i, j int) bool {
+		return serverKey(&candidates[i].Server) < serverKey(&candidates[j].Server)
+	})
+	// uploads are spread over the racks of the zone,
+	// the file is replicated to the other racks anyway.
+	candidates = PreferLocal(candidates, c.config.Zone, gox.TValue(uploadable, "", c.config.Rack).(string))
+	selected := gox.TValue(uploadable, c.uploadBalancer, c.downloadBalancer).(Balancer).Select(candidates, key)
+	if selected == nil {
+		return nil
+	}
+	logger.Debug("selected storage server: ", selected.ConnectionString())
+	return &common.StorageServer{
+		Server: selected.Server,
+		Group:  selected.Attributes["group"],
+	}
+}
+
+func (c *clientAPIImpl) ReleaseStorageServer(server *common.StorageServer, uploadable bool, elapsed time.Duration, err error) {
+	gox.TValue(uploadable, c.uploadBalancer, c.downloadBalancer).(Balancer).Done(&server.Server, elapsed, err)
+}
+
+// releaser returns a function which releases the selected storage server.
+func (c *clientAPIImpl) releaser(server *common.StorageServer, uploadable bool) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		// missing files and uploads over quotas are not failures of the server.
+		if err == common.NotFoundErr || err == common.QuotaExceededErr {
+			err = nil
 		}
+		c.ReleaseStorageServer(server, uploadable, time.Since(start), err)
+	}
+}
+
+// IsMirrorOf judges whether the storage server mirrors the group.
+func IsMirrorOf(ins *common.Instance, group string) bool {
+	if ins.Attributes == nil || ins.Attributes["mirrorGroups"] == "" {
 		return false
-	})
-	if selectedStorage != nil {
-		c.weights[selectedStorage.InstanceId] = c.weights[selectedStorage.InstanceId] + 1
-		logger.Debug("selected storage server: ", selectedStorage.ConnectionString())
 	}
-	return selectedStorage
+	for _, g := range strings.Split(ins.Attributes["mirrorGroups"], ",") {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// isHealthy judges whether the instance passes the health check of trackers.
+func isHealthy(ins *common.Instance) bool {
+	return ins.Attributes["health"] != common.HEALTH_UNHEALTHY
 }
 
 // isExcluded judges whether a storage server is in the exclude list.
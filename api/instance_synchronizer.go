@@ -16,17 +16,25 @@ var (
 	syncLock      *sync.Mutex
 	countLock     *sync.Mutex
 	synced        = 0
+	// synchronization timers of tracker servers.
+	trackTimers     map[string]*timer.Timer
+	trackTimersLock *sync.Mutex
+	expireOnce      *sync.Once
 )
 
 func init() {
 	syncLock = new(sync.Mutex)
 	countLock = new(sync.Mutex)
 	syncInstances = make(map[string]*instanceStore)
+	trackTimers = make(map[string]*timer.Timer)
+	trackTimersLock = new(sync.Mutex)
+	expireOnce = new(sync.Once)
 }
 
 type instanceStore struct {
 	fetchTime time.Time
 	instance  *common.Instance
+	source    string // the tracker server which the instance is synchronized from
 }
 
 func (ins *instanceStore) expired() bool {
@@ -35,9 +43,11 @@ func (ins *instanceStore) expired() bool {
 
 func tracks(clientAPI ClientAPI, server *common.Server, synchronizeOnce bool, c chan int) {
 	if !synchronizeOnce {
-		go expireDetection()
+		expireOnce.Do(func() {
+			go expireDetection()
+		})
 	}
-	timer.Start(0, common.SYNCHRONIZE_INTERVAL, 0, func(t *timer.Timer) {
+	t := timer.Start(0, common.SYNCHRONIZE_INTERVAL, 0, func(t *timer.Timer) {
 		ret, err := clientAPI.SyncInstances(server)
 		if err != nil {
 			logger.Error("error synchronize with tracker server: ", server.ConnectionString(), ": ", err)
@@ -45,12 +55,20 @@ func tracks(clientAPI ClientAPI, server *common.Server, synchronizeOnce bool, c
 			syncLock.Lock()
 			defer syncLock.Unlock()
 
+			// instances deregistered from the tracker are removed at once.
+			source := server.ConnectionString()
+			for k, v := range syncInstances {
+				if v.source == source && ret[k] == nil {
+					delete(syncInstances, k)
+				}
+			}
 			if ret != nil && len(ret) > 0 {
 				now := time.Now()
 				for k, v := range ret {
 					syncInstances[k] = &instanceStore{
 						instance:  v,
 						fetchTime: now,
+						source:    source,
 					}
 					if common.BootAs == common.BOOT_STORAGE {
 						util.StoreSecrets(v.InstanceId, util.CollectMapKeys(v.Server.HistorySecrets)...)
@@ -70,6 +88,21 @@ func tracks(clientAPI ClientAPI, server *common.Server, synchronizeOnce bool, c
 			}
 		}
 	})
+	if !synchronizeOnce {
+		trackTimersLock.Lock()
+		trackTimers[server.ConnectionString()] = t
+		trackTimersLock.Unlock()
+	}
+}
+
+// untracks stops synchronization with the tracker server.
+func untracks(server *common.Server) {
+	trackTimersLock.Lock()
+	defer trackTimersLock.Unlock()
+	if t := trackTimers[server.ConnectionString()]; t != nil {
+		t.Destroy()
+		delete(trackTimers, server.ConnectionString())
+	}
 }
 
 func FilterInstances(role common.Role) *list.List {
@@ -104,7 +137,8 @@ func FilterUploadableInstances() *list.List {
 
 	ret := list.New()
 	for _, v := range syncInstances {
-		if v.instance.Role == common.ROLE_STORAGE && v.instance.Attributes["readonly"] != "true" {
+		if v.instance.Role == common.ROLE_STORAGE && v.instance.Attributes["readonly"] != "true" &&
+			v.instance.Attributes["drain"] == "" && isHealthy(v.instance) {
 			ret.PushBack(v.instance)
 		}
 	}
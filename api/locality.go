@@ -0,0 +1,49 @@
+package api
+
+import "github.com/hetianyi/godfs/common"
+
+// locality levels of a server relative to this server,
+// lower level is preferred.
+const (
+	LOCALITY_SAME_RACK = iota
+	LOCALITY_SAME_ZONE
+	LOCALITY_REMOTE
+)
+
+// Locality returns the locality level of the instance relative to the zone and rack,
+// rack labels are only compared within the same zone.
+//
+// Instances are remote to a server which has no zone configured.
+func Locality(ins *common.Instance, zone, rack string) int {
+	if zone == "" || ins.Attributes == nil || ins.Attributes["zone"] != zone {
+		return LOCALITY_REMOTE
+	}
+	if rack != "" && ins.Attributes["rack"] == rack {
+		return LOCALITY_SAME_RACK
+	}
+	return LOCALITY_SAME_ZONE
+}
+
+// PreferLocal returns the candidates with the best locality level,
+// the order of candidates is kept.
+func PreferLocal(candidates []*common.Instance, zone, rack string) []*common.Instance {
+	if zone == "" || len(candidates) == 0 {
+		return candidates
+	}
+	best := LOCALITY_REMOTE
+	for _, c := range candidates {
+		if l := Locality(c, zone, rack); l < best {
+			best = l
+		}
+	}
+	if best == LOCALITY_REMOTE {
+		return candidates
+	}
+	var ret []*common.Instance
+	for _, c := range candidates {
+		if Locality(c, zone, rack) == best {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
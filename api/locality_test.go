@@ -0,0 +1,32 @@
+package api
+
+import (
+	"testing"
+)
+
+func TestPreferLocal(t *testing.T) {
+	candidates := newTestCandidates(4)
+	candidates[0].Attributes["zone"] = "z1"
+	candidates[0].Attributes["rack"] = "r1"
+	candidates[1].Attributes["zone"] = "z1"
+	candidates[1].Attributes["rack"] = "r2"
+	candidates[2].Attributes["zone"] = "z2"
+	candidates[2].Attributes["rack"] = "r1"
+
+	ret := PreferLocal(candidates, "z1", "r1")
+	if len(ret) != 1 || ret[0].InstanceId != "storage0" {
+		t.Fatal("same-rack server is not preferred: ", ret)
+	}
+	ret = PreferLocal(candidates, "z1", "")
+	if len(ret) != 2 || ret[0].InstanceId != "storage0" || ret[1].InstanceId != "storage1" {
+		t.Fatal("same-zone servers are not preferred: ", ret)
+	}
+	// the same rack label in another zone is not local.
+	ret = PreferLocal(candidates[1:], "z1", "r1")
+	if len(ret) != 1 || ret[0].InstanceId != "storage1" {
+		t.Fatal("same-zone server is not preferred: ", ret)
+	}
+	if len(PreferLocal(candidates, "z3", "r1")) != 4 || len(PreferLocal(candidates, "", "")) != 4 {
+		t.Fatal("remote servers are filtered")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/file"
 	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
 	"io"
 	"os"
 	"sync"
@@ -23,6 +24,11 @@ const (
 	TRACKER_BINLOG_MANAGER XBinlogManagerType = 3
 	MAX_BINLOG_SIZE        int                = 2 << 20 // 200w binlog records
 	LOCAL_BINLOG_SIZE                         = 102     // single binlog size.
+	// the expire time and the metadata in json of a file follow its binlog
+	// in an extension record, which starts with the marker and never has the binlog size,
+	// servers of old versions skip it as an invalid binlog but still get the binlog.
+	BINLOG_EXTENSION_MARKER      byte = 0
+	BINLOG_EXTENSION_HEADER_SIZE      = 9 // marker and expire time
 )
 
 var binlogMapManager *XBinlogMapManager
@@ -51,6 +57,10 @@ type XBinlogManager interface {
 	//  fileIndex: the binlog file index, -1 means reads from latest binlog file.
 	//  offset: read offset in bytes, must be integer multiple of the binlog.
 	Read(fileIndex int, offset int64, fetchLine int) ([]common.BingLogDTO, int64, error)
+
+	// Close flushes and closes the binlog files,
+	// binlogs can not be written after the manager is closed.
+	Close() error
 }
 
 // NewXBinlogManager creates a new binlog manager.
@@ -63,8 +73,8 @@ func NewXBinlogManager(managerType XBinlogManagerType) XBinlogManager {
 	if err := initialBinlogDir(binlogDir); err != nil {
 		logger.Fatal("failed to create binlog dir: ", err)
 	}
-	// initialize XBinlogMapManager
-	if binlogMapManager == nil {
+	// initialize XBinlogMapManager, it is opened again if the last manager is closed.
+	if binlogMapManager == nil || binlogMapManager.mapFile == nil {
 		binlogMapManager = &XBinlogMapManager{
 			lock:      new(sync.Mutex),
 			buffer:    make([]byte, 8),
@@ -74,8 +84,10 @@ func NewXBinlogManager(managerType XBinlogManagerType) XBinlogManager {
 			logger.Fatal("failed to initialize binlog map file: ", err)
 		}
 	}
-	if managerType == LOCAL_BINLOG_MANAGER {
+	// trackers write binlog of the replicated fileIds in the same format.
+	if managerType == LOCAL_BINLOG_MANAGER || managerType == TRACKER_BINLOG_MANAGER {
 		return &localBinlogManager{
+			managerType:        managerType,
 			writeLock:          new(sync.Mutex),
 			binlogSize:         0,
 			buffer:             bytes.Buffer{},
@@ -86,8 +98,9 @@ func NewXBinlogManager(managerType XBinlogManagerType) XBinlogManager {
 	return nil
 }
 
-// localBinlogManager is a binlog manager for storage server.
+// localBinlogManager is a binlog manager for storage server and tracker server.
 type localBinlogManager struct {
+	managerType        XBinlogManagerType
 	writeLock          *sync.Mutex
 	currentBinLogFile  *os.File // current binlog file
 	binlogSize         int      // binlog items count
@@ -95,10 +108,11 @@ type localBinlogManager struct {
 	lengthBuffer       []byte
 	singleBinlogBuffer []byte
 	currentIndex       int
+	closed             bool
 }
 
 func (m *localBinlogManager) GetType() XBinlogManagerType {
-	return LOCAL_BINLOG_MANAGER
+	return m.managerType
 }
 
 func (m *localBinlogManager) GetCurrentIndex() int {
@@ -115,6 +129,10 @@ func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 	m.writeLock.Lock()
 	defer m.writeLock.Unlock()
 
+	if m.closed {
+		return errors.New("binlog manager is closed")
+	}
+
 	logger.Debug("writing binlog")
 
 	// initialize binlog file or create new binlog file if it exceeds max size.
@@ -142,9 +160,18 @@ func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 	for i := 0; i < l; i++ {
 		copy(m.singleBinlogBuffer[0:8], bin[i].SourceInstance[:])
 		copy(m.singleBinlogBuffer[8:16], bin[i].FileLength[:])
-		copy(m.singleBinlogBuffer[16:], bin[i].FileId[:])
+		copy(m.singleBinlogBuffer[16:LOCAL_BINLOG_SIZE], bin[i].FileId[:])
 		m.buffer.WriteString(base64.RawURLEncoding.EncodeToString(m.singleBinlogBuffer))
 		m.buffer.WriteRune('\n')
+		if bin[i].ExpireTime <= 0 && bin[i].Meta == nil {
+			continue
+		}
+		ext, err := binlogExtension(bin[i])
+		if err != nil {
+			return err
+		}
+		m.buffer.WriteString(base64.RawURLEncoding.EncodeToString(ext))
+		m.buffer.WriteRune('\n')
 	}
 
 	// persist binlog data.
@@ -162,6 +189,62 @@ func (m *localBinlogManager) Write(bin ...*common.BingLog) error {
 	return nil
 }
 
+// binlogExtension builds the extension record of the binlog.
+func binlogExtension(bin *common.BingLog) ([]byte, error) {
+	ext := make([]byte, BINLOG_EXTENSION_HEADER_SIZE)
+	ext[0] = BINLOG_EXTENSION_MARKER
+	convert.Length2Bytes(bin.ExpireTime, ext[1:])
+	if bin.Meta == nil {
+		return ext, nil
+	}
+	meta, err := json.Marshal(bin.Meta)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) > common.MAX_FILE_META_SIZE {
+		return nil, errors.New("file meta is too large")
+	}
+	ext = append(ext, meta...)
+	// it must not be mistaken for a binlog, the padding is a json whitespace.
+	if len(ext) == LOCAL_BINLOG_SIZE {
+		ext = append(ext, ' ')
+	}
+	return ext, nil
+}
+
+// readBinlogExtension sets the expire time and the metadata of the binlog by its extension record.
+func readBinlogExtension(bl *common.BingLog, ext []byte) {
+	bl.ExpireTime = convert.Bytes2Length(ext[1:BINLOG_EXTENSION_HEADER_SIZE])
+	if len(ext) == BINLOG_EXTENSION_HEADER_SIZE {
+		return
+	}
+	meta := &common.FileMeta{}
+	if err := json.Unmarshal(ext[BINLOG_EXTENSION_HEADER_SIZE:], meta); err != nil {
+		logger.Debug("skip invalid file meta of binlog: ", err)
+		return
+	}
+	bl.Meta = meta
+}
+
+func (m *localBinlogManager) Close() error {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.currentBinLogFile != nil {
+		if err := m.currentBinLogFile.Sync(); err != nil {
+			return err
+		}
+		if err := m.currentBinLogFile.Close(); err != nil {
+			return err
+		}
+	}
+	return binlogMapManager.close()
+}
+
 func (m *localBinlogManager) Read(fileIndex int, offset int64, fetchLine int) ([]common.BingLogDTO, int64, error) {
 	// prepare binlog dir if it not exists.
 	binlogDir := getBinlogDir()
@@ -197,9 +280,11 @@ func (m *localBinlogManager) Read(fileIndex int, offset int64, fetchLine int) ([
 	tmpContainer := list.New()
 	var forwardOffset int64 = 0
 	readLines := 0
+	// the extension record following a binlog belongs to it.
+	var last *common.BingLog
 
 	for {
-		bs, err := bf.ReadBytes('\n')
+		line, err := bf.ReadBytes('\n')
 		if err == io.EOF {
 			break
 		}
@@ -208,44 +293,56 @@ func (m *localBinlogManager) Read(fileIndex int, offset int64, fetchLine int) ([
 			return nil, offset, err
 		}
 
-		forwardOffset += int64(len(bs))
 		// invalid binlog size, skip.
-		if bs == nil || len(bs) < 2 {
+		if line == nil || len(line) < 2 {
+			forwardOffset += int64(len(line))
 			continue
 		}
 		// restore binlog from
-		bs, err = base64.RawURLEncoding.DecodeString(string(bs))
+		bs, err := base64.RawURLEncoding.DecodeString(string(line))
 		if err != nil {
 			return nil, offset, err
 		}
 
+		if len(bs) >= BINLOG_EXTENSION_HEADER_SIZE && bs[0] == BINLOG_EXTENSION_MARKER && len(bs) != LOCAL_BINLOG_SIZE {
+			forwardOffset += int64(len(line))
+			if last != nil {
+				readBinlogExtension(last, bs)
+			}
+			last = nil
+			continue
+		}
 		// invalid binlog size, skip.
 		if len(bs) != LOCAL_BINLOG_SIZE {
+			forwardOffset += int64(len(line))
+			last = nil
 			continue
 		}
-		bl := common.BingLog{
+		// the binlog is left for the next read with its extension record.
+		if readLines >= fetchLine {
+			break
+		}
+		forwardOffset += int64(len(line))
+		last = &common.BingLog{
 			SourceInstance: Copy8(bs[0:8]),
 			FileLength:     Copy8(bs[8:16]),
-			FileId:         bs[16:],
+			FileId:         bs[16:LOCAL_BINLOG_SIZE],
 		}
-
 		readLines++
-		tmpContainer.PushBack(bl)
-
-		if readLines >= fetchLine {
-			break
-		}
+		tmpContainer.PushBack(last)
 	}
 
 	ret := make([]common.BingLogDTO, tmpContainer.Len())
 	i := 0
 
 	gox.WalkList(tmpContainer, func(item interface{}) bool {
-		sit := item.(common.BingLog)
+		sit := item.(*common.BingLog)
 		ret[i] = common.BingLogDTO{
 			SourceInstance: string(sit.SourceInstance[:]),
 			FileLength:     convert.Bytes2Length(sit.FileLength[:]),
 			FileId:         string(sit.FileId),
+			ExpireTime:     sit.ExpireTime,
+			Meta:           sit.Meta,
 		}
 		i++
 		return false
@@ -410,3 +507,21 @@ func TryFixBinlogFile() error {
 	_, err = newFile.WriteString("\n")
 	return err
 }
+
+// GetBinlogEndPosition returns the end position of local binlog files,
+// which is the index of the latest binlog file and its size.
+func GetBinlogEndPosition() (*common.BinlogQueryDTO, error) {
+	binlogDir := getBinlogDir()
+	ret := &common.BinlogQueryDTO{}
+	for i := 0; ; i++ {
+		info, err := os.Stat(getBinLogFileNameByIndex(binlogDir, i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return ret, nil
+			}
+			return nil, err
+		}
+		ret.FileIndex = i
+		ret.Offset = info.Size()
+	}
+}
@@ -110,3 +110,19 @@ func (m *XBinlogMapManager) SetRecords(fileIndex int, value int) (err error) {
 	m.memMap[fileIndex] = d3
 	return nil
 }
+
+// close flushes and closes the binlog map file.
+func (m *XBinlogMapManager) close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.mapFile == nil {
+		return nil
+	}
+	if err := m.mapFile.Sync(); err != nil {
+		return err
+	}
+	err := m.mapFile.Close()
+	m.mapFile = nil
+	return err
+}
@@ -1,11 +1,16 @@
 package binlog_test
 
 import (
+	"bufio"
 	"encoding/base64"
 	"fmt"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/convert"
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 )
@@ -39,3 +44,66 @@ func TestFixZeros(t *testing.T) {
 	fmt.Println(err)
 	fmt.Println(string(bs))
 }
+
+func TestBinlogExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(bootAs common.BootMode, c *common.StorageConfig) {
+		common.BootAs = bootAs
+		common.InitializedStorageConfiguration = c
+	}(common.BootAs, common.InitializedStorageConfiguration)
+
+	common.BootAs = common.BOOT_STORAGE
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		DataDir: dir,
+	}
+	util.GenerateDecKey("123456")
+	m := binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	defer m.Close()
+
+	fileId := "G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d"
+	plain := binlog.CreateLocalBinlog(util.CreateAlias(fileId, "storage1", false, time.Now()), 3, "storage1")
+	expiring := binlog.CreateLocalBinlog(util.CreateAlias(fileId, "storage1", false, time.Now()), 3, "storage1")
+	expiring.ExpireTime = 1577836800
+	expiring.Meta = &common.FileMeta{Name: "a.txt", Size: 3}
+	if err := m.Write(expiring, plain); err != nil {
+		t.Fatal(err)
+	}
+
+	// old servers must still get every binlog of the base size.
+	f, err := os.Open(dir + "/binlog/bin.000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		bs, err := base64.RawURLEncoding.DecodeString(sc.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) == binlog.LOCAL_BINLOG_SIZE {
+			records++
+		}
+	}
+	if records != 2 {
+		t.Fatal("expect 2 binlogs of the base size, got ", records)
+	}
+
+	// the extension record is read with the binlog it follows.
+	bls, offset, err := m.Read(0, 0, 1)
+	if err != nil || len(bls) != 1 {
+		t.Fatal("unexpected binlogs: ", bls, err)
+	}
+	if bls[0].ExpireTime != expiring.ExpireTime || bls[0].Meta == nil || bls[0].Meta.Name != "a.txt" {
+		t.Fatal("unexpected extension: ", bls[0])
+	}
+	bls, _, err = m.Read(0, offset, 1)
+	if err != nil || len(bls) != 1 || bls[0].FileId != string(plain.FileId) || bls[0].ExpireTime != 0 || bls[0].Meta != nil {
+		t.Fatal("unexpected binlogs: ", bls, err)
+	}
+}
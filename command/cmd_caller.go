@@ -11,16 +11,25 @@ func call(cmd common.Command) {
 	case common.CMD_BOOT_STORAGE:
 		common.BootAs = common.BOOT_STORAGE
 		ConfigAssembly(common.BOOT_STORAGE)
+		svc.SetConfigLoader(func() (interface{}, error) {
+			return assembleConfig(common.BOOT_STORAGE)
+		})
 		svc.BootStorageServer()
 		break
 	case common.CMD_BOOT_AGENT:
 		common.BootAs = common.BOOT_AGENT
 		ConfigAssembly(common.BOOT_AGENT)
+		svc.SetConfigLoader(func() (interface{}, error) {
+			return assembleConfig(common.BOOT_AGENT)
+		})
 		svc.BootAgentServer()
 		break
 	case common.CMD_BOOT_TRACKER:
 		common.BootAs = common.BOOT_TRACKER
 		ConfigAssembly(common.BOOT_TRACKER)
+		svc.SetConfigLoader(func() (interface{}, error) {
+			return assembleConfig(common.BOOT_TRACKER)
+		})
 		svc.BootTrackerServer()
 		break
 	case common.CMD_UPLOAD_FILE:
@@ -38,11 +47,45 @@ func call(cmd common.Command) {
 		ConfigAssembly(common.BOOT_CLIENT)
 		handleInspectFile()
 		break
+	case common.CMD_LIST_FILES:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleListFiles()
+		break
 	case common.CMD_TEST_UPLOAD:
 		common.BootAs = common.BOOT_CLIENT
 		ConfigAssembly(common.BOOT_CLIENT)
 		handleTestUploadFile()
 		break
+	case common.CMD_DECOMMISSION:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleDecommission()
+		break
+	case common.CMD_ROTATE_KEY:
+		common.BootAs = common.BOOT_CLIENT
+		handleRotateKey()
+		break
+	case common.CMD_FSCK:
+		common.BootAs = common.BOOT_STORAGE
+		ConfigAssembly(common.BOOT_STORAGE)
+		handleFsck()
+		break
+	case common.CMD_GC:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleGc()
+		break
+	case common.CMD_USAGE:
+		common.BootAs = common.BOOT_CLIENT
+		ConfigAssembly(common.BOOT_CLIENT)
+		handleUsage()
+		break
+	case common.CMD_STRIP_TAILS:
+		common.BootAs = common.BOOT_STORAGE
+		ConfigAssembly(common.BOOT_STORAGE)
+		handleStripTails()
+		break
 	case common.CMD_GENERATE_TOKEN:
 		common.BootAs = common.BOOT_CLIENT
 		handleGenerateToken()
@@ -35,6 +35,12 @@ func Parse(arguments []string) {
 				return nil
 			},
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "config, c",
+					Value:       "",
+					Usage:       "config file in json format, which overrides command line flags and could be reloaded by SIGHUP",
+					Destination: &configFile,
+				},
 				cli.StringFlag{
 					Name:  "log-level",
 					Value: "",
@@ -105,6 +111,29 @@ func Parse(arguments []string) {
 					Usage:       "allowed access domains",
 					Destination: &allowedDomains,
 				},
+				cli.StringFlag{
+					Name:        "zone",
+					Usage:       "zone label of the server, same-zone servers are preferred",
+					Destination: &zone,
+				},
+				cli.StringFlag{
+					Name:        "rack",
+					Usage:       "rack label of the server, same-rack servers are preferred",
+					Destination: &rack,
+				},
+				cli.StringFlag{
+					Name:  "index-backend",
+					Value: common.INDEX_BACKEND_SET,
+					Usage: `backend of the fileId index, the index is migrated online when it changes, available options:
+	(set|bolt)`,
+					Destination: &indexBackend,
+				},
+				cli.StringFlag{
+					Name: "quotas",
+					Usage: `quotas of the bytes and the file count of groups and identities(0 means unlimited), example:
+	group:G01=10737418240/0,identity:alice=0/1000`,
+					Destination: &quotas,
+				},
 				cli.StringFlag{
 					Name:  "trackers",
 					Value: "",
@@ -146,6 +175,12 @@ func Parse(arguments []string) {
 				return nil
 			},
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "config, c",
+					Value:       "",
+					Usage:       "config file in json format, which overrides command line flags and could be reloaded by SIGHUP",
+					Destination: &configFile,
+				},
 				cli.StringFlag{
 					Name:  "log-level",
 					Value: "",
@@ -234,6 +269,119 @@ func Parse(arguments []string) {
 					Usage:       "allowed access hosts",
 					Destination: &allowedDomains,
 				},
+				cli.IntFlag{
+					Name:        "sync-rate-limit",
+					Value:       0,
+					Usage:       "bandwidth limit of file synchronization in KB/s(0 means unlimited)",
+					Destination: &syncRateLimit,
+				},
+				cli.IntFlag{
+					Name:        "download-rate-limit",
+					Value:       0,
+					Usage:       "bandwidth limit of tcp download in KB/s(0 means unlimited)",
+					Destination: &downloadRateLimit,
+				},
+				cli.IntFlag{
+					Name:        "http-download-rate-limit",
+					Value:       0,
+					Usage:       "bandwidth limit of http download in KB/s(0 means unlimited)",
+					Destination: &httpDownloadRateLimit,
+				},
+				cli.IntFlag{
+					Name:        "anti-entropy-interval",
+					Value:       60,
+					Usage:       "interval of anti-entropy reconciliation between group members in minutes(0 means disabled)",
+					Destination: &antiEntropyInterval,
+				},
+				cli.BoolFlag{
+					Name:        "bootstrap",
+					Usage:       "bootstrap from a snapshot of a group member if this server is new to the group",
+					Destination: &bootstrap,
+				},
+				cli.StringFlag{
+					Name:        "zone",
+					Usage:       "zone label of the server, same-zone servers are preferred",
+					Destination: &zone,
+				},
+				cli.StringFlag{
+					Name:        "rack",
+					Usage:       "rack label of the server, same-rack servers are preferred",
+					Destination: &rack,
+				},
+				cli.StringFlag{
+					Name:  "index-backend",
+					Value: common.INDEX_BACKEND_SET,
+					Usage: `backend of the fileId index, the index is migrated online when it changes, available options:
+	(set|bolt)`,
+					Destination: &indexBackend,
+				},
+				cli.StringFlag{
+					Name:        "mirror-groups",
+					Usage:       "mirror files of the groups for disaster recovery, example: group1,group2",
+					Destination: &mirrorGroups,
+				},
+				cli.StringFlag{
+					Name:        "data-dirs",
+					Usage:       "data dirs for blobs besides data dir, each one is usually a disk, example: /disk1,/disk2",
+					Destination: &dataDirs,
+				},
+				cli.StringFlag{
+					Name:  "blob-placement",
+					Value: common.PLACEMENT_FREE_SPACE,
+					Usage: `strategy of choosing data dir for new blobs, available options:
+	(free-space|hash)`,
+					Destination: &blobPlacement,
+				},
+				cli.IntFlag{
+					Name:        "volume-threshold",
+					Value:       0,
+					Usage:       "files smaller than it(in KB) are packed into volume files to save inodes(0 means disabled)",
+					Destination: &volumeThreshold,
+				},
+				cli.StringFlag{
+					Name:  "compression",
+					Value: common.COMPRESSION_NONE,
+					Usage: `codec of compressing files at rest, files of compressed mime types are skipped, available options:
+	(none|lz4|deflate)`,
+					Destination: &compression,
+				},
+				cli.IntFlag{
+					Name:        "compression-threshold",
+					Value:       4,
+					Usage:       "files smaller than it(in KB) are not compressed",
+					Destination: &compressionThreshold,
+				},
+				cli.StringFlag{
+					Name:  "compression-policies",
+					Value: "",
+					Usage: `compression policies of groups overriding compression and compression-threshold, for example:
+	G01=lz4/64,G02=none`,
+					Destination: &compressionPolicies,
+				},
+				cli.StringFlag{
+					Name:        "encryption-key-file",
+					Value:       "",
+					Usage:       "master key file for encrypting files at rest, a new key is generated if it does not exist(empty means disabled)",
+					Destination: &encryptionKeyFile,
+				},
+				cli.IntFlag{
+					Name:        "gc-interval",
+					Value:       60,
+					Usage:       "interval of deleting stale tmp files and orphan blobs in minutes(0 means disabled)",
+					Destination: &gcInterval,
+				},
+				cli.IntFlag{
+					Name:        "gc-tmp-file-age",
+					Value:       common.DEFAULT_GC_TMP_FILE_AGE,
+					Usage:       "tmp files older than it(in minutes) are deleted by gc",
+					Destination: &gcTmpFileAge,
+				},
+				cli.IntFlag{
+					Name:        "gc-grace-period",
+					Value:       common.DEFAULT_GC_GRACE_PERIOD,
+					Usage:       "orphan blobs modified in it(in minutes) are kept by gc",
+					Destination: &gcGracePeriod,
+				},
 				cli.StringFlag{
 					Name:  "trackers",
 					Value: "",
@@ -266,6 +414,190 @@ func Parse(arguments []string) {
 					Destination: &disableSaveLogfile,
 				},
 			},
+			Subcommands: cli.Commands{
+				{
+					Name:  "decommission",
+					Usage: "drain a storage server and remove it from the cluster",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_DECOMMISSION
+						if storages == "" {
+							return errors.New(`Err: no storage server provided.
+Usage: godfs storage decommission --storages [<secret>@]host:port`)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "storages",
+							Value:       "",
+							Usage:       "the storage server to decommission, example: [<secret>@]host:port",
+							Destination: &storages,
+						},
+						cli.BoolFlag{
+							Name:        "status",
+							Usage:       "show decommission progress only",
+							Destination: &decommissionStatusOnly,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "rotate-key",
+					Usage: "re-wrap the data keys of a storage server by a new master key, the server must be stopped",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_ROTATE_KEY
+						if dataDir == "" || encryptionKeyFile == "" || newKeyFile == "" {
+							return errors.New(`Err: data dir and key files are required.
+Usage: godfs storage rotate-key --data-dir <dir> --encryption-key-file <old key file> --new-key-file <new key file>`)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the storage server",
+							Destination: &dataDir,
+						},
+						cli.StringFlag{
+							Name:        "encryption-key-file",
+							Value:       "",
+							Usage:       "current master key file",
+							Destination: &encryptionKeyFile,
+						},
+						cli.StringFlag{
+							Name:        "new-key-file",
+							Value:       "",
+							Usage:       "new master key file, a new key is generated if it does not exist",
+							Destination: &newKeyFile,
+						},
+					},
+				},
+				{
+					Name:  "fsck",
+					Usage: "check the fileId dataset and blobs of a storage server against its binlogs, the server must be stopped",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_FSCK
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "config, c",
+							Value:       "",
+							Usage:       "config file of the storage server in json format",
+							Destination: &configFile,
+						},
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the storage server",
+							Destination: &dataDir,
+						},
+						cli.StringFlag{
+							Name:        "data-dirs",
+							Usage:       "data dirs for blobs besides data dir, example: /disk1,/disk2",
+							Destination: &dataDirs,
+						},
+						cli.StringFlag{
+							Name:        "mirror-groups",
+							Usage:       "groups mirrored by the storage server, example: group1,group2",
+							Destination: &mirrorGroups,
+						},
+						cli.StringFlag{
+							Name:        "secret, s",
+							Value:       "",
+							Usage:       "global secret of the storage server",
+							Destination: &secret,
+						},
+						cli.BoolFlag{
+							Name: "fix",
+							Usage: `rebuild the dataset, correct reference counts
+	and move orphan blobs to lost+found, otherwise only report the problems`,
+							Destination: &fsckFix,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "strip-tails",
+					Usage: "move the reference count tails of blobs stored by old versions into the blob states, the server must be stopped",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_STRIP_TAILS
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "config, c",
+							Value:       "",
+							Usage:       "config file of the storage server in json format",
+							Destination: &configFile,
+						},
+						cli.StringFlag{
+							Name:        "data-dir",
+							Value:       "",
+							Usage:       "data directory of the storage server",
+							Destination: &dataDir,
+						},
+						cli.StringFlag{
+							Name:        "data-dirs",
+							Usage:       "data dirs for blobs besides data dir, example: /disk1,/disk2",
+							Destination: &dataDirs,
+						},
+						cli.StringFlag{
+							Name:        "secret, s",
+							Value:       "",
+							Usage:       "global secret of the storage server",
+							Destination: &secret,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "gc",
+					Usage: "report the stale tmp files and orphan blobs of a running storage server without deleting them",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_GC
+						if storages == "" {
+							return errors.New(`Err: no storage server provided.
+Usage: godfs storage gc --storages [<secret>@]host:port`)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "storages",
+							Value:       "",
+							Usage:       "the storage server to report, example: [<secret>@]host:port",
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+			},
 		},
 		{
 			Name:  "agent",
@@ -275,6 +607,12 @@ func Parse(arguments []string) {
 				return nil
 			},
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "config, c",
+					Value:       "",
+					Usage:       "config file in json format, which overrides command line flags and could be reloaded by SIGHUP",
+					Destination: &configFile,
+				},
 				cli.StringFlag{
 					Name:  "log-level",
 					Value: "",
@@ -312,6 +650,16 @@ func Parse(arguments []string) {
 					Usage:       "http port",
 					Destination: &httpPort,
 				},
+				cli.StringFlag{
+					Name:        "zone",
+					Usage:       "zone label of the server, same-zone servers are preferred",
+					Destination: &zone,
+				},
+				cli.StringFlag{
+					Name:        "rack",
+					Usage:       "rack label of the server, same-rack servers are preferred",
+					Destination: &rack,
+				},
 				cli.StringFlag{
 					Name:  "trackers",
 					Value: "",
@@ -343,6 +691,20 @@ func Parse(arguments []string) {
 					Usage:       "disable save log to file",
 					Destination: &disableSaveLogfile,
 				},
+				cli.StringFlag{
+					Name:  "upload-balancer",
+					Value: common.BALANCER_ROUND_ROBIN,
+					Usage: `strategy of choosing storage server for uploading, available options:
+	(round-robin|least-inflight|latency-ewma|capacity-weighted|consistent-hash)`,
+					Destination: &uploadBalancer,
+				},
+				cli.StringFlag{
+					Name:  "download-balancer",
+					Value: common.BALANCER_ROUND_ROBIN,
+					Usage: `strategy of choosing storage server for downloading, available options:
+	(round-robin|least-inflight|latency-ewma|capacity-weighted|consistent-hash)`,
+					Destination: &downloadBalancer,
+				},
 			},
 		},
 		{
@@ -392,6 +754,23 @@ Usage: godfs client upload <file1> <file2> ...`)
 							Usage:       "mark as public files",
 							Destination: &publicUpload,
 						},
+						cli.DurationFlag{
+							Name:        "ttl",
+							Usage:       "time to live of the files, they are dropped after expiry, example: 24h(0 means never expire)",
+							Destination: &uploadTTL,
+						},
+						cli.StringFlag{
+							Name:        "meta",
+							Value:       "",
+							Usage:       "custom attributes of the files, example: author=godfs,tag=doc",
+							Destination: &uploadMeta,
+						},
+						cli.StringFlag{
+							Name:        "identity",
+							Value:       "",
+							Usage:       "identity the files are charged to for quotas",
+							Destination: &uploadIdentity,
+						},
 						cli.StringFlag{
 							Name:  "storages",
 							Value: "",
@@ -497,6 +876,104 @@ Usage: godfs client inspect <fid1> <fid2> ...`)
 							Name:  "log-level",
 							Value: "",
 							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "ls",
+					Usage: "list a page of files on a tracker server or storage server",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_LIST_FILES
+						if trackers == "" && storages == "" {
+							return errors.New(`Err: no server provided.
+Usage: godfs client ls --trackers [<secret>@]host:port [--group <group>] [--cursor <cursor>]`)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "group, g",
+							Value:       "",
+							Usage:       "list files of the group",
+							Destination: &listGroup,
+						},
+						cli.StringFlag{
+							Name:        "source",
+							Value:       "",
+							Usage:       "list files uploaded to the storage instance",
+							Destination: &listSource,
+						},
+						cli.StringFlag{
+							Name:        "from",
+							Value:       "",
+							Usage:       "list files uploaded since the time, example: 2020-01-01T00:00:00+08:00 or unix seconds",
+							Destination: &listFrom,
+						},
+						cli.StringFlag{
+							Name:        "to",
+							Value:       "",
+							Usage:       "list files uploaded before the time, example: 2020-01-01T00:00:00+08:00 or unix seconds",
+							Destination: &listTo,
+						},
+						cli.StringFlag{
+							Name:        "cursor",
+							Value:       "",
+							Usage:       "list files after the cursor printed by the last listing",
+							Destination: &listCursor,
+						},
+						cli.IntFlag{
+							Name:        "limit",
+							Value:       common.LIST_DEFAULT_LIMIT,
+							Usage:       "max count of listed files",
+							Destination: &listLimit,
+						},
+						cli.StringFlag{
+							Name:  "storages",
+							Value: "",
+							Usage: `list files of the storage server if no tracker server is set, example:
+	[<secret>@]host:port`,
+							Destination: &storages,
+						},
+						cli.StringFlag{
+							Name:  "trackers",
+							Value: "",
+							Usage: `list files of the tracker server, example:
+	[<secret>@]host:port`,
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
+	(trace|debug|info|warn|error|fatal)`,
+							Destination: &logLevel,
+						},
+					},
+				},
+				{
+					Name:  "usage",
+					Usage: "show the usage and quotas of groups and identities on a tracker server",
+					Action: func(c *cli.Context) error {
+						finalCommand = common.CMD_USAGE
+						if trackers == "" {
+							return errors.New(`Err: no tracker server provided.
+Usage: godfs client usage --trackers [<secret>@]host:port`)
+						}
+						return nil
+					},
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:        "trackers",
+							Value:       "",
+							Usage:       "the tracker server to query, example: [<secret>@]host:port",
+							Destination: &trackers,
+						},
+						cli.StringFlag{
+							Name:  "log-level",
+							Value: "",
+							Usage: `set log level, available options:
 	(trace|debug|info|warn|error|fatal)`,
 							Destination: &logLevel,
 						},
@@ -1,9 +1,11 @@
 package command
 
 import (
+	"errors"
 	"fmt"
 	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/svc"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/convert"
@@ -81,6 +83,10 @@ func handleUploadFile() error {
 	if err != nil {
 		return err
 	}
+	attributes, err := parseUploadMeta(uploadMeta)
+	if err != nil {
+		return err
+	}
 	total := 0   // total files
 	success := 0 // success files
 	// upload all files in work dir.
@@ -106,7 +112,13 @@ func handleUploadFile() error {
 					name = name[0:10] + "..." + name[len(name)-10:]
 				}
 				pro := pg.NewWrappedReaderProgress(inf.Size(), 50, "uploading: ["+name+"]", pg.Top, r)
-				ret, err := client.Upload(r, inf.Size(), group, common.InitializedClientConfiguration.PrivateUpload)
+				ret, err := client.UploadWithOptions(r, inf.Size(), group, &api.UploadOptions{
+					IsPrivate:  common.InitializedClientConfiguration.PrivateUpload,
+					TTL:        uploadTTL,
+					Name:       inf.Name(),
+					Attributes: attributes,
+					Identity:   uploadIdentity,
+				})
 				fi.Close()
 				if err != nil {
 					pro.Destroy()
@@ -137,7 +149,13 @@ func handleUploadFile() error {
 				name = name[0:10] + "..." + name[len(name)-10:]
 			}
 			pro := pg.NewWrappedReaderProgress(inf.Size(), 50, "uploading: ["+name+"]", pg.Top, r)
-			ret, err := client.Upload(r, inf.Size(), group, common.InitializedClientConfiguration.PrivateUpload)
+			ret, err := client.UploadWithOptions(r, inf.Size(), group, &api.UploadOptions{
+				IsPrivate:  common.InitializedClientConfiguration.PrivateUpload,
+				TTL:        uploadTTL,
+				Name:       inf.Name(),
+				Attributes: attributes,
+				Identity:   uploadIdentity,
+			})
 			if err != nil {
 				pro.Destroy()
 				logger.Error(err)
@@ -153,6 +171,27 @@ func handleUploadFile() error {
 	return nil
 }
 
+// parseUploadMeta parses the custom attributes of uploading files,
+// for example: author=godfs,tag=doc
+func parseUploadMeta(meta string) (map[string]string, error) {
+	var ret map[string]string
+	for _, kv := range strings.Split(meta, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, errors.New("invalid attribute \"" + kv + "\", attributes must be key=value")
+		}
+		if ret == nil {
+			ret = make(map[string]string)
+		}
+		ret[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	return ret, nil
+}
+
 // handleDownloadFile handles download files by client cli.
 func handleDownloadFile() error {
 	// initialize APIClient
@@ -284,6 +323,158 @@ func handleInspectFile() error {
 }
 
 // handleGenerateToken
+// handleDecommission starts decommission of a storage server
+// and prints the progress until it is finished.
+// handleListFiles lists a page of files on the tracker server,
+// or on the storage server if no tracker server is set.
+func handleListFiles() {
+	// initialize APIClient
+	if err := initClient(); err != nil {
+		logger.Fatal(err)
+	}
+	servers, err := util.ParseServers(gox.TValue(trackers != "", trackers, storages).(string))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(servers) != 1 {
+		logger.Fatal("exactly one tracker server or storage server is required")
+	}
+	query := &common.FileListQuery{
+		Group:  listGroup,
+		Source: listSource,
+		Cursor: listCursor,
+		Limit:  listLimit,
+	}
+	if query.From, err = parseListTime(listFrom); err != nil {
+		logger.Fatal(err)
+	}
+	if query.To, err = parseListTime(listTo); err != nil {
+		logger.Fatal(err)
+	}
+	ret, err := client.List(servers[0], query)
+	if err != nil {
+		logger.Fatal("error list files: ", err)
+	}
+	bs, err := json.MarshalIndent(ret.Files, "", "  ")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("list result:\n", string(bs))
+	if ret.HasMore {
+		logger.Info("listed ", len(ret.Files), " files, more files are listed by: --cursor ", ret.Cursor)
+	} else {
+		logger.Info("listed ", len(ret.Files), " files, no more files, new files are listed by: --cursor ", ret.Cursor)
+	}
+}
+
+// parseListTime parses the time of listing files in RFC3339 or unix seconds.
+func parseListTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := convert.StrToInt64(s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("invalid time \"" + s + "\", example: 2020-01-01T00:00:00+08:00 or unix seconds")
+	}
+	return t.Unix(), nil
+}
+
+func handleDecommission() {
+	// initialize APIClient
+	if err := initClient(); err != nil {
+		logger.Fatal(err)
+	}
+	servers, err := util.ParseServers(storages)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(servers) != 1 {
+		logger.Fatal("exactly one storage server is required")
+	}
+	server := servers[0]
+
+	lastRound := 0
+	status, err := client.Decommission(server, !decommissionStatusOnly)
+	for {
+		if err != nil {
+			logger.Fatal("error decommission storage server ", server.ConnectionString(), ": ", err)
+		}
+		logger.Info("decommission ", status.State, ": round ", status.Round,
+			", checked ", status.Checked, " of ", status.Total, " files, missing ", status.Missing,
+			", pushed ", status.Pushed, ", blocking ", status.BlockingCount,
+			gox.TValue(status.Message == "", "", ", "+status.Message).(string))
+		if status.State == common.DECOMMISSION_BLOCKED && status.Round != lastRound {
+			lastRound = status.Round
+			for _, fileId := range status.Blocking {
+				logger.Warn("blocking file: ", fileId)
+			}
+			if status.BlockingCount > len(status.Blocking) {
+				logger.Warn("... and ", status.BlockingCount-len(status.Blocking), " more")
+			}
+		}
+		if decommissionStatusOnly || status.State == common.DECOMMISSION_DONE {
+			break
+		}
+		time.Sleep(time.Second * 3)
+		status, err = client.Decommission(server, false)
+	}
+}
+
+// handleStripTails moves the reference count tails of the blobs of the stopped storage server into blob states.
+func handleStripTails() {
+	n, err := svc.RunStripBlobTails()
+	if err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
+	fmt.Println(n, "blobs are stripped of the reference count tail")
+}
+
+// handleGc prints the garbage the next collection of the storage server would delete.
+func handleGc() {
+	// initialize APIClient
+	if err := initClient(); err != nil {
+		logger.Fatal(err)
+	}
+	servers, err := util.ParseServers(storages)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(servers) != 1 {
+		logger.Fatal("exactly one storage server is required")
+	}
+	report, err := client.GcReport(servers[0])
+	if err != nil {
+		logger.Fatal("error query gc report of storage server ", servers[0].ConnectionString(), ": ", err)
+	}
+	bs, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(bs))
+}
+
+// handleUsage prints the usage and quotas of groups and identities aggregated by the tracker server.
+func handleUsage() {
+	// initialize APIClient
+	if err := initClient(); err != nil {
+		logger.Fatal(err)
+	}
+	servers, err := util.ParseServers(trackers)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if len(servers) != 1 {
+		logger.Fatal("exactly one tracker server is required")
+	}
+	usage, err := client.QueryUsage(servers[0])
+	if err != nil {
+		logger.Fatal("error query usage of tracker server ", servers[0].ConnectionString(), ": ", err)
+	}
+	bs, _ := json.MarshalIndent(usage, "", "  ")
+	fmt.Println(string(bs))
+}
+
 func handleGenerateToken() {
 	ts := convert.Int64ToStr(gox.GetTimestamp(time.Now().Add(time.Second * time.Duration(tokenLife))))
 	util.GenerateDecKey(secret)
@@ -304,3 +495,34 @@ func handleGenerateToken() {
 		fmt.Println("token=" + token + "&ts=" + ts)
 	}
 }
+
+// handleRotateKey re-wraps the data keys in the keyring of the data dir by the new master key.
+func handleRotateKey() {
+	n, err := svc.RunRotateMasterKey(dataDir, encryptionKeyFile, newKeyFile)
+	if err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
+	fmt.Println(n, "data keys are re-wrapped by the new master key,",
+		"set encryptionKeyFile of the storage server to", newKeyFile, "before starting it")
+}
+
+// handleFsck checks the stopped storage server and prints the report.
+func handleFsck() {
+	report, err := svc.RunFsck(fsckFix)
+	if report != nil {
+		bs, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(bs))
+	}
+	if err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
+	if !fsckFix && (report.DatasetLost || report.DatasetMissing > 0 || len(report.OrphanBlobs) > 0 ||
+		len(report.RefCounts) > 0) {
+		fmt.Println("run with --fix to repair the dataset, reference counts and orphan blobs")
+	}
+	if len(report.MissingBlobs) > 0 {
+		fmt.Println(len(report.MissingBlobs), "files have no blob, they are repaired by anti-entropy after the server starts")
+	}
+}
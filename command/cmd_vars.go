@@ -2,10 +2,13 @@ package command
 
 import (
 	"container/list"
+	"fmt"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
+	"os"
 	"strings"
+	"time"
 )
 
 // var sets
@@ -46,11 +49,67 @@ var (
 	tokenFileId            string
 	tokenLife              int    // token life(in seconds)
 	tokenFormat            string // token format: url or json
+	syncRateLimit          int    // peer synchronization bandwidth limit(KB/s)
+	downloadRateLimit      int    // tcp download bandwidth limit(KB/s)
+	httpDownloadRateLimit  int    // http download bandwidth limit(KB/s)
+	antiEntropyInterval    int    // anti-entropy reconciliation interval(in minutes)
+	bootstrap              bool   // bootstrap from a snapshot of a group member
+	decommissionStatusOnly bool   // show decommission progress only
+	uploadBalancer         string // strategy of choosing storage server for uploading
+	downloadBalancer       string // strategy of choosing storage server for downloading
+	zone                   string // zone label of the server
+	rack                   string // rack label of the server
+	mirrorGroups           string // groups mirrored by the storage server
+	dataDirs               string // data dirs for blobs besides data dir
+	blobPlacement          string // strategy of choosing data dir for new blobs
+	volumeThreshold        int    // files smaller than it are packed into volume files(KB)
+	compression            string // codec of compressing files at rest
+	compressionThreshold   int    // files smaller than it are not compressed(KB)
+	compressionPolicies    string // compression policies of groups
+	encryptionKeyFile      string // master key file for encrypting files at rest
+	newKeyFile             string // new master key file of key rotation
 	finalCommand           common.Command
+	uploadTTL              time.Duration // time to live of uploaded files
+	uploadMeta             string        // custom attributes of uploaded files
+	uploadIdentity         string        // identity uploaded files are charged to
+	listGroup              string        // list files of the group
+	listSource             string        // list files of the source instance
+	listFrom               string        // list files uploaded since the time
+	listTo                 string        // list files uploaded before the time
+	listCursor             string        // list files after the cursor
+	listLimit              int           // max count of listed files
+	fsckFix                bool          // fix the problems found by fsck
+	indexBackend           string        // backend of the fileId index
+	gcInterval             int           // garbage collection interval(in minutes)
+	gcTmpFileAge           int           // tmp files older than it are deleted by gc(in minutes)
+	gcGracePeriod          int           // orphan blobs modified in it are kept by gc(in minutes)
+	quotas                 string        // quotas of groups and identities
 )
 
-//
+// ConfigAssembly assembles the config of the boot mode
+// and sets it as the initialized configuration.
 func ConfigAssembly(bm common.BootMode) interface{} {
+	c, err := assembleConfig(bm)
+	if err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
+	switch c.(type) {
+	case *common.StorageConfig:
+		common.InitializedStorageConfiguration = c.(*common.StorageConfig)
+	case *common.AgentConfig:
+		common.InitializedAgentConfiguration = c.(*common.AgentConfig)
+	case *common.TrackerConfig:
+		common.InitializedTrackerConfiguration = c.(*common.TrackerConfig)
+	case *common.ClientConfig:
+		common.InitializedClientConfiguration = c.(*common.ClientConfig)
+	}
+	return c
+}
+
+// assembleConfig builds config from command line flags and the config file,
+// it is called again when servers reload config.
+func assembleConfig(bm common.BootMode) (interface{}, error) {
 	if bm == common.BOOT_STORAGE {
 		c := &common.StorageConfig{}
 		c.Port = gox.TValue(port <= 0, common.DEFAULT_STORAGE_TCP_PORT, port).(int)
@@ -63,6 +122,17 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		c.MaxRollingLogfileSize = maxLogfileSize
 		c.SaveLog2File = !disableSaveLogfile
 		c.Readonly = readOnly
+		c.SyncRateLimit = syncRateLimit
+		c.DownloadRateLimit = downloadRateLimit
+		c.HttpDownloadRateLimit = httpDownloadRateLimit
+		c.AntiEntropyInterval = antiEntropyInterval
+		c.Bootstrap = bootstrap
+		c.Zone = zone
+		c.Rack = rack
+		c.IndexBackend = indexBackend
+		c.GcInterval = gcInterval
+		c.GcTmpFileAge = gcTmpFileAge
+		c.GcGracePeriod = gcGracePeriod
 
 		if defaultAccessMode == "public" {
 			c.PublicAccessMode = true
@@ -105,8 +175,25 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		if allowedDomains != "" {
 			c.AllowedDomains = strings.Split(allowedDomains, ",")
 		}
-		common.InitializedStorageConfiguration = c
-		return c
+		if mirrorGroups != "" {
+			c.MirrorGroups = strings.Split(mirrorGroups, ",")
+		}
+		if dataDirs != "" {
+			c.DataDirs = strings.Split(dataDirs, ",")
+		}
+		c.BlobPlacement = blobPlacement
+		c.VolumeThreshold = volumeThreshold
+		c.Compression = compression
+		c.CompressionThreshold = compressionThreshold
+		if compressionPolicies != "" {
+			p, err := util.ParseCompressionPolicies(compressionPolicies)
+			if err != nil {
+				return nil, err
+			}
+			c.CompressionPolicies = p
+		}
+		c.EncryptionKeyFile = encryptionKeyFile
+		return c, loadConfigFile(bm, c)
 	} else if bm == common.BOOT_AGENT {
 		c := &common.AgentConfig{}
 		c.Port = gox.TValue(port <= 0, common.DEFAULT_AGENT_TCP_PORT, port).(int)
@@ -116,6 +203,10 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		c.LogRotationInterval = logRotationInterval
 		c.MaxRollingLogfileSize = maxLogfileSize
 		c.SaveLog2File = !disableSaveLogfile
+		c.UploadBalancer = uploadBalancer
+		c.DownloadBalancer = downloadBalancer
+		c.Zone = zone
+		c.Rack = rack
 
 		if logDir == "" {
 			logDir = util.DefaultLogDir()
@@ -136,8 +227,7 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		if trackers != "" {
 			c.Trackers = strings.Split(trackers, ",")
 		}
-		common.InitializedAgentConfiguration = c
-		return c
+		return c, loadConfigFile(bm, c)
 	} else if bm == common.BOOT_TRACKER {
 		c := &common.TrackerConfig{}
 		c.Port = gox.TValue(port <= 0, common.DEFAULT_TRACKER_TCP_PORT, port).(int)
@@ -148,6 +238,16 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		c.LogRotationInterval = logRotationInterval
 		c.MaxRollingLogfileSize = maxLogfileSize
 		c.SaveLog2File = !disableSaveLogfile
+		c.Zone = zone
+		c.Rack = rack
+		c.IndexBackend = indexBackend
+		if quotas != "" {
+			q, err := util.ParseQuotas(quotas)
+			if err != nil {
+				return nil, err
+			}
+			c.Quotas = q
+		}
 
 		if logDir == "" {
 			logDir = util.DefaultLogDir()
@@ -179,8 +279,7 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 		if trackers != "" {
 			c.Trackers = strings.Split(trackers, ",")
 		}
-		common.InitializedTrackerConfiguration = c
-		return c
+		return c, loadConfigFile(bm, c)
 	} else if bm == common.BOOT_CLIENT {
 		c := &common.ClientConfig{}
 		c.Secret = secret
@@ -194,8 +293,25 @@ func ConfigAssembly(bm common.BootMode) interface{} {
 			tokenFormat = "url"
 		}
 		c.PrivateUpload = !publicUpload
-		common.InitializedClientConfiguration = c
-		return c
+		return c, nil
+	}
+	return nil, nil
+}
+
+// loadConfigFile overrides the config with the config file if it is specified.
+func loadConfigFile(bm common.BootMode, c interface{}) error {
+	if configFile == "" {
+		return nil
+	}
+	if err := util.LoadConfig(configFile, bm, c); err != nil {
+		return err
+	}
+	// data dir may be changed by the config file.
+	switch c.(type) {
+	case *common.StorageConfig:
+		c.(*common.StorageConfig).TmpDir = c.(*common.StorageConfig).DataDir + "/tmp"
+	case *common.AgentConfig:
+		c.(*common.AgentConfig).TmpDir = c.(*common.AgentConfig).DataDir + "/tmp"
 	}
 	return nil
 }
@@ -20,6 +20,8 @@ const (
 	HTTP_AUTH_PATTERN   = "^([^:]+):([^:]+)$"
 	INSTANCE_ID_PATTERN = "^[0-9a-z-]{8}$"
 	FILE_META_PATTERN   = "^([0-9a-zA-Z-_]{1,30})/([0-9A-F]{2})/([0-9A-F]{2})/([0-9a-f]{32})$"
+	LABEL_PATTERN       = "^[0-9a-zA-Z-_.]{0,30}$"
+	IDENTITY_PATTERN    = "^[0-9a-zA-Z-_.@]{1,64}$"
 	//
 	DEFAULT_STORAGE_TCP_PORT  = 10706
 	DEFAULT_STORAGE_HTTP_PORT = 11222
@@ -38,12 +40,25 @@ const (
 	OPERATION_SYNC_INSTANCES Operation = 5
 	OPERATION_PUSH_BINLOGS   Operation = 6
 	OPERATION_SYNC_BINLOGS   Operation = 7
+	OPERATION_FILEID_DIGEST  Operation = 8
+	OPERATION_FILEID_LIST    Operation = 9
+	OPERATION_SNAPSHOT       Operation = 10
+	OPERATION_REPLICATE_FILE Operation = 11
+	OPERATION_DECOMMISSION   Operation = 12
+	OPERATION_INSTANCE_INFO  Operation = 13
+	OPERATION_DEREGISTER     Operation = 14
+	OPERATION_HEALTH_CHECK   Operation = 15
+	OPERATION_PROBE_FILE     Operation = 16
+	OPERATION_LIST_FILES     Operation = 17
+	OPERATION_GC             Operation = 18
+	OPERATION_USAGE          Operation = 19
 	//
 	SUCCESS           OperationResult = 0
 	ERROR             OperationResult = 1
 	UNAUTHORIZED      OperationResult = 2
 	NOT_FOUND         OperationResult = 3
 	UNKNOWN_OPERATION OperationResult = 4
+	QUOTA_EXCEEDED    OperationResult = 5
 	//
 	CMD_SHOW_HELP      Command = 0
 	CMD_SHOW_VERSION   Command = 1
@@ -57,6 +72,13 @@ const (
 	CMD_TEST_UPLOAD    Command = 9
 	CMD_GENERATE_TOKEN Command = 10
 	CMD_BOOT_AGENT     Command = 11
+	CMD_DECOMMISSION   Command = 12
+	CMD_ROTATE_KEY     Command = 13
+	CMD_LIST_FILES     Command = 14
+	CMD_FSCK           Command = 15
+	CMD_GC             Command = 16
+	CMD_STRIP_TAILS    Command = 17
+	CMD_USAGE          Command = 18
 	//
 	ROLE_TRACKER Role = 1
 	ROLE_STORAGE Role = 2
@@ -64,22 +86,95 @@ const (
 	ROLE_CLIENT  Role = 4
 	ROLE_ANY     Role = 5
 	//
-	REGISTER_HOLD RegisterState = 1
-	REGISTER_FREE RegisterState = 2
+	REGISTER_HOLD        RegisterState = 1
+	REGISTER_FREE        RegisterState = 2
+	REGISTER_UNCONFIRMED RegisterState = 3 // restored from snapshot and not registered again yet
+	//
+	DRAIN_DRAINING       = "draining"
+	DRAIN_DECOMMISSIONED = "decommissioned"
+	DRAIN_SHUTDOWN       = "shutdown"
+	//
+	REGISTRY_JOIN     = "join"
+	REGISTRY_LEAVE    = "leave"
+	REGISTRY_EXPIRE   = "expire"
+	REGISTRY_CONFLICT = "conflict"
+	REGISTRY_RESTORE  = "restore"
+	REGISTRY_CONFIRM  = "confirm"
+	//
+	HEALTH_HEALTHY   = "healthy"
+	HEALTH_UNHEALTHY = "unhealthy"
+	//
+	BALANCER_ROUND_ROBIN       = "round-robin"
+	BALANCER_LEAST_INFLIGHT    = "least-inflight"
+	BALANCER_LATENCY_EWMA      = "latency-ewma"
+	BALANCER_CAPACITY_WEIGHTED = "capacity-weighted"
+	BALANCER_CONSISTENT_HASH   = "consistent-hash"
+	//
+	PLACEMENT_FREE_SPACE = "free-space"
+	PLACEMENT_HASH       = "hash"
+	//
+	COMPRESSION_NONE    = "none"
+	COMPRESSION_LZ4     = "lz4"
+	COMPRESSION_DEFLATE = "deflate"
+	//
+	INDEX_BACKEND_SET  = "set"
+	INDEX_BACKEND_BOLT = "bolt"
+	//
+	DECOMMISSION_RUNNING = "running"
+	DECOMMISSION_BLOCKED = "blocked"
+	DECOMMISSION_DONE    = "done"
 	//
 	REGISTER_INTERVAL    = time.Second * 30
 	SYNCHRONIZE_INTERVAL = time.Second * 45
+	// docker kills the container 10 seconds after SIGTERM by default.
+	SHUTDOWN_TIMEOUT = time.Second * 8
+	// interrupted requests are given time to return after their connections are closed.
+	SHUTDOWN_FORCE_TIMEOUT = time.Second
+	// storage servers are marked unhealthy after continuous failures of health check.
+	HEALTH_CHECK_INTERVAL = time.Second * 10
+	HEALTH_CHECK_TIMEOUT  = time.Second * 5
+	HEALTH_CHECK_FAILURES = 2
+	// small files are packed into volume files of this size at most.
+	VOLUME_SIZE          = 1 << 30 // 1G
+	VOLUME_MAX_THRESHOLD = 1 << 14 // KB
+	// sealed volumes are compacted if the ratio of deleted space reaches.
+	VOLUME_COMPACT_RATIO    = 0.5
+	VOLUME_COMPACT_INTERVAL = time.Hour
+	// expired files are reaped in batches.
+	FILE_REAP_INTERVAL   = time.Minute
+	FILE_REAP_BATCH_SIZE = 1000
+	// custom attributes of files are given by parameters with the prefix.
+	FILE_META_ATTRIBUTE_PREFIX = "meta-"
+	MAX_FILE_META_SIZE         = 4096 // max size of the encoded file metadata in bytes
+	// group members which do not answer file probes in time are reported as errors.
+	FILE_PROBE_TIMEOUT = time.Second * 5
+	// pages of listing files, a page is cut short when too many binlogs are scanned.
+	LIST_DEFAULT_LIMIT = 100
+	LIST_MAX_LIMIT     = 1000
+	LIST_SCAN_LIMIT    = 100000
+	// uploads are charged to the quotas on the storage server until trackers count them,
+	// which takes a binlog push and a usage refresh.
+	QUOTA_PENDING_TTL = time.Minute
+	// gc keeps tmp files and orphan blobs modified in this period by default, in minutes.
+	DEFAULT_GC_TMP_FILE_AGE = 1440
+	DEFAULT_GC_GRACE_PERIOD = 1440
 
 	FILE_ID_SIZE = 86
 
 	BUCKET_KEY_CONFIGMAP         = "configMap"
 	BUCKET_KEY_FAILED_BINLOG_POS = "failedBinlogPos"
 	BUCKET_KEY_FILEID            = "fileIds"
+	BUCKET_KEY_FILE_META         = "fileMeta"
+	BUCKET_KEY_FILE_EXPIRY       = "fileExpiry"  // expire time and fileId of files to be reaped
+	BUCKET_KEY_BLOB_STATE        = "blobState"   // reference count and size of standalone blobs
+	BUCKET_KEY_USAGE             = "usage"       // bytes and count of the live files of groups and identities
+	BUCKET_KEY_USAGE_EXPIRY      = "usageExpiry" // expire time and fileId of the usage to be released
 )
 
 var (
 	NotFoundErr                     = errors.New("file not found")
 	ServerErr                       = errors.New("server internal error")
+	QuotaExceededErr                = errors.New("quota exceeded")
 	InitializedTrackerConfiguration *TrackerConfig
 	InitializedStorageConfiguration *StorageConfig
 	InitializedAgentConfiguration   *AgentConfig
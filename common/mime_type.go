@@ -1,6 +1,7 @@
 package common
 
 import (
+	"net/http"
 	"strings"
 )
 
@@ -9,6 +10,29 @@ var (
 	mimeTypes       = make(map[string]string)
 	webMimeTypes    = make(map[string]string)
 	defaultMimeType = "application/octet-stream"
+	// mime types of compressed formats, which are not compressed again at rest.
+	compressedMimeTypes = map[string]bool{
+		"image/gif":                        true,
+		"image/jpeg":                       true,
+		"image/png":                        true,
+		"image/webp":                       true,
+		"image/x-jng":                      true,
+		"application/font-woff":            true,
+		"application/java-archive":         true,
+		"application/pdf":                  true,
+		"application/vnd.google-earth.kmz": true,
+		"application/x-7z-compressed":      true,
+		"application/x-rar-compressed":     true,
+		"application/x-gzip":               true,
+		"application/gzip":                 true,
+		"application/zip":                  true,
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+		"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+		"audio/mpeg":  true,
+		"audio/ogg":   true,
+		"audio/x-m4a": true,
+	}
 )
 
 func init() {
@@ -124,3 +148,20 @@ func GetMimeType(ext string) string {
 func AddWebMimeType(ext string, mimetype string) {
 	mimeTypes[ext] = mimetype
 }
+
+// DetectMimeType detects mime type of a file by its name,
+// or by the content if the name has no known extension.
+func DetectMimeType(fileName string, head []byte) string {
+	if i := strings.LastIndex(fileName, "."); i >= 0 {
+		if format := mimeTypes[fileName[i+1:]]; format != "" {
+			return format
+		}
+	}
+	return strings.TrimSpace(strings.Split(http.DetectContentType(head), ";")[0])
+}
+
+// IsCompressedMimeType judges whether the mime type is a compressed format,
+// such as images, videos and archives.
+func IsCompressedMimeType(mimeType string) bool {
+	return compressedMimeTypes[mimeType] || strings.HasPrefix(mimeType, "video/")
+}
@@ -38,10 +38,30 @@ type StorageConfig struct {
 	Readonly              bool     `json:"readonly"`
 	PublicAccessMode      bool     `json:"publicAccessMode"`
 	AllowedDomains        []string `json:"allowedDomains"`
-	InstanceId            string
-	HistorySecrets        map[string]string
-	TmpDir                string
-	ParsedTrackers        []Server
+	SyncRateLimit         int      `json:"syncRateLimit"`         // KB/s, 0 means unlimited
+	DownloadRateLimit     int      `json:"downloadRateLimit"`     // KB/s, 0 means unlimited
+	HttpDownloadRateLimit int      `json:"httpDownloadRateLimit"` // KB/s, 0 means unlimited
+	AntiEntropyInterval   int      `json:"antiEntropyInterval"`   // in minutes, 0 means disabled
+	Bootstrap             bool     `json:"bootstrap"`             // bootstrap from a snapshot of a group member
+	Zone                  string   `json:"zone"`
+	Rack                  string   `json:"rack"`
+	MirrorGroups          []string `json:"mirrorGroups"`         // groups whose files are mirrored by this server
+	DataDirs              []string `json:"dataDirs"`             // data dirs for blobs besides dataDir
+	BlobPlacement         string   `json:"blobPlacement"`        // strategy of choosing data dir for new blobs
+	VolumeThreshold       int      `json:"volumeThreshold"`      // KB, smaller files are packed into volume files, 0 means disabled
+	Compression           string   `json:"compression"`          // codec of compressing files of this group at rest
+	CompressionThreshold  int      `json:"compressionThreshold"` // KB, smaller files are not compressed
+	// per-group policies overriding compression and compressionThreshold.
+	CompressionPolicies []CompressionPolicy `json:"compressionPolicies"`
+	EncryptionKeyFile   string              `json:"encryptionKeyFile"` // master key file for encrypting files at rest, empty means disabled
+	IndexBackend        string              `json:"indexBackend"`      // backend of the fileId index, which is migrated online on change
+	GcInterval          int                 `json:"gcInterval"`        // in minutes, 0 means disabled
+	GcTmpFileAge        int                 `json:"gcTmpFileAge"`      // in minutes, older tmp files are deleted by gc
+	GcGracePeriod       int                 `json:"gcGracePeriod"`     // in minutes, recently modified orphan blobs are kept by gc
+	InstanceId          string
+	HistorySecrets      map[string]string
+	TmpDir              string
+	ParsedTrackers      []Server
 }
 
 type AgentConfig struct {
@@ -56,6 +76,10 @@ type AgentConfig struct {
 	MaxRollingLogfileSize int      `json:"maxRollingLogfileSize"`
 	LogRotationInterval   string   `json:"logRotationInterval"`
 	HttpPort              int      `json:"httpPort"`
+	UploadBalancer        string   `json:"uploadBalancer"`   // strategy of choosing storage server for uploading
+	DownloadBalancer      string   `json:"downloadBalancer"` // strategy of choosing storage server for downloading
+	Zone                  string   `json:"zone"`
+	Rack                  string   `json:"rack"`
 	InstanceId            string
 	HistorySecrets        map[string]string
 	TmpDir                string
@@ -66,19 +90,23 @@ type TrackerConfig struct {
 	Trackers              []string `json:"trackers"`
 	Secret                string   `json:"secret"`
 	InstanceId            string
-	BindAddress           string `json:"bindAddress"`
-	Port                  int    `json:"port"`
-	AdvertiseAddress      string `json:"advertiseAddress"`
-	AdvertisePort         int    `json:"advertisePort"`
-	DataDir               string `json:"dataDir"`
-	PreferredNetworks     string `json:"preferredNetworks"`
-	LogLevel              string `json:"logLevel"`
-	LogDir                string `json:"logDir"`
-	SaveLog2File          bool   `json:"saveLog2File"`
-	MaxRollingLogfileSize int    `json:"maxRollingLogfileSize"`
-	LogRotationInterval   string `json:"logRotationInterval"`
-	EnableHttp            bool   `json:"enableHttp"`
-	HttpPort              int    `json:"httpPort"` // TODO add advertise http port
+	BindAddress           string  `json:"bindAddress"`
+	Port                  int     `json:"port"`
+	AdvertiseAddress      string  `json:"advertiseAddress"`
+	AdvertisePort         int     `json:"advertisePort"`
+	DataDir               string  `json:"dataDir"`
+	PreferredNetworks     string  `json:"preferredNetworks"`
+	LogLevel              string  `json:"logLevel"`
+	LogDir                string  `json:"logDir"`
+	SaveLog2File          bool    `json:"saveLog2File"`
+	MaxRollingLogfileSize int     `json:"maxRollingLogfileSize"`
+	LogRotationInterval   string  `json:"logRotationInterval"`
+	EnableHttp            bool    `json:"enableHttp"`
+	HttpPort              int     `json:"httpPort"` // TODO add advertise http port
+	Zone                  string  `json:"zone"`
+	Rack                  string  `json:"rack"`
+	IndexBackend          string  `json:"indexBackend"` // backend of the fileId index, which is migrated online on change
+	Quotas                []Quota `json:"quotas"`       // quotas of groups and identities enforced by storage servers
 	HistorySecrets        map[string]string
 	ParsedTrackers        []Server
 }
@@ -138,18 +166,68 @@ type Header struct {
 }
 
 type UploadResult struct {
-	Group    string `json:"group"`
-	Instance string `json:"instance"`
-	FileId   string `json:"fileId"`
+	Group      string `json:"group"`
+	Instance   string `json:"instance"`
+	FileId     string `json:"fileId"`
+	ExpireTime int64  `json:"expireTime,omitempty"` // unix seconds, 0 means never expire
 }
 
 type FileInfo struct {
-	Group      string `json:"group"`
-	Path       string `json:"path"`
-	FileLength int64  `json:"size"`
+	Group      string    `json:"group"`
+	Path       string    `json:"path"`
+	FileLength int64     `json:"size"`
+	InstanceId string    `json:"instance"`
+	IsPrivate  bool      `json:"isPrivate"`
+	CreateTime int64     `json:"createTime"`
+	ExpireTime int64     `json:"expireTime,omitempty"` // unix seconds, 0 means never expire
+	Meta       *FileMeta `json:"meta,omitempty"`
+	// stored state of the file, which is not encoded in the fileId.
+	Md5      string        `json:"md5,omitempty"`
+	RefCount int64         `json:"refCount,omitempty"` // reference count of the blob
+	ModTime  int64         `json:"modTime,omitempty"`  // unix seconds when the blob is modified
+	Replicas []FileReplica `json:"replicas,omitempty"`
+}
+
+// FileReplica is the state of a file on a storage server which should hold a copy.
+type FileReplica struct {
 	InstanceId string `json:"instance"`
-	IsPrivate  bool   `json:"isPrivate"`
-	CreateTime int64  `json:"createTime"`
+	Exists     bool   `json:"exists"`
+	FileLength int64  `json:"size,omitempty"`
+	RefCount   int64  `json:"refCount,omitempty"`
+	ModTime    int64  `json:"modTime,omitempty"`
+	Error      string `json:"error,omitempty"` // the server cannot be probed
+}
+
+// FileMeta is the metadata of a fileId stored on the storage server,
+// it is given at upload and replicated with the binlog.
+type FileMeta struct {
+	Name        string            `json:"name,omitempty"`        // original file name
+	ContentType string            `json:"contentType,omitempty"` // mime type, sniffed if not given
+	Size        int64             `json:"size,omitempty"`
+	Md5         string            `json:"md5,omitempty"`
+	UploadTime  int64             `json:"uploadTime,omitempty"` // unix seconds
+	Attributes  map[string]string `json:"attributes"`           // custom attributes
+	ExpireTime  int64             `json:"expireTime,omitempty"` // unix seconds when the file expires, 0 means never
+	Owner       string            `json:"owner,omitempty"`      // identity which uploads the file
+	Referenced  bool              `json:"referenced,omitempty"` // the fileId holds a reference of the blob on this server
+	Reaped      bool              `json:"reaped,omitempty"`     // the expired file is dropped
+}
+
+// Expired judges whether the file is expired at the time.
+func (m *FileMeta) Expired(now time.Time) bool {
+	return m != nil && m.ExpireTime > 0 && m.ExpireTime <= now.Unix()
+}
+
+// Public returns a copy of the metadata without the state of this server,
+// which is shown to clients and replicated to other servers.
+func (m *FileMeta) Public() *FileMeta {
+	if m == nil {
+		return nil
+	}
+	ret := *m
+	ret.Referenced = false
+	ret.Reaped = false
+	return &ret
 }
 
 type Instance struct {
@@ -165,15 +243,19 @@ type InstanceMap struct {
 }
 
 type BingLog struct {
-	SourceInstance [8]byte // file source instance
-	FileLength     [8]byte // file length
-	FileId         []byte  // fileId
+	SourceInstance [8]byte   // file source instance
+	FileLength     [8]byte   // file length
+	FileId         []byte    // fileId
+	ExpireTime     int64     // unix seconds when the file expires, 0 means never
+	Meta           *FileMeta // metadata of the file, nil if it is unknown
 }
 
 type BingLogDTO struct {
 	SourceInstance string
 	FileLength     int64
 	FileId         string
+	ExpireTime     int64     `json:",omitempty"`
+	Meta           *FileMeta `json:",omitempty"`
 }
 
 // FileId is a file
@@ -195,6 +277,144 @@ type BinlogQueryResultDTO struct {
 	Logs []BingLogDTO `json:"logs"`
 }
 
+// FileIdDigestDTO is the digest of fileIds which share the same prefix,
+// it is exchanged between storage servers for anti-entropy reconciliation.
+type FileIdDigestDTO struct {
+	Digest string `json:"digest"`
+	Count  int    `json:"count"`
+}
+
+// AntiEntropyReport is the summary of an anti-entropy run.
+type AntiEntropyReport struct {
+	StartTime     int64          `json:"startTime"`
+	EndTime       int64          `json:"endTime"`
+	LocalFiles    int            `json:"localFiles"`
+	Peers         int            `json:"peers"`
+	FailedPeers   int            `json:"failedPeers"`
+	DiffBuckets   int            `json:"diffBuckets"`
+	Missing       int            `json:"missing"`
+	Repaired      int            `json:"repaired"`
+	Failed        int            `json:"failed"`
+	MissingByPeer map[string]int `json:"missingByPeer"`
+	SkipReason    string         `json:"skipReason,omitempty"` // why the run was skipped
+}
+
+// FileListQuery filters the files listed in binlog order.
+type FileListQuery struct {
+	Group  string `json:"group,omitempty"`
+	Source string `json:"source,omitempty"` // source instance of the files
+	From   int64  `json:"from,omitempty"`   // upload time in unix seconds, inclusive
+	To     int64  `json:"to,omitempty"`     // upload time in unix seconds, exclusive
+	Cursor string `json:"cursor,omitempty"` // cursor of the last page, empty for the first page
+	Limit  int    `json:"limit,omitempty"`  // max count of the page
+}
+
+// FileListResult is a page of the listed files.
+type FileListResult struct {
+	Files   []FileEntry `json:"files"`
+	Cursor  string      `json:"cursor"`  // position after the page, which can be resumed from later
+	HasMore bool        `json:"hasMore"` // there may be more files after the cursor
+}
+
+// FileEntry is a listed file.
+type FileEntry struct {
+	FileId     string    `json:"fileId"`
+	Group      string    `json:"group"`
+	InstanceId string    `json:"instance"` // source instance
+	FileLength int64     `json:"size"`
+	CreateTime int64     `json:"createTime"`
+	ExpireTime int64     `json:"expireTime,omitempty"`
+	Meta       *FileMeta `json:"meta,omitempty"`
+}
+
+// FsckReport is the result of checking the fileId dataset and the blobs
+// of a stopped storage server against its local binlogs.
+type FsckReport struct {
+	Fix            bool               `json:"fix"`            // whether the problems are fixed
+	FileIds        int                `json:"fileIds"`        // distinct fileIds in the binlogs
+	ReapedFileIds  int                `json:"reapedFileIds"`  // expired fileIds whose blobs are released
+	InvalidFileIds []string           `json:"invalidFileIds"` // fileIds which cannot be parsed
+	Blobs          int                `json:"blobs"`          // standalone and packed blobs
+	DatasetLost    bool               `json:"datasetLost"`    // the dataset files are lost or unreadable
+	DatasetMissing int                `json:"datasetMissing"` // fileIds absent from the dataset
+	OrphanBlobs    []string           `json:"orphanBlobs"`    // blobs no fileId refers to
+	MissingBlobs   []string           `json:"missingBlobs"`   // fileIds whose blob does not exist
+	CorruptBlobs   []string           `json:"corruptBlobs"`   // blobs whose reference count is unreadable
+	RefCounts      []RefCountMismatch `json:"refCounts"`      // reference counts disagreeing with the binlogs
+}
+
+// RefCountMismatch is a blob whose reference count disagrees with its fileIds in the binlogs.
+type RefCountMismatch struct {
+	Blob     string `json:"blob"`
+	RefCount int64  `json:"refCount"`
+	Expected int64  `json:"expected"`
+}
+
+// GcReport is the result of a garbage collection of a storage server.
+type GcReport struct {
+	DryRun      bool     `json:"dryRun"`      // whether the garbage is only reported
+	StartTime   int64    `json:"startTime"`   // unix seconds
+	TmpFiles    int      `json:"tmpFiles"`    // stale tmp files
+	TmpBytes    int64    `json:"tmpBytes"`    // size of the stale tmp files
+	OrphanBlobs []string `json:"orphanBlobs"` // blobs no live fileId refers to
+	BlobBytes   int64    `json:"blobBytes"`   // size of the orphan blobs
+	InGrace     int      `json:"inGrace"`     // orphan blobs kept for the grace period
+	Message     string   `json:"message,omitempty"`
+}
+
+// SnapshotDTO describes a snapshot of a storage server,
+// it is used for bootstrapping new group members.
+type SnapshotDTO struct {
+	InstanceId string                     `json:"instanceId"` // the snapshot source instance
+	Position   BinlogQueryDTO             `json:"position"`   // binlog end position of the source instance
+	States     map[string]*BinlogQueryDTO `json:"states"`     // binlog synchronization states of the source instance
+}
+
+// SnapshotBootstrapState is the resumable state of snapshot bootstrap.
+type SnapshotBootstrapState struct {
+	Snapshot *SnapshotDTO   `json:"snapshot"`
+	Cursor   BinlogQueryDTO `json:"cursor"`
+	Files    int            `json:"files"`
+	Done     bool           `json:"done"`
+}
+
+// DecommissionStatus is the progress of storage decommission.
+type DecommissionStatus struct {
+	State         string   `json:"state"`
+	StartTime     int64    `json:"startTime"`
+	EndTime       int64    `json:"endTime"`
+	Round         int      `json:"round"`
+	Total         int      `json:"total"`
+	Checked       int      `json:"checked"`
+	Missing       int      `json:"missing"`
+	Pushed        int      `json:"pushed"`
+	BlockingCount int      `json:"blockingCount"`
+	Blocking      []string `json:"blocking"` // part of the fileIds which exist nowhere else
+	Message       string   `json:"message"`
+}
+
+// ConfigChange is a changed config field found by config reloading.
+type ConfigChange struct {
+	Field    string `json:"field"`
+	OldValue string `json:"oldValue"`
+	NewValue string `json:"newValue"`
+}
+
+// ConfigReloadResult is the result of config reloading.
+type ConfigReloadResult struct {
+	Applied         []ConfigChange `json:"applied"`
+	RestartRequired []ConfigChange `json:"restartRequired"` // changes take effect after restart
+	Error           string         `json:"error,omitempty"` // the config is rejected and the running one is kept
+}
+
+// RegistryEvent is an entry of the registry history of an instance.
+type RegistryEvent struct {
+	Time    int64  `json:"time"`
+	Event   string `json:"event"`
+	Server  string `json:"server"`
+	Message string `json:"msg,omitempty"`
+}
+
 type ConfigMap struct {
 	db *bolt.DB
 }
@@ -220,6 +440,21 @@ func NewConfigMap(path string) (*ConfigMap, error) {
 			if e != nil {
 				return nil
 			}
+			if _, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_USAGE)); e != nil {
+				return e
+			}
+			if _, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_USAGE_EXPIRY)); e != nil {
+				return e
+			}
+		}
+		if BootAs == BOOT_STORAGE {
+			if _, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_FILE_META)); e != nil {
+				return e
+			}
+			if _, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_FILE_EXPIRY)); e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists([]byte(BUCKET_KEY_BLOB_STATE))
 		}
 		return e
 	})
@@ -239,6 +474,13 @@ func (c *ConfigMap) BatchUpdate(w func(tx *bolt.Tx) error) error {
 	})
 }
 
+// Close closes the bolt database after the running updates finish.
+func (c *ConfigMap) Close() error {
+	configMapLock.Lock()
+	defer configMapLock.Unlock()
+	return c.db.Close()
+}
+
 func (c *ConfigMap) PutConfig(key string, value []byte) error {
 	configMapLock.Lock()
 	defer func() {
@@ -293,6 +535,304 @@ func (c *ConfigMap) GetFile(key string) (ret []byte, err error) {
 	return
 }
 
+// PutFileMeta saves the metadata of the fileId,
+// the fileId is indexed by its expire time for reaping if it is not reaped.
+func (c *ConfigMap) PutFileMeta(fileId string, meta *FileMeta) error {
+	configMapLock.Lock()
+	defer func() {
+		configMapLock.Unlock()
+		if err := recover(); err != nil {
+			logger.Error("error performing action PutFileMeta: ", err)
+		}
+	}()
+
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return c.db.Batch(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(BUCKET_KEY_FILE_META)).Put([]byte(fileId), bs); err != nil {
+			return err
+		}
+		if meta.ExpireTime <= 0 {
+			return nil
+		}
+		b := tx.Bucket([]byte(BUCKET_KEY_FILE_EXPIRY))
+		key := fileExpiryKey(meta.ExpireTime, fileId)
+		if meta.Reaped {
+			return b.Delete(key)
+		}
+		return b.Put(key, nil)
+	})
+}
+
+// GetFileMeta returns the metadata of the fileId, or nil if there is none.
+func (c *ConfigMap) GetFileMeta(fileId string) (*FileMeta, error) {
+	var bs []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(BUCKET_KEY_FILE_META)).Get([]byte(fileId)); v != nil {
+			bs = make([]byte, len(v))
+			copy(bs, v)
+		}
+		return nil
+	})
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	meta := &FileMeta{}
+	return meta, json.Unmarshal(bs, meta)
+}
+
+// ExpiredFileIds returns at most limit fileIds which expire before the time
+// and are not reaped yet, in the order of expire time.
+func (c *ConfigMap) ExpiredFileIds(before time.Time, limit int) ([]string, error) {
+	var ret []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket([]byte(BUCKET_KEY_FILE_EXPIRY)).Cursor()
+		for k, _ := cur.First(); k != nil && len(ret) < limit; k, _ = cur.Next() {
+			if len(k) <= 8 || convert.Bytes2Length(k[:8]) > before.Unix() {
+				break
+			}
+			ret = append(ret, string(k[8:]))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+func fileExpiryKey(expireTime int64, fileId string) []byte {
+	key := make([]byte, 8+len(fileId))
+	convert.Length2Bytes(expireTime, key)
+	copy(key[8:], fileId)
+	return key
+}
+
+// BlobState is the reference count and the stored size of a standalone blob.
+//
+// Blobs of old versions have no state,
+// their reference count is kept in the 4-byte tail of the blob file.
+type BlobState struct {
+	RefCount int64
+	Size     int64 // size of the stored blob in bytes
+}
+
+func (s *BlobState) encode() []byte {
+	bs := make([]byte, 16)
+	convert.Length2Bytes(s.RefCount, bs[:8])
+	convert.Length2Bytes(s.Size, bs[8:])
+	return bs
+}
+
+func decodeBlobState(bs []byte) *BlobState {
+	if len(bs) != 16 {
+		return nil
+	}
+	return &BlobState{
+		RefCount: convert.Bytes2Length(bs[:8]),
+		Size:     convert.Bytes2Length(bs[8:]),
+	}
+}
+
+// GetBlobState returns the state of the blob, or nil if it has none.
+func (c *ConfigMap) GetBlobState(rel string) (*BlobState, error) {
+	var ret *BlobState
+	err := c.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(BUCKET_KEY_BLOB_STATE)); b != nil {
+			ret = decodeBlobState(b.Get([]byte(rel)))
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// PutBlobState saves the state of the blob.
+func (c *ConfigMap) PutBlobState(rel string, state *BlobState) error {
+	configMapLock.Lock()
+	defer configMapLock.Unlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_BLOB_STATE)).Put([]byte(rel), state.encode())
+	})
+}
+
+// AddBlobRefCount changes the reference count of the blob in a transaction,
+// and returns the new state, or nil if the blob has no state.
+func (c *ConfigMap) AddBlobRefCount(rel string, value int64) (*BlobState, error) {
+	configMapLock.Lock()
+	defer configMapLock.Unlock()
+
+	var ret *BlobState
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_BLOB_STATE))
+		if ret = decodeBlobState(b.Get([]byte(rel))); ret == nil {
+			return nil
+		}
+		ret.RefCount += value
+		return b.Put([]byte(rel), ret.encode())
+	})
+	return ret, err
+}
+
+// DeleteBlobState deletes the state of the removed blob.
+func (c *ConfigMap) DeleteBlobState(rel string) error {
+	configMapLock.Lock()
+	defer configMapLock.Unlock()
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_BLOB_STATE)).Delete([]byte(rel))
+	})
+}
+
+// CompressionPolicy is the policy of compressing files of a group at rest.
+type CompressionPolicy struct {
+	Group     string `json:"group"`
+	Codec     string `json:"codec"`
+	Threshold int    `json:"threshold"` // KB, smaller files are not compressed
+}
+
+// Quota limits the live files uploaded to a group or by an identity,
+// 0 means no limit.
+type Quota struct {
+	Group    string `json:"group,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	MaxBytes int64  `json:"maxBytes"`
+	MaxFiles int64  `json:"maxFiles"`
+}
+
+// Usage is the bytes and the count of the live files of a group or an identity,
+// with the limits of its quota.
+type Usage struct {
+	Group    string `json:"group,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Bytes    int64  `json:"bytes"`
+	Files    int64  `json:"files"`
+	MaxBytes int64  `json:"maxBytes"`
+	MaxFiles int64  `json:"maxFiles"`
+}
+
+// Exceeded judges whether the usage exceeds its quota after the bytes and files are added.
+func (u *Usage) Exceeded(bytes, files int64) bool {
+	return (u.MaxBytes > 0 && u.Bytes+bytes > u.MaxBytes) ||
+		(u.MaxFiles > 0 && u.Files+files > u.MaxFiles)
+}
+
+// UsageCharge is the usage of a file charged to its group and its owner.
+type UsageCharge struct {
+	Group    string `json:"group,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func usageKeys(charge *UsageCharge) [][]byte {
+	var ret [][]byte
+	if charge.Group != "" {
+		ret = append(ret, []byte("g/"+charge.Group))
+	}
+	if charge.Identity != "" {
+		ret = append(ret, []byte("i/"+charge.Identity))
+	}
+	return ret
+}
+
+func addUsage(b *bolt.Bucket, charge *UsageCharge, files int64) error {
+	for _, key := range usageKeys(charge) {
+		bs := make([]byte, 16)
+		if v := b.Get(key); len(v) == 16 {
+			copy(bs, v)
+		}
+		convert.Length2Bytes(convert.Bytes2Length(bs[:8])+charge.Bytes*files, bs[:8])
+		convert.Length2Bytes(convert.Bytes2Length(bs[8:])+files, bs[8:])
+		if err := b.Put(key, bs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChargeUsage adds the file to the usage of its group and its owner,
+// the usage is released at the expire time if the file expires.
+func (c *ConfigMap) ChargeUsage(fileId string, charge *UsageCharge, expireTime int64) error {
+	configMapLock.Lock()
+	defer configMapLock.Unlock()
+
+	bs, err := json.Marshal(charge)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := addUsage(tx.Bucket([]byte(BUCKET_KEY_USAGE)), charge, 1); err != nil {
+			return err
+		}
+		if expireTime <= 0 {
+			return nil
+		}
+		return tx.Bucket([]byte(BUCKET_KEY_USAGE_EXPIRY)).Put(fileExpiryKey(expireTime, fileId), bs)
+	})
+}
+
+// ReleaseExpiredUsage removes at most limit files which expire before the time from the usage,
+// and returns the count of them.
+func (c *ConfigMap) ReleaseExpiredUsage(before time.Time, limit int) (int, error) {
+	configMapLock.Lock()
+	defer configMapLock.Unlock()
+
+	var released [][]byte
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_KEY_USAGE))
+		eb := tx.Bucket([]byte(BUCKET_KEY_USAGE_EXPIRY))
+		cur := eb.Cursor()
+		for k, v := cur.First(); k != nil && len(released) < limit; k, v = cur.Next() {
+			if len(k) <= 8 || convert.Bytes2Length(k[:8]) > before.Unix() {
+				break
+			}
+			charge := &UsageCharge{}
+			if err := json.Unmarshal(v, charge); err != nil {
+				return err
+			}
+			if err := addUsage(b, charge, -1); err != nil {
+				return err
+			}
+			released = append(released, append([]byte{}, k...))
+		}
+		// keys are deleted after iterating, for deleting under the cursor skips the next key.
+		for _, k := range released {
+			if err := eb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(released), nil
+}
+
+// ListUsage returns the usage of all groups and identities,
+// groups are listed before identities.
+func (c *ConfigMap) ListUsage() ([]Usage, error) {
+	var ret []Usage
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_KEY_USAGE)).ForEach(func(k, v []byte) error {
+			if len(k) < 3 || len(v) != 16 {
+				return nil
+			}
+			u := Usage{
+				Bytes: convert.Bytes2Length(v[:8]),
+				Files: convert.Bytes2Length(v[8:]),
+			}
+			if k[0] == 'g' {
+				u.Group = string(k[2:])
+			} else {
+				u.Identity = string(k[2:])
+			}
+			ret = append(ret, u)
+			return nil
+		})
+	})
+	return ret, err
+}
+
 func (c *ConfigMap) PutFailedBinlogPos(binlogPos *BinlogQueryDTO) error {
 	configMapLock.Lock()
 	defer func() {
@@ -317,3 +857,29 @@ func (c *ConfigMap) IteratorFailedBinlog(iterator func(c *bolt.Cursor) error) er
 		return iterator(b.Cursor())
 	})
 }
+
+// MirrorStatus is the mirroring state of a group pair.
+type MirrorStatus struct {
+	SourceGroup   string `json:"sourceGroup"`
+	MirrorGroup   string `json:"mirrorGroup"`
+	SourceMembers int    `json:"sourceMembers"` // alive members of the source group
+	MirrorMembers int    `json:"mirrorMembers"` // members of the mirror group reporting the state
+	CaughtUpTime  int64  `json:"caughtUpTime"`  // last time the mirror caught up with the source binlogs
+	Lag           int64  `json:"lag"`           // in seconds, -1 if the mirror never caught up
+}
+
+// DataDirStatus is the state of a data dir of the storage server.
+type DataDirStatus struct {
+	Path      string `json:"path"`
+	Online    bool   `json:"online"`
+	Blobs     int    `json:"blobs"`
+	FreeSpace int64  `json:"freeSpace"`
+}
+
+// VolumeStatus is the state of a volume file packing small files.
+type VolumeStatus struct {
+	Id     uint32 `json:"id"`
+	Size   int64  `json:"size"`
+	Live   int64  `json:"live"` // bytes of the files which are not deleted
+	Active bool   `json:"active"`
+}
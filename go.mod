@@ -15,7 +15,8 @@ require (
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mattn/go-isatty v0.0.11 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
-	github.com/pierrec/lz4 v2.3.0+incompatible // indirect
+	github.com/pierrec/lz4 v2.3.0+incompatible
+	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/urfave/cli v1.22.4
 	golang.org/x/sys v0.0.0-20200107162124-548cf772de50 // indirect
@@ -10,6 +10,7 @@ import (
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
 	"sync"
@@ -21,12 +22,19 @@ var (
 	instanceSet    = make(map[string]*common.Instance)
 	lock           = new(sync.Mutex)
 	ExpirationTime = time.Second * 30 // 30s
+	// UnconfirmedExpirationTime is the time for the instances restored
+	// from snapshot to register again, instances registered to the tracker
+	// reconnect in a synchronization interval.
+	UnconfirmedExpirationTime = common.SYNCHRONIZE_INTERVAL * 2
+	healthAttributes          = []string{"health", "healthCheckTime", "healthError"}
 )
 
-// InitRegistry starts a timer job for instance expiration detection
-// in a single goroutine.
+// InitRegistry restores the instances from snapshot and starts timer jobs
+// for instance expiration detection and snapshot saving.
 func InitRegistry() {
+	restore()
 	go expirationDetection()
+	go snapshotSaving()
 }
 
 // Put registers a new Instance.
@@ -39,9 +47,31 @@ func Put(ins *common.Instance) error {
 		return errors.New("instance cannot be null")
 	}
 	if i := isInstanceConflict(ins); i != nil {
-		return errors.New("instance conflict with server " + i.Server.ConnectionString())
+		if i.State != common.REGISTER_UNCONFIRMED {
+			addEvent(ins.InstanceId, common.REGISTRY_CONFLICT, ins.Server.ConnectionString(),
+				"conflict with server "+i.Server.ConnectionString())
+			return errors.New("instance conflict with server " + i.Server.ConnectionString())
+		}
+		// the instance restored from snapshot is outdated.
+		addEvent(ins.InstanceId, common.REGISTRY_CONFLICT, ins.Server.ConnectionString(),
+			"replace unconfirmed server "+i.Server.ConnectionString())
 	}
 	logger.Debug("registered new instance: ", ins.InstanceId, "@", ins.Server.ConnectionString())
+	if i := instanceSet[ins.InstanceId]; i == nil || i.State == common.REGISTER_FREE {
+		addEvent(ins.InstanceId, common.REGISTRY_JOIN, ins.Server.ConnectionString(), "")
+	} else if i.State == common.REGISTER_UNCONFIRMED {
+		addEvent(ins.InstanceId, common.REGISTRY_CONFIRM, ins.Server.ConnectionString(), "")
+	}
+	dirty = true
+	// health check results are maintained by the tracker.
+	if i := instanceSet[ins.InstanceId]; i != nil && i.Attributes["health"] != "" {
+		if ins.Attributes == nil {
+			ins.Attributes = make(map[string]string)
+		}
+		for _, k := range healthAttributes {
+			ins.Attributes[k] = i.Attributes[k]
+		}
+	}
 	ins.State = common.REGISTER_HOLD
 	ins.RegisterTime = time.Now().UnixNano()
 	instanceSet[ins.InstanceId] = ins
@@ -56,7 +86,8 @@ func Free(instanceId string) {
 	lock.Lock()
 	defer lock.Unlock()
 	ins := instanceSet[instanceId]
-	if ins != nil {
+	// unconfirmed instances expire by themselves.
+	if ins != nil && ins.State != common.REGISTER_UNCONFIRMED {
 		logger.Debug("free instance: ", ins.InstanceId, "@", ins.Server.ConnectionString())
 		ins.RegisterTime = time.Now().UnixNano()
 		ins.State = common.REGISTER_FREE
@@ -68,6 +99,10 @@ func Remove(ins *common.Instance) {
 	lock.Lock()
 	defer lock.Unlock()
 	logger.Debug("deregister instance: ", ins.InstanceId, "@", ins.Server.ConnectionString())
+	if instanceSet[ins.InstanceId] != nil {
+		addEvent(ins.InstanceId, common.REGISTRY_LEAVE, ins.Server.ConnectionString(), "")
+		dirty = true
+	}
 	delete(instanceSet, ins.InstanceId)
 }
 
@@ -82,6 +117,33 @@ func InstanceSetSnapshot() map[string]*common.Instance {
 	return snapshot
 }
 
+// SetHealth records the health check result of the instance,
+// health changes are recorded in the history.
+func SetHealth(instanceId string, healthy bool, message string) {
+	lock.Lock()
+	defer lock.Unlock()
+	ins := instanceSet[instanceId]
+	if ins == nil {
+		return
+	}
+	health := gox.TValue(healthy, common.HEALTH_HEALTHY, common.HEALTH_UNHEALTHY).(string)
+	// newly checked healthy instances are not recorded.
+	if ins.Attributes["health"] != health && (ins.Attributes["health"] != "" || !healthy) {
+		addEvent(instanceId, health, ins.Server.ConnectionString(), message)
+		dirty = true
+	}
+	// snapshots share the instances, so the instance is copied instead of modified.
+	n := *ins
+	n.Attributes = make(map[string]string)
+	for k, v := range ins.Attributes {
+		n.Attributes[k] = v
+	}
+	n.Attributes["health"] = health
+	n.Attributes["healthCheckTime"] = convert.Int64ToStr(gox.GetTimestamp(time.Now()))
+	n.Attributes["healthError"] = message
+	instanceSet[instanceId] = &n
+}
+
 // isInstanceConflict for judgement whether the new instance
 // is conflict with other registered instance.
 func isInstanceConflict(ins *common.Instance) *common.Instance {
@@ -101,10 +163,15 @@ func expirationDetection() {
 
 		logger.Debug("current instances: ", len(instanceSet)) // TODO remove
 
-		deadLine := time.Now().UnixNano() - int64(ExpirationTime)
+		now := time.Now().UnixNano()
+		deadLine := now - int64(ExpirationTime)
+		unconfirmedDeadLine := now - int64(UnconfirmedExpirationTime)
 		for _, i := range instanceSet {
-			if i.State == common.REGISTER_FREE && i.RegisterTime <= deadLine {
+			if (i.State == common.REGISTER_FREE && i.RegisterTime <= deadLine) ||
+				(i.State == common.REGISTER_UNCONFIRMED && i.RegisterTime <= unconfirmedDeadLine) {
 				logger.Debug("instance expired: ", i.InstanceId, "@", i.Server.ConnectionString())
+				addEvent(i.InstanceId, common.REGISTRY_EXPIRE, i.Server.ConnectionString(), "")
+				dirty = true
 				delete(instanceSet, i.InstanceId)
 			}
 		}
@@ -0,0 +1,189 @@
+package reg
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotKey       = "registrySnapshot"
+	historyKeyPrefix  = "registryHistory:"
+	maxHistoryEvents  = 50
+	historyRetention  = time.Hour * 24 * 7
+	snapshotSaveDelay = time.Second * 5
+)
+
+var (
+	// history stores recent registry events of each instance.
+	history = make(map[string][]common.RegistryEvent)
+	// dirty marks the registry changed since last saving.
+	dirty = false
+	// historyChanged stores instanceIds whose history changed since last saving.
+	historyChanged = make(map[string]bool)
+)
+
+// addEvent appends an event to the history of the instance,
+// the lock must be held by the caller.
+func addEvent(instanceId, event, server, message string) {
+	events := append(history[instanceId], common.RegistryEvent{
+		Time:    gox.GetTimestamp(time.Now()),
+		Event:   event,
+		Server:  server,
+		Message: message,
+	})
+	if len(events) > maxHistoryEvents {
+		events = events[len(events)-maxHistoryEvents:]
+	}
+	history[instanceId] = events
+	historyChanged[instanceId] = true
+}
+
+// History returns the registry history of the instance,
+// or all instances if instanceId is empty.
+func History(instanceId string) map[string][]common.RegistryEvent {
+	lock.Lock()
+	defer lock.Unlock()
+	ret := make(map[string][]common.RegistryEvent)
+	for k, v := range history {
+		if instanceId == "" || k == instanceId {
+			ret[k] = append([]common.RegistryEvent{}, v...)
+		}
+	}
+	return ret
+}
+
+// restore loads the instances saved before restart as unconfirmed instances,
+// clients can still use them until they register again or expire.
+func restore() {
+	config := common.GetConfigMap()
+	if config == nil {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := config.BatchUpdate(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(common.BUCKET_KEY_CONFIGMAP)).Cursor()
+		prefix := []byte(historyKeyPrefix)
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), historyKeyPrefix); k, v = c.Next() {
+			var events []common.RegistryEvent
+			if err := json.Unmarshal(v, &events); err != nil {
+				logger.Debug("error load registry history: ", err)
+				continue
+			}
+			history[strings.TrimPrefix(string(k), historyKeyPrefix)] = events
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("error load registry history: ", err)
+	}
+
+	bs, err := config.GetConfig(snapshotKey)
+	if err != nil || len(bs) == 0 {
+		return
+	}
+	var instances []*common.Instance
+	if err := json.Unmarshal(bs, &instances); err != nil {
+		logger.Error("error load registry snapshot: ", err)
+		return
+	}
+	now := time.Now().UnixNano()
+	for _, ins := range instances {
+		if ins.InstanceId == "" || instanceSet[ins.InstanceId] != nil {
+			continue
+		}
+		ins.State = common.REGISTER_UNCONFIRMED
+		ins.RegisterTime = now
+		instanceSet[ins.InstanceId] = ins
+		addEvent(ins.InstanceId, common.REGISTRY_RESTORE, ins.Server.ConnectionString(), "")
+	}
+	logger.Info("restore ", len(instances), " instances from registry snapshot")
+}
+
+// snapshotSaving is a timer job for saving the registry snapshot.
+func snapshotSaving() {
+	timer.Start(snapshotSaveDelay, snapshotSaveDelay, 0, func(t *timer.Timer) {
+		Save()
+	})
+}
+
+// Save saves the registry snapshot and history if they have changed.
+func Save() {
+	config := common.GetConfigMap()
+	if config == nil {
+		return
+	}
+	lock.Lock()
+	if !dirty && len(historyChanged) == 0 {
+		lock.Unlock()
+		return
+	}
+	var instances []common.Instance
+	for _, ins := range instanceSet {
+		instances = append(instances, *ins)
+	}
+	deadLine := gox.GetTimestamp(time.Now().Add(-historyRetention))
+	changed := make(map[string][]common.RegistryEvent)
+	for k := range historyChanged {
+		changed[k] = history[k]
+	}
+	for k, v := range history {
+		// instances left long ago.
+		if instanceSet[k] == nil && len(v) > 0 && v[len(v)-1].Time < deadLine {
+			delete(history, k)
+			changed[k] = nil
+		}
+	}
+	saveInstances := dirty
+	dirty = false
+	historyChanged = make(map[string]bool)
+	lock.Unlock()
+
+	err := config.BatchUpdate(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(common.BUCKET_KEY_CONFIGMAP))
+		if saveInstances {
+			bs, err := json.Marshal(instances)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(snapshotKey), bs); err != nil {
+				return err
+			}
+		}
+		for k, v := range changed {
+			if v == nil {
+				if err := b.Delete([]byte(historyKeyPrefix + k)); err != nil {
+					return err
+				}
+				continue
+			}
+			bs, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(historyKeyPrefix+k), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("error save registry snapshot: ", err)
+		// retry in next round.
+		lock.Lock()
+		dirty = dirty || saveInstances
+		for k := range changed {
+			historyChanged[k] = true
+		}
+		lock.Unlock()
+		return
+	}
+	logger.Debug("save registry snapshot success")
+}
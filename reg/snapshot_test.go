@@ -0,0 +1,67 @@
+package reg
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRegistrySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, err := common.NewConfigMap(dir + "/boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.Close()
+	common.SetConfigMap(config)
+	defer common.SetConfigMap(nil)
+
+	newInstance := func(host string) *common.Instance {
+		return &common.Instance{
+			Server: common.Server{Host: host, Port: 10706, InstanceId: "snap0001"},
+			Role:   common.ROLE_STORAGE,
+		}
+	}
+	if err := Put(newInstance("192.168.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	Save()
+
+	// restart.
+	instanceSet = make(map[string]*common.Instance)
+	history = make(map[string][]common.RegistryEvent)
+	restore()
+	ins := InstanceSetSnapshot()["snap0001"]
+	if ins == nil || ins.State != common.REGISTER_UNCONFIRMED {
+		t.Fatal("instance is not restored as unconfirmed")
+	}
+
+	// the restored instance is replaced by the new registration.
+	if err := Put(newInstance("192.168.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Put(newInstance("192.168.0.3")); err == nil {
+		t.Fatal("conflict instance is registered")
+	}
+	Remove(newInstance("192.168.0.2"))
+
+	var events []string
+	for _, e := range History("snap0001")["snap0001"] {
+		events = append(events, e.Event)
+	}
+	expect := []string{common.REGISTRY_JOIN, common.REGISTRY_RESTORE, common.REGISTRY_CONFLICT,
+		common.REGISTRY_CONFIRM, common.REGISTRY_CONFLICT, common.REGISTRY_LEAVE}
+	if len(events) != len(expect) {
+		t.Fatal("unexpected history: ", events)
+	}
+	for i := range expect {
+		if events[i] != expect[i] {
+			t.Fatal("unexpected history: ", events)
+		}
+	}
+}
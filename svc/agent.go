@@ -16,6 +16,10 @@ func BootAgentServer() {
 		fmt.Println("Err:", err)
 		os.Exit(1)
 	}
+	if err := util.InitAgentConfig(common.InitializedAgentConfiguration); err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
 
 	if err := util.PrepareDirs(common.InitializedAgentConfiguration.TmpDir); err != nil {
 		logger.Fatal("cannot create tmp dir: ", err)
@@ -30,7 +34,11 @@ func BootAgentServer() {
 	// print godfs logo.
 	util.PrintLogo()
 
+	handleShutdownSignals(nil, nil)
+	handleReloadSignal()
+
 	StartAgentTcpServer()
 
 	StartAgentHttpServer(common.InitializedAgentConfiguration)
+	waitForShutdown()
 }
@@ -2,6 +2,7 @@ package svc
 
 import (
 	"container/list"
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/common"
@@ -31,8 +32,11 @@ func StartAgentHttpServer(c *common.AgentConfig) {
 	r.HandleFunc("/ul", proxyHttpUpload1).Methods("POST")
 	r.HandleFunc("/upload", proxyHttpUpload1).Methods("POST")
 	// r.HandleFunc("/upload1", httpUpload).Methods("POST")
-	r.HandleFunc("/dl", proxyHttpDownload).Methods("GET")
-	r.HandleFunc("/download", proxyHttpDownload).Methods("GET")
+	r.HandleFunc("/dl", proxyHttpDownload).Methods("GET", "HEAD")
+	r.HandleFunc("/download", proxyHttpDownload).Methods("GET", "HEAD")
+	// file info is checked and served by storage servers as downloading.
+	r.HandleFunc("/info", proxyHttpDownload).Methods("GET")
+	r.HandleFunc("/reload", httpReloadConfig).Methods("POST")
 
 	srv := &http.Server{
 		Handler:           r,
@@ -42,11 +46,12 @@ func StartAgentHttpServer(c *common.AgentConfig) {
 		ReadTimeout:       0,
 		MaxHeaderBytes:    1 << 20, // 1MB
 	}
+	coordinator.registerHttpServer(srv)
 	/*go func() {
 
 	}()*/
 	logger.Info("http server listening on ", c.BindAddress, ":", c.HttpPort)
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logger.Fatal(err)
 	}
 }
@@ -86,11 +91,13 @@ func proxyHttpUpload1(w http.ResponseWriter, r *http.Request) {
 
 			logger.Info("agent upload to target server: ", selectedStorage.Host, ":", convert.Uint16ToStr(selectedStorage.HttpPort), "(", selectedStorage.InstanceId, ")")
 
+			start := time.Now()
 			req, err := http.NewRequest("POST",
 				"http://"+selectedStorage.GetHost()+":"+convert.Uint16ToStr(selectedStorage.HttpPort)+r.RequestURI,
 				r.Body)
 			if err != nil {
 				logger.Error(err)
+				clientAPI.ReleaseStorageServer(selectedStorage, true, time.Since(start), err)
 				continue
 			}
 
@@ -103,6 +110,7 @@ func proxyHttpUpload1(w http.ResponseWriter, r *http.Request) {
 			resp, err := httpClient.Do(req)
 			if err != nil {
 				logger.Error(err)
+				clientAPI.ReleaseStorageServer(selectedStorage, true, time.Since(start), err)
 				return
 			}
 
@@ -112,6 +120,7 @@ func proxyHttpUpload1(w http.ResponseWriter, r *http.Request) {
 			} else {
 				logger.Debug("upload failed")
 			}
+			clientAPI.ReleaseStorageServer(selectedStorage, true, time.Since(start), httpStatusErr(code))
 
 			for k, v := range resp.Header {
 				for _, h := range v {
@@ -142,9 +151,9 @@ func proxyHttpDownload(w http.ResponseWriter, r *http.Request) {
 
 	// handle http options method
 	headers := w.Header()
-	// download method must be GET or OPTIONS
+	// download method must be GET, HEAD or OPTIONS
 	method := r.Method
-	headers.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	headers.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
 	headers.Set("Access-Control-Allow-Credentials", "true")
 	headers.Set("Access-Control-Allow-Headers", "*")
 	if method == http.MethodOptions {
@@ -216,9 +225,12 @@ func proxyHttpDownload(w http.ResponseWriter, r *http.Request) {
 				}
 				logger.Info("download from source server: ", selectedStorage.Host, ":", convert.Uint16ToStr(selectedStorage.HttpPort), "(", selectedStorage.InstanceId, ")")
 			}
+			// the source server is not selected by balancer.
+			balanced := false
 			if selectedStorage == nil {
 				// select storage server.
-				selectedStorage = clientAPI.SelectStorageServer(info.Group, false, exclude)
+				selectedStorage = clientAPI.SelectStorageServerByKey(info.Group, fid, false, exclude)
+				balanced = true
 			}
 			if selectedStorage == nil {
 				if lastErr == nil {
@@ -226,11 +238,18 @@ func proxyHttpDownload(w http.ResponseWriter, r *http.Request) {
 				}
 				break
 			}
+			start := time.Now()
+			release := func(err error) {
+				if balanced {
+					clientAPI.ReleaseStorageServer(selectedStorage, false, time.Since(start), err)
+				}
+			}
 
-			req, err := http.NewRequest("GET",
+			req, err := http.NewRequest(method,
 				"http://"+selectedStorage.GetHost()+":"+convert.Uint16ToStr(selectedStorage.HttpPort)+r.RequestURI, nil)
 			if err != nil {
 				logger.Error(err)
+				release(err)
 				continue
 			}
 
@@ -243,6 +262,7 @@ func proxyHttpDownload(w http.ResponseWriter, r *http.Request) {
 			resp, err := httpClient.Do(req)
 			if err != nil {
 				logger.Error(err)
+				release(err)
 				return
 			}
 
@@ -262,6 +282,7 @@ func proxyHttpDownload(w http.ResponseWriter, r *http.Request) {
 			//resp.Body.Read(b)
 			w.WriteHeader(code)
 			io.Copy(w, resp.Body)
+			release(httpStatusErr(code))
 			break
 		}
 	}, func(e interface{}) {
@@ -269,3 +290,12 @@ func proxyHttpDownload(w http.ResponseWriter, r *http.Request) {
 		panic(lastErr)
 	})
 }
+
+// httpStatusErr converts server side errors of storage servers to error.
+func httpStatusErr(code int) error {
+	// uploads over quotas are not failures of the server.
+	if code >= http.StatusInternalServerError && code != http.StatusInsufficientStorage {
+		return errors.New("storage server responses " + convert.IntToStr(code))
+	}
+	return nil
+}
@@ -12,12 +12,13 @@ import (
 
 func StartAgentTcpServer() {
 
-	_, err := net.Listen("tcp",
+	listener, err := net.Listen("tcp",
 		common.InitializedAgentConfiguration.BindAddress+":"+
 			convert.IntToStr(common.InitializedAgentConfiguration.Port))
 	if err != nil {
 		logger.Fatal(err)
 	}
+	coordinator.registerListener(listener)
 
 	time.Sleep(time.Millisecond * 50)
 
@@ -31,13 +32,25 @@ func StartAgentTcpServer() {
 	if common.InitializedAgentConfiguration.ParsedTrackers != nil &&
 		len(common.InitializedAgentConfiguration.ParsedTrackers) > 0 {
 		servers := make([]*common.Server, len(common.InitializedAgentConfiguration.ParsedTrackers))
-		for i, s := range common.InitializedAgentConfiguration.ParsedTrackers {
-			servers[i] = &s
+		for i := range common.InitializedAgentConfiguration.ParsedTrackers {
+			servers[i] = &common.InitializedAgentConfiguration.ParsedTrackers[i]
+		}
+		uploadBalancer, err := api.NewBalancer(common.InitializedAgentConfiguration.UploadBalancer)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		downloadBalancer, err := api.NewBalancer(common.InitializedAgentConfiguration.DownloadBalancer)
+		if err != nil {
+			logger.Fatal(err)
 		}
 		config := &api.Config{
 			MaxConnectionsPerServer: MaxConnPerServer,
 			SynchronizeOnce:         false,
 			TrackerServers:          servers,
+			UploadBalancer:          uploadBalancer,
+			DownloadBalancer:        downloadBalancer,
+			Zone:                    common.InitializedAgentConfiguration.Zone,
+			Rack:                    common.InitializedAgentConfiguration.Rack,
 		}
 		InitializeClientAPI(config)
 	}
@@ -0,0 +1,477 @@
+package svc
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// max prefixes of a single fileId list request.
+	maxListPrefixes = 64
+	// binlog fetch size when walking local binlogs.
+	walkFetchSize = 1000
+	// max age of the cached fileId digest tree,
+	// it is independent of the local anti-entropy interval
+	// because the tree also serves requests from other members.
+	digestTreeMaxAge = time.Minute * 5
+)
+
+var (
+	antiEntropyReportKey = "antiEntropyReport"
+	digestTree           *fileIdDigestTree
+	digestTreeBuilding   chan struct{} // not nil if the digest tree is being built
+	digestTreeLock       = new(sync.Mutex)
+	lastAntiEntropyRun   *common.AntiEntropyReport
+	antiEntropyRunning   bool
+	antiEntropyLock      = new(sync.Mutex)
+)
+
+// leafDigest is the digest of the fileIds which have the same 2 chars prefix.
+//
+// The digest is the xor of md5 of every fileId,
+// so it is independent of the order of the binlogs.
+// The binlogs of the fileIds are kept to answer fileId list requests.
+type leafDigest struct {
+	sum   [md5.Size]byte
+	count int
+	bls   []common.BingLogDTO
+}
+
+// add adds a fileId to the leaf.
+func (l *leafDigest) add(bl *common.BingLogDTO) {
+	s := md5.Sum([]byte(bl.FileId))
+	for i := range l.sum {
+		l.sum[i] ^= s[i]
+	}
+	l.count++
+	l.bls = append(l.bls, *bl)
+}
+
+// fileIdDigestTree is a 2 level merkle tree of local fileIds,
+// level 1 is bucketed by the first char of fileIds
+// and level 2 is bucketed by the first 2 chars.
+type fileIdDigestTree struct {
+	buildTime time.Time
+	total     int
+	leaves    map[string]*leafDigest
+}
+
+// level returns digests of the child buckets of the prefix,
+// prefix must be empty or a single char.
+func (t *fileIdDigestTree) level(prefix string) map[string]*common.FileIdDigestDTO {
+	sums := make(map[string]*leafDigest)
+	for p, l := range t.leaves {
+		if prefix != "" && p[0:1] != prefix {
+			continue
+		}
+		key := p
+		if prefix == "" {
+			key = p[0:1]
+		}
+		s := sums[key]
+		if s == nil {
+			s = &leafDigest{}
+			sums[key] = s
+		}
+		for i := range s.sum {
+			s.sum[i] ^= l.sum[i]
+		}
+		s.count += l.count
+	}
+	ret := make(map[string]*common.FileIdDigestDTO)
+	for k, v := range sums {
+		ret[k] = &common.FileIdDigestDTO{
+			Digest: hex.EncodeToString(v.sum[:]),
+			Count:  v.count,
+		}
+	}
+	return ret
+}
+
+// walkLocalBinlogs walks through all local binlogs in order,
+// the walk stops if the walker returns true.
+func walkLocalBinlogs(walker func(bl *common.BingLogDTO) bool) error {
+	fileIndex := 0
+	var offset int64 = 0
+	for {
+		bls, nOffset, err := writableBinlogManager.Read(fileIndex, offset, walkFetchSize)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if len(bls) == 0 {
+			fileIndex++
+			offset = 0
+			continue
+		}
+		for i := range bls {
+			if walker(&bls[i]) {
+				return nil
+			}
+		}
+		offset = nOffset
+	}
+}
+
+// localFileExists checks if the fileId is stored on this server,
+// expired files are treated as nonexistent.
+func localFileExists(fileId string) bool {
+	fInfo, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+	if err != nil || fileExpired(fileId) {
+		return false
+	}
+	return util.ExistsFile(fInfo)
+}
+
+// buildFileIdDigestTree builds digest tree from local binlogs,
+// only fileIds whose file exists on disk are counted.
+func buildFileIdDigestTree() (*fileIdDigestTree, error) {
+	tree := &fileIdDigestTree{
+		leaves: make(map[string]*leafDigest),
+	}
+	found := make(map[string]bool)
+	err := walkLocalBinlogs(func(bl *common.BingLogDTO) bool {
+		if len(bl.FileId) < 2 || found[bl.FileId] || !localFileExists(bl.FileId) {
+			return false
+		}
+		found[bl.FileId] = true
+		tree.add(bl)
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	tree.buildTime = time.Now()
+	return tree, nil
+}
+
+// add adds a fileId to the leaf of its prefix.
+func (t *fileIdDigestTree) add(bl *common.BingLogDTO) {
+	p := bl.FileId[0:2]
+	l := t.leaves[p]
+	if l == nil {
+		l = &leafDigest{}
+		t.leaves[p] = l
+	}
+	l.add(bl)
+	t.total++
+}
+
+// list returns binlogs of the fileIds which have one of the prefixes.
+func (t *fileIdDigestTree) list(prefixes []string) []common.BingLogDTO {
+	var ret []common.BingLogDTO
+	for _, p := range prefixes {
+		if l := t.leaves[p]; l != nil {
+			ret = append(ret, l.bls...)
+		}
+	}
+	return ret
+}
+
+// getFileIdDigestTree returns the cached digest tree,
+// the tree will be rebuilt if it is forced or out of date.
+//
+// The lock is not held while building the tree,
+// requests arriving during a rebuild get the stale tree if there is one,
+// otherwise they wait for the running build.
+func getFileIdDigestTree(force bool) (*fileIdDigestTree, error) {
+	digestTreeLock.Lock()
+	tree := digestTree
+	if !force && tree != nil && time.Since(tree.buildTime) < digestTreeMaxAge {
+		digestTreeLock.Unlock()
+		return tree, nil
+	}
+	if building := digestTreeBuilding; building != nil {
+		digestTreeLock.Unlock()
+		if !force && tree != nil {
+			return tree, nil
+		}
+		<-building
+		digestTreeLock.Lock()
+		tree = digestTree
+		digestTreeLock.Unlock()
+		if tree == nil {
+			return nil, errors.New("error building fileId digest tree")
+		}
+		return tree, nil
+	}
+	building := make(chan struct{})
+	digestTreeBuilding = building
+	digestTreeLock.Unlock()
+
+	tree, err := buildFileIdDigestTree()
+
+	digestTreeLock.Lock()
+	if err == nil {
+		digestTree = tree
+	}
+	digestTreeBuilding = nil
+	close(building)
+	digestTreeLock.Unlock()
+	return tree, err
+}
+
+// listLocalFileIds lists binlogs of local fileIds which have one of the prefixes,
+// the result is served from the cached digest tree.
+func listLocalFileIds(prefixes []string) ([]common.BingLogDTO, error) {
+	tree, err := getFileIdDigestTree(false)
+	if err != nil {
+		return nil, err
+	}
+	return tree.list(prefixes), nil
+}
+
+// InitAntiEntropy starts a timer job which reconciles fileIds
+// with other members of the group periodically.
+func InitAntiEntropy() {
+	if bs, err := common.GetConfigMap().GetConfig(antiEntropyReportKey); err == nil && len(bs) > 0 {
+		report := &common.AntiEntropyReport{}
+		if err := json.Unmarshal(bs, report); err == nil {
+			lastAntiEntropyRun = report
+		}
+	}
+	interval := common.InitializedStorageConfiguration.AntiEntropyInterval
+	if interval <= 0 {
+		logger.Info("anti-entropy reconciliation is disabled")
+		return
+	}
+	timer.Start(time.Minute, time.Minute*time.Duration(interval), 0, func(t *timer.Timer) {
+		if !beginAntiEntropy() {
+			logger.Debug("anti-entropy reconciliation is running, skip")
+			return
+		}
+		runAntiEntropy()
+	})
+}
+
+// LastAntiEntropyReport returns summary of the last anti-entropy run,
+// and whether a run is in progress.
+func LastAntiEntropyReport() (*common.AntiEntropyReport, bool) {
+	antiEntropyLock.Lock()
+	defer antiEntropyLock.Unlock()
+	return lastAntiEntropyRun, antiEntropyRunning
+}
+
+// StartAntiEntropy starts an anti-entropy run in background,
+// it returns false if there is already a run in progress.
+func StartAntiEntropy() bool {
+	if !beginAntiEntropy() {
+		return false
+	}
+	go runAntiEntropy()
+	return true
+}
+
+// beginAntiEntropy marks anti-entropy as running,
+// it returns false if it is already running.
+func beginAntiEntropy() bool {
+	antiEntropyLock.Lock()
+	defer antiEntropyLock.Unlock()
+	if antiEntropyRunning {
+		return false
+	}
+	antiEntropyRunning = true
+	return true
+}
+
+// finishAntiEntropy publishes the report of a run and clears the running flag.
+func finishAntiEntropy(report *common.AntiEntropyReport) {
+	antiEntropyLock.Lock()
+	lastAntiEntropyRun = report
+	antiEntropyRunning = false
+	antiEntropyLock.Unlock()
+
+	if bs, err := json.Marshal(report); err == nil {
+		if err := common.GetConfigMap().PutConfig(antiEntropyReportKey, bs); err != nil {
+			logger.Debug("error save anti-entropy report: ", err)
+		}
+	}
+}
+
+// runAntiEntropy compares local fileIds with each group member,
+// and synchronizes the missing files.
+//
+// It must be called after beginAntiEntropy succeeds.
+func runAntiEntropy() {
+	report := &common.AntiEntropyReport{
+		StartTime:     gox.GetTimestamp(time.Now()),
+		MissingByPeer: make(map[string]int),
+	}
+	defer func() {
+		report.EndTime = gox.GetTimestamp(time.Now())
+		finishAntiEntropy(report)
+	}()
+
+	if clientAPI == nil {
+		report.SkipReason = "client api is not initialized"
+		return
+	}
+	if isBootstrapping() {
+		report.SkipReason = "snapshot bootstrap is in progress"
+		return
+	}
+	members := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE),
+		common.InitializedStorageConfiguration.Group)
+	if members.Len() == 0 {
+		report.SkipReason = "no other group member available"
+		return
+	}
+
+	logger.Debug("anti-entropy reconciliation begin")
+
+	local, err := getFileIdDigestTree(true)
+	if err != nil {
+		logger.Error("anti-entropy: error building fileId digest: ", err)
+		report.SkipReason = "error building fileId digest: " + err.Error()
+		return
+	}
+	report.LocalFiles = local.total
+
+	// fileIds which are already processed in this run.
+	handled := make(map[string]bool)
+
+	gox.WalkList(members, func(item interface{}) bool {
+		server := &item.(*common.Instance).Server
+		report.Peers++
+		missing, diff, err := reconcileWith(server, local)
+		report.DiffBuckets += diff
+		if err != nil {
+			report.FailedPeers++
+			logger.Error("anti-entropy: error reconcile with server ",
+				server.ConnectionString(), "(", server.InstanceId, "): ", err)
+		}
+		for i := range missing {
+			bl := missing[i]
+			if handled[bl.FileId] {
+				continue
+			}
+			handled[bl.FileId] = true
+			report.Missing++
+			report.MissingByPeer[server.InstanceId]++
+			if err := repairFile(&bl, server); err != nil {
+				logger.Debug("anti-entropy: error repair file ", bl.FileId, ": ", err)
+				report.Failed++
+				continue
+			}
+			report.Repaired++
+		}
+		return false
+	})
+
+	logger.Info("anti-entropy reconciliation finished: peers ", report.Peers,
+		"(failed ", report.FailedPeers, "), different buckets ", report.DiffBuckets,
+		", missing files ", report.Missing, ", repaired ", report.Repaired,
+		", failed ", report.Failed, ", elapsed ", gox.GetTimestamp(time.Now())-report.StartTime, "ms")
+}
+
+// diffDigests returns the keys whose digest in remote differs from local.
+func diffDigests(local, remote map[string]*common.FileIdDigestDTO) []string {
+	var ret []string
+	for p, d := range remote {
+		if l := local[p]; l != nil && l.Digest == d.Digest {
+			continue
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// batchPrefixes splits prefixes into batches of at most size prefixes.
+func batchPrefixes(prefixes []string, size int) [][]string {
+	var ret [][]string
+	for i := 0; i < len(prefixes); i += size {
+		end := i + size
+		if end > len(prefixes) {
+			end = len(prefixes)
+		}
+		ret = append(ret, prefixes[i:end])
+	}
+	return ret
+}
+
+// reconcileWith drills down the different buckets with the server
+// and returns the binlogs of files which exist on the server but not here.
+func reconcileWith(server *common.Server, local *fileIdDigestTree) ([]common.BingLogDTO, int, error) {
+	remoteTop, err := clientAPI.FileIdDigest(server, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var diffPrefixes []string
+	for _, p := range diffDigests(local.level(""), remoteTop) {
+		remoteSub, err := clientAPI.FileIdDigest(server, p)
+		if err != nil {
+			return nil, len(diffPrefixes), err
+		}
+		diffPrefixes = append(diffPrefixes, diffDigests(local.level(p), remoteSub)...)
+	}
+	if len(diffPrefixes) == 0 {
+		return nil, 0, nil
+	}
+
+	logger.Debug("anti-entropy: ", len(diffPrefixes), " different buckets with server ",
+		server.ConnectionString(), "(", server.InstanceId, ")")
+
+	var missing []common.BingLogDTO
+	for _, batch := range batchPrefixes(diffPrefixes, maxListPrefixes) {
+		bls, err := clientAPI.ListFileIds(server, batch)
+		if err != nil {
+			return missing, len(diffPrefixes), err
+		}
+		for _, bl := range bls {
+			if !localFileExists(bl.FileId) {
+				missing = append(missing, bl)
+			}
+		}
+	}
+	return missing, len(diffPrefixes), nil
+}
+
+// repairFile synchronizes a missing file, from the reconciled server first
+// and then from other group members, and writes its binlog if it is unknown.
+//
+// The binlog is written only after the file is in place,
+// otherwise the fileId would be advertised and replicated by a server not holding it.
+func repairFile(bl *common.BingLogDTO, server *common.Server) error {
+	var err error
+	if server != nil {
+		if err = syncFile(bl, server); err != nil {
+			logger.Debug("cannot download from server ", server.ConnectionString(),
+				", try other servers: ", err)
+		}
+	}
+	if server == nil || err != nil {
+		if err = syncFile(bl, nil); err != nil {
+			return err
+		}
+	}
+	if fileExpired(bl.FileId) {
+		return nil
+	}
+	if !localFileExists(bl.FileId) {
+		return errors.New("file is not synchronized")
+	}
+	return DoIfNotExist(bl.FileId, func() error {
+		b := binlog.CreateLocalBinlog(bl.FileId, bl.FileLength, bl.SourceInstance)
+		b.ExpireTime = bl.ExpireTime
+		b.Meta = bl.Meta
+		if err := writableBinlogManager.Write(b); err != nil {
+			return err
+		}
+		return Add(bl.FileId)
+	})
+}
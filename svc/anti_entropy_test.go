@@ -0,0 +1,112 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	json "github.com/json-iterator/go"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFileIds = []string{"aa001", "aa002", "ab001", "ba001", "bb001", "bb002", "c0001"}
+
+func newTestDigestTree(fileIds []string) *fileIdDigestTree {
+	tree := &fileIdDigestTree{
+		leaves:    make(map[string]*leafDigest),
+		buildTime: time.Now(),
+	}
+	for _, id := range fileIds {
+		tree.add(&common.BingLogDTO{FileId: id})
+	}
+	return tree
+}
+
+func TestDigestTreeLevel(t *testing.T) {
+	tree := newTestDigestTree(testFileIds)
+	reversed := make([]string, len(testFileIds))
+	for i, id := range testFileIds {
+		reversed[len(testFileIds)-1-i] = id
+	}
+	tree2 := newTestDigestTree(reversed)
+
+	for _, prefix := range []string{"", "a", "b", "c", "d"} {
+		l1, l2 := tree.level(prefix), tree2.level(prefix)
+		if len(diffDigests(l1, l2)) != 0 || len(diffDigests(l2, l1)) != 0 {
+			t.Fatal("digest depends on the order of fileIds, prefix: ", prefix)
+		}
+	}
+
+	top := tree.level("")
+	if len(top) != 3 || top["a"].Count != 3 || top["b"].Count != 3 || top["c"].Count != 1 {
+		t.Fatal("unexpected top level: ", top)
+	}
+	sub := tree.level("b")
+	if len(sub) != 2 || sub["ba"].Count != 1 || sub["bb"].Count != 2 {
+		t.Fatal("unexpected sub level: ", sub)
+	}
+
+	// a bucket with a single leaf has the same digest on both levels.
+	if top["c"].Digest != tree.level("c")["c0"].Digest {
+		t.Fatal("single leaf digest mismatch")
+	}
+
+	tree3 := newTestDigestTree(append([]string{"bb003"}, testFileIds...))
+	if d := diffDigests(tree.level(""), tree3.level("")); len(d) != 1 || d[0] != "b" {
+		t.Fatal("unexpected top level diff: ", d)
+	}
+	if d := diffDigests(tree.level("b"), tree3.level("b")); len(d) != 1 || d[0] != "bb" {
+		t.Fatal("unexpected sub level diff: ", d)
+	}
+	if bls := tree3.list([]string{"bb", "zz"}); len(bls) != 3 {
+		t.Fatal("unexpected list result: ", bls)
+	}
+}
+
+func TestBatchPrefixes(t *testing.T) {
+	var prefixes []string
+	for i := 0; i < maxListPrefixes*2+1; i++ {
+		prefixes = append(prefixes, "xx")
+	}
+	batches := batchPrefixes(prefixes, maxListPrefixes)
+	if len(batches) != 3 || len(batches[0]) != maxListPrefixes ||
+		len(batches[1]) != maxListPrefixes || len(batches[2]) != 1 {
+		t.Fatal("unexpected batches")
+	}
+	if len(batchPrefixes(nil, maxListPrefixes)) != 0 {
+		t.Fatal("unexpected batches of empty prefixes")
+	}
+}
+
+func TestFileIdHandlers(t *testing.T) {
+	digestTreeLock.Lock()
+	digestTree = newTestDigestTree(testFileIds)
+	digestTreeLock.Unlock()
+
+	for _, attrs := range []map[string]string{
+		nil,
+		{"prefixes": ""},
+		{"prefixes": "a"},
+		{"prefixes": "aa,abc"},
+		{"prefixes": strings.Repeat("aa,", maxListPrefixes) + "aa"},
+	} {
+		h, _, _, err := fileIdListHandler(&common.Header{Attributes: attrs})
+		if err != nil || h.Result != common.ERROR {
+			t.Fatal("invalid request accepted: ", attrs)
+		}
+	}
+	h, _, _, err := fileIdDigestHandler(&common.Header{Attributes: map[string]string{"prefix": "ab"}})
+	if err != nil || h.Result != common.ERROR {
+		t.Fatal("invalid prefix accepted")
+	}
+
+	h, b, _, err := fileIdListHandler(&common.Header{Attributes: map[string]string{"prefixes": "aa,bb"}})
+	if err != nil || h.Result != common.SUCCESS {
+		t.Fatal("error list fileIds: ", h.Msg, err)
+	}
+	bs, _ := ioutil.ReadAll(b)
+	var bls []common.BingLogDTO
+	if err := json.Unmarshal(bs, &bls); err != nil || len(bls) != 4 {
+		t.Fatal("unexpected fileIds: ", string(bs))
+	}
+}
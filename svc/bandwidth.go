@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+)
+
+const (
+	RATE_LIMIT_SYNC          = "sync"
+	RATE_LIMIT_DOWNLOAD      = "download"
+	RATE_LIMIT_HTTP_DOWNLOAD = "httpDownload"
+)
+
+var (
+	// syncRateLimiter limits peer synchronization traffic, both serving and fetching.
+	syncRateLimiter = util.NewRateLimiter(0)
+	// downloadRateLimiter limits client tcp downloads.
+	downloadRateLimiter = util.NewRateLimiter(0)
+	// httpDownloadRateLimiter limits http downloads.
+	httpDownloadRateLimiter = util.NewRateLimiter(0)
+)
+
+// initRateLimiters applies the bandwidth limits of storage config.
+func initRateLimiters(c *common.StorageConfig) {
+	syncRateLimiter.SetRate(int64(c.SyncRateLimit) << 10)
+	downloadRateLimiter.SetRate(int64(c.DownloadRateLimit) << 10)
+	httpDownloadRateLimiter.SetRate(int64(c.HttpDownloadRateLimit) << 10)
+	logger.Debug("bandwidth limits(KB/s): sync=", c.SyncRateLimit,
+		", download=", c.DownloadRateLimit, ", httpDownload=", c.HttpDownloadRateLimit)
+}
+
+// SetRateLimit changes the bandwidth limit of the given kind at runtime.
+//
+// kb is in KB/s, 0 means unlimited.
+// The runtime value is only kept by the limiter,
+// the storage config is left untouched.
+func SetRateLimit(kind string, kb int) error {
+	if kb < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	switch kind {
+	case RATE_LIMIT_SYNC:
+		syncRateLimiter.SetRate(int64(kb) << 10)
+	case RATE_LIMIT_DOWNLOAD:
+		downloadRateLimiter.SetRate(int64(kb) << 10)
+	case RATE_LIMIT_HTTP_DOWNLOAD:
+		httpDownloadRateLimiter.SetRate(int64(kb) << 10)
+	default:
+		return errors.New("unknown rate limit kind: " + kind)
+	}
+	logger.Info("bandwidth limit of ", kind, " changed to ", kb, "KB/s")
+	return nil
+}
+
+// RateLimitStats returns the state of all bandwidth limiters.
+func RateLimitStats() map[string]util.RateLimiterStats {
+	return map[string]util.RateLimiterStats{
+		RATE_LIMIT_SYNC:          syncRateLimiter.Stats(),
+		RATE_LIMIT_DOWNLOAD:      downloadRateLimiter.Stats(),
+		RATE_LIMIT_HTTP_DOWNLOAD: httpDownloadRateLimiter.Stats(),
+	}
+}
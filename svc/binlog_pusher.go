@@ -6,13 +6,22 @@ import (
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
+	"sync"
 	"time"
 )
 
+var (
+	// binlog pusher timers of tracker servers.
+	binlogPushers     = make(map[string]*timer.Timer)
+	binlogPushersLock = new(sync.Mutex)
+)
+
 // binlogPusher starts a timer job for pushing binlog to a tracker.
 func binlogPusher(server *common.Server) {
+	binlogPushersLock.Lock()
+	defer binlogPushersLock.Unlock()
 	// allow 2 round failure synchronization
-	timer.Start(time.Second*3, time.Second*10, 0, func(t *timer.Timer) {
+	binlogPushers[server.ConnectionString()] = timer.Start(time.Second*3, time.Second*10, 0, func(t *timer.Timer) {
 		for true {
 			// waiting for instanceId
 			if server.InstanceId == "" {
@@ -62,6 +71,16 @@ func binlogPusher(server *common.Server) {
 	})
 }
 
+// stopBinlogPusher stops pushing binlog to the tracker.
+func stopBinlogPusher(server *common.Server) {
+	binlogPushersLock.Lock()
+	defer binlogPushersLock.Unlock()
+	if t := binlogPushers[server.ConnectionString()]; t != nil {
+		t.Destroy()
+		delete(binlogPushers, server.ConnectionString())
+	}
+}
+
 // getPusherStatus gets current binlog push state of the tracker server.
 func getPusherStatus(instanceId string) (fileIndex int, offset int64, err error) {
 	configMap := common.GetConfigMap()
@@ -3,7 +3,6 @@ package svc
 import (
 	"container/list"
 	"github.com/boltdb/bolt"
-	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
@@ -83,6 +82,48 @@ func checkServer(instanceId string) bool {
 	return false
 }
 
+// saveSynchronizationState persists the synchronization state
+// if any of it has changed since last saving.
+func saveSynchronizationState() {
+	configChangeLock.Lock()
+	defer configChangeLock.Unlock()
+
+	configChanged := false
+	for _, v := range synchronizationFlag {
+		if v > 0 {
+			configChanged = true
+			break
+		}
+	}
+	if !configChanged {
+		return
+	}
+
+	config := common.GetConfigMap()
+	err := config.BatchUpdate(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(common.BUCKET_KEY_CONFIGMAP))
+		for k, v := range synchronizationState {
+			bs, err := json.Marshal(v)
+			if err != nil {
+				logger.Debug(err)
+				continue
+			}
+			if err := b.Put([]byte(configKeyPrefix+k), bs); err != nil {
+				logger.Debug("error save config")
+				continue
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		logger.Error(err)
+	} else {
+		logger.Debug("save synchronization state success")
+	}
+	updateConfigChangeState("", true, true)
+}
+
 // InitStorageMemberBinlogWatcher initializes timer jobs for binlog and file synchronization.
 func InitStorageMemberBinlogWatcher() {
 	syncLock.Lock()
@@ -92,49 +133,16 @@ func InitStorageMemberBinlogWatcher() {
 
 	// timer task: save synchronization state every second.
 	timer.Start(time.Second*10, time.Second, 0, func(t *timer.Timer) {
-		configChanged := false
-		for _, v := range synchronizationFlag {
-			if v > 0 {
-				configChanged = true
-				break
-			}
-		}
-		if !configChanged {
-			return
-		}
-
-		configChangeLock.Lock()
-		defer configChangeLock.Unlock()
-
-		config := common.GetConfigMap()
-		err := config.BatchUpdate(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(common.BUCKET_KEY_CONFIGMAP))
-			for k, v := range synchronizationState {
-				bs, err := json.Marshal(v)
-				if err != nil {
-					logger.Debug(err)
-					continue
-				}
-				if err := b.Put([]byte(configKeyPrefix+k), bs); err != nil {
-					logger.Debug("error save config")
-					continue
-				}
-			}
-			return nil
-		})
-
-		if err != nil {
-			logger.Error(err)
-		} else {
-			logger.Debug("save synchronization state success")
-		}
-		updateConfigChangeState("", true, true)
+		saveSynchronizationState()
 	})
 
 	// timer task: check and watch storage server instances
 	timer.Start(time.Second*5, common.SYNCHRONIZE_INTERVAL, 0, func(t *timer.Timer) {
-		ss := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE),
-			common.InitializedStorageConfiguration.Group)
+		// binlogs are followed from the snapshot position after bootstrap.
+		if isBootstrapping() {
+			return
+		}
+		ss := syncSourceMembers()
 		if ss == nil || ss.Len() == 0 {
 			return
 		}
@@ -159,14 +167,15 @@ func InitStorageMemberBinlogWatcher() {
 			return false
 		})
 		gox.WalkList(ss, func(item interface{}) bool {
-			watch(&item.(*common.Instance).Server)
+			watch(&item.(*common.Instance).Server, mirroredGroupOf(item.(*common.Instance)))
 			return false
 		})
 	})
 }
 
-// watch starts to watch a single storage member server.
-func watch(server *common.Server) {
+// watch starts to watch a single storage member server,
+// group is the mirrored group of the server or empty for members of this group.
+func watch(server *common.Server, group string) {
 	syncLock.Lock()
 	defer syncLock.Unlock()
 
@@ -180,6 +189,9 @@ func watch(server *common.Server) {
 	}
 
 	watchingMembers[server.InstanceId] = server
+	if group != "" {
+		startMirrorFollowing(server.InstanceId, group)
+	}
 
 	binlogList := list.New()
 
@@ -212,6 +224,7 @@ func watch(server *common.Server) {
 
 			if ret.FileIndex == config.FileIndex && ret.Offset == config.Offset {
 				logger.Debug("nothing changed")
+				markMirrorCaughtUp(server.InstanceId)
 				break
 			}
 
@@ -226,10 +239,15 @@ func watch(server *common.Server) {
 					// binlog is mime, so skip.
 					continue
 				}
+				if !acceptMirrorBinlog(v.FileId, group) {
+					continue
+				}
 
 				if err = DoIfNotExist(v.FileId, func() error {
-					binlogList.PushBack(binlog.CreateLocalBinlog(v.FileId,
-						v.FileLength, v.SourceInstance))
+					bl := binlog.CreateLocalBinlog(v.FileId, v.FileLength, v.SourceInstance)
+					bl.ExpireTime = v.ExpireTime
+					bl.Meta = v.Meta
+					binlogList.PushBack(bl)
 					return nil
 				}); err != nil {
 					failed++
@@ -279,6 +297,7 @@ func watch(server *common.Server) {
 				break
 			}
 			if len(ret.Logs) == 0 {
+				markMirrorCaughtUp(server.InstanceId)
 				break
 			}
 		}
@@ -293,4 +312,5 @@ func unWatch(server *common.Server) {
 
 	logger.Debug("unwatch server: ", server.ConnectionString(), "(", server.InstanceId, "): ")
 	delete(watchingMembers, server.InstanceId)
+	stopMirrorFollowing(server.InstanceId)
 }
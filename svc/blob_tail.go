@@ -0,0 +1,56 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+)
+
+// RunStripBlobTails moves the reference count tails of the blobs stored by old versions
+// into the blob states of the stopped storage server, and returns the number of stripped blobs.
+//
+// Blobs with tails stay readable, so the server works before the tails are stripped.
+// The storage config must be initialized as the server does on boot.
+func RunStripBlobTails() (int, error) {
+	c := common.InitializedStorageConfiguration
+	if err := util.ValidateStorageConfig(c); err != nil {
+		return 0, err
+	}
+	if err := checkStorageStopped(c.DataDir); err != nil {
+		return 0, err
+	}
+	if err := util.InitStorageConfig(c); err != nil {
+		return 0, err
+	}
+	defer closeConfigMap()
+	util.InitDataDirs(c)
+	return stripBlobTails()
+}
+
+// stripBlobTails strips the tails of the standalone blobs,
+// the ones whose tail is unreadable are left for fsck.
+func stripBlobTails() (int, error) {
+	blobs, err := util.ListBlobs()
+	if err != nil {
+		return 0, err
+	}
+	stripped := 0
+	for _, b := range blobs {
+		if b.Packed {
+			continue
+		}
+		if b.RefCount < 0 {
+			logger.Warn("skip blob ", b.Rel, ": reference count tail is unreadable")
+			continue
+		}
+		ok, err := util.StripBlobTail(b.Rel)
+		if err != nil {
+			return stripped, errors.New("error strip blob " + b.Rel + ": " + err.Error())
+		}
+		if ok {
+			stripped++
+		}
+	}
+	return stripped, nil
+}
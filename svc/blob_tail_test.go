@@ -0,0 +1,68 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestStoreBlobConcurrently(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+
+	rel := "0A/1B/e92c1c72e7fff2801c7d4af5b154f88d"
+	if err := file.CreateDirs(dir + "/0A/1B"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/"+rel, append([]byte("abc"), tailRefCount...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tmp := dir + "/tmp" + convert.IntToStr(i)
+				if err := ioutil.WriteFile(tmp, append([]byte("abc"), tailRefCount...), 0644); err != nil {
+					t.Error(err)
+					return
+				}
+				defer os.Remove(tmp)
+				if err := storeBlob(tmp, rel, "a.txt"); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	}
+	refCount := func() int64 {
+		b, err := util.OpenBlob(rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		return b.RefCount
+	}
+
+	// blobs of old versions are counted in the tail.
+	upload(20)
+	if c := refCount(); c != 21 {
+		t.Fatal("increments of the tail are lost: ", c)
+	}
+	if n, err := stripBlobTails(); n != 1 || err != nil {
+		t.Fatal("unexpected stripped blobs: ", n, err)
+	}
+	upload(20)
+	if c := refCount(); c != 41 {
+		t.Fatal("increments of the state are lost: ", c)
+	}
+	if n, err := stripBlobTails(); n != 0 || err != nil {
+		t.Fatal("unexpected stripped blobs: ", n, err)
+	}
+}
@@ -1,19 +1,21 @@
 package svc
 
 import (
-	"errors"
 	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/file"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/timer"
 	json "github.com/json-iterator/go"
 	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"path"
 	"sync"
 	"time"
 )
@@ -92,7 +94,7 @@ func authenticationHandler(header *common.Header, secret string) (*common.Header
 				}, nil, nil, 0, err
 			}
 			if instance.InstanceId != "" {
-				if err := reg.Put(instance); err != nil {
+				if err := registerInstance(instance); err != nil {
 					return &common.Header{
 						Result: common.ERROR,
 						Msg:    err.Error(),
@@ -108,7 +110,94 @@ func authenticationHandler(header *common.Header, secret string) (*common.Header
 	}, instance, nil, 0, nil
 }
 
-func updateFileReferenceCount(path string, value int64) error {
+// registerInstance registers the instance to the registry,
+// decommissioned and shutting down instances are removed instead.
+func registerInstance(instance *common.Instance) error {
+	if drain := instance.Attributes["drain"]; drain == common.DRAIN_DECOMMISSIONED ||
+		drain == common.DRAIN_SHUTDOWN {
+		reg.Remove(instance)
+		return nil
+	}
+	return reg.Put(instance)
+}
+
+// isStoragePeer judges whether the connecting client is a storage server
+// of the same group.
+//
+// The instance id carried in the authentication header must be
+// a storage member registered on the trackers,
+// the role declared by the client itself is not trusted.
+func isStoragePeer(header *common.Header) bool {
+	if header.Attributes == nil || header.Attributes["instance"] == "" {
+		return false
+	}
+	instance := &common.Instance{}
+	if err := json.Unmarshal([]byte(header.Attributes["instance"]), instance); err != nil {
+		return false
+	}
+	if instance.InstanceId == "" || instance.InstanceId == common.InitializedStorageConfiguration.InstanceId {
+		return false
+	}
+	registered := api.FilterInstanceByInstanceId(instance.InstanceId)
+	return registered != nil && registered.Role == common.ROLE_STORAGE &&
+		registered.Attributes["group"] == common.InitializedStorageConfiguration.Group
+}
+
+// blobLocks serialize the reference count changes of blobs of the same content,
+// a blob is locked by the hash of its md5.
+var blobLocks [256]sync.Mutex
+
+// lockBlob locks the blob and returns the function which unlocks it.
+func lockBlob(rel string) func() {
+	m := &blobLocks[crc32.ChecksumIEEE([]byte(path.Base(rel)))%uint32(len(blobLocks))]
+	m.Lock()
+	return m.Unlock
+}
+
+// storeBlob places the uploaded tmp file as the blob if it does not exist,
+// or increases the reference count of the existing one.
+func storeBlob(tmpFileName, rel, name string) error {
+	defer lockBlob(rel)()
+
+	if !util.BlobExists(rel) {
+		logger.Debug("file not exists, move to target dir.")
+		// mime type is detected by the name or the content.
+		if err := util.CompressBlob(tmpFileName, common.InitializedStorageConfiguration.Group, name); err != nil {
+			return err
+		}
+		_, err := util.PlaceBlob(tmpFileName, rel)
+		return err
+	}
+	logger.Debug("file already exists, increasing reference count.")
+	return updateFileReferenceCount(rel, 1)
+}
+
+// updateFileReferenceCount changes the reference count of the blob,
+// which is kept in the volume index for packed blobs,
+// or in the state of the blob otherwise, blobs of old versions keep it in the tail.
+//
+// The caller must hold the lock of the blob.
+func updateFileReferenceCount(rel string, value int64) error {
+	if packed, err := util.UpdateVolumeReferenceCount(rel, value); packed || err != nil {
+		return err
+	}
+	return updateStandaloneReferenceCount(rel, value)
+}
+
+// updateStandaloneReferenceCount changes the reference count of the standalone blob.
+func updateStandaloneReferenceCount(rel string, value int64) error {
+	fullPath, exists := util.LocateBlob(rel)
+	if !exists {
+		return common.NotFoundErr
+	}
+	if stated, err := util.UpdateBlobReferenceCount(rel, value); stated || err != nil {
+		return err
+	}
+	return updateTailReferenceCount(fullPath, value)
+}
+
+// updateTailReferenceCount changes the reference count in the tail of the blob file.
+func updateTailReferenceCount(path string, value int64) error {
 	oldFile, err := file.OpenFile(path, os.O_RDWR, 0666)
 	if err != nil {
 		return err
@@ -122,7 +211,6 @@ func updateFileReferenceCount(path string, value int64) error {
 	if _, err := io.ReadAtLeast(oldFile, tailRefBytes[4:], 4); err != nil {
 		return err
 	}
-	// must add lock
 	count := convert.Bytes2Length(tailRefBytes)
 	logger.Debug("file referenced count: ", count)
 	count += value
@@ -136,31 +224,47 @@ func updateFileReferenceCount(path string, value int64) error {
 	return nil
 }
 
-func seekRead(fullPath string, offset, length int64) (io.Reader, int64, error) {
-	if !file.Exists(fullPath) {
-		return nil, 0, errors.New("file not found")
-	}
-	fi, err := file.GetFile(fullPath)
+// seekRead opens a stored blob and returns a reader of the given range,
+// read rate of the returned reader is limited by the limiter.
+//
+// The range is of the decompressed content, or of the stored form if raw is true.
+func seekRead(rel string, offset, length int64, raw bool, limiter *util.RateLimiter) (io.Reader, int64, error) {
+	blob, err := util.OpenBlob(rel)
 	if err != nil {
 		return nil, 0, err
 	}
-	info, err := fi.Stat()
-	if err != nil {
-		return nil, 0, err
+	content := blob.SectionReader
+	if !raw {
+		content = util.OpenContent(blob)
 	}
-	if info.Size() < 4 {
-		return nil, 0, errors.New("invalid format file")
+	size := content.Size()
+	if offset >= size {
+		offset = size
 	}
-	if offset >= info.Size()-4 {
-		offset = info.Size() - 4
+	if length == -1 || offset+length >= size {
+		length = size - offset
 	}
-	if length == -1 || offset+length >= info.Size()-4 {
-		length = info.Size() - 4 - offset
-	}
-	if _, err := fi.Seek(offset, 0); err != nil {
-		return nil, 0, err
+	return limiter.NewReader(&blobReader{
+		r:         io.NewSectionReader(content, offset, length),
+		blob:      blob,
+		remaining: length,
+	}), length, nil
+}
+
+// blobReader closes the blob once the range is read.
+type blobReader struct {
+	r         io.Reader
+	blob      *util.Blob
+	remaining int64
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if err != nil || b.remaining <= 0 {
+		b.blob.Close()
 	}
-	return io.LimitReader(fi, length), length, nil
+	return n, err
 }
 
 func increaseCountForTheSecond() {
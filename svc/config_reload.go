@@ -0,0 +1,326 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	// configLoader builds config from command line flags and the config file.
+	configLoader func() (interface{}, error)
+	reloadLock   = new(sync.Mutex)
+	// configLock guards the config fields which are changed by reloading,
+	// requests read them through the accessors below.
+	configLock = new(sync.RWMutex)
+	// config fields which take effect without restart.
+	storageReloadableFields = map[string]bool{
+		"logLevel":              true,
+		"allowedDomains":        true,
+		"publicAccessMode":      true,
+		"trackers":              true,
+		"syncRateLimit":         true,
+		"downloadRateLimit":     true,
+		"httpDownloadRateLimit": true,
+	}
+	trackerReloadableFields = map[string]bool{
+		"logLevel": true,
+		"trackers": true,
+		"quotas":   true,
+	}
+	agentReloadableFields = map[string]bool{
+		"logLevel": true,
+		"trackers": true,
+	}
+)
+
+// SetConfigLoader sets the function which loads config for reloading.
+func SetConfigLoader(loader func() (interface{}, error)) {
+	configLoader = loader
+}
+
+// handleReloadSignal reloads config on SIGHUP.
+func handleReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			logger.Info("receive signal SIGHUP, reloading config")
+			if _, err := ReloadConfig(); err != nil {
+				logger.Error("error reload config: ", err)
+			}
+		}
+	}()
+}
+
+// ReloadConfig re-reads the config file and environment overlays,
+// validates the config and applies the fields which can change at runtime.
+//
+// Changes of the other fields are reported as restart required.
+// An invalid config is rejected with the error in the result,
+// and the running config is kept.
+func ReloadConfig() (*common.ConfigReloadResult, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if configLoader == nil {
+		return nil, errors.New("config reloading is not supported")
+	}
+	c, err := configLoader()
+	if err != nil {
+		return rejectConfig(err)
+	}
+
+	var result *common.ConfigReloadResult
+	switch common.BootAs {
+	case common.BOOT_STORAGE:
+		nc := c.(*common.StorageConfig)
+		if err := util.ValidateStorageConfig(nc); err != nil {
+			return rejectConfig(err)
+		}
+		result = splitConfigChanges(util.DiffConfig(common.InitializedStorageConfiguration, nc),
+			storageReloadableFields)
+		applyStorageConfig(nc, result)
+	case common.BOOT_TRACKER:
+		nc := c.(*common.TrackerConfig)
+		if err := util.ValidateTrackerConfig(nc); err != nil {
+			return rejectConfig(err)
+		}
+		result = splitConfigChanges(util.DiffConfig(common.InitializedTrackerConfiguration, nc),
+			trackerReloadableFields)
+		applyTrackerConfig(nc, result)
+	case common.BOOT_AGENT:
+		nc := c.(*common.AgentConfig)
+		if err := util.ValidateAgentConfig(nc); err != nil {
+			return rejectConfig(err)
+		}
+		result = splitConfigChanges(util.DiffConfig(common.InitializedAgentConfiguration, nc),
+			agentReloadableFields)
+		applyAgentConfig(nc, result)
+	default:
+		return nil, errors.New("config reloading is not supported")
+	}
+
+	for _, ch := range result.Applied {
+		logger.Info("config \"", ch.Field, "\" changed: ", ch.OldValue, " -> ", ch.NewValue)
+	}
+	for _, ch := range result.RestartRequired {
+		logger.Warn("config \"", ch.Field, "\" changed: ", ch.OldValue, " -> ", ch.NewValue,
+			", restart required")
+	}
+	logger.Info("config reloaded, ", len(result.Applied), " applied, ",
+		len(result.RestartRequired), " require restart")
+	return result, nil
+}
+
+func rejectConfig(err error) (*common.ConfigReloadResult, error) {
+	return &common.ConfigReloadResult{Error: err.Error()}, err
+}
+
+// splitConfigChanges splits config changes into
+// the ones can be applied and the ones require restart.
+func splitConfigChanges(changes []common.ConfigChange, reloadable map[string]bool) *common.ConfigReloadResult {
+	result := &common.ConfigReloadResult{}
+	for _, ch := range changes {
+		if reloadable[ch.Field] {
+			result.Applied = append(result.Applied, ch)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, ch)
+		}
+	}
+	return result
+}
+
+// applyConfigChanges applies the changes one by one,
+// the changes which fail to apply are moved to restart required.
+func applyConfigChanges(result *common.ConfigReloadResult, apply func(field string) bool) {
+	var applied []common.ConfigChange
+	for _, ch := range result.Applied {
+		if apply(ch.Field) {
+			applied = append(applied, ch)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, ch)
+		}
+	}
+	result.Applied = applied
+}
+
+func applyStorageConfig(nc *common.StorageConfig, result *common.ConfigReloadResult) {
+	c := common.InitializedStorageConfiguration
+	applyConfigChanges(result, func(field string) bool {
+		switch field {
+		case "logLevel":
+			updateConfig(func() { c.LogLevel = nc.LogLevel })
+			util.SetLogLevel(nc.LogLevel)
+		case "allowedDomains":
+			updateConfig(func() { c.AllowedDomains = nc.AllowedDomains })
+		case "publicAccessMode":
+			updateConfig(func() { c.PublicAccessMode = nc.PublicAccessMode })
+		case "syncRateLimit":
+			updateConfig(func() { c.SyncRateLimit = nc.SyncRateLimit })
+			return SetRateLimit(RATE_LIMIT_SYNC, nc.SyncRateLimit) == nil
+		case "downloadRateLimit":
+			updateConfig(func() { c.DownloadRateLimit = nc.DownloadRateLimit })
+			return SetRateLimit(RATE_LIMIT_DOWNLOAD, nc.DownloadRateLimit) == nil
+		case "httpDownloadRateLimit":
+			updateConfig(func() { c.HttpDownloadRateLimit = nc.HttpDownloadRateLimit })
+			return SetRateLimit(RATE_LIMIT_HTTP_DOWNLOAD, nc.HttpDownloadRateLimit) == nil
+		case "trackers":
+			if !reloadTrackers(c.ParsedTrackers, nc.ParsedTrackers, true) {
+				return false
+			}
+			updateConfig(func() { c.Trackers, c.ParsedTrackers = nc.Trackers, nc.ParsedTrackers })
+		}
+		return true
+	})
+}
+
+func applyTrackerConfig(nc *common.TrackerConfig, result *common.ConfigReloadResult) {
+	c := common.InitializedTrackerConfiguration
+	applyConfigChanges(result, func(field string) bool {
+		switch field {
+		case "logLevel":
+			updateConfig(func() { c.LogLevel = nc.LogLevel })
+			util.SetLogLevel(nc.LogLevel)
+		case "trackers":
+			if !reloadTrackers(c.ParsedTrackers, nc.ParsedTrackers, false) {
+				return false
+			}
+			updateConfig(func() { c.Trackers, c.ParsedTrackers = nc.Trackers, nc.ParsedTrackers })
+		case "quotas":
+			updateConfig(func() { c.Quotas = nc.Quotas })
+		}
+		return true
+	})
+}
+
+func applyAgentConfig(nc *common.AgentConfig, result *common.ConfigReloadResult) {
+	c := common.InitializedAgentConfiguration
+	applyConfigChanges(result, func(field string) bool {
+		switch field {
+		case "logLevel":
+			updateConfig(func() { c.LogLevel = nc.LogLevel })
+			util.SetLogLevel(nc.LogLevel)
+		case "trackers":
+			if !reloadTrackers(c.ParsedTrackers, nc.ParsedTrackers, false) {
+				return false
+			}
+			updateConfig(func() { c.Trackers, c.ParsedTrackers = nc.Trackers, nc.ParsedTrackers })
+		}
+		return true
+	})
+}
+
+// updateConfig changes the reloadable config fields under configLock.
+func updateConfig(update func()) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	update()
+}
+
+// publicAccessMode returns whether the files uploaded over http are public by default.
+func publicAccessMode() bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return common.InitializedStorageConfiguration.PublicAccessMode
+}
+
+// parsedTrackers returns the tracker servers of the running server,
+// the returned slice is replaced rather than modified by reloading.
+func parsedTrackers() []common.Server {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	switch common.BootAs {
+	case common.BOOT_STORAGE:
+		return common.InitializedStorageConfiguration.ParsedTrackers
+	case common.BOOT_TRACKER:
+		return common.InitializedTrackerConfiguration.ParsedTrackers
+	case common.BOOT_AGENT:
+		return common.InitializedAgentConfiguration.ParsedTrackers
+	}
+	return nil
+}
+
+// trackerQuotas returns the quotas of the tracker.
+func trackerQuotas() []common.Quota {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return common.InitializedTrackerConfiguration.Quotas
+}
+
+// reloadTrackers updates the tracker servers of the client api,
+// storage servers also start or stop pushing binlog to the trackers.
+//
+// It returns false if the server is running in standalone mode,
+// which requires restart to join a cluster.
+func reloadTrackers(oldTrackers []common.Server, newTrackers []common.Server, pushBinlog bool) bool {
+	if clientAPI == nil {
+		return len(newTrackers) == 0
+	}
+	servers := make([]*common.Server, len(newTrackers))
+	for i := range newTrackers {
+		servers[i] = &newTrackers[i]
+	}
+	clientAPI.UpdateTrackerServers(servers)
+	if !pushBinlog {
+		return true
+	}
+	// pushers of the kept trackers are restarted on the new server objects,
+	// the push positions are saved by instance id.
+	for i := range oldTrackers {
+		stopBinlogPusher(&oldTrackers[i])
+	}
+	for _, s := range servers {
+		binlogPusher(s)
+	}
+	return true
+}
+
+// adminSecret returns the secret of management requests.
+func adminSecret() string {
+	switch common.BootAs {
+	case common.BOOT_STORAGE:
+		return common.InitializedStorageConfiguration.Secret
+	case common.BOOT_TRACKER:
+		return common.InitializedTrackerConfiguration.Secret
+	case common.BOOT_AGENT:
+		return common.InitializedAgentConfiguration.Secret
+	}
+	return ""
+}
+
+// httpReloadConfig reloads config of the server
+// and responses the applied and restart required changes.
+func httpReloadConfig(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, adminSecret()) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	status := http.StatusOK
+	result, err := ReloadConfig()
+	if err != nil {
+		if result == nil {
+			util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		status = http.StatusBadRequest
+	}
+	retJSON, err := json.Marshal(result)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, status, string(retJSON))
+}
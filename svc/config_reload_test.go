@@ -0,0 +1,80 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"os"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	bootAs, config, loader := common.BootAs, common.InitializedStorageConfiguration, configLoader
+	defer func() {
+		common.BootAs, common.InitializedStorageConfiguration, configLoader = bootAs, config, loader
+	}()
+
+	newConfig := func() *common.StorageConfig {
+		return &common.StorageConfig{
+			Port:     1024,
+			HttpPort: 8001,
+			LogLevel: "info",
+			DataDir:  "/tmp/godfs",
+		}
+	}
+	common.BootAs = common.BOOT_STORAGE
+	common.InitializedStorageConfiguration = newConfig()
+	if err := util.ValidateStorageConfig(common.InitializedStorageConfiguration); err != nil {
+		t.Fatal(err)
+	}
+	SetConfigLoader(func() (interface{}, error) {
+		c := newConfig()
+		c.LogLevel = "debug"
+		c.PublicAccessMode = true
+		c.Port = 1025
+		return c, nil
+	})
+
+	result, err := ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 2 || len(result.RestartRequired) != 1 ||
+		result.RestartRequired[0].Field != "port" {
+		t.Fatal("wrong reload result: ", result)
+	}
+	c := common.InitializedStorageConfiguration
+	if c.LogLevel != "debug" || !c.PublicAccessMode {
+		t.Fatal("reloadable config is not applied")
+	}
+	if c.Port != 1024 {
+		t.Fatal("config which requires restart is applied")
+	}
+
+	// invalid config is rejected as a whole.
+	SetConfigLoader(func() (interface{}, error) {
+		c := newConfig()
+		c.LogLevel = "warn"
+		c.Group = "invalid group"
+		return c, nil
+	})
+	if _, err := ReloadConfig(); err == nil {
+		t.Fatal("invalid config is reloaded")
+	}
+	if common.InitializedStorageConfiguration.LogLevel != "debug" {
+		t.Fatal("invalid config is applied")
+	}
+
+	// invalid environment overlays are rejected rather than exiting.
+	SetConfigLoader(func() (interface{}, error) {
+		return newConfig(), nil
+	})
+	os.Setenv("httpPort", "80x")
+	defer os.Unsetenv("httpPort")
+	result, err = ReloadConfig()
+	if err == nil || result == nil || result.Error == "" {
+		t.Fatal("invalid environment overlay is reloaded")
+	}
+	if common.InitializedStorageConfiguration.LogLevel != "debug" {
+		t.Fatal("invalid environment overlay is applied")
+	}
+}
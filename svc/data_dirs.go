@@ -0,0 +1,171 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// interval of retrying the files failed to repopulate.
+const repopulateRetryInterval = time.Minute * 10
+
+var (
+	// data dirs which are being checked.
+	dataDirChecking = make(map[string]bool)
+	dataDirLock     = new(sync.Mutex)
+	// repopulating marks missing files are being synchronized again.
+	repopulating bool
+	// repopulatePending marks missing files need to be synchronized again,
+	// such as some files failed in last round.
+	repopulatePending bool
+	lastRepopulate    time.Time
+)
+
+// InitDataDirCheck starts a timer job for checking the data dirs,
+// a failed data dir is marked offline and its files are synchronized
+// from the group members to the other data dirs.
+//
+// An offline data dir comes back when it passes the check again.
+func InitDataDirCheck() {
+	for _, st := range util.DataDirStatus() {
+		if !st.Online {
+			repopulatePending = true
+		}
+	}
+	reportDataDirs()
+	timer.Start(common.HEALTH_CHECK_INTERVAL, common.HEALTH_CHECK_INTERVAL, 0, func(t *timer.Timer) {
+		if coordinator.isShuttingDown() {
+			return
+		}
+		dataDirLock.Lock()
+		pending := repopulatePending && !repopulating && time.Since(lastRepopulate) > repopulateRetryInterval
+		dataDirLock.Unlock()
+		if pending {
+			go repopulateFiles()
+		}
+		for _, st := range util.DataDirStatus() {
+			dataDirLock.Lock()
+			if dataDirChecking[st.Path] {
+				// last check hangs.
+				dataDirLock.Unlock()
+				continue
+			}
+			dataDirChecking[st.Path] = true
+			dataDirLock.Unlock()
+			go checkDataDir(st)
+		}
+	})
+}
+
+// checkDataDir checks the data dir once.
+func checkDataDir(st common.DataDirStatus) {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- checkCanaryFile(st.Path)
+		dataDirLock.Lock()
+		delete(dataDirChecking, st.Path)
+		dataDirLock.Unlock()
+	}()
+	var err error
+	select {
+	case err = <-ch:
+	case <-time.After(common.HEALTH_CHECK_TIMEOUT):
+		err = errors.New("canary check timeout")
+	}
+
+	if err == nil {
+		if !st.Online && util.SetDataDirOnline(st.Path, true) {
+			logger.Info("data dir ", st.Path, " is online again")
+			reportDataDirs()
+		}
+		return
+	}
+	if st.Online && util.SetDataDirOnline(st.Path, false) {
+		logger.Error("data dir ", st.Path, " is offline: ", err)
+		reportDataDirs()
+		// repopulate files immediately.
+		go repopulateFiles()
+	}
+}
+
+// reportDataDirs sets the number of offline data dirs as an instance attribute.
+func reportDataDirs() {
+	offline := 0
+	for _, st := range util.DataDirStatus() {
+		if !st.Online {
+			offline++
+		}
+	}
+	api.SetInstanceAttribute("offlineDataDirs", convert.IntToStr(offline))
+}
+
+// repopulateFiles synchronizes the files which are missing from the data dirs,
+// such as files on an offline data dir.
+func repopulateFiles() {
+	dataDirLock.Lock()
+	if repopulating {
+		dataDirLock.Unlock()
+		return
+	}
+	repopulating = true
+	repopulatePending = false
+	lastRepopulate = time.Now()
+	dataDirLock.Unlock()
+
+	total, failed := 0, 0
+	defer func() {
+		dataDirLock.Lock()
+		repopulating = false
+		repopulatePending = repopulatePending || failed > 0
+		dataDirLock.Unlock()
+	}()
+
+	logger.Info("repopulating missing files")
+	err := walkLocalBinlogs(func(bl *common.BingLogDTO) bool {
+		if coordinator.isShuttingDown() {
+			return true
+		}
+		if localFileExists(bl.FileId) {
+			return false
+		}
+		total++
+		if err := syncFile(bl, nil); err != nil {
+			failed++
+			logger.Debug("error repopulate file ", bl.FileId, ": ", err)
+		}
+		return false
+	})
+	if err != nil {
+		failed++
+		logger.Error("error repopulate missing files: ", err)
+		return
+	}
+	logger.Info("repopulate ", total-failed, " of ", total, " missing files")
+}
+
+// httpDataDirs responses the state of each data dir.
+func httpDataDirs(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedStorageConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	retJSON, err := json.Marshal(util.DataDirStatus())
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
@@ -1,14 +1,40 @@
 package svc
 
 import (
+	"bytes"
+	"errors"
+	"github.com/boltdb/bolt"
 	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/file"
 	"github.com/hetianyi/gox/logger"
 	"github.com/hetianyi/gox/set"
+	"os"
 	"sync"
+	"sync/atomic"
 )
 
+const (
+	// indexBackendKey is the config key of the backend which holds the complete fileId index.
+	indexBackendKey = "indexBackend"
+	bucketFileIds   = "fileIds"
+)
+
+// IndexNotIterableErr is returned by indexes which cannot walk through the fileIds.
+var IndexNotIterableErr = errors.New("index backend does not support iteration")
+
+// FileIndex stores the fileIds known to the server.
+type FileIndex interface {
+	Add(fileId string) error
+	Remove(fileId string) (bool, error)
+	Contains(fileId string) (bool, error)
+	// Walk walks through the fileIds with the prefix in order,
+	// the walk stops if the walker returns false.
+	Walk(prefix string, walker func(fileId string) bool) error
+	Close() error
+}
+
 var (
-	dataset   *set.DataSet
+	dataset   FileIndex
 	initLock  *sync.Mutex
 	writeLock *sync.Mutex
 	initd     = false
@@ -20,6 +46,9 @@ func init() {
 }
 
 // initDataSet initializes database which stores fileId.
+//
+// If the configured index backend differs from the one holding the complete index,
+// the index is migrated online by InitIndexMigration.
 func initDataSet() error {
 	initLock.Lock()
 	defer initLock.Unlock()
@@ -34,6 +63,102 @@ func initDataSet() error {
 		logger.Fatal("cannot init dataset: invalid boot role ", common.BootAs)
 	}
 
+	dataDir, backend := "", ""
+	if common.BootAs == common.BOOT_TRACKER {
+		dataDir = common.InitializedTrackerConfiguration.DataDir
+		backend = common.InitializedTrackerConfiguration.IndexBackend
+	} else {
+		dataDir = common.InitializedStorageConfiguration.DataDir
+		backend = common.InitializedStorageConfiguration.IndexBackend
+	}
+
+	active := activeIndexBackend(dataDir, backend)
+	idx, err := openFileIndex(active, dataDir)
+	if err != nil {
+		return err
+	}
+	if active == backend {
+		if err := common.GetConfigMap().PutConfig(indexBackendKey, []byte(active)); err != nil {
+			return err
+		}
+		// files left by a finished migration.
+		for _, b := range []string{common.INDEX_BACKEND_SET, common.INDEX_BACKEND_BOLT} {
+			if b != active {
+				removeIndexFiles(b, dataDir)
+			}
+		}
+		dataset = idx
+	} else {
+		// the target of an interrupted migration is rebuilt.
+		removeIndexFiles(backend, dataDir)
+		to, err := openFileIndex(backend, dataDir)
+		if err != nil {
+			return err
+		}
+		dataset = &migratingIndex{
+			from:    idx,
+			to:      to,
+			backend: backend,
+		}
+		logger.Info("fileId index is migrated from ", active, " to ", backend)
+	}
+
+	logger.Debug("dataset initializes success")
+
+	return nil
+}
+
+// activeIndexBackend returns the backend which holds the complete fileId index of the data dir,
+// data dirs of old versions use the set.
+func activeIndexBackend(dataDir, configured string) string {
+	if cm := common.GetConfigMap(); cm != nil {
+		if bs, _ := cm.GetConfig(indexBackendKey); len(bs) > 0 {
+			return string(bs)
+		}
+	}
+	for _, p := range indexFiles(common.INDEX_BACKEND_SET, dataDir) {
+		if file.Exists(p) {
+			return common.INDEX_BACKEND_SET
+		}
+	}
+	if configured == "" {
+		return common.INDEX_BACKEND_SET
+	}
+	return configured
+}
+
+// indexFiles returns the files of the index backend under the data dir.
+func indexFiles(backend, dataDir string) []string {
+	if backend == common.INDEX_BACKEND_BOLT {
+		return []string{dataDir + "/fileid.db"}
+	}
+	return []string{dataDir + "/index", dataDir + "/aof"}
+}
+
+func removeIndexFiles(backend, dataDir string) {
+	for _, p := range indexFiles(backend, dataDir) {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			logger.Error("error remove index file ", p, ": ", err)
+		}
+	}
+}
+
+// openFileIndex opens the index of the backend under the data dir,
+// the files are created if they do not exist.
+func openFileIndex(backend, dataDir string) (FileIndex, error) {
+	if backend == common.INDEX_BACKEND_BOLT {
+		return openBoltIndex(indexFiles(backend, dataDir)[0])
+	}
+	d, err := openDataSet(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &setIndex{d}, nil
+}
+
+// openDataSet opens the dataset files under the data dir,
+// the files are created if they do not exist.
+func openDataSet(dataDir string) (*set.DataSet, error) {
 	// slotSize is the slot size of the set,
 	// it loads the size of slots bytes in memory, so be careful.
 	//
@@ -49,42 +174,247 @@ func initDataSet() error {
 
 	logger.Debug("slot size: ", slotSize)
 
-	dataDir := ""
-	if common.BootAs == common.BOOT_TRACKER {
-		dataDir = common.InitializedTrackerConfiguration.DataDir
-	} else {
-		dataDir = common.InitializedStorageConfiguration.DataDir
+	m, err := set.NewFileMap(slotNum, 8, dataDir+"/index")
+	if err != nil {
+		return nil, err
 	}
+	a, err := set.NewAppendFile(slotSize, 2, dataDir+"/aof")
+	if err != nil {
+		return nil, err
+	}
+	return set.NewDataSet(m, a), nil
+}
 
-	m, err := set.NewFileMap(slotNum, 8, dataDir+"/index")
+// setIndex is the fixed-size set, whose slots are allocated in memory up front.
+type setIndex struct {
+	d *set.DataSet
+}
+
+func (s *setIndex) Add(fileId string) error {
+	return s.d.Add([]byte(fileId))
+}
+
+func (s *setIndex) Remove(fileId string) (bool, error) {
+	return s.d.Remove([]byte(fileId))
+}
+
+func (s *setIndex) Contains(fileId string) (bool, error) {
+	return s.d.Contains([]byte(fileId))
+}
+
+func (s *setIndex) Walk(prefix string, walker func(fileId string) bool) error {
+	return IndexNotIterableErr
+}
+
+// Close does nothing, files of the set are closed on exit.
+func (s *setIndex) Close() error {
+	return nil
+}
+
+// boltIndex is the disk-backed index which grows with the fileIds.
+type boltIndex struct {
+	db *bolt.DB
+}
+
+func openBoltIndex(path string) (*boltIndex, error) {
+	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucketFileIds))
 		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
-	a, err := set.NewAppendFile(slotSize, 2, dataDir+"/aof")
+	return &boltIndex{db}, nil
+}
+
+func (b *boltIndex) Add(fileId string) error {
+	// concurrent uploads are committed in batches.
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketFileIds)).Put([]byte(fileId), []byte{1})
+	})
+}
+
+func (b *boltIndex) Remove(fileId string) (bool, error) {
+	existed := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketFileIds))
+		existed = bucket.Get([]byte(fileId)) != nil
+		return bucket.Delete([]byte(fileId))
+	})
+	return existed, err
+}
+
+func (b *boltIndex) Contains(fileId string) (bool, error) {
+	exists := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(bucketFileIds)).Get([]byte(fileId)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// Walk walks in a read transaction, so the walker must not write the index.
+func (b *boltIndex) Walk(prefix string, walker func(fileId string) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucketFileIds)).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if !walker(string(k)) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltIndex) Close() error {
+	return b.db.Close()
+}
+
+// migratingIndex writes both indexes while the fileIds are copied to the target,
+// reads are answered by the source until the copy completes.
+type migratingIndex struct {
+	from    FileIndex
+	to      FileIndex
+	backend string // backend of the target
+	done    int32
+}
+
+func (m *migratingIndex) current() FileIndex {
+	if atomic.LoadInt32(&m.done) == 1 {
+		return m.to
+	}
+	return m.from
+}
+
+func (m *migratingIndex) Add(fileId string) error {
+	if err := m.from.Add(fileId); err != nil {
+		return err
+	}
+	return m.to.Add(fileId)
+}
+
+func (m *migratingIndex) Remove(fileId string) (bool, error) {
+	existed, err := m.from.Remove(fileId)
 	if err != nil {
+		return existed, err
+	}
+	removed, err := m.to.Remove(fileId)
+	if atomic.LoadInt32(&m.done) == 1 {
+		return removed, err
+	}
+	return existed, err
+}
+
+func (m *migratingIndex) Contains(fileId string) (bool, error) {
+	return m.current().Contains(fileId)
+}
+
+func (m *migratingIndex) Walk(prefix string, walker func(fileId string) bool) error {
+	return m.current().Walk(prefix, walker)
+}
+
+func (m *migratingIndex) Close() error {
+	if err := m.from.Close(); err != nil {
 		return err
 	}
+	return m.to.Close()
+}
 
-	dataset = set.NewDataSet(m, a)
+// migrate copies the fileIds from the source index if it is iterable,
+// or from the local binlogs otherwise, and switches reads to the target.
+//
+// Every fileId is written to the binlogs before it is added,
+// and fileIds added during the copy are written to both indexes,
+// so the target is complete when the copy finishes.
+func (m *migratingIndex) migrate() (int, error) {
+	copied := 0
+	var ids []string
+	err := m.from.Walk("", func(fileId string) bool {
+		ids = append(ids, fileId)
+		return true
+	})
+	if err == IndexNotIterableErr {
+		var addErr error
+		err = walkLocalBinlogs(func(bl *common.BingLogDTO) bool {
+			if coordinator.isShuttingDown() {
+				addErr = errors.New("server is shutting down")
+				return true
+			}
+			if addErr = m.to.Add(bl.FileId); addErr != nil {
+				return true
+			}
+			copied++
+			return false
+		})
+		if err == nil {
+			err = addErr
+		}
+	} else if err == nil {
+		for _, fileId := range ids {
+			if coordinator.isShuttingDown() {
+				return copied, errors.New("server is shutting down")
+			}
+			if err := m.to.Add(fileId); err != nil {
+				return copied, err
+			}
+			copied++
+		}
+	}
+	if err != nil {
+		return copied, err
+	}
+	if err := common.GetConfigMap().PutConfig(indexBackendKey, []byte(m.backend)); err != nil {
+		return copied, err
+	}
+	atomic.StoreInt32(&m.done, 1)
+	return copied, nil
+}
 
-	logger.Debug("dataset initializes success")
+// InitIndexMigration starts migrating the fileId index in background if the index backend changes,
+// an interrupted migration is started over on the next boot.
+func InitIndexMigration() {
+	m, ok := dataset.(*migratingIndex)
+	if !ok {
+		return
+	}
+	go func() {
+		n, err := m.migrate()
+		if err != nil {
+			logger.Error("error migrate fileId index, it is started over on the next boot: ", err)
+			return
+		}
+		logger.Info("fileId index is migrated to ", m.backend, ", ", n, " fileIds are copied")
+	}()
+}
 
-	return nil
+// closeDataSet closes the fileId index on shutdown.
+func closeDataSet() {
+	if dataset == nil {
+		return
+	}
+	if err := dataset.Close(); err != nil {
+		logger.Error("error close fileId index: ", err)
+	}
 }
 
 // Add adds fileId to dataset database.
 func Add(fileId string) error {
-	return dataset.Add([]byte(fileId))
+	return dataset.Add(fileId)
 }
 
 // Add removes fileId from dataset database.
 func Remove(fileId string) (bool, error) {
-	return dataset.Remove([]byte(fileId))
+	return dataset.Remove(fileId)
 }
 
 // Contains checks if the fileId exists in dataset database.
 func Contains(fileId string) (bool, error) {
-	return dataset.Contains([]byte(fileId))
+	return dataset.Contains(fileId)
 }
 
 // DoIfNotExist does work if the fileId not exists.
@@ -92,7 +422,7 @@ func DoIfNotExist(fileId string, work func() error) error {
 	writeLock.Lock()
 	defer writeLock.Unlock()
 
-	c, err := dataset.Contains([]byte(fileId))
+	c, err := dataset.Contains(fileId)
 	if err != nil {
 		return err
 	}
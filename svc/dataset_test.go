@@ -0,0 +1,102 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBoltIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idx, err := openBoltIndex(dir + "/fileid.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	for _, id := range []string{"G01/a", "G01/b", "G02/c"} {
+		if err := idx.Add(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, err := idx.Contains("G01/a"); err != nil || !c {
+		t.Fatal("fileId is not added: ", err)
+	}
+	if removed, err := idx.Remove("G01/a"); err != nil || !removed {
+		t.Fatal("fileId is not removed: ", err)
+	}
+	if c, _ := idx.Contains("G01/a"); c {
+		t.Fatal("removed fileId exists")
+	}
+	var walked []string
+	if err := idx.Walk("G01/", func(fileId string) bool {
+		walked = append(walked, fileId)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(walked, ",") != "G01/b" {
+		t.Fatal("unexpected walked fileIds: ", walked)
+	}
+}
+
+func TestMigrateIndex(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	defer writableBinlogManager.Close()
+
+	from := newTestSetIndex(t, dir)
+	to, err := openBoltIndex(dir + "/fileid.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+
+	id1, id2 := strings.Repeat("a", common.FILE_ID_SIZE), strings.Repeat("b", common.FILE_ID_SIZE)
+	if err := writableBinlogManager.Write(binlog.CreateLocalBinlog(id1, 1, "storage1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Add(id1); err != nil {
+		t.Fatal(err)
+	}
+	mi := &migratingIndex{from: from, to: to, backend: common.INDEX_BACKEND_BOLT}
+	// fileIds added during the migration are written to both indexes.
+	if err := mi.Add(id2); err != nil {
+		t.Fatal(err)
+	}
+	if err := mi.Walk("", func(string) bool { return true }); err != IndexNotIterableErr {
+		t.Fatal("expect reads answered by the set before migration")
+	}
+	n, err := mi.migrate()
+	if err != nil || n != 1 {
+		t.Fatal("unexpected migrated count: ", n, err)
+	}
+	for _, id := range []string{id1, id2} {
+		if c, err := to.Contains(id); err != nil || !c {
+			t.Fatal("fileId is not migrated: ", id, err)
+		}
+	}
+	if bs, _ := common.GetConfigMap().GetConfig(indexBackendKey); string(bs) != common.INDEX_BACKEND_BOLT {
+		t.Fatal("active index backend is not recorded: ", string(bs))
+	}
+	if activeIndexBackend(dir, common.INDEX_BACKEND_SET) != common.INDEX_BACKEND_BOLT {
+		t.Fatal("recorded index backend is not active")
+	}
+	if err := mi.Walk("", func(string) bool { return true }); err != nil {
+		t.Fatal("expect reads answered by the bolt index after migration: ", err)
+	}
+
+	// migrate back by walking the bolt index.
+	back := &migratingIndex{from: to, to: &setIndex{from.d}, backend: common.INDEX_BACKEND_SET}
+	if n, err := back.migrate(); err != nil || n != 2 {
+		t.Fatal("unexpected migrated count: ", n, err)
+	}
+}
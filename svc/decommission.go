@@ -0,0 +1,368 @@
+package svc
+
+import (
+	"container/list"
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// max blocking fileIds in the decommission status.
+	maxReportBlocking = 100
+	// retry interval of decommission when some files exist nowhere else.
+	decommissionRetryInterval = time.Second * 30
+)
+
+var (
+	decommissionStateKey = "decommissionState"
+	decommissionState    *common.DecommissionStatus
+	decommissionLock     = new(sync.Mutex)
+)
+
+// initDecommission restores the decommission state,
+// a decommissioned server stays out of the registry after restart.
+func initDecommission() {
+	bs, err := common.GetConfigMap().GetConfig(decommissionStateKey)
+	if err != nil || len(bs) == 0 {
+		return
+	}
+	state := &common.DecommissionStatus{}
+	if err := json.Unmarshal(bs, state); err != nil {
+		logger.Error("error load decommission state: ", err)
+		return
+	}
+	decommissionState = state
+	api.SetInstanceAttribute("readonly", "true")
+	if state.State == common.DECOMMISSION_DONE {
+		api.SetInstanceAttribute("drain", common.DRAIN_DECOMMISSIONED)
+		logger.Warn("this server is decommissioned")
+		return
+	}
+	api.SetInstanceAttribute("drain", common.DRAIN_DRAINING)
+	logger.Warn("this server is draining, continue decommission")
+	startDecommission(true)
+}
+
+// isDraining judges whether this server is draining or decommissioned.
+func isDraining() bool {
+	decommissionLock.Lock()
+	defer decommissionLock.Unlock()
+	return decommissionState != nil
+}
+
+// DecommissionStatus returns a copy of the decommission progress,
+// it returns nil if decommission is never started.
+func DecommissionStatus() *common.DecommissionStatus {
+	decommissionLock.Lock()
+	defer decommissionLock.Unlock()
+	if decommissionState == nil {
+		return nil
+	}
+	ret := *decommissionState
+	return &ret
+}
+
+// StartDecommission starts to decommission this server in background.
+//
+// The server goes readonly and draining, verifies that every local file
+// exists on at least one other group member, pushes the missing files
+// and then deregisters from trackers.
+func StartDecommission() *common.DecommissionStatus {
+	return startDecommission(false)
+}
+
+func startDecommission(resume bool) *common.DecommissionStatus {
+	decommissionLock.Lock()
+	if decommissionState != nil && !resume {
+		ret := *decommissionState
+		decommissionLock.Unlock()
+		return &ret
+	}
+	decommissionState = &common.DecommissionStatus{
+		State:     common.DECOMMISSION_RUNNING,
+		StartTime: gox.GetTimestamp(time.Now()),
+	}
+	ret := *decommissionState
+	decommissionLock.Unlock()
+
+	logger.Info("decommission begin")
+	saveDecommissionState()
+	go runDecommission()
+	return &ret
+}
+
+// updateDecommissionState updates the decommission progress.
+func updateDecommissionState(update func(s *common.DecommissionStatus)) {
+	decommissionLock.Lock()
+	defer decommissionLock.Unlock()
+	update(decommissionState)
+}
+
+func saveDecommissionState() {
+	state := DecommissionStatus()
+	if state == nil {
+		return
+	}
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err := common.GetConfigMap().PutConfig(decommissionStateKey, bs); err != nil {
+		logger.Error("error save decommission state: ", err)
+	}
+}
+
+// notifyTrackers sends the latest instance info to all trackers.
+func notifyTrackers(deregister bool) error {
+	var lastErr error
+	trackers := parsedTrackers()
+	for i := range trackers {
+		server := &trackers[i]
+		var err error
+		if deregister {
+			err = clientAPI.Deregister(server)
+		} else {
+			err = clientAPI.UpdateInstance(server)
+		}
+		if err != nil {
+			logger.Error("error notify tracker server ", server.ConnectionString(), ": ", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// runDecommission runs decommission rounds until
+// no local file is held by this server only.
+func runDecommission() {
+	api.SetInstanceAttribute("readonly", "true")
+	api.SetInstanceAttribute("drain", common.DRAIN_DRAINING)
+	for {
+		if clientAPI != nil && notifyTrackers(false) == nil {
+			break
+		}
+		time.Sleep(decommissionRetryInterval)
+	}
+
+	for {
+		blocking, err := decommissionRound()
+		if err == nil && blocking == 0 {
+			// members answer fileId lists from their cached digest tree,
+			// so the files are verified one by one before deregistration.
+			blocking, err = verifyDecommission()
+		}
+		if err == nil && blocking == 0 {
+			break
+		}
+		updateDecommissionState(func(s *common.DecommissionStatus) {
+			s.State = common.DECOMMISSION_BLOCKED
+			if err != nil {
+				s.Message = err.Error()
+			} else {
+				s.Message = "some files exist on this server only, retry later"
+			}
+		})
+		saveDecommissionState()
+		logger.Warn("decommission is blocked: ", gox.TValue(err != nil, err, blocking))
+		time.Sleep(decommissionRetryInterval)
+	}
+
+	// trackers will refuse registration of this server from now on.
+	api.SetInstanceAttribute("drain", common.DRAIN_DECOMMISSIONED)
+	notifyTrackers(true)
+	updateDecommissionState(func(s *common.DecommissionStatus) {
+		s.State = common.DECOMMISSION_DONE
+		s.EndTime = gox.GetTimestamp(time.Now())
+		s.Message = "decommission finished"
+	})
+	saveDecommissionState()
+	logger.Info("decommission finished")
+}
+
+// decommissionRound verifies local files with group members once,
+// the files which exist nowhere else are pushed to a member.
+//
+// It returns the count of files which cannot be pushed.
+func decommissionRound() (int, error) {
+	members, err := decommissionMembers()
+	if err != nil {
+		return 0, err
+	}
+	local, err := buildFileIdDigestTree()
+	if err != nil {
+		return 0, err
+	}
+	var prefixes []string
+	for p := range local.leaves {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	updateDecommissionState(func(s *common.DecommissionStatus) {
+		s.State = common.DECOMMISSION_RUNNING
+		s.Round++
+		s.Total = local.total
+		s.Checked = 0
+		s.Missing = 0
+		s.BlockingCount = 0
+		s.Blocking = nil
+		s.Message = ""
+	})
+
+	blocking := 0
+	for _, batch := range batchPrefixes(prefixes, maxListPrefixes) {
+		remote := make(map[string]bool)
+		gox.WalkList(members, func(item interface{}) bool {
+			server := &item.(*common.Instance).Server
+			bls, err := clientAPI.ListFileIds(server, batch)
+			if err != nil {
+				logger.Debug("decommission: error list fileIds from server ",
+					server.ConnectionString(), ": ", err)
+				return false
+			}
+			for _, bl := range bls {
+				remote[bl.FileId] = true
+			}
+			return false
+		})
+		bls := local.list(batch)
+		for i := range bls {
+			bl := &bls[i]
+			if remote[bl.FileId] {
+				continue
+			}
+			updateDecommissionState(func(s *common.DecommissionStatus) {
+				s.Missing++
+			})
+			if pushFile(bl, members) {
+				updateDecommissionState(func(s *common.DecommissionStatus) {
+					s.Pushed++
+				})
+				continue
+			}
+			blocking++
+			addDecommissionBlocking(bl.FileId)
+		}
+		updateDecommissionState(func(s *common.DecommissionStatus) {
+			s.Checked += len(bls)
+		})
+	}
+	return blocking, nil
+}
+
+// verifyDecommission probes every local file on group members,
+// which is answered from disk instead of the cached digest tree,
+// and pushes the files which exist nowhere else.
+//
+// It returns the count of files which cannot be pushed.
+func verifyDecommission() (int, error) {
+	members, err := decommissionMembers()
+	if err != nil {
+		return 0, err
+	}
+	local, err := buildFileIdDigestTree()
+	if err != nil {
+		return 0, err
+	}
+	var prefixes []string
+	for p := range local.leaves {
+		prefixes = append(prefixes, p)
+	}
+	bls := local.list(prefixes)
+
+	updateDecommissionState(func(s *common.DecommissionStatus) {
+		s.Total = local.total
+		s.Checked = 0
+		s.Message = "verifying files on group members"
+	})
+	blocking := 0
+	for i := range bls {
+		bl := &bls[i]
+		updateDecommissionState(func(s *common.DecommissionStatus) {
+			s.Checked++
+		})
+		if replicatedOnMembers(bl.FileId, members) {
+			continue
+		}
+		updateDecommissionState(func(s *common.DecommissionStatus) {
+			s.Missing++
+		})
+		if pushFile(bl, members) {
+			updateDecommissionState(func(s *common.DecommissionStatus) {
+				s.Pushed++
+			})
+			continue
+		}
+		blocking++
+		addDecommissionBlocking(bl.FileId)
+	}
+	return blocking, nil
+}
+
+// decommissionMembers returns the group members which can hold the files of this server,
+// draining members are not the destination of files.
+func decommissionMembers() (*list.List, error) {
+	members := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE),
+		common.InitializedStorageConfiguration.Group)
+	for ele := members.Front(); ele != nil; {
+		next := ele.Next()
+		if ele.Value.(*common.Instance).Attributes["drain"] != "" {
+			members.Remove(ele)
+		}
+		ele = next
+	}
+	if members.Len() == 0 {
+		return nil, errors.New("no other group member available")
+	}
+	return members, nil
+}
+
+// replicatedOnMembers judges whether one of the members holds the file.
+func replicatedOnMembers(fileId string, members *list.List) bool {
+	exists := false
+	gox.WalkList(members, func(item interface{}) bool {
+		server := &item.(*common.Instance).Server
+		r, err := clientAPI.ProbeFile(server, fileId)
+		if err != nil {
+			logger.Debug("decommission: error probe file ", fileId, " on server ",
+				server.ConnectionString(), ": ", err)
+			return false
+		}
+		exists = r.Exists
+		return exists
+	})
+	return exists
+}
+
+func addDecommissionBlocking(fileId string) {
+	updateDecommissionState(func(s *common.DecommissionStatus) {
+		s.BlockingCount++
+		if len(s.Blocking) < maxReportBlocking {
+			s.Blocking = append(s.Blocking, fileId)
+		}
+	})
+}
+
+// pushFile asks group members to synchronize the file from this server
+// until one of them succeeds.
+func pushFile(bl *common.BingLogDTO, members *list.List) bool {
+	pushed := false
+	gox.WalkList(members, func(item interface{}) bool {
+		ins := item.(*common.Instance)
+		if err := clientAPI.ReplicateFile(&ins.Server, bl); err != nil {
+			logger.Debug("decommission: error push file ", bl.FileId, " to server ",
+				ins.Server.ConnectionString(), ": ", err)
+			return false
+		}
+		pushed = true
+		return true
+	})
+	return pushed
+}
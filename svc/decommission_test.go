@@ -0,0 +1,47 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	json "github.com/json-iterator/go"
+	"testing"
+)
+
+func TestRegisterDecommissionedInstance(t *testing.T) {
+	ins := &common.Instance{
+		Server: common.Server{
+			Host:       "127.0.0.1",
+			Port:       10706,
+			InstanceId: "decomm01",
+		},
+		Role:       common.ROLE_TRACKER,
+		Attributes: map[string]string{},
+	}
+	if err := registerInstance(ins); err != nil {
+		t.Fatal(err)
+	}
+	if reg.InstanceSetSnapshot()["decomm01"] == nil {
+		t.Fatal("instance is not registered")
+	}
+
+	info, _ := json.MarshalToString(&common.Instance{
+		Server: common.Server{InstanceId: "decomm02"},
+	})
+	h, _, _, _ := updateInstanceHandler(&common.Header{
+		Attributes: map[string]string{"instance": info},
+	}, ins)
+	if h.Result != common.ERROR {
+		t.Fatal("instance of another connection is updated")
+	}
+
+	info = `{"host":"127.0.0.1","port":10706,"instanceId":"decomm01","role":1,"ats":{"drain":"decommissioned"}}`
+	h, _, _, _ = updateInstanceHandler(&common.Header{
+		Attributes: map[string]string{"instance": info},
+	}, ins)
+	if h.Result != common.SUCCESS {
+		t.Fatal("error update instance: ", h.Msg)
+	}
+	if reg.InstanceSetSnapshot()["decomm01"] != nil {
+		t.Fatal("decommissioned instance is still registered")
+	}
+}
@@ -0,0 +1,17 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/util"
+)
+
+// RunRotateMasterKey re-wraps the data keys of the stopped storage server by the new master key,
+// and returns the number of data keys re-wrapped.
+//
+// A running server may create data keys wrapped by the old master key during the rotation,
+// which cannot be unwrapped after it restarts with the new one.
+func RunRotateMasterKey(dataDir, oldKeyFile, newKeyFile string) (int, error) {
+	if err := checkStorageStopped(dataDir); err != nil {
+		return 0, err
+	}
+	return util.RotateMasterKey(dataDir, oldKeyFile, newKeyFile)
+}
@@ -0,0 +1,126 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"time"
+)
+
+// parseExpireTime parses the expire time of an uploading file
+// from the ttl(in seconds) or the absolute expire time(unix seconds),
+// it returns 0 if neither is provided.
+func parseExpireTime(ttl, expireAt string, now time.Time) (int64, error) {
+	if ttl != "" && expireAt != "" {
+		return 0, errors.New("ttl and expireAt cannot be used together")
+	}
+	if ttl != "" {
+		s, err := convert.StrToInt64(ttl)
+		if err != nil || s <= 0 {
+			return 0, errors.New("invalid ttl \"" + ttl + "\", ttl must be positive seconds")
+		}
+		return now.Unix() + s, nil
+	}
+	if expireAt != "" {
+		t, err := convert.StrToInt64(expireAt)
+		if err != nil || t <= now.Unix() {
+			return 0, errors.New("invalid expireAt \"" + expireAt + "\", expireAt must be unix seconds in the future")
+		}
+		return t, nil
+	}
+	return 0, nil
+}
+
+// fileExpired judges whether the fileId is expired.
+func fileExpired(fileId string) bool {
+	return getFileMeta(fileId).Expired(time.Now())
+}
+
+// InitFileReaper starts a timer job which drops the expired files.
+//
+// The metadata of reaped files is kept,
+// so that downloading them is told apart from unknown files.
+func InitFileReaper() {
+	timer.Start(common.FILE_REAP_INTERVAL, common.FILE_REAP_INTERVAL, 0, func(t *timer.Timer) {
+		if coordinator.isShuttingDown() {
+			return
+		}
+		if n := reapExpiredFiles(time.Now()); n > 0 {
+			logger.Info(n, " expired files are reaped")
+		}
+	})
+}
+
+// reapExpiredFiles reaps the files expired before the time,
+// and returns the number of reaped files.
+func reapExpiredFiles(now time.Time) int {
+	reaped := 0
+	for {
+		fileIds, err := common.GetConfigMap().ExpiredFileIds(now, common.FILE_REAP_BATCH_SIZE)
+		if err != nil {
+			logger.Error("error query expired files: ", err)
+			return reaped
+		}
+		for _, fileId := range fileIds {
+			if err := reapFile(fileId); err != nil {
+				logger.Error("error reap expired file ", fileId, ": ", err)
+				return reaped
+			}
+			reaped++
+		}
+		if len(fileIds) < common.FILE_REAP_BATCH_SIZE {
+			return reaped
+		}
+	}
+}
+
+// reapFile releases the blob reference of the expired fileId and marks it reaped.
+func reapFile(fileId string) error {
+	meta, err := common.GetConfigMap().GetFileMeta(fileId)
+	if err != nil || meta == nil {
+		return err
+	}
+	if meta.Referenced {
+		fInfo, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			return err
+		}
+		if err := releaseBlob(util.GetFileRelativePath(fInfo)); err != nil {
+			return err
+		}
+	}
+	logger.Debug("file expired: ", fileId)
+	meta.Referenced = false
+	meta.Reaped = true
+	return common.GetConfigMap().PutFileMeta(fileId, meta)
+}
+
+// releaseBlob decreases the reference count of the blob,
+// and deletes the blob if it is no longer referenced.
+func releaseBlob(rel string) error {
+	defer lockBlob(rel)()
+
+	if err := updateFileReferenceCount(rel, -1); err != nil {
+		if err == common.NotFoundErr {
+			return nil
+		}
+		return err
+	}
+	blob, err := util.OpenBlob(rel)
+	if err == common.NotFoundErr {
+		// packed blobs are reclaimed by volume compaction.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	refCount := blob.RefCount
+	blob.Close()
+	if refCount > 0 {
+		return nil
+	}
+	return util.RemoveBlob(rel)
+}
@@ -0,0 +1,85 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseExpireTime(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cases := []struct {
+		ttl      string
+		expireAt string
+		expect   int64
+		err      bool
+	}{
+		{"", "", 0, false},
+		{"60", "", 1060, false},
+		{"", "2000", 2000, false},
+		{"0", "", 0, true},
+		{"abc", "", 0, true},
+		{"", "1000", 0, true},
+		{"60", "2000", 0, true},
+	}
+	for _, c := range cases {
+		ret, err := parseExpireTime(c.ttl, c.expireAt, now)
+		if (err != nil) != c.err || ret != c.expect {
+			t.Fatal("unexpected result of ", c.ttl, "/", c.expireAt, ": ", ret, err)
+		}
+	}
+}
+
+func TestReapExpiredFiles(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+
+	// the blob is referenced by 3 fileIds.
+	os.MkdirAll(dir+"/0A/1B", 0755)
+	blob := dir + "/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d"
+	if err := ioutil.WriteFile(blob, []byte{'a', 'b', 'c', 0, 0, 0, 3}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	path := "G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d"
+	expired1 := util.CreateAlias(path, "aaaaaaaa", true, now)
+	expired2 := util.CreateAlias(path, "bbbbbbbb", true, now)
+	alive := util.CreateAlias(path, "cccccccc", true, now)
+	saveFileMeta(expired1, &common.FileMeta{ExpireTime: now.Unix() - 10}, true)
+	saveFileMeta(alive, &common.FileMeta{ExpireTime: now.Unix() + 3600}, true)
+	// the fileId does not hold a reference if it is never synchronized.
+	saveFileMeta(expired2, &common.FileMeta{ExpireTime: now.Unix() - 5}, false)
+
+	if !fileExpired(expired1) || fileExpired(alive) {
+		t.Fatal("unexpected expiry state")
+	}
+	if n := reapExpiredFiles(now); n != 2 {
+		t.Fatal("expect 2 files reaped, got ", n)
+	}
+	if meta := getFileMeta(expired1); meta == nil || !meta.Reaped || meta.Referenced {
+		t.Fatal("expired file is not marked reaped: ", meta)
+	}
+	b, err := util.OpenBlob("0A/1B/e92c1c72e7fff2801c7d4af5b154f88d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.RefCount != 2 {
+		t.Fatal("expect reference count 2, got ", b.RefCount)
+	}
+	b.Close()
+	if n := reapExpiredFiles(now); n != 0 {
+		t.Fatal("reaped files are reaped again: ", n)
+	}
+
+	// the blob is deleted when the last references expire.
+	updateFileReferenceCount("0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", -1)
+	if n := reapExpiredFiles(now.Add(time.Hour * 2)); n != 1 {
+		t.Fatal("expect 1 file reaped, got ", n)
+	}
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatal("blob is not deleted: ", err)
+	}
+}
@@ -0,0 +1,237 @@
+package svc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// InvalidCursorErr is returned when the cursor of listing files is not issued by the server.
+var InvalidCursorErr = errors.New("invalid cursor")
+
+const (
+	listCursorPositionSize = 16 // file index and offset of the binlog
+	listCursorMacSize      = 16
+)
+
+// encodeListCursor encodes the binlog position as a cursor,
+// which is signed by the secret of the server so that only issued positions are read.
+func encodeListCursor(position *common.BinlogQueryDTO) string {
+	bs := make([]byte, listCursorPositionSize)
+	convert.Length2Bytes(int64(position.FileIndex), bs[:8])
+	convert.Length2Bytes(position.Offset, bs[8:])
+	return base64.RawURLEncoding.EncodeToString(append(bs, listCursorMac(bs)...))
+}
+
+// decodeListCursor decodes the binlog position of the cursor,
+// empty cursor is the beginning of the binlogs.
+//
+// A cursor which is malformed or not signed by the secret of the server is rejected,
+// for a crafted offset may point into the middle of a binlog.
+func decodeListCursor(cursor string) (*common.BinlogQueryDTO, error) {
+	if cursor == "" {
+		return &common.BinlogQueryDTO{}, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(bs) != listCursorPositionSize+listCursorMacSize {
+		return nil, InvalidCursorErr
+	}
+	if !hmac.Equal(bs[listCursorPositionSize:], listCursorMac(bs[:listCursorPositionSize])) {
+		return nil, InvalidCursorErr
+	}
+	position := &common.BinlogQueryDTO{
+		FileIndex: int(convert.Bytes2Length(bs[:8])),
+		Offset:    convert.Bytes2Length(bs[8:listCursorPositionSize]),
+	}
+	if position.FileIndex < 0 || position.Offset < 0 {
+		return nil, InvalidCursorErr
+	}
+	return position, nil
+}
+
+// listCursorMac signs the binlog position of a cursor.
+func listCursorMac(position []byte) []byte {
+	h := hmac.New(sha256.New, []byte(adminSecret()))
+	h.Write(position)
+	return h.Sum(nil)[:listCursorMacSize]
+}
+
+// listFiles pages through the files in binlog order from the cursor of the query,
+// expired files are skipped.
+//
+// The page may be shorter than the limit if too many binlogs are filtered out,
+// the listing ends when HasMore of the result is false.
+func listFiles(query *common.FileListQuery, now time.Time) (*common.FileListResult, error) {
+	position, err := decodeListCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = common.LIST_DEFAULT_LIMIT
+	} else if limit > common.LIST_MAX_LIMIT {
+		limit = common.LIST_MAX_LIMIT
+	}
+	ret := &common.FileListResult{
+		Files:   []common.FileEntry{},
+		HasMore: true,
+	}
+	scanned := 0
+	for len(ret.Files) < limit && scanned < common.LIST_SCAN_LIMIT {
+		// a batch never exceeds the remaining count, so that the page ends at the batch end.
+		bls, nOffset, err := writableBinlogManager.Read(position.FileIndex, position.Offset, limit-len(ret.Files))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(bls) == 0 {
+			// binlog files are not written any more once the next one is created.
+			if _, _, err := writableBinlogManager.Read(position.FileIndex+1, 0, 1); os.IsNotExist(err) {
+				ret.HasMore = false
+				break
+			}
+			position.FileIndex++
+			position.Offset = 0
+			continue
+		}
+		scanned += len(bls)
+		position.Offset = nOffset
+		for i := range bls {
+			if entry := filterListedFile(&bls[i], query, now); entry != nil {
+				ret.Files = append(ret.Files, *entry)
+			}
+		}
+	}
+	ret.Cursor = encodeListCursor(position)
+	return ret, nil
+}
+
+// filterListedFile returns the entry of the binlog if it matches the query.
+func filterListedFile(bl *common.BingLogDTO, query *common.FileListQuery, now time.Time) *common.FileEntry {
+	if bl.ExpireTime > 0 && bl.ExpireTime <= now.Unix() {
+		return nil
+	}
+	if query.Source != "" && bl.SourceInstance != query.Source {
+		return nil
+	}
+	fInfo, _, err := util.ParseAlias(bl.FileId, "")
+	if err != nil {
+		logger.Debug("list: skip invalid fileId ", bl.FileId)
+		return nil
+	}
+	if (query.Group != "" && fInfo.Group != query.Group) ||
+		(query.From > 0 && fInfo.CreateTime < query.From) ||
+		(query.To > 0 && fInfo.CreateTime >= query.To) {
+		return nil
+	}
+	return &common.FileEntry{
+		FileId:     bl.FileId,
+		Group:      fInfo.Group,
+		InstanceId: bl.SourceInstance,
+		FileLength: bl.FileLength,
+		CreateTime: fInfo.CreateTime,
+		ExpireTime: bl.ExpireTime,
+		Meta:       bl.Meta,
+	}
+}
+
+// listFilesHandler responses a page of the listed files as body,
+// it is served by both storage servers and tracker servers.
+func listFilesHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	query := &common.FileListQuery{}
+	if header.Attributes == nil || json.UnmarshalFromString(header.Attributes["query"], query) != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	ret, err := listFiles(query, time.Now())
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error list files: " + err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// httpListFiles responses a page of the listed files in json,
+// which are filtered by query parameters "group", "source", "from" and "to"(unix seconds),
+// for example:
+//
+//	GET /files?group=G01&from=1577836800&limit=100&cursor=<cursor of the last page>
+func httpListFiles(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var secret string
+	if common.BootAs == common.BOOT_TRACKER {
+		secret = common.InitializedTrackerConfiguration.Secret
+	} else {
+		secret = common.InitializedStorageConfiguration.Secret
+	}
+	if !checkAdminSecret(r, secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	qs := r.URL.Query()
+	query := &common.FileListQuery{
+		Group:  strings.TrimSpace(qs.Get("group")),
+		Source: strings.TrimSpace(qs.Get("source")),
+		Cursor: strings.TrimSpace(qs.Get("cursor")),
+	}
+	var err error
+	for k, v := range map[string]*int64{"from": &query.From, "to": &query.To} {
+		if s := strings.TrimSpace(qs.Get(k)); s != "" {
+			if *v, err = convert.StrToInt64(s); err != nil {
+				util.HttpWriteResponse(w, http.StatusBadRequest, "invalid "+k+": "+s)
+				return
+			}
+		}
+	}
+	if s := strings.TrimSpace(qs.Get("limit")); s != "" {
+		if query.Limit, err = convert.StrToInt(s); err != nil {
+			util.HttpWriteResponse(w, http.StatusBadRequest, "invalid limit: "+s)
+			return
+		}
+	}
+
+	ret, err := listFiles(query, time.Now())
+	if err == InvalidCursorErr {
+		util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	retJSON, err := json.Marshal(ret)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
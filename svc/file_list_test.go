@@ -0,0 +1,92 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"testing"
+	"time"
+)
+
+func TestListFiles(t *testing.T) {
+	_, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	defer writableBinlogManager.Close()
+
+	now := time.Unix(1577836800, 0)
+	files := []struct {
+		group    string
+		source   string
+		created  time.Time
+		expireAt int64
+	}{
+		{"G01", "storage1", now, 0},
+		{"G02", "storage2", now, 0},
+		{"G01", "storage2", now.Add(time.Hour), 0},
+		{"G01", "storage1", now.Add(time.Hour), now.Unix()},
+		{"G01", "storage1", now.Add(time.Hour * 2), 0},
+	}
+	var fileIds []string
+	for _, f := range files {
+		fileId := util.CreateAlias(f.group+"/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", f.source, false, f.created)
+		bl := binlog.CreateLocalBinlog(fileId, 3, f.source)
+		bl.ExpireTime = f.expireAt
+		if err := writableBinlogManager.Write(bl); err != nil {
+			t.Fatal(err)
+		}
+		fileIds = append(fileIds, fileId)
+	}
+
+	// pages through all files, the expired file is skipped.
+	var listed []string
+	query := &common.FileListQuery{Limit: 2}
+	for i := 0; ; i++ {
+		ret, err := listFiles(query, now.Add(time.Hour*3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range ret.Files {
+			listed = append(listed, f.FileId)
+		}
+		query.Cursor = ret.Cursor
+		if !ret.HasMore {
+			break
+		}
+		if i > 5 {
+			t.Fatal("listing does not end")
+		}
+	}
+	if len(listed) != 4 || listed[0] != fileIds[0] || listed[2] != fileIds[2] || listed[3] != fileIds[4] {
+		t.Fatal("unexpected listed files: ", listed)
+	}
+
+	// files written after the last page are listed by its cursor.
+	fileId := util.CreateAlias("G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", "storage3", false, now)
+	if err := writableBinlogManager.Write(binlog.CreateLocalBinlog(fileId, 3, "storage3")); err != nil {
+		t.Fatal(err)
+	}
+	ret, err := listFiles(query, now)
+	if err != nil || len(ret.Files) != 1 || ret.Files[0].FileId != fileId || ret.Files[0].InstanceId != "storage3" {
+		t.Fatal("unexpected files after the cursor: ", ret, err)
+	}
+
+	ret, err = listFiles(&common.FileListQuery{
+		Group:  "G01",
+		Source: "storage1",
+		From:   now.Unix(),
+		To:     now.Add(time.Hour * 2).Unix(),
+	}, now)
+	if err != nil || len(ret.Files) != 1 || ret.Files[0].FileId != fileIds[0] || ret.HasMore {
+		t.Fatal("unexpected filtered files: ", ret, err)
+	}
+
+	// cursors which are not issued by the server are rejected.
+	forged := encodeListCursor(&common.BinlogQueryDTO{Offset: 7})
+	common.InitializedStorageConfiguration.Secret = "654321"
+	for _, cursor := range []string{"invalid", query.Cursor[:22], forged} {
+		if _, err := listFiles(&common.FileListQuery{Cursor: cursor}, now); err != InvalidCursorErr {
+			t.Fatal("expect invalid cursor, got ", err)
+		}
+	}
+}
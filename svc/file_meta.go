@@ -0,0 +1,185 @@
+package svc
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// names of custom file attributes, which are also used in http headers.
+var fileAttributeNamePattern = regexp.MustCompile("^[0-9A-Za-z_-]{1,64}$")
+
+// customFileAttributes collects the custom attributes of an uploading file
+// from the parameters prefixed with "meta-", for example "meta-author=godfs".
+func customFileAttributes(params map[string]string) (map[string]string, error) {
+	var ret map[string]string
+	for k, v := range params {
+		if !strings.HasPrefix(k, common.FILE_META_ATTRIBUTE_PREFIX) {
+			continue
+		}
+		name := k[len(common.FILE_META_ATTRIBUTE_PREFIX):]
+		if !fileAttributeNamePattern.MatchString(name) {
+			return nil, errors.New("invalid attribute name \"" + name + "\"")
+		}
+		if ret == nil {
+			ret = make(map[string]string)
+		}
+		ret[name] = v
+	}
+	return ret, nil
+}
+
+// queryFileAttributes collects the custom attributes of uploading files from the query.
+func queryFileAttributes(qs url.Values) (map[string]string, error) {
+	params := make(map[string]string)
+	for k := range qs {
+		params[k] = qs.Get(k)
+	}
+	return customFileAttributes(params)
+}
+
+// prepareFileMeta completes the metadata of an uploaded file,
+// the content type is detected by the name and the content of the tmp file if it is not given.
+func prepareFileMeta(meta *common.FileMeta, tmpFileName string) error {
+	if meta.ContentType == "" {
+		contentType, err := detectContentType(tmpFileName, meta.Name, meta.Size)
+		if err != nil {
+			return err
+		}
+		meta.ContentType = contentType
+	}
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if len(bs) > common.MAX_FILE_META_SIZE {
+		return errors.New("file metadata exceeds " + convert.IntToStr(common.MAX_FILE_META_SIZE) + " bytes")
+	}
+	return nil
+}
+
+// detectContentType detects the mime type of the tmp file,
+// the content of which is followed by the reference count tail.
+func detectContentType(tmpFileName, name string, size int64) (string, error) {
+	f, err := os.Open(tmpFileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	if size < int64(len(head)) {
+		head = head[:size]
+	}
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return "", err
+	}
+	return common.DetectMimeType(name, head), nil
+}
+
+// getFileMeta returns the metadata of the fileId, or nil if there is none.
+func getFileMeta(fileId string) *common.FileMeta {
+	meta, err := common.GetConfigMap().GetFileMeta(fileId)
+	if err != nil {
+		logger.Debug("error get file meta of ", fileId, ": ", err)
+		return nil
+	}
+	return meta
+}
+
+// saveFileMeta saves the metadata of the fileId,
+// referenced marks that the fileId holds a reference of the blob on this server,
+// which is released when the file is reaped.
+//
+// The metadata of a fileId never changes,
+// so only the reference mark of saved metadata is updated.
+func saveFileMeta(fileId string, meta *common.FileMeta, referenced bool) error {
+	if meta == nil {
+		return nil
+	}
+	cm := common.GetConfigMap()
+	old, err := cm.GetFileMeta(fileId)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		if old.Reaped || old.Referenced || !referenced {
+			return nil
+		}
+		old.Referenced = true
+		return cm.PutFileMeta(fileId, old)
+	}
+	meta = meta.Public()
+	meta.Referenced = referenced
+	return cm.PutFileMeta(fileId, meta)
+}
+
+// binlogFileMeta returns the metadata carried by the binlog,
+// binlogs of old versions carry the expire time only.
+func binlogFileMeta(bl *common.BingLogDTO) *common.FileMeta {
+	if bl.Meta != nil {
+		meta := bl.Meta.Public()
+		meta.ExpireTime = bl.ExpireTime
+		return meta
+	}
+	if bl.ExpireTime > 0 {
+		return &common.FileMeta{ExpireTime: bl.ExpireTime}
+	}
+	return nil
+}
+
+// describeFile fills the stored state and the metadata of a local file.
+func describeFile(fileInfo *common.FileInfo, meta *common.FileMeta) error {
+	blob, err := util.OpenBlob(util.GetFileRelativePath(fileInfo))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	fileInfo.FileLength = util.OpenContent(blob).Size()
+	// the blob is named by the md5 of the content.
+	fileInfo.Md5 = path.Base(fileInfo.Path)
+	fileInfo.RefCount = blob.RefCount
+	fileInfo.ModTime = blob.ModTime.Unix()
+	if meta != nil {
+		fileInfo.ExpireTime = meta.ExpireTime
+		fileInfo.Meta = meta.Public()
+	}
+	return nil
+}
+
+// setFileMetaHeaders sets the response headers of downloading a file by its metadata,
+// the content type and the file name are used unless they are given by the request.
+func setFileMetaHeaders(headers http.Header, meta *common.FileMeta, useName bool) {
+	if meta == nil {
+		return
+	}
+	if useName {
+		if meta.ContentType != "" {
+			headers.Set("Content-Type", meta.ContentType)
+		}
+		if meta.Name != "" {
+			headers.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": meta.Name}))
+		}
+	}
+	if meta.Md5 != "" {
+		headers.Set("X-Godfs-Md5", meta.Md5)
+	}
+	if meta.UploadTime > 0 {
+		headers.Set("X-Godfs-Upload-Time", convert.Int64ToStr(meta.UploadTime))
+	}
+	if meta.ExpireTime > 0 {
+		headers.Set("X-Godfs-Expire-Time", convert.Int64ToStr(meta.ExpireTime))
+	}
+	for k, v := range meta.Attributes {
+		headers.Set("X-Godfs-Meta-"+k, v)
+	}
+}
@@ -0,0 +1,110 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestCustomFileAttributes(t *testing.T) {
+	attributes, err := customFileAttributes(map[string]string{
+		"isPrivate":   "1",
+		"meta-author": "godfs",
+		"meta-tag_1":  "doc",
+	})
+	if err != nil || len(attributes) != 2 || attributes["author"] != "godfs" || attributes["tag_1"] != "doc" {
+		t.Fatal("unexpected attributes: ", attributes, err)
+	}
+	if attributes, _ := customFileAttributes(map[string]string{"ttl": "60"}); attributes != nil {
+		t.Fatal("expect no attributes, got ", attributes)
+	}
+	for _, name := range []string{"meta-", "meta-a b", "meta-a:b"} {
+		if _, err := customFileAttributes(map[string]string{name: "x"}); err == nil {
+			t.Fatal("expect invalid attribute name: ", name)
+		}
+	}
+}
+
+func TestPrepareFileMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := dir + "/tmp"
+	content := []byte("<html><body>godfs</body></html>")
+	if err := ioutil.WriteFile(tmp, append(content, tailRefCount...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	meta := &common.FileMeta{Size: int64(len(content))}
+	if err := prepareFileMeta(meta, tmp); err != nil || meta.ContentType != "text/html" {
+		t.Fatal("unexpected content type ", meta.ContentType, ": ", err)
+	}
+	meta = &common.FileMeta{Name: "a.png", Size: int64(len(content))}
+	if err := prepareFileMeta(meta, tmp); err != nil || meta.ContentType != "image/png" {
+		t.Fatal("unexpected content type ", meta.ContentType, ": ", err)
+	}
+	meta = &common.FileMeta{Name: "a.png", ContentType: "text/plain", Size: int64(len(content))}
+	if err := prepareFileMeta(meta, tmp); err != nil || meta.ContentType != "text/plain" {
+		t.Fatal("given content type is changed: ", meta.ContentType, err)
+	}
+	meta = &common.FileMeta{Name: string(make([]byte, common.MAX_FILE_META_SIZE)), ContentType: "text/plain"}
+	if err := prepareFileMeta(meta, tmp); err == nil {
+		t.Fatal("expect error of too large metadata")
+	}
+}
+
+func TestSaveFileMeta(t *testing.T) {
+	_, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+
+	fileId := "G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d"
+	if err := saveFileMeta(fileId, nil, true); err != nil || getFileMeta(fileId) != nil {
+		t.Fatal("nil meta should not be saved: ", err)
+	}
+	bl := &common.BingLogDTO{
+		FileId: fileId,
+		Meta:   &common.FileMeta{Name: "a.txt", ContentType: "text/plain", Referenced: true},
+	}
+	if err := saveFileMeta(fileId, binlogFileMeta(bl), false); err != nil {
+		t.Fatal(err)
+	}
+	meta := getFileMeta(fileId)
+	if meta == nil || meta.Name != "a.txt" || meta.Referenced {
+		t.Fatal("unexpected file meta: ", meta)
+	}
+	// the metadata is kept and the reference is marked.
+	if err := saveFileMeta(fileId, &common.FileMeta{Name: "b.txt"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if meta = getFileMeta(fileId); meta.Name != "a.txt" || !meta.Referenced {
+		t.Fatal("unexpected file meta: ", meta)
+	}
+	if binlogFileMeta(&common.BingLogDTO{FileId: fileId}) != nil {
+		t.Fatal("expect nil meta of binlogs without metadata")
+	}
+}
+
+func TestSetFileMetaHeaders(t *testing.T) {
+	meta := &common.FileMeta{
+		Name:        "报告 1.pdf",
+		ContentType: "application/pdf",
+		Md5:         "e92c1c72e7fff2801c7d4af5b154f88d",
+		Attributes:  map[string]string{"author": "godfs"},
+	}
+	headers := http.Header{}
+	setFileMetaHeaders(headers, meta, true)
+	if headers.Get("Content-Type") != "application/pdf" ||
+		headers.Get("Content-Disposition") != "inline; filename*=utf-8''%E6%8A%A5%E5%91%8A%201.pdf" ||
+		headers.Get("X-Godfs-Md5") != meta.Md5 || headers.Get("X-Godfs-Meta-Author") != "godfs" {
+		t.Fatal("unexpected headers: ", headers)
+	}
+	headers = http.Header{}
+	setFileMetaHeaders(headers, meta, false)
+	if headers.Get("Content-Type") != "" || headers.Get("Content-Disposition") != "" {
+		t.Fatal("metadata overrides the requested file name: ", headers)
+	}
+}
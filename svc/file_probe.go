@@ -0,0 +1,126 @@
+package svc
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox"
+	json "github.com/json-iterator/go"
+	"io"
+	"time"
+)
+
+// inspectFile describes the file stored on this server,
+// with the state of the replicas on the servers which should hold a copy.
+func inspectFile(fileInfo *common.FileInfo, fileId string, meta *common.FileMeta) error {
+	if err := describeFile(fileInfo, meta); err != nil {
+		return err
+	}
+	fileInfo.Replicas = probeReplicas(fileId, fileReplicaMembers(api.FilterInstances(common.ROLE_STORAGE), fileInfo.Group))
+	return nil
+}
+
+// fileReplicaMembers filters the other storage servers which hold files of the group,
+// which are the members of the group and the members mirroring the group.
+func fileReplicaMembers(members *list.List, group string) *list.List {
+	ret := list.New()
+	gox.WalkList(members, func(item interface{}) bool {
+		ins := item.(*common.Instance)
+		if ins.InstanceId == common.InitializedStorageConfiguration.InstanceId {
+			return false
+		}
+		if _, mirrored := ins.Attributes[mirrorAttributePrefix+group]; mirrored || ins.Attributes["group"] == group {
+			ret.PushBack(ins)
+		}
+		return false
+	})
+	return ret
+}
+
+// probeReplicas probes the file on this server and the members concurrently,
+// members which do not answer in time are reported as errors.
+func probeReplicas(fileId string, members *list.List) []common.FileReplica {
+	type probeResult struct {
+		index   int
+		replica *common.FileReplica
+	}
+	ret := make([]common.FileReplica, 1, members.Len()+1)
+	ret[0] = *probeLocalFile(fileId)
+	// buffered so that probes answering after timeout do not block.
+	results := make(chan probeResult, members.Len())
+	gox.WalkList(members, func(item interface{}) bool {
+		ins := item.(*common.Instance)
+		ret = append(ret, common.FileReplica{
+			InstanceId: ins.InstanceId,
+			Error:      "probe timeout",
+		})
+		go func(index int) {
+			replica, err := clientAPI.ProbeFile(&ins.Server, fileId)
+			if err != nil {
+				replica = &common.FileReplica{Error: err.Error()}
+			}
+			replica.InstanceId = ins.InstanceId
+			results <- probeResult{index, replica}
+		}(len(ret) - 1)
+		return false
+	})
+	timeout := time.After(common.FILE_PROBE_TIMEOUT)
+	for i := 1; i < len(ret); i++ {
+		select {
+		case r := <-results:
+			ret[r.index] = *r.replica
+		case <-timeout:
+			return ret
+		}
+	}
+	return ret
+}
+
+// probeLocalFile returns the state of the file stored on this server,
+// expired files are treated as nonexistent.
+func probeLocalFile(fileId string) *common.FileReplica {
+	ret := &common.FileReplica{
+		InstanceId: common.InitializedStorageConfiguration.InstanceId,
+	}
+	fileInfo, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+	if err != nil {
+		ret.Error = err.Error()
+		return ret
+	}
+	if fileExpired(fileId) {
+		return ret
+	}
+	if err := describeFile(fileInfo, nil); err != nil {
+		if err != common.NotFoundErr {
+			ret.Error = err.Error()
+		}
+		return ret
+	}
+	ret.Exists = true
+	ret.FileLength = fileInfo.FileLength
+	ret.RefCount = fileInfo.RefCount
+	ret.ModTime = fileInfo.ModTime
+	return ret
+}
+
+// probeFileHandler responses the state of the file stored on this server as body.
+func probeFileHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if header.Attributes == nil || header.Attributes["fileId"] == "" {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(probeLocalFile(header.Attributes["fileId"]))
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
@@ -0,0 +1,80 @@
+package svc
+
+import (
+	"container/list"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileReplicaMembers(t *testing.T) {
+	defer func(c *common.StorageConfig) {
+		common.InitializedStorageConfiguration = c
+	}(common.InitializedStorageConfiguration)
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		Group:      "G01",
+		InstanceId: "storage0",
+	}
+
+	members := list.New()
+	for i, attributes := range []map[string]string{
+		{"group": "G01"},
+		{"group": "G01"},
+		{"group": "G02", mirrorAttributePrefix + "G01": "0"},
+		{"group": "G03"},
+	} {
+		members.PushBack(&common.Instance{
+			Server:     common.Server{InstanceId: "storage" + convert.IntToStr(i)},
+			Role:       common.ROLE_STORAGE,
+			Attributes: attributes,
+		})
+	}
+	l := fileReplicaMembers(members, "G01")
+	if l.Len() != 2 || l.Front().Value.(*common.Instance).InstanceId != "storage1" ||
+		l.Back().Value.(*common.Instance).InstanceId != "storage2" {
+		t.Fatal("unexpected replica members: ", l.Len())
+	}
+}
+
+func TestProbeLocalFile(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{
+		Group:      "G01",
+		InstanceId: "storage0",
+	})
+	defer teardown()
+
+	os.MkdirAll(dir+"/0A/1B", 0755)
+	if err := ioutil.WriteFile(dir+"/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", []byte{'a', 'b', 'c', 0, 0, 0, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	fileId := util.CreateAlias("G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", "storage0", false, now)
+	replicas := probeReplicas(fileId, list.New())
+	if len(replicas) != 1 {
+		t.Fatal("unexpected replicas: ", replicas)
+	}
+	if r := replicas[0]; !r.Exists || r.InstanceId != "storage0" || r.FileLength != 3 || r.RefCount != 2 || r.ModTime == 0 {
+		t.Fatal("unexpected local replica: ", r)
+	}
+
+	info, _, _ := util.ParseAlias(fileId, "123456")
+	if err := describeFile(info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info.FileLength != 3 || info.Md5 != "e92c1c72e7fff2801c7d4af5b154f88d" || info.RefCount != 2 {
+		t.Fatal("unexpected file info: ", info)
+	}
+
+	missing := util.CreateAlias("G01/0C/2D/0123456789abcdef0123456789abcdef", "storage0", false, now)
+	if r := probeLocalFile(missing); r.Exists || r.Error != "" {
+		t.Fatal("unexpected replica of missing file: ", r)
+	}
+	saveFileMeta(fileId, &common.FileMeta{ExpireTime: now.Unix() - 1}, true)
+	if r := probeLocalFile(fileId); r.Exists {
+		t.Fatal("expired file should not exist")
+	}
+}
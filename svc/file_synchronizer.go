@@ -14,7 +14,7 @@ import (
 	"github.com/hetianyi/gox/uuid"
 	json "github.com/json-iterator/go"
 	"io"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
@@ -51,7 +51,7 @@ func InitFileSynchronization() {
 		config := common.GetConfigMap()
 		for true {
 			// filter group members.
-			ins := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE), common.InitializedStorageConfiguration.Group)
+			ins := syncSourceMembers()
 			if ins.Len() == 0 {
 				// logger.Debug("no group member available")
 				break
@@ -222,6 +222,27 @@ func syncFiles(bls []common.BingLogDTO) int {
 	return failed
 }
 
+// orderSyncSources sorts the group members by locality,
+// the source server comes first within the same locality level.
+func orderSyncSources(ins *list.List, sourceInstance string) []*common.Instance {
+	conf := common.InitializedStorageConfiguration
+	var ret []*common.Instance
+	for ele := ins.Front(); ele != nil; ele = ele.Next() {
+		ret = append(ret, ele.Value.(*common.Instance))
+	}
+	rank := func(s *common.Instance) int {
+		r := api.Locality(s, conf.Zone, conf.Rack) * 2
+		if s.InstanceId != sourceInstance {
+			r++
+		}
+		return r
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return rank(ret[i]) < rank(ret[j])
+	})
+	return ret
+}
+
 // syncFile synchronizes a single file.
 func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 
@@ -237,6 +258,14 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 		return errors.New("cannot parse alias: " + binlog.FileId)
 	}
 
+	// expired files are not synchronized.
+	if err := saveFileMeta(binlog.FileId, binlogFileMeta(binlog), false); err != nil {
+		return err
+	}
+	if fileExpired(binlog.FileId) {
+		return nil
+	}
+
 	if util.ExistsFile(fInfo) {
 		// logger.Debug("file already exists")
 		return nil
@@ -248,39 +277,13 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 			return errors.New("no storage server available")
 		}
 
-		// filter group members.
-		ins = filterGroupMembers(ins, common.InitializedStorageConfiguration.Group)
-
-		// download from source server first.
-		var srcServer *common.Server
-		gox.WalkList(ins, func(item interface{}) bool {
-			if item.(*common.Instance).InstanceId == binlog.SourceInstance {
-				srcServer = &item.(*common.Instance).Server
-				return true
-			}
-			return false
-		})
+		// filter members holding files of the group.
+		ins = fileSourceMembers(ins, fInfo.Group)
 
+		// download from same-zone servers first,
+		// and from the source server first within the same locality level.
 		var lasErr error
-
-		if srcServer != nil {
-			if err := syncFile(binlog, srcServer); err != nil {
-				lasErr = err
-			}
-			if lasErr == nil {
-				return nil
-			}
-		}
-
-		logger.Debug("cannot download from source server, try other servers: ", lasErr)
-
-		// fallback, download from other servers.
-		for ele := ins.Front(); ele != nil; ele = ele.Next() {
-			s := ele.Value.(*common.Instance)
-			if s.InstanceId == binlog.SourceInstance {
-				continue
-			}
-
+		for _, s := range orderSyncSources(ins, binlog.SourceInstance) {
 			server = &s.Server
 
 			logger.Debug("trying to download from ",
@@ -288,6 +291,7 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 
 			if err := syncFile(binlog, &s.Server); err != nil {
 				lasErr = err
+				logger.Debug("cannot download from ", server.ConnectionString(), ", try other servers: ", err)
 				continue
 			}
 			// upload success, clear error.
@@ -306,7 +310,8 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 	logger.Debug("begin to synchronize file ", binlog.FileId, " from ",
 		server.ConnectionString(), "(", server.InstanceId, ")")
 
-	return clientAPI.DownloadFrom(binlog.FileId, 0, -1, server, func(body io.Reader, bodyLength int64) error {
+	// files are synchronized in the stored form, such as compressed blobs.
+	return clientAPI.DownloadRaw(binlog.FileId, server, func(body io.Reader, bodyLength int64) error {
 		tmpFileName := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
 		out, err := file.CreateFile(tmpFileName)
 		if err != nil {
@@ -324,7 +329,7 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 		}
 
 		logger.Debug("copy file")
-		_, err = io.Copy(proxy, io.LimitReader(body, bodyLength))
+		_, err = io.Copy(proxy, syncRateLimiter.NewReader(io.LimitReader(body, bodyLength)))
 		if err != nil {
 			return err
 		}
@@ -337,18 +342,11 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 		}
 		out.Close()
 
-		targetLoc := common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path[0:strings.LastIndex(fInfo.Path, "/")]
-		targetFile := common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path
-
-		if !file.Exists(targetLoc) {
-			if err := file.CreateDirs(targetLoc); err != nil {
-				return err
-			}
-		}
-
-		if !file.Exists(targetFile) {
+		defer lockBlob(util.GetFileRelativePath(fInfo))()
+		exists := util.BlobExists(util.GetFileRelativePath(fInfo))
+		if !exists {
 			logger.Debug("file not exists, move to target dir.")
-			if err := file.MoveFile(tmpFileName, targetFile); err != nil {
+			if _, err := util.PlaceBlob(tmpFileName, util.GetFileRelativePath(fInfo)); err != nil {
 				return err
 			}
 		} else {
@@ -362,12 +360,13 @@ func syncFile(binlog *common.BingLogDTO, server *common.Server) error {
 				return nil
 			}
 			// increase file reference count.
-			if err = updateFileReferenceCount(targetFile, 1); err != nil {
+			if err = updateFileReferenceCount(util.GetFileRelativePath(fInfo), 1); err != nil {
 				return err
 			}
 		}
 		logger.Debug("download success")
-		return nil
+		// the reference is released when the file expires.
+		return saveFileMeta(binlog.FileId, binlogFileMeta(binlog), true)
 	})
 }
 
@@ -0,0 +1,281 @@
+package svc
+
+import (
+	"errors"
+	"github.com/boltdb/bolt"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"os"
+	"path"
+	"time"
+)
+
+// fsckFile is a distinct fileId of the local binlogs.
+type fsckFile struct {
+	fileId string
+	rel    string // relative path of the blob
+	// whether the fileId holds a reference of the blob,
+	// fileIds without metadata are uploaded before it is recorded and always hold one.
+	referenced bool
+	reaped     bool
+}
+
+// RunFsck checks the fileId dataset and the blobs of the stopped storage server against its local binlogs,
+// which are the source of truth, and fixes the problems if fix is true.
+//
+// The storage config must be initialized as the server does on boot.
+func RunFsck(fix bool) (*common.FsckReport, error) {
+	c := common.InitializedStorageConfiguration
+	if err := util.ValidateStorageConfig(c); err != nil {
+		return nil, err
+	}
+	if err := checkStorageStopped(c.DataDir); err != nil {
+		return nil, err
+	}
+	if err := util.InitStorageConfig(c); err != nil {
+		return nil, err
+	}
+	defer closeConfigMap()
+	util.InitDataDirs(c)
+	if err := util.InitVolumes(c); err != nil {
+		return nil, err
+	}
+	defer util.CloseVolumes()
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	defer writableBinlogManager.Close()
+	return fsck(fix)
+}
+
+// checkStorageStopped fails if the config map of the data dir is locked by a running server.
+func checkStorageStopped(dataDir string) error {
+	cfg := dataDir + "/cfg.dat"
+	if !file.Exists(cfg) {
+		return nil
+	}
+	db, err := bolt.Open(cfg, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return errors.New("the storage server of data dir " + dataDir + " is running, stop it first")
+	}
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// fsck checks and fixes the initialized storage server.
+func fsck(fix bool) (*common.FsckReport, error) {
+	report := &common.FsckReport{Fix: fix}
+	files, err := collectFsckFiles(report)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := util.ListBlobs()
+	if err != nil {
+		return nil, err
+	}
+	report.Blobs = len(blobs)
+
+	standalone := make(map[string]*util.BlobRef)
+	packed := make(map[string]*util.BlobRef)
+	for i := range blobs {
+		if blobs[i].Packed {
+			packed[blobs[i].Rel] = &blobs[i]
+		} else {
+			standalone[blobs[i].Rel] = &blobs[i]
+		}
+	}
+	// fileIds which do not hold a reference still keep their blobs from being orphans.
+	expected := make(map[*util.BlobRef]int64)
+	for _, f := range files {
+		if f.reaped {
+			continue
+		}
+		b := standalone[f.rel]
+		if b == nil {
+			b = packed[path.Base(f.rel)]
+		}
+		if b == nil {
+			report.MissingBlobs = append(report.MissingBlobs, f.fileId)
+			continue
+		}
+		if f.referenced {
+			expected[b]++
+		} else {
+			expected[b] += 0
+		}
+	}
+
+	var orphans []*util.BlobRef
+	var mismatches []*util.BlobRef
+	for i := range blobs {
+		b := &blobs[i]
+		n, referred := expected[b]
+		switch {
+		case b.RefCount < 0:
+			report.CorruptBlobs = append(report.CorruptBlobs, blobName(b))
+		case !referred:
+			orphans = append(orphans, b)
+			report.OrphanBlobs = append(report.OrphanBlobs, blobName(b))
+		case b.RefCount != n:
+			mismatches = append(mismatches, b)
+			report.RefCounts = append(report.RefCounts, common.RefCountMismatch{
+				Blob:     blobName(b),
+				RefCount: b.RefCount,
+				Expected: n,
+			})
+		}
+	}
+
+	if err := fsckDataSet(files, report, fix); err != nil {
+		return report, err
+	}
+	if !fix {
+		return report, nil
+	}
+	for _, b := range mismatches {
+		if err := addBlobReferenceCount(b, expected[b]-b.RefCount); err != nil {
+			return report, err
+		}
+	}
+	for _, b := range orphans {
+		if b.Packed {
+			// the space is reclaimed by volume compaction.
+			if err := addBlobReferenceCount(b, -b.RefCount); err != nil {
+				return report, err
+			}
+			continue
+		}
+		target, err := util.QuarantineBlob(b.Rel)
+		if err != nil {
+			return report, err
+		}
+		logger.Info("orphan blob ", b.Rel, " is moved to ", target)
+	}
+	return report, nil
+}
+
+// collectFsckFiles walks the local binlogs and returns the distinct fileIds.
+func collectFsckFiles(report *common.FsckReport) ([]*fsckFile, error) {
+	var files []*fsckFile
+	found := make(map[string]bool)
+	err := walkLocalBinlogs(func(bl *common.BingLogDTO) bool {
+		if found[bl.FileId] {
+			return false
+		}
+		found[bl.FileId] = true
+		fInfo, _, err := util.ParseAlias(bl.FileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			report.InvalidFileIds = append(report.InvalidFileIds, bl.FileId)
+			return false
+		}
+		meta := getFileMeta(bl.FileId)
+		f := &fsckFile{
+			fileId:     bl.FileId,
+			rel:        util.GetFileRelativePath(fInfo),
+			referenced: meta == nil || meta.Referenced,
+			reaped:     meta != nil && meta.Reaped,
+		}
+		if f.reaped {
+			report.ReapedFileIds++
+		}
+		files = append(files, f)
+		return false
+	})
+	report.FileIds = len(files)
+	return files, err
+}
+
+// fsckDataSet counts the fileIds absent from the index, and adds them if fix is true,
+// the index is rebuilt if it is lost or unreadable.
+//
+// Reaped fileIds are kept in the index, so that downloading them is told apart from unknown files.
+func fsckDataSet(files []*fsckFile, report *common.FsckReport, fix bool) error {
+	c := common.InitializedStorageConfiguration
+	backend := activeIndexBackend(c.DataDir, c.IndexBackend)
+	paths := indexFiles(backend, c.DataDir)
+	var idx FileIndex
+	lost := false
+	for _, p := range paths {
+		lost = lost || !file.Exists(p)
+	}
+	if !lost {
+		var err error
+		if idx, err = openFileIndex(backend, c.DataDir); err != nil {
+			logger.Error("cannot open fileId index: ", err)
+			idx = nil
+		}
+	}
+	var absent []string
+	for _, f := range files {
+		if idx == nil {
+			break
+		}
+		exists, err := idx.Contains(f.fileId)
+		if err != nil {
+			logger.Error("cannot read fileId index: ", err)
+			idx.Close()
+			idx = nil
+			break
+		}
+		if !exists {
+			absent = append(absent, f.fileId)
+		}
+	}
+	if idx == nil {
+		report.DatasetLost = true
+		absent = absent[:0]
+		for _, f := range files {
+			absent = append(absent, f.fileId)
+		}
+	}
+	report.DatasetMissing = len(absent)
+	if !fix || (!report.DatasetLost && len(absent) == 0) {
+		if idx != nil {
+			return idx.Close()
+		}
+		return nil
+	}
+
+	if report.DatasetLost {
+		// the broken files are kept for inspection.
+		for _, p := range paths {
+			if !file.Exists(p) {
+				continue
+			}
+			if err := os.Rename(p, p+".bak"); err != nil {
+				return err
+			}
+		}
+		var err error
+		if idx, err = openFileIndex(backend, c.DataDir); err != nil {
+			return err
+		}
+	}
+	defer idx.Close()
+	for _, fileId := range absent {
+		if err := idx.Add(fileId); err != nil {
+			return errors.New("error writing fileId index: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// addBlobReferenceCount changes the reference count of the blob listed by fsck.
+func addBlobReferenceCount(b *util.BlobRef, value int64) error {
+	if b.Packed {
+		_, err := util.UpdateVolumeReferenceCount(b.Rel, value)
+		return err
+	}
+	return updateStandaloneReferenceCount(b.Rel, value)
+}
+
+// blobName is the name of the blob in fsck reports.
+func blobName(b *util.BlobRef) string {
+	if b.Packed {
+		return "volume:" + b.Rel
+	}
+	return b.Rel
+}
@@ -0,0 +1,82 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/file"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestFsck(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{
+		Group:      "G01",
+		InstanceId: "storage0",
+	})
+	defer teardown()
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	defer writableBinlogManager.Close()
+
+	blobs := map[string][]byte{
+		// referenced by one fileId, but the tail counts two.
+		"0A/1B/e92c1c72e7fff2801c7d4af5b154f88d": {'a', 0, 0, 0, 2},
+		// referenced by no fileId.
+		"0C/2D/0123456789abcdef0123456789abcdef": {'b', 0, 0, 0, 1},
+	}
+	for rel, content := range blobs {
+		if err := file.CreateDirs(dir + "/" + rel[:5]); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+rel, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	stored := util.CreateAlias("G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", "storage0", false, now)
+	missing := util.CreateAlias("G01/0E/3F/fedcba9876543210fedcba9876543210", "storage0", false, now)
+	reaped := util.CreateAlias("G01/1A/4B/00112233445566778899aabbccddeeff", "storage0", false, now)
+	for _, fileId := range []string{stored, missing, reaped, stored} {
+		if err := writableBinlogManager.Write(binlog.CreateLocalBinlog(fileId, 1, "storage0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := common.GetConfigMap().PutFileMeta(reaped, &common.FileMeta{ExpireTime: now.Unix() - 1, Reaped: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FileIds != 3 || report.ReapedFileIds != 1 || report.Blobs != 2 ||
+		!report.DatasetLost || report.DatasetMissing != 3 ||
+		len(report.MissingBlobs) != 1 || report.MissingBlobs[0] != missing ||
+		len(report.OrphanBlobs) != 1 || report.OrphanBlobs[0] != "0C/2D/0123456789abcdef0123456789abcdef" ||
+		len(report.RefCounts) != 1 || report.RefCounts[0].RefCount != 2 || report.RefCounts[0].Expected != 1 {
+		t.Fatal("unexpected report: ", report)
+	}
+	if file.Exists(dir + "/index") {
+		t.Fatal("dry run should not create the dataset")
+	}
+
+	if _, err := fsck(true); err != nil {
+		t.Fatal(err)
+	}
+	if !file.Exists(dir + "/lost+found/0C/2D/0123456789abcdef0123456789abcdef") {
+		t.Fatal("orphan blob is not moved to lost+found")
+	}
+	report, err = fsck(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DatasetLost || report.DatasetMissing != 0 || report.Blobs != 1 ||
+		len(report.OrphanBlobs) != 0 || len(report.RefCounts) != 0 || len(report.MissingBlobs) != 1 {
+		t.Fatal("unexpected report after fix: ", report)
+	}
+
+	if err := checkStorageStopped(dir); err == nil {
+		t.Fatal("expect error of running server")
+	}
+}
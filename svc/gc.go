@@ -0,0 +1,222 @@
+package svc
+
+import (
+	"bytes"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// InitGc starts a timer job which deletes the stale tmp files left by failed uploads
+// and the blobs no live fileId refers to.
+func InitGc() {
+	interval := common.InitializedStorageConfiguration.GcInterval
+	if interval <= 0 {
+		logger.Info("garbage collection is disabled")
+		return
+	}
+	timer.Start(time.Minute*time.Duration(interval), time.Minute*time.Duration(interval), 0, func(t *timer.Timer) {
+		if coordinator.isShuttingDown() {
+			return
+		}
+		report, err := collectGarbage(false, time.Now())
+		if err != nil {
+			logger.Error("error collect garbage: ", err)
+			return
+		}
+		if report.Message != "" {
+			logger.Warn("garbage collection: ", report.Message)
+		}
+		if report.TmpFiles > 0 || len(report.OrphanBlobs) > 0 {
+			logger.Info("garbage collection finished, ", report.TmpFiles, " tmp files and ",
+				len(report.OrphanBlobs), " orphan blobs are deleted, ", report.TmpBytes+report.BlobBytes, " bytes reclaimed")
+		}
+	})
+}
+
+// collectGarbage deletes the tmp files older than the configured age
+// and the orphan blobs not modified in the grace period,
+// the garbage is only reported if dryRun is true.
+//
+// A blob is an orphan if no unreaped fileId of the local binlogs refers to it,
+// which includes the blobs whose reference count drops to zero but are failed to be deleted.
+// Blobs referred to by fileIds which do not hold a reference are kept even if their reference count is zero.
+func collectGarbage(dryRun bool, now time.Time) (*common.GcReport, error) {
+	c := common.InitializedStorageConfiguration
+	report := &common.GcReport{
+		DryRun:    dryRun,
+		StartTime: now.Unix(),
+	}
+	if err := collectTmpFiles(report, now.Add(-time.Minute*time.Duration(c.GcTmpFileAge))); err != nil {
+		return report, err
+	}
+
+	// blobs are listed before the binlogs are walked,
+	// so that blobs stored meanwhile are referred to or in the grace period.
+	blobs, err := util.ListBlobs()
+	if err != nil {
+		return report, err
+	}
+	scratch := &common.FsckReport{}
+	files, err := collectFsckFiles(scratch)
+	if err != nil {
+		return report, err
+	}
+	if len(scratch.InvalidFileIds) > 0 {
+		// blobs of the unparsable fileIds cannot be told.
+		report.Message = convert.IntToStr(len(scratch.InvalidFileIds)) +
+			" fileIds cannot be parsed, orphan blobs are not collected, run fsck to check them"
+		return report, nil
+	}
+	referred := make(map[string]bool)
+	referredPacked := make(map[string]bool)
+	for _, f := range files {
+		if !f.reaped {
+			referred[f.rel] = true
+			referredPacked[path.Base(f.rel)] = true
+		}
+	}
+
+	deadline := now.Add(-time.Minute * time.Duration(c.GcGracePeriod)).Unix()
+	for i := range blobs {
+		b := &blobs[i]
+		if b.RefCount < 0 || (b.Packed && referredPacked[b.Rel]) || (!b.Packed && referred[b.Rel]) {
+			continue
+		}
+		if b.ModTime > deadline {
+			report.InGrace++
+			continue
+		}
+		if !dryRun {
+			removed, err := removeOrphanBlob(b)
+			if err != nil {
+				logger.Error("error remove orphan blob ", blobName(b), ": ", err)
+				continue
+			}
+			if !removed {
+				continue
+			}
+			logger.Debug("orphan blob removed: ", blobName(b))
+		}
+		report.OrphanBlobs = append(report.OrphanBlobs, blobName(b))
+		report.BlobBytes += b.Size
+	}
+	return report, nil
+}
+
+// collectTmpFiles deletes the tmp files modified before the time.
+func collectTmpFiles(report *common.GcReport, before time.Time) error {
+	dir := common.InitializedStorageConfiguration.TmpDir
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !info.ModTime().Before(before) {
+			continue
+		}
+		if !report.DryRun {
+			if err := os.Remove(dir + "/" + info.Name()); err != nil && !os.IsNotExist(err) {
+				logger.Error("error remove tmp file ", info.Name(), ": ", err)
+				continue
+			}
+		}
+		report.TmpFiles++
+		report.TmpBytes += info.Size()
+	}
+	return nil
+}
+
+// removeTmpFiles deletes the tmp files left by the transfers interrupted on shutdown.
+func removeTmpFiles() {
+	report := &common.GcReport{}
+	if err := collectTmpFiles(report, time.Now()); err != nil {
+		logger.Error("error remove tmp files: ", err)
+		return
+	}
+	if report.TmpFiles > 0 {
+		logger.Info(report.TmpFiles, " tmp files of interrupted transfers are removed")
+	}
+}
+
+// removeOrphanBlob removes the standalone blob, or releases the packed one for volume compaction.
+//
+// The blob is kept and false is returned if it changes since it is listed,
+// for it may be referred to by a new upload of the same content.
+// Uploads are stored under the lock of the blob, so they see the blob either kept or removed.
+func removeOrphanBlob(b *util.BlobRef) (bool, error) {
+	defer lockBlob(b.Rel)()
+
+	if b.Packed {
+		cur := util.LookupVolumeBlob(b.Rel)
+		if cur == nil || cur.RefCount != b.RefCount {
+			return false, nil
+		}
+		return true, addBlobReferenceCount(b, -b.RefCount)
+	}
+	fullPath, exists := util.LocateBlob(b.Rel)
+	if !exists {
+		return false, nil
+	}
+	if cur := util.StatBlob(fullPath, b.Rel); cur.ModTime != b.ModTime || cur.RefCount != b.RefCount {
+		return false, nil
+	}
+	return true, util.RemoveBlob(b.Rel)
+}
+
+// gcHandler responses the garbage the next collection would delete as body.
+func gcHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	report, err := collectGarbage(true, time.Now())
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error collect garbage: " + err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(report)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// httpGc responses the garbage the next collection would delete in json.
+func httpGc(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedStorageConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+	report, err := collectGarbage(true, time.Now())
+	if err != nil {
+		logger.Error("error collect garbage: ", err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	retJSON, err := json.Marshal(report)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
@@ -0,0 +1,87 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/file"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{
+		Group:         "G01",
+		InstanceId:    "storage0",
+		GcTmpFileAge:  60,
+		GcGracePeriod: 60,
+	})
+	defer teardown()
+	common.InitializedStorageConfiguration.TmpDir = dir + "/tmp"
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	defer writableBinlogManager.Close()
+
+	now := time.Now()
+	old := now.Add(-time.Hour * 2)
+	files := []struct {
+		rel     string
+		content []byte
+		modTime time.Time
+	}{
+		{"tmp/stale", []byte("abc"), old},
+		{"tmp/uploading", []byte("abc"), now},
+		// referenced by a fileId.
+		{"0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", []byte{'a', 0, 0, 0, 1}, old},
+		// referenced by no fileId.
+		{"0C/2D/0123456789abcdef0123456789abcdef", []byte{'b', 'b', 0, 0, 0, 1}, old},
+		// referenced by no fileId, but stored recently.
+		{"0E/3F/fedcba9876543210fedcba9876543210", []byte{'c', 0, 0, 0, 0}, now},
+	}
+	for _, f := range files {
+		if err := file.CreateDirs(path.Dir(dir + "/" + f.rel)); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/"+f.rel, f.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir+"/"+f.rel, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fileId := util.CreateAlias("G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", "storage0", false, now)
+	if err := writableBinlogManager.Write(binlog.CreateLocalBinlog(fileId, 1, "storage0")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := collectGarbage(true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TmpFiles != 1 || report.TmpBytes != 3 || report.InGrace != 1 || report.BlobBytes != 2 ||
+		len(report.OrphanBlobs) != 1 || report.OrphanBlobs[0] != "0C/2D/0123456789abcdef0123456789abcdef" {
+		t.Fatal("unexpected report: ", report)
+	}
+	if !file.Exists(dir+"/tmp/stale") || !file.Exists(dir+"/0C/2D/0123456789abcdef0123456789abcdef") {
+		t.Fatal("dry run should not delete garbage")
+	}
+
+	if _, err := collectGarbage(false, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		deleted := f.rel == "tmp/stale" || f.rel == "0C/2D/0123456789abcdef0123456789abcdef"
+		if file.Exists(dir+"/"+f.rel) == deleted {
+			t.Fatal("unexpected existence of ", f.rel)
+		}
+	}
+	report, err = collectGarbage(true, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.TmpFiles != 0 || len(report.OrphanBlobs) != 0 || report.InGrace != 1 {
+		t.Fatal("unexpected report after collection: ", report)
+	}
+}
@@ -0,0 +1,162 @@
+package svc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// canary locks of each dir.
+	canaryLocks = make(map[string]*sync.Mutex)
+	// continuous health check failures of storage servers.
+	healthFailures = make(map[string]int)
+	// storage servers which are being checked.
+	healthChecking = make(map[string]bool)
+	healthLock     = new(sync.Mutex)
+	healthClient   = &http.Client{Timeout: common.HEALTH_CHECK_TIMEOUT}
+)
+
+// checkCanary writes a canary file to the data dir and reads it back,
+// it hangs or fails if the disk does.
+func checkCanary() error {
+	return checkCanaryFile(common.InitializedStorageConfiguration.DataDir)
+}
+
+// checkCanaryFile checks the disk of the dir by a canary file.
+func checkCanaryFile(dir string) error {
+	healthLock.Lock()
+	l := canaryLocks[dir]
+	if l == nil {
+		l = new(sync.Mutex)
+		canaryLocks[dir] = l
+	}
+	healthLock.Unlock()
+	l.Lock()
+	defer l.Unlock()
+
+	path := dir + "/canary"
+	content := []byte(convert.Int64ToStr(time.Now().UnixNano()))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(bs, content) {
+		return errors.New("canary file is corrupted")
+	}
+	return nil
+}
+
+// healthCheckHandler checks the disk of this server for trackers.
+func healthCheckHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if err := checkCanary(); err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error read canary file: " + err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, nil, 0, nil
+}
+
+// httpHealthCheck responses 200 if the server is healthy, or 503 if not.
+func httpHealthCheck(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if err := checkCanary(); err != nil {
+		util.HttpWriteResponse(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	util.HttpWriteResponse(w, http.StatusOK, "OK")
+}
+
+// InitHealthCheck starts a timer job for checking registered storage servers,
+// the results are recorded in the instance attributes.
+//
+// A storage server is checked by tcp authentication, a synthetic read
+// of the canary file and the http health api if http is enabled.
+func InitHealthCheck() {
+	timer.Start(common.HEALTH_CHECK_INTERVAL, common.HEALTH_CHECK_INTERVAL, 0, func(t *timer.Timer) {
+		for _, ins := range reg.InstanceSetSnapshot() {
+			if ins.Role != common.ROLE_STORAGE {
+				continue
+			}
+			healthLock.Lock()
+			if healthChecking[ins.InstanceId] {
+				// last check hangs.
+				healthLock.Unlock()
+				continue
+			}
+			healthChecking[ins.InstanceId] = true
+			healthLock.Unlock()
+			go checkInstance(ins)
+		}
+	})
+}
+
+// checkInstance checks the storage server once.
+func checkInstance(ins *common.Instance) {
+	err := checkInstanceHealth(ins)
+
+	healthLock.Lock()
+	delete(healthChecking, ins.InstanceId)
+	if err == nil {
+		delete(healthFailures, ins.InstanceId)
+	} else {
+		healthFailures[ins.InstanceId]++
+	}
+	failures := healthFailures[ins.InstanceId]
+	healthLock.Unlock()
+
+	if err == nil {
+		reg.SetHealth(ins.InstanceId, true, "")
+		return
+	}
+	logger.Debug("health check failed for storage server ",
+		ins.Server.ConnectionString(), "(", ins.InstanceId, "): ", err)
+	if failures >= common.HEALTH_CHECK_FAILURES {
+		reg.SetHealth(ins.InstanceId, false, err.Error())
+	}
+}
+
+func checkInstanceHealth(ins *common.Instance) error {
+	if err := api.CheckHealth(&ins.Server, common.HEALTH_CHECK_TIMEOUT); err != nil {
+		return err
+	}
+	if ins.Attributes["http"] != "true" || ins.HttpPort == 0 {
+		return nil
+	}
+	resp, err := healthClient.Get("http://" + ins.Host + ":" + convert.Uint16ToStr(ins.HttpPort) + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("http health check responses " + convert.IntToStr(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"testing"
+)
+
+func TestHealthCheckHandler(t *testing.T) {
+	dir, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+
+	if h, _, _, _ := healthCheckHandler(&common.Header{}); h.Result != common.SUCCESS {
+		t.Fatal("health check failed: ", h.Msg)
+	}
+	common.InitializedStorageConfiguration.DataDir = dir + "/not_exist"
+	if h, _, _, _ := healthCheckHandler(&common.Header{}); h.Result != common.ERROR {
+		t.Fatal("health check passed without data dir")
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	newInstance := func() *common.Instance {
+		return &common.Instance{
+			Server:     common.Server{Host: "127.0.0.1", Port: 10706, InstanceId: "health01"},
+			Role:       common.ROLE_STORAGE,
+			Attributes: map[string]string{"group": "G01"},
+		}
+	}
+	if err := reg.Put(newInstance()); err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Remove(newInstance())
+
+	reg.SetHealth("health01", false, "disk hangs")
+	// health check results survive the instance update.
+	if err := reg.Put(newInstance()); err != nil {
+		t.Fatal(err)
+	}
+	ins := reg.InstanceSetSnapshot()["health01"]
+	if ins.Attributes["health"] != common.HEALTH_UNHEALTHY || ins.Attributes["healthError"] != "disk hangs" ||
+		ins.Attributes["group"] != "G01" {
+		t.Fatal("unexpected attributes: ", ins.Attributes)
+	}
+	reg.SetHealth("health01", true, "")
+	if reg.InstanceSetSnapshot()["health01"].Attributes["health"] != common.HEALTH_HEALTHY {
+		t.Fatal("instance is not recovered")
+	}
+	events := reg.History("health01")["health01"]
+	if len(events) < 2 || events[len(events)-2].Event != common.HEALTH_UNHEALTHY ||
+		events[len(events)-1].Event != common.HEALTH_HEALTHY {
+		t.Fatal("unexpected history: ", events)
+	}
+}
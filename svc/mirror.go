@@ -0,0 +1,253 @@
+package svc
+
+import (
+	"container/list"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorAttributePrefix prefixes the instance attributes
+// which report the caught up time of each mirrored group.
+const mirrorAttributePrefix = "mirrorCaughtUp."
+
+// mirrorFollowing is the following state of a member of a mirrored group.
+type mirrorFollowing struct {
+	group    string
+	caughtUp int64 // last time the binlogs are followed to the end, or the time following starts
+}
+
+var (
+	// followed members of the mirrored groups.
+	mirrorMembers = make(map[string]*mirrorFollowing)
+	// caught up time of each mirrored group,
+	// which is kept when no member of the group is alive.
+	mirrorCaughtUp = make(map[string]int64)
+	mirrorLock     = new(sync.Mutex)
+)
+
+// isMirrored judges whether the group is mirrored by this server.
+func isMirrored(group string) bool {
+	for _, g := range common.InitializedStorageConfiguration.MirrorGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// syncSourceMembers returns the storage servers whose binlogs are followed,
+// which are the other members of this group and the members of the mirrored groups.
+func syncSourceMembers() *list.List {
+	ret := list.New()
+	gox.WalkList(api.FilterInstances(common.ROLE_STORAGE), func(item interface{}) bool {
+		ins := item.(*common.Instance)
+		if ins.InstanceId == common.InitializedStorageConfiguration.InstanceId {
+			return false
+		}
+		if g := ins.Attributes["group"]; g == common.InitializedStorageConfiguration.Group || isMirrored(g) {
+			ret.PushBack(ins)
+		}
+		return false
+	})
+	return ret
+}
+
+// fileSourceMembers filters the storage servers which hold files of the group,
+// files of the mirrored groups are held by the other members of this group as well.
+func fileSourceMembers(members *list.List, group string) *list.List {
+	ret := filterGroupMembers(members, common.InitializedStorageConfiguration.Group)
+	if group == "" || group == common.InitializedStorageConfiguration.Group {
+		return ret
+	}
+	gox.WalkList(filterGroupMembers(members, group), func(item interface{}) bool {
+		ret.PushBack(item)
+		return false
+	})
+	return ret
+}
+
+// mirroredGroupOf returns the group of the storage server if the group is mirrored
+// by this server, or empty if the server is a member of this group.
+func mirroredGroupOf(ins *common.Instance) string {
+	if g := ins.Attributes["group"]; g != common.InitializedStorageConfiguration.Group {
+		return g
+	}
+	return ""
+}
+
+// acceptMirrorBinlog judges whether the binlog followed from a member of the mirrored group
+// should be accepted, only files of the group are accepted so that mirroring is not transitive.
+func acceptMirrorBinlog(fileId, group string) bool {
+	if group == "" {
+		return true
+	}
+	fInfo, _, err := util.ParseAlias(fileId, common.InitializedStorageConfiguration.Secret)
+	if err != nil {
+		logger.Debug("skip invalid fileId from mirrored group ", group, ": ", fileId)
+		return false
+	}
+	return fInfo.Group == group
+}
+
+// startMirrorFollowing starts tracking the lag of a member of the mirrored group.
+func startMirrorFollowing(instanceId, group string) {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	if mirrorMembers[instanceId] == nil {
+		mirrorMembers[instanceId] = &mirrorFollowing{
+			group:    group,
+			caughtUp: gox.GetTimestamp(time.Now()),
+		}
+	}
+}
+
+// stopMirrorFollowing stops tracking the lag of the member.
+func stopMirrorFollowing(instanceId string) {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	delete(mirrorMembers, instanceId)
+}
+
+// markMirrorCaughtUp records that binlogs of the member are followed to the end.
+func markMirrorCaughtUp(instanceId string) {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	if m := mirrorMembers[instanceId]; m != nil {
+		m.caughtUp = gox.GetTimestamp(time.Now())
+	}
+}
+
+// MirrorStatus returns the mirroring state of each group mirrored by this server,
+// a group is caught up when the binlogs of all its alive members are.
+func MirrorStatus() []common.MirrorStatus {
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+
+	now := gox.GetTimestamp(time.Now())
+	var ret []common.MirrorStatus
+	for _, g := range common.InitializedStorageConfiguration.MirrorGroups {
+		members := 0
+		var oldest int64
+		for _, m := range mirrorMembers {
+			if m.group != g {
+				continue
+			}
+			if members == 0 || m.caughtUp < oldest {
+				oldest = m.caughtUp
+			}
+			members++
+		}
+		if members > 0 {
+			mirrorCaughtUp[g] = oldest
+		}
+		ret = append(ret, newMirrorStatus(g, common.InitializedStorageConfiguration.Group,
+			members, 1, mirrorCaughtUp[g], now))
+	}
+	return ret
+}
+
+func newMirrorStatus(source, mirror string, sourceMembers, mirrorMembers int, caughtUp, now int64) common.MirrorStatus {
+	st := common.MirrorStatus{
+		SourceGroup:   source,
+		MirrorGroup:   mirror,
+		SourceMembers: sourceMembers,
+		MirrorMembers: mirrorMembers,
+		CaughtUpTime:  caughtUp,
+		Lag:           -1,
+	}
+	if caughtUp > 0 {
+		st.Lag = (now - caughtUp) / 1000
+	}
+	return st
+}
+
+// reportMirrorStatus sets the caught up time of each mirrored group
+// as instance attributes, so that trackers can report the lag of each group pair.
+func reportMirrorStatus() {
+	for _, st := range MirrorStatus() {
+		api.SetInstanceAttribute(mirrorAttributePrefix+st.SourceGroup, convert.Int64ToStr(st.CaughtUpTime))
+	}
+}
+
+// aggregateMirrorStatus builds the mirroring state of each group pair
+// from the attributes reported by the storage servers,
+// the lag of a pair is the lag of its slowest mirror member.
+func aggregateMirrorStatus(instances map[string]*common.Instance, now int64) []common.MirrorStatus {
+	type pair struct {
+		source, mirror string
+	}
+	groupMembers := make(map[string]int)
+	mirrors := make(map[pair]int)
+	caughtUp := make(map[pair]int64)
+	for _, ins := range instances {
+		if ins.Role != common.ROLE_STORAGE {
+			continue
+		}
+		groupMembers[ins.Attributes["group"]]++
+		for k, v := range ins.Attributes {
+			if !strings.HasPrefix(k, mirrorAttributePrefix) {
+				continue
+			}
+			p := pair{strings.TrimPrefix(k, mirrorAttributePrefix), ins.Attributes["group"]}
+			t, _ := convert.StrToInt64(v)
+			if mirrors[p] == 0 || t < caughtUp[p] {
+				caughtUp[p] = t
+			}
+			mirrors[p]++
+		}
+	}
+	var ret []common.MirrorStatus
+	for p, n := range mirrors {
+		ret = append(ret, newMirrorStatus(p.source, p.mirror, groupMembers[p.source], n, caughtUp[p], now))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].SourceGroup != ret[j].SourceGroup {
+			return ret[i].SourceGroup < ret[j].SourceGroup
+		}
+		return ret[i].MirrorGroup < ret[j].MirrorGroup
+	})
+	return ret
+}
+
+// httpMirrorStatus responses the mirroring state of each group pair,
+// it is served by both storage and tracker servers.
+func httpMirrorStatus(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var secret string
+	if common.BootAs == common.BOOT_TRACKER {
+		secret = common.InitializedTrackerConfiguration.Secret
+	} else {
+		secret = common.InitializedStorageConfiguration.Secret
+	}
+	if !checkAdminSecret(r, secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	ret := []common.MirrorStatus{}
+	if common.BootAs == common.BOOT_TRACKER {
+		ret = append(ret, aggregateMirrorStatus(reg.InstanceSetSnapshot(), gox.GetTimestamp(time.Now()))...)
+	} else {
+		ret = append(ret, MirrorStatus()...)
+	}
+	retJSON, err := json.Marshal(ret)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
@@ -0,0 +1,64 @@
+package svc
+
+import (
+	"container/list"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/convert"
+	"testing"
+)
+
+func TestFileSourceMembers(t *testing.T) {
+	defer func(c *common.StorageConfig) {
+		common.InitializedStorageConfiguration = c
+	}(common.InitializedStorageConfiguration)
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		Group:        "G02",
+		InstanceId:   "storage1",
+		DataDir:      "/data",
+		MirrorGroups: []string{"G01"},
+	}
+
+	members := list.New()
+	for i, g := range []string{"G01", "G02", "G02", "G03"} {
+		members.PushBack(&common.Instance{
+			Server:     common.Server{InstanceId: "storage" + convert.IntToStr(i)},
+			Role:       common.ROLE_STORAGE,
+			Attributes: map[string]string{"group": g},
+		})
+	}
+	if l := fileSourceMembers(members, "G02"); l.Len() != 1 {
+		t.Fatal("unexpected sources of own group: ", l.Len())
+	}
+	// files of the mirrored group are held by both groups.
+	if l := fileSourceMembers(members, "G01"); l.Len() != 2 {
+		t.Fatal("unexpected sources of mirrored group: ", l.Len())
+	}
+
+	if p := util.GetFilePath(&common.FileInfo{Group: "G01", Path: "0A/0B/abc"}); p != "/data/mirror/G01/0A/0B/abc" {
+		t.Fatal("unexpected path of mirrored file: ", p)
+	}
+	if p := util.GetFilePath(&common.FileInfo{Group: "G02", Path: "0A/0B/abc"}); p != "/data/0A/0B/abc" {
+		t.Fatal("unexpected path of own file: ", p)
+	}
+}
+
+func TestAggregateMirrorStatus(t *testing.T) {
+	instances := map[string]*common.Instance{
+		"s0": {Role: common.ROLE_STORAGE, Attributes: map[string]string{"group": "G01"}},
+		"s1": {Role: common.ROLE_STORAGE, Attributes: map[string]string{"group": "G02", mirrorAttributePrefix + "G01": "50000"}},
+		"s2": {Role: common.ROLE_STORAGE, Attributes: map[string]string{"group": "G02", mirrorAttributePrefix + "G01": "40000"}},
+		"s3": {Role: common.ROLE_STORAGE, Attributes: map[string]string{"group": "G03", mirrorAttributePrefix + "G01": "0"}},
+	}
+	ret := aggregateMirrorStatus(instances, 100000)
+	if len(ret) != 2 {
+		t.Fatal("unexpected group pairs: ", ret)
+	}
+	if st := ret[0]; st.MirrorGroup != "G02" || st.SourceMembers != 1 || st.MirrorMembers != 2 || st.Lag != 60 {
+		t.Fatal("unexpected status: ", st)
+	}
+	// mirror which never caught up.
+	if st := ret[1]; st.MirrorGroup != "G03" || st.Lag != -1 {
+		t.Fatal("unexpected status: ", st)
+	}
+}
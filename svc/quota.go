@@ -0,0 +1,292 @@
+package svc
+
+import (
+	"bytes"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	quotaLock = new(sync.Mutex)
+	// usage of the quotas fetched from trackers, keyed by usageKey.
+	quotaUsage map[string]common.Usage
+	// uploads which trackers may not count yet, in upload order.
+	pendingCharges []pendingCharge
+	// sum of the pending charges, keyed by usageKey.
+	pendingUsage = make(map[string]*common.Usage)
+)
+
+type pendingCharge struct {
+	charge common.UsageCharge
+	time   time.Time
+}
+
+func usageKey(group, identity string) string {
+	if group != "" {
+		return "g/" + group
+	}
+	return "i/" + identity
+}
+
+// quotaName describes the group or identity of the usage.
+func quotaName(u *common.Usage) string {
+	if u.Group != "" {
+		return "group \"" + u.Group + "\""
+	}
+	return "identity \"" + u.Identity + "\""
+}
+
+// chargeUsage charges the file of the pushed binlog to the usage of its group and its owner,
+// files which already expire are not charged.
+func chargeUsage(bl *common.BingLogDTO, now time.Time) error {
+	cm := common.GetConfigMap()
+	if cm == nil || (bl.ExpireTime > 0 && bl.ExpireTime <= now.Unix()) {
+		return nil
+	}
+	charge := &common.UsageCharge{Bytes: bl.FileLength}
+	if fInfo, _, err := util.ParseAlias(bl.FileId, common.InitializedTrackerConfiguration.Secret); err == nil {
+		charge.Group = fInfo.Group
+	} else {
+		logger.Debug("cannot parse group of fileId ", bl.FileId, ": ", err)
+	}
+	if bl.Meta != nil {
+		charge.Identity = bl.Meta.Owner
+	}
+	if charge.Group == "" && charge.Identity == "" {
+		return nil
+	}
+	return cm.ChargeUsage(bl.FileId, charge, bl.ExpireTime)
+}
+
+// InitUsageReaper starts a timer job which releases the usage of the expired files.
+func InitUsageReaper() {
+	timer.Start(common.FILE_REAP_INTERVAL, common.FILE_REAP_INTERVAL, 0, func(t *timer.Timer) {
+		if coordinator.isShuttingDown() {
+			return
+		}
+		if n := releaseExpiredUsage(time.Now()); n > 0 {
+			logger.Info("usage of ", n, " expired files is released")
+		}
+	})
+}
+
+// releaseExpiredUsage releases the usage of the files expired before the time,
+// and returns the number of released files.
+func releaseExpiredUsage(now time.Time) int {
+	released := 0
+	for {
+		n, err := common.GetConfigMap().ReleaseExpiredUsage(now, common.FILE_REAP_BATCH_SIZE)
+		released += n
+		if err != nil {
+			logger.Error("error release usage of expired files: ", err)
+			return released
+		}
+		if n < common.FILE_REAP_BATCH_SIZE {
+			return released
+		}
+	}
+}
+
+// listUsage returns the usage of the groups and identities with their quotas,
+// the quotas which are not used yet are included.
+func listUsage() ([]common.Usage, error) {
+	usage, err := common.GetConfigMap().ListUsage()
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int)
+	for i := range usage {
+		index[usageKey(usage[i].Group, usage[i].Identity)] = i
+	}
+	for _, q := range trackerQuotas() {
+		i, ok := index[usageKey(q.Group, q.Identity)]
+		if !ok {
+			usage = append(usage, common.Usage{Group: q.Group, Identity: q.Identity})
+			i = len(usage) - 1
+		}
+		usage[i].MaxBytes, usage[i].MaxFiles = q.MaxBytes, q.MaxFiles
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if (usage[i].Group == "") != (usage[j].Group == "") {
+			return usage[i].Group != ""
+		}
+		return usage[i].Group+usage[i].Identity < usage[j].Group+usage[j].Identity
+	})
+	return usage, nil
+}
+
+// usageHandler responses the usage with the quotas as body.
+func usageHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	usage, err := listUsage()
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error list usage: " + err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(usage)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// httpUsage responses the usage with the quotas in json.
+func httpUsage(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedTrackerConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+	usage, err := listUsage()
+	if err != nil {
+		logger.Error("error list usage: ", err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	retJSON, err := json.Marshal(usage)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
+
+// InitQuotaRefresher starts a timer job which fetches the usage with the quotas from trackers,
+// uploads are not limited until the usage is fetched.
+func InitQuotaRefresher() {
+	timer.Start(time.Second*3, common.REGISTER_INTERVAL, 0, func(t *timer.Timer) {
+		if clientAPI == nil || coordinator.isShuttingDown() {
+			return
+		}
+		refreshQuotaUsage()
+	})
+}
+
+// refreshQuotaUsage fetches the usage with the quotas from the first tracker which answers,
+// the last fetched usage is kept if no tracker answers.
+func refreshQuotaUsage() {
+	trackers := parsedTrackers()
+	for i := range trackers {
+		server := &trackers[i]
+		usage, err := clientAPI.QueryUsage(server)
+		if err != nil {
+			logger.Debug("error query usage from tracker server ", server.ConnectionString(), ": ", err)
+			continue
+		}
+		setQuotaUsage(usage)
+		return
+	}
+}
+
+// setQuotaUsage replaces the usage of the quotas.
+func setQuotaUsage(usage []common.Usage) {
+	m := make(map[string]common.Usage)
+	for _, u := range usage {
+		if u.MaxBytes > 0 || u.MaxFiles > 0 {
+			m[usageKey(u.Group, u.Identity)] = u
+		}
+	}
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	quotaUsage = m
+}
+
+// reserveQuota charges the upload to the usage of the group and the identity,
+// it returns the usage whose quota would be exceeded without charging, or nil.
+//
+// Trackers count the upload after its binlog is pushed and their usage is fetched again,
+// meanwhile it is counted by a pending charge which is dropped after common.QUOTA_PENDING_TTL.
+// A charge may be counted twice in the period, which errs on rejecting uploads,
+// and uploads which fail after the reservation are charged until the charge is dropped.
+func reserveQuota(group, identity string, size int64, now time.Time) *common.Usage {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+
+	dropped := 0
+	for _, p := range pendingCharges {
+		if now.Sub(p.time) < common.QUOTA_PENDING_TTL {
+			break
+		}
+		addPendingUsage(&p.charge, -1)
+		dropped++
+	}
+	pendingCharges = pendingCharges[dropped:]
+
+	charge := common.UsageCharge{Group: group, Identity: identity, Bytes: size}
+	limited := false
+	for _, key := range chargeKeys(&charge) {
+		u, ok := quotaUsage[key]
+		if !ok {
+			continue
+		}
+		if p := pendingUsage[key]; p != nil {
+			u.Bytes += p.Bytes
+			u.Files += p.Files
+		}
+		if u.Exceeded(size, 1) {
+			return &u
+		}
+		limited = true
+	}
+	// uploads out of quotas are not tracked.
+	if limited {
+		addPendingUsage(&charge, 1)
+		pendingCharges = append(pendingCharges, pendingCharge{charge: charge, time: now})
+	}
+	return nil
+}
+
+// chargeKeys returns the keys of the usage the charge counts in.
+func chargeKeys(charge *common.UsageCharge) []string {
+	keys := []string{usageKey(charge.Group, "")}
+	if charge.Identity != "" {
+		keys = append(keys, usageKey("", charge.Identity))
+	}
+	return keys
+}
+
+func addPendingUsage(charge *common.UsageCharge, files int64) {
+	for _, key := range chargeKeys(charge) {
+		p := pendingUsage[key]
+		if p == nil {
+			p = &common.Usage{}
+			pendingUsage[key] = p
+		}
+		p.Bytes += charge.Bytes * files
+		p.Files += files
+		if p.Files <= 0 {
+			delete(pendingUsage, key)
+		}
+	}
+}
+
+// quotaExceededMessage describes the exceeded quota.
+func quotaExceededMessage(u *common.Usage) string {
+	return common.QuotaExceededErr.Error() + ": " + quotaName(u)
+}
+
+// identityPatternRegexp matches the identities of uploads.
+var identityPatternRegexp = regexp.MustCompile(common.IDENTITY_PATTERN)
+
+// validIdentity judges whether the identity of an upload is valid, empty identity is valid.
+func validIdentity(identity string) bool {
+	return identity == "" || identityPatternRegexp.MatchString(identity)
+}
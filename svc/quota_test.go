@@ -0,0 +1,111 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChargeUsage(t *testing.T) {
+	dir, teardown := setupTestTracker(t, &common.TrackerConfig{
+		Quotas: []common.Quota{
+			{Group: "G01", MaxBytes: 100},
+			{Identity: "bob", MaxFiles: 1},
+		},
+	})
+	defer teardown()
+	dataset = newTestSetIndex(t, dir)
+
+	now := time.Now()
+	id1 := util.CreateAlias("G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", "storage0", false, now)
+	id2 := util.CreateAlias("G01/0C/2D/0123456789abcdef0123456789abcdef", "storage0", false, now)
+	id3 := util.CreateAlias("G01/0E/3F/fedcba9876543210fedcba9876543210", "storage0", false, now)
+	owned := &common.FileMeta{Owner: "alice"}
+	if added, err := addFileIds([]common.BingLogDTO{
+		{FileId: id1, SourceInstance: "storage0", FileLength: 10, Meta: owned},
+		{FileId: id2, SourceInstance: "storage0", FileLength: 20, ExpireTime: now.Unix() + 60, Meta: owned},
+		// expired files are not charged.
+		{FileId: id3, SourceInstance: "storage0", FileLength: 40, ExpireTime: now.Unix() - 1},
+	}); err != nil || added != 3 {
+		t.Fatal("unexpected added count: ", added, err)
+	}
+	// fileIds pushed by the other group members are not charged again.
+	if _, err := addFileIds([]common.BingLogDTO{{FileId: id1, SourceInstance: "storage1", FileLength: 10, Meta: owned}}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertUsage := func(expect []common.Usage) {
+		usage, err := listUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(usage, expect) {
+			t.Fatal("unexpected usage: ", usage)
+		}
+	}
+	assertUsage([]common.Usage{
+		{Group: "G01", Bytes: 30, Files: 2, MaxBytes: 100},
+		{Identity: "alice", Bytes: 30, Files: 2},
+		{Identity: "bob", MaxFiles: 1},
+	})
+
+	if n := releaseExpiredUsage(now); n != 0 {
+		t.Fatal("usage of unexpired files is released: ", n)
+	}
+	if n := releaseExpiredUsage(now.Add(time.Minute * 2)); n != 1 {
+		t.Fatal("unexpected released count: ", n)
+	}
+	assertUsage([]common.Usage{
+		{Group: "G01", Bytes: 10, Files: 1, MaxBytes: 100},
+		{Identity: "alice", Bytes: 10, Files: 1},
+		{Identity: "bob", MaxFiles: 1},
+	})
+}
+
+func TestReserveQuota(t *testing.T) {
+	defer func(u map[string]common.Usage) {
+		quotaUsage = u
+		pendingCharges = nil
+		pendingUsage = make(map[string]*common.Usage)
+	}(quotaUsage)
+
+	setQuotaUsage([]common.Usage{
+		{Group: "G01", Bytes: 80, Files: 1, MaxBytes: 100},
+		{Identity: "alice", Files: 1, MaxFiles: 2},
+		{Identity: "bob", Bytes: 1000, Files: 1000},
+	})
+	now := time.Now()
+	if u := reserveQuota("G01", "", 15, now); u != nil {
+		t.Fatal("upload in quota is rejected: ", quotaName(u))
+	}
+	// pending uploads are counted.
+	if u := reserveQuota("G01", "bob", 10, now); u == nil || u.Group != "G01" {
+		t.Fatal("upload over group quota is accepted")
+	}
+	if u := reserveQuota("G01", "", 5, now); u != nil {
+		t.Fatal("rejected upload is charged: ", quotaName(u))
+	}
+	if u := reserveQuota("G02", "alice", 1, now); u != nil {
+		t.Fatal("upload in quota is rejected: ", quotaName(u))
+	}
+	if u := reserveQuota("G02", "alice", 1, now); u == nil || u.Identity != "alice" {
+		t.Fatal("upload over identity quota is accepted")
+	}
+	// uploads out of quotas are not limited.
+	if u := reserveQuota("G02", "bob", 1<<30, now); u != nil {
+		t.Fatal("upload out of quotas is rejected: ", quotaName(u))
+	}
+	if len(pendingCharges) != 3 {
+		t.Fatal("unexpected pending charges: ", len(pendingCharges))
+	}
+
+	// pending charges are dropped when trackers should have counted them.
+	if u := reserveQuota("G02", "alice", 1, now.Add(common.QUOTA_PENDING_TTL)); u != nil {
+		t.Fatal("expired pending charge is counted: ", quotaName(u))
+	}
+	if len(pendingCharges) != 1 || pendingUsage["g/G01"] != nil {
+		t.Fatal("expired pending charges are kept: ", len(pendingCharges))
+	}
+}
@@ -0,0 +1,96 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/set"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testSecret is the secret of the servers set up by tests.
+const testSecret = "123456"
+
+// setupTestStorage sets up a storage server of the config in a temporary data dir,
+// whose DataDir, TmpDir and Secret are filled if they are empty.
+//
+// The returned function closes the config map, removes the dir
+// and restores every global changed by the test.
+func setupTestStorage(t *testing.T, config *common.StorageConfig) (string, func()) {
+	return setupTestServer(t, common.BOOT_STORAGE, func(dir string) {
+		if config.DataDir == "" {
+			config.DataDir = dir
+		}
+		if config.TmpDir == "" {
+			config.TmpDir = dir
+		}
+		if config.Secret == "" {
+			config.Secret = testSecret
+		}
+		common.InitializedStorageConfiguration = config
+	})
+}
+
+// setupTestTracker sets up a tracker server of the config in a temporary data dir,
+// whose DataDir and Secret are filled if they are empty, like setupTestStorage.
+func setupTestTracker(t *testing.T, config *common.TrackerConfig) (string, func()) {
+	return setupTestServer(t, common.BOOT_TRACKER, func(dir string) {
+		if config.DataDir == "" {
+			config.DataDir = dir
+		}
+		if config.Secret == "" {
+			config.Secret = testSecret
+		}
+		common.InitializedTrackerConfiguration = config
+	})
+}
+
+func setupTestServer(t *testing.T, bootAs common.BootMode, configure func(dir string)) (string, func()) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := func(bm common.BootMode, sc *common.StorageConfig, tc *common.TrackerConfig,
+		cm *common.ConfigMap, m binlog.XBinlogManager, ds FileIndex) func() {
+		return func() {
+			common.BootAs = bm
+			common.InitializedStorageConfiguration = sc
+			common.InitializedTrackerConfiguration = tc
+			common.SetConfigMap(cm)
+			writableBinlogManager = m
+			dataset = ds
+		}
+	}(common.BootAs, common.InitializedStorageConfiguration, common.InitializedTrackerConfiguration,
+		common.GetConfigMap(), writableBinlogManager, dataset)
+
+	common.BootAs = bootAs
+	configure(dir)
+	util.GenerateDecKey(testSecret)
+	cm, err := common.NewConfigMap(dir + "/cfg.dat")
+	if err != nil {
+		restore()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	common.SetConfigMap(cm)
+	return dir, func() {
+		cm.Close()
+		restore()
+		os.RemoveAll(dir)
+	}
+}
+
+// newTestSetIndex opens a set index of fileIds in the dir.
+func newTestSetIndex(t *testing.T, dir string) *setIndex {
+	m, err := set.NewFileMap(1<<10, 8, dir+"/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := set.NewAppendFile(common.FILE_ID_SIZE, 2, dir+"/aof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &setIndex{set.NewDataSet(m, a)}
+}
@@ -0,0 +1,222 @@
+package svc
+
+import (
+	"context"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox/logger"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownCoordinator coordinates graceful shutdown of a server:
+// listeners stop accepting, in-flight requests finish
+// and states are flushed before the process exits.
+type shutdownCoordinator struct {
+	lock         *sync.Mutex
+	shuttingDown bool
+	listeners    []net.Listener
+	httpServers  []*http.Server
+	conns        map[net.Conn]bool
+	inflight     sync.WaitGroup
+	done         chan struct{}
+}
+
+var coordinator = newShutdownCoordinator()
+
+func newShutdownCoordinator() *shutdownCoordinator {
+	return &shutdownCoordinator{
+		lock:  new(sync.Mutex),
+		conns: make(map[net.Conn]bool),
+		done:  make(chan struct{}),
+	}
+}
+
+// registerListener registers a tcp listener which is closed on shutdown.
+func (c *shutdownCoordinator) registerListener(l net.Listener) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.listeners = append(c.listeners, l)
+}
+
+// registerHttpServer registers a http server which is shutdown on shutdown.
+func (c *shutdownCoordinator) registerHttpServer(s *http.Server) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.httpServers = append(c.httpServers, s)
+}
+
+// trackConn registers an accepted tcp connection which is closed
+// if its requests are interrupted on shutdown,
+// it returns false if the server is shutting down.
+func (c *shutdownCoordinator) trackConn(conn net.Conn) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.conns[conn] = true
+	return true
+}
+
+// untrackConn unregisters a closed tcp connection.
+func (c *shutdownCoordinator) untrackConn(conn net.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.conns, conn)
+}
+
+// trackHttp marks the http requests served by the handler as in-flight,
+// requests arriving during shutdown are refused.
+func (c *shutdownCoordinator) trackHttp(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.beginRequest() {
+			util.HttpWriteResponse(w, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		defer c.endRequest()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// beginRequest marks a request as in-flight,
+// it returns false if the server is shutting down.
+func (c *shutdownCoordinator) beginRequest() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.inflight.Add(1)
+	return true
+}
+
+// endRequest marks an in-flight request as finished.
+func (c *shutdownCoordinator) endRequest() {
+	c.inflight.Done()
+}
+
+func (c *shutdownCoordinator) isShuttingDown() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.shuttingDown
+}
+
+// shutdown stops accepting new requests and waits for in-flight requests
+// until they finish or the timeout is reached,
+// the connections of the requests still running are closed after the timeout.
+//
+// beforeDrain runs before waiting for in-flight requests
+// and afterDrain runs after that, both could be nil.
+// afterDrain is told whether all the requests have returned,
+// shared states must not be closed if they have not.
+func (c *shutdownCoordinator) shutdown(timeout time.Duration, beforeDrain func(), afterDrain func(drained bool)) {
+	c.lock.Lock()
+	if c.shuttingDown {
+		c.lock.Unlock()
+		return
+	}
+	c.shuttingDown = true
+	listeners, httpServers := c.listeners, c.httpServers
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	if beforeDrain != nil {
+		beforeDrain()
+	}
+
+	wg := new(sync.WaitGroup)
+	for _, s := range httpServers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logger.Warn("error shutdown http server: ", err)
+			}
+		}(s)
+	}
+	finished := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(finished)
+	}()
+	drained := true
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		logger.Warn("shutdown timeout, in-flight requests are interrupted")
+		drained = c.interrupt(finished)
+	}
+	wg.Wait()
+
+	if afterDrain != nil {
+		afterDrain(drained)
+	}
+	close(c.done)
+}
+
+// interrupt closes the connections of in-flight requests,
+// and waits for the requests to return until common.SHUTDOWN_FORCE_TIMEOUT.
+//
+// It returns whether all the requests have returned.
+func (c *shutdownCoordinator) interrupt(finished chan struct{}) bool {
+	c.lock.Lock()
+	httpServers := c.httpServers
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.lock.Unlock()
+	for _, s := range httpServers {
+		s.Close()
+	}
+	select {
+	case <-finished:
+		return true
+	case <-time.After(common.SHUTDOWN_FORCE_TIMEOUT):
+		logger.Error("interrupted requests do not return, states are not flushed")
+		return false
+	}
+}
+
+// handleShutdownSignals shuts the server down gracefully on SIGTERM or SIGINT,
+// a second signal forces the server to exit immediately.
+func handleShutdownSignals(beforeDrain func(), afterDrain func(drained bool)) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		logger.Info("receive signal ", sig, ", shutting down")
+		go func() {
+			<-ch
+			logger.Warn("forced shutdown")
+			os.Exit(1)
+		}()
+		coordinator.shutdown(common.SHUTDOWN_TIMEOUT, beforeDrain, afterDrain)
+		logger.Info("server shutdown")
+	}()
+}
+
+// waitForShutdown blocks until the server shutdown finishes.
+func waitForShutdown() {
+	<-coordinator.done
+}
+
+// closeConfigMap closes the bolt database if it is opened.
+func closeConfigMap() {
+	if common.GetConfigMap() == nil {
+		return
+	}
+	if err := common.GetConfigMap().Close(); err != nil {
+		logger.Error("error close config map: ", err)
+	}
+}
@@ -0,0 +1,74 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownCoordinator(t *testing.T) {
+	c := newShutdownCoordinator()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.registerListener(l)
+	if !c.beginRequest() {
+		t.Fatal("request is refused before shutdown")
+	}
+
+	drained := false
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		drained = true
+		c.endRequest()
+	}()
+	c.shutdown(time.Second*5, nil, func(ok bool) {
+		if !drained || !ok {
+			t.Error("states are flushed before in-flight request finished")
+		}
+	})
+
+	if c.beginRequest() {
+		t.Fatal("request is accepted after shutdown")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("listener is not closed")
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("shutdown is not finished")
+	}
+
+	// in-flight requests are interrupted after timeout.
+	c = newShutdownCoordinator()
+	c.beginRequest()
+	start := time.Now()
+	c.shutdown(time.Millisecond*100, nil, func(ok bool) {
+		if ok {
+			t.Error("hanging request is reported as returned")
+		}
+	})
+	if time.Since(start) > time.Millisecond*100+common.SHUTDOWN_FORCE_TIMEOUT*2 {
+		t.Fatal("shutdown does not respect the timeout")
+	}
+
+	// connections of interrupted requests are closed, so the requests return.
+	c = newShutdownCoordinator()
+	server, client := net.Pipe()
+	defer client.Close()
+	if !c.trackConn(server) || !c.beginRequest() {
+		t.Fatal("connection is refused before shutdown")
+	}
+	go func() {
+		defer c.endRequest()
+		server.Read(make([]byte, 1))
+	}()
+	c.shutdown(time.Millisecond*100, nil, func(ok bool) {
+		if !ok {
+			t.Error("interrupted request is reported as running")
+		}
+	})
+}
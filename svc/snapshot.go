@@ -0,0 +1,602 @@
+package svc
+
+import (
+	"archive/tar"
+	"errors"
+	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	"github.com/hetianyi/gox/uuid"
+	json "github.com/json-iterator/go"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// max size of a snapshot chunk, the last batch may exceed it.
+	snapshotChunkSize int64 = 64 << 20
+	// max files of a snapshot chunk.
+	snapshotChunkFiles = 1000
+	// binlog fetch size when packing a snapshot chunk.
+	snapshotFetchSize = 16
+
+	// pax record keys of snapshot entries.
+	paxFileId = "GODFS.fileId"
+	paxSource = "GODFS.source"
+	paxLength = "GODFS.length"
+	paxBlob   = "GODFS.blob"
+	paxExpire = "GODFS.expire"
+	paxMeta   = "GODFS.meta"
+
+	// blob states of snapshot entries.
+	blobIncluded = "included"
+	blobShared   = "shared"  // the blob is included by a previous entry of the chunk
+	blobMissing  = "missing" // the blob does not exist on the source server
+)
+
+var (
+	snapshotStateKey = "snapshotBootstrapState"
+	bootstrapping    bool
+	bootstrapLock    = new(sync.Mutex)
+)
+
+// snapshotChunkReader reads a snapshot chunk from the temporary file,
+// the file is deleted once it is read to the end.
+type snapshotChunkReader struct {
+	f      *os.File
+	remain int64
+	closed bool
+}
+
+func (r *snapshotChunkReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+	n, err := r.f.Read(p)
+	r.remain -= int64(n)
+	if r.remain <= 0 || err != nil {
+		r.closed = true
+		r.f.Close()
+		file.Delete(r.f.Name())
+	}
+	return n, err
+}
+
+// positionReached judges whether the binlog position pos reaches end.
+func positionReached(pos, end *common.BinlogQueryDTO) bool {
+	return pos.FileIndex > end.FileIndex ||
+		(pos.FileIndex == end.FileIndex && pos.Offset >= end.Offset)
+}
+
+// isBootstrapping judges whether this server is bootstrapping from a snapshot.
+func isBootstrapping() bool {
+	bootstrapLock.Lock()
+	defer bootstrapLock.Unlock()
+	return bootstrapping
+}
+
+func setBootstrapping(b bool) {
+	bootstrapLock.Lock()
+	defer bootstrapLock.Unlock()
+	bootstrapping = b
+}
+
+// snapshotHandler serves snapshot requests from new group members.
+//
+// Action "begin" returns the snapshot info,
+// action "data" returns a chunk of snapshot data beginning at the binlog position.
+func snapshotHandler(header *common.Header, peer bool) (*common.Header, io.Reader, int64, error) {
+	if !peer {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "snapshot is only available for group members",
+		}, nil, 0, nil
+	}
+	if header.Attributes == nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	switch header.Attributes["action"] {
+	case "begin":
+		return snapshotBeginHandler()
+	case "data":
+		return snapshotDataHandler(header)
+	}
+	return &common.Header{
+		Result: common.ERROR,
+		Msg:    "invalid header(1)",
+	}, nil, 0, nil
+}
+
+// snapshotBeginHandler returns the binlog synchronization states
+// and the binlog end position of this server.
+//
+// The states are taken before the end position,
+// so every binlog before the states is included by the snapshot.
+func snapshotBeginHandler() (*common.Header, io.Reader, int64, error) {
+	snapshot := &common.SnapshotDTO{
+		InstanceId: common.InitializedStorageConfiguration.InstanceId,
+		States:     make(map[string]*common.BinlogQueryDTO),
+	}
+	syncLock.Lock()
+	for k, v := range synchronizationState {
+		snapshot.States[k] = &common.BinlogQueryDTO{
+			FileIndex: v.FileIndex,
+			Offset:    v.Offset,
+		}
+	}
+	syncLock.Unlock()
+
+	end, err := binlog.GetBinlogEndPosition()
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error get binlog position: " + err.Error(),
+		}, nil, 0, nil
+	}
+	snapshot.Position = *end
+
+	data, err := json.MarshalToString(snapshot)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"snapshot": data,
+		},
+	}, nil, 0, nil
+}
+
+// snapshotDataHandler packs a chunk of snapshot data into a temporary file
+// and sends it as body.
+func snapshotDataHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	position := &common.BinlogQueryDTO{}
+	if err := json.UnmarshalFromString(header.Attributes["position"], position); err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(2)",
+		}, nil, 0, nil
+	}
+
+	tmpFileName := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
+	out, err := file.CreateFile(tmpFileName)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	next, files, err := packSnapshotChunk(position, out)
+	if err != nil {
+		out.Close()
+		file.Delete(tmpFileName)
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error pack snapshot: " + err.Error(),
+		}, nil, 0, nil
+	}
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		out.Close()
+		file.Delete(tmpFileName)
+		return nil, nil, 0, err
+	}
+	data, _ := json.MarshalToString(next)
+
+	logger.Debug("send snapshot chunk: ", files, " files, ", size, " bytes")
+
+	return &common.Header{
+		Result: common.SUCCESS,
+		Attributes: map[string]string{
+			"next":  data,
+			"files": convert.IntToStr(files),
+		},
+	}, syncRateLimiter.NewReader(&snapshotChunkReader{
+		f:      out,
+		remain: size,
+	}), size, nil
+}
+
+// packSnapshotChunk writes the files of local binlogs beginning at the position
+// to out as a tar stream, and returns the binlog position of the next chunk.
+func packSnapshotChunk(position *common.BinlogQueryDTO, out io.Writer) (*common.BinlogQueryDTO, int, error) {
+	end, err := binlog.GetBinlogEndPosition()
+	if err != nil {
+		return nil, 0, err
+	}
+	next := *position
+	tw := tar.NewWriter(out)
+	sent := make(map[string]bool)
+	var size int64 = 0
+	files := 0
+	for size < snapshotChunkSize && files < snapshotChunkFiles {
+		bls, nOffset, err := writableBinlogManager.Read(next.FileIndex, next.Offset, snapshotFetchSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(bls) == 0 {
+			if next.FileIndex >= end.FileIndex {
+				break
+			}
+			next.FileIndex++
+			next.Offset = 0
+			continue
+		}
+		n, err := writeSnapshotEntries(tw, bls, sent)
+		if err != nil {
+			return nil, 0, err
+		}
+		size += n
+		files += len(bls)
+		next.Offset = nOffset
+	}
+	if err := tw.Close(); err != nil {
+		return nil, 0, err
+	}
+	return &next, files, nil
+}
+
+// writeSnapshotEntries writes an entry for each binlog,
+// the blob file is included only for the first fileId referencing it.
+func writeSnapshotEntries(tw *tar.Writer, bls []common.BingLogDTO, sent map[string]bool) (int64, error) {
+	var size int64 = 0
+	for _, bl := range bls {
+		fInfo, _, err := util.ParseAlias(bl.FileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			logger.Debug("snapshot: skip invalid fileId ", bl.FileId)
+			continue
+		}
+		path := util.GetFileRelativePath(fInfo)
+		h := &tar.Header{
+			Name:     path,
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				paxFileId: bl.FileId,
+				paxSource: bl.SourceInstance,
+				paxLength: convert.Int64ToStr(bl.FileLength),
+				paxBlob:   blobIncluded,
+			},
+		}
+		if bl.ExpireTime > 0 {
+			h.PAXRecords[paxExpire] = convert.Int64ToStr(bl.ExpireTime)
+		}
+		if bl.Meta != nil {
+			meta, err := json.MarshalToString(bl.Meta)
+			if err != nil {
+				return size, err
+			}
+			h.PAXRecords[paxMeta] = meta
+		}
+		var blob *util.Blob
+		if sent[path] {
+			h.PAXRecords[paxBlob] = blobShared
+		} else if fileExpired(bl.FileId) {
+			h.PAXRecords[paxBlob] = blobMissing
+		} else if blob, err = util.OpenBlob(path); err != nil {
+			h.PAXRecords[paxBlob] = blobMissing
+		} else {
+			// the entry includes the reference count tail,
+			// which is kept in the volume index for packed blobs.
+			h.Size = blob.Size() + 4
+			h.ModTime = blob.ModTime
+			sent[path] = true
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			if blob != nil {
+				blob.Close()
+			}
+			return size, err
+		}
+		if blob != nil {
+			err := writeBlobEntry(tw, blob)
+			blob.Close()
+			if err != nil {
+				return size, err
+			}
+			size += h.Size
+		}
+	}
+	return size, nil
+}
+
+// writeBlobEntry writes the content of the blob followed by its reference count tail.
+func writeBlobEntry(w io.Writer, blob *util.Blob) error {
+	if _, err := io.Copy(w, blob); err != nil {
+		return err
+	}
+	tailRefBytes := make([]byte, 8)
+	convert.Length2Bytes(blob.RefCount, tailRefBytes)
+	_, err := w.Write(tailRefBytes[4:])
+	return err
+}
+
+// applySnapshotChunk extracts a snapshot chunk into the data dir,
+// record is called for every fileId whose blob is present,
+// and the binlogs of the fileIds whose blob is missing are returned.
+func applySnapshotChunk(r io.Reader, record func(bl *common.BingLogDTO) error) (int, []common.BingLogDTO, error) {
+	tr := tar.NewReader(r)
+	files := 0
+	var missing []common.BingLogDTO
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files, missing, nil
+		}
+		if err != nil {
+			return files, missing, err
+		}
+		length, err := convert.StrToInt64(h.PAXRecords[paxLength])
+		if err != nil {
+			return files, missing, errors.New("invalid snapshot entry: " + h.Name)
+		}
+		bl := &common.BingLogDTO{
+			FileId:         h.PAXRecords[paxFileId],
+			SourceInstance: h.PAXRecords[paxSource],
+			FileLength:     length,
+		}
+		if expire, ok := h.PAXRecords[paxExpire]; ok {
+			if bl.ExpireTime, err = convert.StrToInt64(expire); err != nil {
+				return files, missing, errors.New("invalid snapshot entry: " + h.Name)
+			}
+		}
+		if meta, ok := h.PAXRecords[paxMeta]; ok {
+			bl.Meta = &common.FileMeta{}
+			if err := json.UnmarshalFromString(meta, bl.Meta); err != nil {
+				return files, missing, errors.New("invalid snapshot entry: " + h.Name)
+			}
+		}
+		// the target path is parsed from the fileId rather than the entry name.
+		fInfo, _, err := util.ParseAlias(bl.FileId, common.InitializedStorageConfiguration.Secret)
+		if err != nil {
+			return files, missing, errors.New("invalid snapshot entry: " + h.Name)
+		}
+		files++
+		if h.PAXRecords[paxBlob] == blobIncluded {
+			if err := extractSnapshotBlob(tr, h.Size, util.GetFileRelativePath(fInfo)); err != nil {
+				return files, missing, err
+			}
+		}
+		if !util.ExistsFile(fInfo) {
+			missing = append(missing, *bl)
+			continue
+		}
+		if err := record(bl); err != nil {
+			return files, missing, err
+		}
+	}
+}
+
+// extractSnapshotBlob moves a blob of the snapshot into the data dir,
+// existing blobs are kept.
+func extractSnapshotBlob(r io.Reader, size int64, path string) error {
+	defer lockBlob(path)()
+
+	if util.BlobExists(path) {
+		return nil
+	}
+	tmpFileName := common.InitializedStorageConfiguration.TmpDir + "/" + uuid.UUID()
+	out, err := file.CreateFile(tmpFileName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		file.Delete(tmpFileName)
+	}()
+	if _, err := io.CopyN(out, r, size); err != nil {
+		return err
+	}
+	out.Close()
+	_, err = util.PlaceBlob(tmpFileName, path)
+	return err
+}
+
+// recordSnapshotFile writes binlog and dataset of a file from the snapshot.
+func recordSnapshotFile(bl *common.BingLogDTO) error {
+	return DoIfNotExist(bl.FileId, func() error {
+		// the reference count tail of the snapshot blob counts the fileId.
+		if err := saveFileMeta(bl.FileId, binlogFileMeta(bl), true); err != nil {
+			return err
+		}
+		b := binlog.CreateLocalBinlog(bl.FileId, bl.FileLength, bl.SourceInstance)
+		b.ExpireTime = bl.ExpireTime
+		b.Meta = bl.Meta
+		if err := writableBinlogManager.Write(b); err != nil {
+			return err
+		}
+		return Add(bl.FileId)
+	})
+}
+
+func loadSnapshotBootstrapState() (*common.SnapshotBootstrapState, error) {
+	bs, err := common.GetConfigMap().GetConfig(snapshotStateKey)
+	if err != nil || len(bs) == 0 {
+		return nil, err
+	}
+	state := &common.SnapshotBootstrapState{}
+	if err := json.Unmarshal(bs, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func saveSnapshotBootstrapState(state *common.SnapshotBootstrapState) error {
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return common.GetConfigMap().PutConfig(snapshotStateKey, bs)
+}
+
+// InitSnapshotBootstrap starts snapshot bootstrap if it is enabled
+// and this server is new to the group or the last bootstrap is not finished.
+//
+// Binlog watchers and anti-entropy wait until the bootstrap is done.
+func InitSnapshotBootstrap() {
+	if !common.InitializedStorageConfiguration.Bootstrap {
+		return
+	}
+	state, err := loadSnapshotBootstrapState()
+	if err != nil {
+		logger.Error("error load snapshot bootstrap state: ", err)
+		return
+	}
+	if state == nil {
+		hasBinlog := false
+		if err := walkLocalBinlogs(func(bl *common.BingLogDTO) bool {
+			hasBinlog = true
+			return true
+		}); err != nil {
+			logger.Error("error read binlog: ", err)
+			return
+		}
+		if hasBinlog {
+			logger.Warn("snapshot bootstrap is skipped because this server already has files")
+			return
+		}
+		state = &common.SnapshotBootstrapState{}
+	}
+	if state.Done {
+		logger.Debug("snapshot bootstrap is already done")
+		return
+	}
+	setBootstrapping(true)
+	timer.Start(time.Second*5, time.Second*10, 0, func(t *timer.Timer) {
+		done, err := bootstrapSnapshot(state)
+		if err != nil {
+			logger.Error("snapshot bootstrap: ", err)
+			return
+		}
+		if done {
+			setBootstrapping(false)
+			t.Destroy()
+		}
+	})
+}
+
+// bootstrapSnapshot transfers the snapshot chunk by chunk,
+// the state is saved after each chunk so the transfer can be resumed.
+func bootstrapSnapshot(state *common.SnapshotBootstrapState) (bool, error) {
+	if clientAPI == nil {
+		return false, nil
+	}
+	members := filterGroupMembers(api.FilterInstances(common.ROLE_STORAGE),
+		common.InitializedStorageConfiguration.Group)
+	var server *common.Server
+	if state.Snapshot != nil {
+		gox.WalkList(members, func(item interface{}) bool {
+			if item.(*common.Instance).InstanceId == state.Snapshot.InstanceId {
+				server = &item.(*common.Instance).Server
+				return true
+			}
+			return false
+		})
+		if server == nil {
+			// files already received are kept, they are skipped by the new snapshot.
+			logger.Warn("snapshot source ", state.Snapshot.InstanceId,
+				" is unavailable, bootstrap from another member")
+			state.Snapshot = nil
+			state.Cursor = common.BinlogQueryDTO{}
+		}
+	}
+	if state.Snapshot == nil {
+		if members.Len() == 0 {
+			logger.Debug("snapshot bootstrap: no group member available")
+			return false, nil
+		}
+		server = &members.Front().Value.(*common.Instance).Server
+		snapshot, err := clientAPI.SnapshotBegin(server)
+		if err != nil {
+			return false, err
+		}
+		state.Snapshot = snapshot
+		if err := saveSnapshotBootstrapState(state); err != nil {
+			return false, err
+		}
+		logger.Info("snapshot bootstrap from ", server.ConnectionString(), "(", server.InstanceId, ")")
+	}
+
+	for !positionReached(&state.Cursor, &state.Snapshot.Position) {
+		var missing []common.BingLogDTO
+		progressed := false
+		err := clientAPI.SnapshotData(server, &state.Cursor, func(next *common.BinlogQueryDTO, body io.Reader, bodyLength int64) error {
+			files, m, err := applySnapshotChunk(syncRateLimiter.NewReader(io.LimitReader(body, bodyLength)), recordSnapshotFile)
+			if err != nil {
+				return err
+			}
+			progressed = next.FileIndex != state.Cursor.FileIndex || next.Offset != state.Cursor.Offset
+			missing = m
+			state.Cursor = *next
+			state.Files += files
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		for i := range missing {
+			if err := syncFile(&missing[i], nil); err != nil {
+				logger.Debug("snapshot bootstrap: error synchronize missing file ", missing[i].FileId, ": ", err)
+			}
+		}
+		if err := saveSnapshotBootstrapState(state); err != nil {
+			return false, err
+		}
+		logger.Info("snapshot bootstrap: ", state.Files, " files received, binlog position ",
+			state.Cursor.FileIndex, ":", state.Cursor.Offset, "/",
+			state.Snapshot.Position.FileIndex, ":", state.Snapshot.Position.Offset)
+		// the source binlog is never truncated, no progress means it is at the end.
+		if !progressed {
+			break
+		}
+	}
+	return true, finishSnapshotBootstrap(state)
+}
+
+// finishSnapshotBootstrap saves the binlog synchronization states of the snapshot,
+// so binlog watchers continue from the snapshot position.
+func finishSnapshotBootstrap(state *common.SnapshotBootstrapState) error {
+	states := make(map[string]*common.BinlogQueryDTO)
+	for k, v := range state.Snapshot.States {
+		if k != common.InitializedStorageConfiguration.InstanceId && v != nil {
+			states[k] = v
+		}
+	}
+	cursor := state.Cursor
+	states[state.Snapshot.InstanceId] = &cursor
+
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	for k, v := range states {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := common.GetConfigMap().PutConfig(configKeyPrefix+k, bs); err != nil {
+			return err
+		}
+		synchronizationState[k] = v
+	}
+	state.Done = true
+	if err := saveSnapshotBootstrapState(state); err != nil {
+		return err
+	}
+	logger.Info("snapshot bootstrap finished: ", state.Files, " files")
+	return nil
+}
@@ -0,0 +1,93 @@
+package svc
+
+import (
+	"archive/tar"
+	"bytes"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPositionReached(t *testing.T) {
+	end := &common.BinlogQueryDTO{FileIndex: 1, Offset: 100}
+	cases := []struct {
+		pos    common.BinlogQueryDTO
+		expect bool
+	}{
+		{common.BinlogQueryDTO{FileIndex: 0, Offset: 200}, false},
+		{common.BinlogQueryDTO{FileIndex: 1, Offset: 99}, false},
+		{common.BinlogQueryDTO{FileIndex: 1, Offset: 100}, true},
+		{common.BinlogQueryDTO{FileIndex: 2, Offset: 0}, true},
+	}
+	for _, c := range cases {
+		if positionReached(&c.pos, end) != c.expect {
+			t.Fatal("unexpected result of position ", c.pos)
+		}
+	}
+}
+
+func TestSnapshotChunk(t *testing.T) {
+	srcDir, teardown := setupTestStorage(t, &common.StorageConfig{})
+	defer teardown()
+	dstDir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	now := time.Now()
+	shared := "G01/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d"
+	bls := []common.BingLogDTO{
+		{FileId: util.CreateAlias(shared, "aaaaaaaa", true, now), SourceInstance: "aaaaaaaa", FileLength: 3,
+			Meta: &common.FileMeta{Name: "a.txt", ContentType: "text/plain", Size: 3}},
+		{FileId: util.CreateAlias(shared, "bbbbbbbb", false, now), SourceInstance: "bbbbbbbb", FileLength: 3},
+		{FileId: util.CreateAlias("G01/0C/2D/0123456789abcdef0123456789abcdef", "aaaaaaaa", true, now),
+			SourceInstance: "aaaaaaaa", FileLength: 3},
+	}
+	os.MkdirAll(srcDir+"/0A/1B", 0755)
+	blob := append([]byte("abc"), tailRefCount...)
+	if err := ioutil.WriteFile(srcDir+"/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d", blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	size, err := writeSnapshotEntries(tw, bls, make(map[string]bool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	if size != int64(len(blob)) {
+		t.Fatal("shared blob is sent more than once: ", size)
+	}
+
+	common.InitializedStorageConfiguration.DataDir = dstDir
+	common.InitializedStorageConfiguration.TmpDir = dstDir
+	var recorded []string
+	files, missing, err := applySnapshotChunk(buf, func(bl *common.BingLogDTO) error {
+		if bl.FileId == bls[0].FileId && (bl.Meta == nil || bl.Meta.Name != "a.txt") {
+			t.Fatal("file meta is lost: ", bl.Meta)
+		}
+		recorded = append(recorded, bl.FileId)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 3 || len(recorded) != 2 || len(missing) != 1 || missing[0].FileId != bls[2].FileId {
+		t.Fatal("unexpected result: ", files, recorded, missing)
+	}
+	// the reference count tail is moved into the blob state.
+	bs, err := ioutil.ReadFile(dstDir + "/0A/1B/e92c1c72e7fff2801c7d4af5b154f88d")
+	if err != nil || string(bs) != "abc" {
+		t.Fatal("blob is not extracted: ", err)
+	}
+	b, err := util.OpenBlob("0A/1B/e92c1c72e7fff2801c7d4af5b154f88d")
+	if err != nil || b.RefCount != 1 || b.Size() != 3 {
+		t.Fatal("unexpected blob state: ", err)
+	}
+	b.Close()
+}
@@ -2,10 +2,12 @@ package svc
 
 import (
 	"fmt"
+	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
 	json "github.com/json-iterator/go"
 	"os"
 )
@@ -17,10 +19,23 @@ func BootStorageServer() {
 		fmt.Println("Err:", err)
 		os.Exit(1)
 	}
+	if err := util.InitStorageConfig(common.InitializedStorageConfiguration); err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
 
 	if err := util.PrepareDirs(common.InitializedStorageConfiguration.TmpDir); err != nil {
 		logger.Fatal("cannot create tmp dir: ", err)
 	}
+	// scan blobs of the data dirs.
+	util.InitDataDirs(common.InitializedStorageConfiguration)
+	// open the index of small files packed in volumes.
+	if err := util.InitVolumes(common.InitializedStorageConfiguration); err != nil {
+		logger.Fatal("cannot open volume index: ", err)
+	}
+	if err := util.InitEncryption(common.InitializedStorageConfiguration); err != nil {
+		logger.Fatal("cannot initialize encryption: ", err)
+	}
 
 	//
 	if true {
@@ -33,15 +48,82 @@ func BootStorageServer() {
 
 	startCounterLoop()
 
+	initRateLimiters(common.InitializedStorageConfiguration)
+
 	// print godfs logo.
 	util.PrintLogo()
 
 	writableBinlogManager = binlog.NewXBinlogManager(binlog.LOCAL_BINLOG_MANAGER)
+	handleShutdownSignals(deregisterStorage, flushStorage)
+	handleReloadSignal()
+	// restore decommission state before registering to trackers.
+	initDecommission()
 	if common.InitializedStorageConfiguration.EnableHttp {
 		StartStorageHttpServer(common.InitializedStorageConfiguration)
 	}
+	// migrate the fileId index if the backend changes.
+	InitIndexMigration()
+	// start snapshot bootstrap before binlog synchronizer.
+	InitSnapshotBootstrap()
 	// start member binlog synchronizer.
 	InitStorageMemberBinlogWatcher()
+	// start anti-entropy reconciliation.
+	InitAntiEntropy()
+	// check data dirs and repopulate files of offline ones.
+	InitDataDirCheck()
+	// reclaim deleted space of volumes.
+	InitVolumeCompaction()
+	// drop expired files.
+	InitFileReaper()
+	// delete stale tmp files and orphan blobs.
+	InitGc()
+	// refresh instance info on trackers.
+	InitInstanceRefresher()
+	// fetch usage and quotas from trackers.
+	InitQuotaRefresher()
 	// start tcp server.
 	StartStorageTcpServer()
 }
+
+// deregisterStorage removes this server from trackers on shutdown,
+// clients stop choosing it before the in-flight requests finish.
+func deregisterStorage() {
+	if clientAPI == nil {
+		return
+	}
+	api.SetInstanceAttribute("drain", common.DRAIN_SHUTDOWN)
+	notifyTrackers(true)
+}
+
+// flushStorage persists the storage states on shutdown
+// and removes the tmp files of interrupted transfers.
+//
+// The shared stores are left to the process exit
+// if interrupted requests may still be writing to them.
+func flushStorage(drained bool) {
+	saveSynchronizationState()
+	removeTmpFiles()
+	if !drained {
+		return
+	}
+	if err := writableBinlogManager.Close(); err != nil {
+		logger.Error("error close binlog: ", err)
+	}
+	closeDataSet()
+	closeConfigMap()
+	if err := util.CloseVolumes(); err != nil {
+		logger.Error("error close volume index: ", err)
+	}
+}
+
+// InitInstanceRefresher starts a timer job which sends the latest instance info,
+// such as the free space, to trackers.
+func InitInstanceRefresher() {
+	timer.Start(common.REGISTER_INTERVAL, common.REGISTER_INTERVAL, 0, func(t *timer.Timer) {
+		if clientAPI == nil || coordinator.isShuttingDown() {
+			return
+		}
+		reportMirrorStatus()
+		notifyTrackers(false)
+	})
+}
@@ -3,6 +3,7 @@ package svc
 import (
 	"bytes"
 	"container/list"
+	"crypto/subtle"
 	"errors"
 	"github.com/gorilla/mux"
 	"github.com/hetianyi/godfs/binlog"
@@ -18,6 +19,7 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -47,6 +49,7 @@ type FormEntry struct {
 	InstanceId     string `json:"instanceId,omitempty"`
 	Md5            string `json:"md5,omitempty"`
 	FileId         string `json:"fileId,omitempty"`
+	ExpireTime     int64  `json:"expireTime,omitempty"`
 }
 
 func init() {
@@ -59,20 +62,31 @@ func StartStorageHttpServer(c *common.StorageConfig) {
 	r.HandleFunc("/ul", httpUpload1).Methods("POST")
 	r.HandleFunc("/upload", httpUpload1).Methods("POST")
 	// r.HandleFunc("/upload1", httpUpload).Methods("POST")
-	r.HandleFunc("/dl", httpDownload).Methods("GET")
-	r.HandleFunc("/download", httpDownload).Methods("GET")
+	r.HandleFunc("/dl", httpDownload).Methods("GET", "HEAD")
+	r.HandleFunc("/download", httpDownload).Methods("GET", "HEAD")
+	r.HandleFunc("/info", httpFileInfo).Methods("GET")
+	r.HandleFunc("/bandwidth", httpBandwidth).Methods("GET", "POST")
+	r.HandleFunc("/antientropy", httpAntiEntropy).Methods("GET", "POST")
+	r.HandleFunc("/reload", httpReloadConfig).Methods("POST")
+	r.HandleFunc("/health", httpHealthCheck).Methods("GET")
+	r.HandleFunc("/mirrors", httpMirrorStatus).Methods("GET")
+	r.HandleFunc("/datadirs", httpDataDirs).Methods("GET")
+	r.HandleFunc("/volumes", httpVolumes).Methods("GET", "POST")
+	r.HandleFunc("/files", httpListFiles).Methods("GET")
+	r.HandleFunc("/gc", httpGc).Methods("GET")
 
 	srv := &http.Server{
-		Handler:           r,
+		Handler:           coordinator.trackHttp(r),
 		Addr:              c.BindAddress + ":" + convert.IntToStr(c.HttpPort),
 		ReadHeaderTimeout: time.Second * 15,
 		WriteTimeout:      0,
 		ReadTimeout:       0,
 		MaxHeaderBytes:    1 << 20, // 1MB
 	}
+	coordinator.registerHttpServer(srv)
 	go func() {
 		logger.Info("http server listening on ", c.BindAddress, ":", c.HttpPort)
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logger.Fatal(err)
 		}
 	}()
@@ -82,19 +96,41 @@ func StartStorageHttpServer(c *common.StorageConfig) {
 func httpUpload(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	if isDraining() {
+		util.HttpWriteResponse(w, http.StatusServiceUnavailable, "server is draining")
+		return
+	}
+
 	logger.Debug("accept new upload request")
 
 	increaseCountForTheSecond()
 
 	// file is private or public
 	s := strings.TrimSpace(r.URL.Query().Get("s"))
-	isPrivate := common.InitializedStorageConfiguration.PublicAccessMode
+	isPrivate := publicAccessMode()
 	if s == "false" || s == "0" {
 		isPrivate = false
 	} else if s == "true" || s == "1" {
 		isPrivate = true
 	}
 
+	// file expires after ttl seconds or at expireAt.
+	expireTime, err := parseExpireTime(r.URL.Query().Get("ttl"), r.URL.Query().Get("expireAt"), time.Now())
+	if err != nil {
+		util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// custom attributes of the files, for example: meta-author=godfs
+	attributes, err := queryFileAttributes(r.URL.Query())
+	if err != nil {
+		util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	identity, ok := uploadIdentity(w, r)
+	if !ok {
+		return
+	}
+
 	// formEntries stores form's text fields and file fields.
 	formEntries := list.New()
 	var result = make(map[string]interface{})
@@ -106,6 +142,7 @@ func httpUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	formEntryIndex := 0
+	var exceeded *common.Usage // the quota exceeded by a file
 
 	// handle form text field.
 	handler.OnFormField = func(paraName, paraValue string) {
@@ -161,6 +198,12 @@ func httpUpload(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					return err
 				}
+				if u := reserveQuota(common.InitializedStorageConfiguration.Group, identity,
+					fInfo.Size()-int64(len(tailRefCount)), time.Now()); u != nil {
+					exceeded = u
+					file.Delete(tmpFileName)
+					return common.QuotaExceededErr
+				}
 
 				// get crc and md5.
 				crc32String := util.GetCrc32HashString(proxy.crcH)
@@ -169,33 +212,37 @@ func httpUpload(w http.ResponseWriter, r *http.Request) {
 				// build target dir and fileId.
 				targetDir := strings.ToUpper(strings.Join([]string{crc32String[len(crc32String)-4 : len(crc32String)-2], "/",
 					crc32String[len(crc32String)-2:]}, ""))
-				targetLoc := common.InitializedStorageConfiguration.DataDir + "/" + targetDir
-				targetFile := common.InitializedStorageConfiguration.DataDir + "/" + targetDir + "/" + md5String
 				finalFileId := common.InitializedStorageConfiguration.Group + "/" + targetDir + "/" + md5String
 				logger.Debug("create alias")
-				finalFileId = util.CreateAlias(finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, time.Now())
+				now := time.Now()
+				finalFileId = util.CreateAlias(finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, now)
+
+				meta := &common.FileMeta{
+					Name:       fileName,
+					Size:       fInfo.Size() - int64(len(tailRefCount)),
+					Md5:        md5String,
+					UploadTime: now.Unix(),
+					Attributes: attributes,
+					ExpireTime: expireTime,
+					Owner:      identity,
+				}
+				if err := prepareFileMeta(meta, tmpFileName); err != nil {
+					return err
+				}
 
-				if !file.Exists(targetLoc) {
-					if err := file.CreateDirs(targetLoc); err != nil {
-						return err
-					}
+				if err := storeBlob(tmpFileName, targetDir+"/"+md5String, fileName); err != nil {
+					return err
 				}
-				if !file.Exists(targetFile) {
-					logger.Debug("file not exists, move to target dir.")
-					if err := file.MoveFile(tmpFileName, targetFile); err != nil {
-						return err
-					}
-				} else {
-					logger.Debug("file already exists, increasing reference count.")
-					// increase file reference count.
-					if err = updateFileReferenceCount(targetFile, 1); err != nil {
-						return err
-					}
+				if err := saveFileMeta(finalFileId, meta, true); err != nil {
+					return errors.New("error writing file meta: " + err.Error())
 				}
 				// write binlog.
 				logger.Debug("writing binlog...")
-				if err = writableBinlogManager.Write(binlog.CreateLocalBinlog(finalFileId,
-					fInfo.Size()-int64(len(tailRefCount)), common.InitializedStorageConfiguration.InstanceId)); err != nil {
+				bl := binlog.CreateLocalBinlog(finalFileId,
+					fInfo.Size()-int64(len(tailRefCount)), common.InitializedStorageConfiguration.InstanceId)
+				bl.ExpireTime = expireTime
+				bl.Meta = meta
+				if err = writableBinlogManager.Write(bl); err != nil {
 					return errors.New("error writing binlog: " + err.Error())
 				}
 
@@ -216,6 +263,7 @@ func httpUpload(w http.ResponseWriter, r *http.Request) {
 					Group:          common.InitializedStorageConfiguration.Group,
 					InstanceId:     common.InitializedStorageConfiguration.InstanceId,
 					FileId:         finalFileId,
+					ExpireTime:     expireTime,
 				})
 				return nil
 			},
@@ -230,46 +278,53 @@ func httpUpload(w http.ResponseWriter, r *http.Request) {
 	if err := handler.Parse(); err != nil {
 		logger.Error("error upload files: ", err)
 	}
-
-	// result form field entries
-	formEntriesArray := make([]FormEntry, formEntries.Len())
-	i := 0
-	gox.WalkList(formEntries, func(item interface{}) bool {
-		formEntriesArray[i] = item.(FormEntry)
-		i++
-		return false
-	})
-
-	result["form"] = formEntriesArray
-	retJSON, err := json.Marshal(result)
-	if err != nil {
-		logger.Debug(err)
-		util.HttpInternalServerError(w, "Internal Server Error.")
+	if exceeded != nil {
+		result["error"] = quotaExceededMessage(exceeded)
+		writeUploadResult(w, http.StatusInsufficientStorage, result, formEntries)
 		return
 	}
-
-	// write response.
-	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+	writeUploadResult(w, http.StatusOK, result, formEntries)
 }
 
 // httpUpload1 upload files using golang
 func httpUpload1(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	if isDraining() {
+		util.HttpWriteResponse(w, http.StatusServiceUnavailable, "server is draining")
+		return
+	}
+
 	logger.Debug("accept new upload request")
 
 	increaseCountForTheSecond()
 
 	// file is private or public
 	s := strings.TrimSpace(r.URL.Query().Get("s"))
-	isPrivate := common.InitializedStorageConfiguration.PublicAccessMode
+	isPrivate := publicAccessMode()
 	if s == "false" || s == "0" {
 		isPrivate = false
 	} else if s == "true" || s == "1" {
 		isPrivate = true
 	}
 
+	// file expires after ttl seconds or at expireAt.
+	expireTime, err := parseExpireTime(r.URL.Query().Get("ttl"), r.URL.Query().Get("expireAt"), time.Now())
+	if err != nil {
+		util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// custom attributes of the files, for example: meta-author=godfs
+	attributes, err := queryFileAttributes(r.URL.Query())
+	if err != nil {
+		util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	identity, ok := uploadIdentity(w, r)
+	if !ok {
+		return
+	}
+
 	// formEntries stores form's text fields and file fields.
 	formEntries := list.New()
 	var result = make(map[string]interface{})
@@ -289,6 +344,7 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 
 	var buffer = new(bytes.Buffer)
 	var lastErr error
+	var exceeded *common.Usage // the quota exceeded by a file
 	formEntryIndex := 0
 
 	for {
@@ -346,6 +402,11 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 			clean()
 			break
 		}
+		if exceeded = reserveQuota(common.InitializedStorageConfiguration.Group, identity, n, time.Now()); exceeded != nil {
+			lastErr = common.QuotaExceededErr
+			clean()
+			break
+		}
 		logger.Debug("write tail")
 		// write reference count mark.
 		_, err = out.Write(tailRefCount)
@@ -365,45 +426,53 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 		// build target dir and fileId.
 		targetDir := strings.ToUpper(strings.Join([]string{crc32String[len(crc32String)-4 : len(crc32String)-2], "/",
 			crc32String[len(crc32String)-2:]}, ""))
-		targetLoc := common.InitializedStorageConfiguration.DataDir + "/" + targetDir
-		targetFile := common.InitializedStorageConfiguration.DataDir + "/" + targetDir + "/" + md5String
 		finalFileId := common.InitializedStorageConfiguration.Group + "/" + targetDir + "/" + md5String
 
 		logger.Debug("create alias")
 
-		finalFileId = util.CreateAlias(finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, time.Now())
+		now := time.Now()
+		finalFileId = util.CreateAlias(finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, now)
+
+		meta := &common.FileMeta{
+			Name:       p.FileName(),
+			Size:       n,
+			Md5:        md5String,
+			UploadTime: now.Unix(),
+			Attributes: attributes,
+			ExpireTime: expireTime,
+			Owner:      identity,
+		}
+		// browsers send octet-stream for unknown types, which is sniffed instead.
+		if ct := p.Header.Get("Content-Type"); ct != "" && ct != "application/octet-stream" {
+			meta.ContentType = ct
+		}
+		if err := prepareFileMeta(meta, tmpFileName); err != nil {
+			logger.Debug(err)
+			lastErr = err
+			clean()
+			break
+		}
 
-		if !file.Exists(targetLoc) {
-			if err := file.CreateDirs(targetLoc); err != nil {
-				logger.Debug(err)
-				lastErr = err
-				clean()
-				break
-			}
+		if err := storeBlob(tmpFileName, targetDir+"/"+md5String, p.FileName()); err != nil {
+			logger.Debug(err)
+			lastErr = err
+			clean()
+			break
 		}
-		if !file.Exists(targetFile) {
-			logger.Debug("file not exists, move to target dir.")
-			if err := file.MoveFile(tmpFileName, targetFile); err != nil {
-				logger.Debug(err)
-				lastErr = err
-				clean()
-				break
-			}
-		} else {
-			logger.Debug("file already exists, increasing reference count.")
-			// increase file reference count.
-			if err = updateFileReferenceCount(targetFile, 1); err != nil {
-				logger.Debug(err)
-				lastErr = err
-				clean()
-				break
-			}
+
+		if err := saveFileMeta(finalFileId, meta, true); err != nil {
+			lastErr = errors.New("error writing file meta: " + err.Error())
+			logger.Debug(lastErr)
+			clean()
+			break
 		}
 
 		// write binlog.
 		logger.Debug("write binlog...")
-		if err = writableBinlogManager.Write(binlog.CreateLocalBinlog(finalFileId,
-			n, common.InitializedStorageConfiguration.InstanceId)); err != nil {
+		bl := binlog.CreateLocalBinlog(finalFileId, n, common.InitializedStorageConfiguration.InstanceId)
+		bl.ExpireTime = expireTime
+		bl.Meta = meta
+		if err = writableBinlogManager.Write(bl); err != nil {
 			lastErr = errors.New("error writing binlog: " + err.Error())
 			logger.Debug(lastErr)
 			clean()
@@ -431,14 +500,27 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 			InstanceId:     common.InitializedStorageConfiguration.InstanceId,
 			Md5:            md5String,
 			FileId:         finalFileId,
+			ExpireTime:     expireTime,
 		})
 	}
 
+	if exceeded != nil {
+		result["error"] = quotaExceededMessage(exceeded)
+		writeUploadResult(w, http.StatusInsufficientStorage, result, formEntries)
+		return
+	}
 	if lastErr != nil {
 		util.HttpInternalServerError(w, "Internal Server Error")
 		return
 	}
+	writeUploadResult(w, http.StatusOK, result, formEntries)
+}
 
+// writeUploadResult responses the result of uploading with the form entries in json.
+//
+// The files stored before a file over quota are kept,
+// so the result is responded with the quota error, which carries their fileIds.
+func writeUploadResult(w http.ResponseWriter, status int, result map[string]interface{}, formEntries *list.List) {
 	// result form field entries
 	formEntriesArray := make([]FormEntry, formEntries.Len())
 	i := 0
@@ -452,13 +534,13 @@ func httpUpload1(w http.ResponseWriter, r *http.Request) {
 	retJSON, err := json.Marshal(result)
 	if err != nil {
 		logger.Debug(err)
-		util.HttpInternalServerError(w, "Internal Server Error")
+		util.HttpInternalServerError(w, "Internal Server Error.")
 		return
 	}
 
 	// write response.
 	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
-	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+	util.HttpWriteResponse(w, status, string(retJSON))
 }
 
 // httpDownload handles http file upload.
@@ -473,9 +555,9 @@ func httpDownload(w http.ResponseWriter, r *http.Request) {
 
 	// handle http options method
 	headers := w.Header()
-	// download method must be GET or OPTIONS
+	// download method must be GET, HEAD or OPTIONS
 	method := r.Method
-	headers.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	headers.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
 	headers.Set("Access-Control-Allow-Credentials", "true")
 	headers.Set("Access-Control-Allow-Headers", "*")
 	if method == http.MethodOptions {
@@ -483,20 +565,14 @@ func httpDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fid := ""
-	token := ""
-	timestamp := ""
 	fileName := ""
 	// if EnableMimeTypes is on and fileName is not empty,
 	// EnableMimeTypes will be ignored.
 	ext := ""
 	qs := r.URL.Query()
 	if qs != nil {
-		fid = qs.Get("id")
 		fileName = qs.Get("fn")
 		ext = qs.Get("type")
-		token = qs.Get("token")
-		timestamp = qs.Get("timestamp")
 		// custom content type
 		if fileName == "" {
 			fileName = qs.Get("fileName")
@@ -504,71 +580,222 @@ func httpDownload(w http.ResponseWriter, r *http.Request) {
 		if fileName != "" {
 			ext = file.GetFileExt(fileName)
 		}
-		if token == "" {
-			token = qs.Get("tk")
-		}
-		if timestamp == "" {
-			timestamp = qs.Get("ts")
-		}
+	}
+
+	info, meta, ok := checkFileAccess(w, qs)
+	if !ok {
+		return
+	}
+
+	blob, err := util.OpenBlob(util.GetFileRelativePath(info))
+	if err == common.NotFoundErr {
+		logger.Debug("error open file: ", info.Path, ": ", err)
+		util.HttpFileNotFoundError(w)
+		return
+	}
+	if err != nil {
+		logger.Debug("error open file: ", info.Path, ": ", err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	defer blob.Close()
+
+	// the metadata gives the content type and the file name by default.
+	setFileMetaHeaders(headers, meta, fileName == "" && ext == "")
+	if fileName != "" {
+		headers.Set("Content-Disposition", "attachment;filename=\""+fileName+"\"")
+	} else if fileName == "" && ext != "" {
+		fileName = uuid.UUID() + "." + ext
+	}
+	content := util.OpenContent(blob)
+	httpx.ServeContent(w, r, fileName, blob.ModTime, httpDownloadRateLimiter.NewReadSeeker(content), content.Size())
+}
+
+// httpFileInfo responses the information of a file in json as inspecting,
+// the access is checked in the same way as downloading.
+func httpFileInfo(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	info, meta, ok := checkFileAccess(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	err := inspectFile(info, r.URL.Query().Get("id"), meta)
+	if err == common.NotFoundErr {
+		util.HttpFileNotFoundError(w)
+		return
+	}
+	if err != nil {
+		logger.Debug("error open file: ", info.Path, ": ", err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	retJSON, err := json.Marshal(info)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
+
+// checkFileAccess checks whether the file of the request exists and can be accessed,
+// it writes the error response and returns false if not.
+func checkFileAccess(w http.ResponseWriter, qs url.Values) (*common.FileInfo, *common.FileMeta, bool) {
+	fid := qs.Get("id")
+	token := qs.Get("token")
+	timestamp := qs.Get("timestamp")
+	if token == "" {
+		token = qs.Get("tk")
+	}
+	if timestamp == "" {
+		timestamp = qs.Get("ts")
 	}
 
 	// query and determine if the file exists.
 	if c, err := Contains(fid); !c || err != nil {
 		logger.Debug("error query fileId: ", c, "<->", err)
 		util.HttpFileNotFoundError(w)
-		return
+		return nil, nil, false
 	}
 
 	info, curSecret, err := util.ParseAlias(fid, common.InitializedStorageConfiguration.Secret)
 	if err != nil {
 		logger.Debug("error parse alias: ", err)
 		util.HttpFileNotFoundError(w)
-		return
+		return nil, nil, false
 	}
 
 	// check token
 	if info.IsPrivate {
 		if len(token) != 32 || timestamp == "" {
 			util.HttpForbiddenError(w, "Forbidden.")
-			return
+			return nil, nil, false
 		}
 		cToken := util.GenerateToken(fid, curSecret, timestamp)
 		nts, err := convert.StrToInt64(timestamp)
 		if err != nil {
 			util.HttpForbiddenError(w, "Forbidden.")
-			return
+			return nil, nil, false
 		}
 		if token != cToken || nts < gox.GetTimestamp(time.Now()) {
 			util.HttpForbiddenError(w, "Forbidden.")
-			return
+			return nil, nil, false
 		}
 	}
 
-	filePath := strings.Join([]string{common.InitializedStorageConfiguration.DataDir, info.Path}, "/")
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		logger.Debug("error stat file: ", info.Path, ": ", err)
-		util.HttpFileNotFoundError(w)
+	meta := getFileMeta(fid)
+	if meta.Expired(time.Now()) {
+		logger.Debug("file expired: ", fid)
+		util.HttpFileGoneError(w)
+		return nil, nil, false
+	}
+	return info, meta, true
+}
+
+// httpBandwidth shows bandwidth limiter state on GET
+// and changes bandwidth limits(KB/s) on POST, for example:
+//
+//	POST /bandwidth?sync=1024&download=0&httpDownload=2048
+func httpBandwidth(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedStorageConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
 		return
 	}
-	if fileInfo.Size() < 4 {
-		logger.Debug("invalid file length")
+
+	if r.Method == http.MethodPost {
+		qs := r.URL.Query()
+		for _, kind := range []string{RATE_LIMIT_SYNC, RATE_LIMIT_DOWNLOAD, RATE_LIMIT_HTTP_DOWNLOAD} {
+			v := strings.TrimSpace(qs.Get(kind))
+			if v == "" {
+				continue
+			}
+			kb, err := convert.StrToInt(v)
+			if err != nil {
+				util.HttpWriteResponse(w, http.StatusBadRequest, "invalid rate limit: "+v)
+				return
+			}
+			if err = SetRateLimit(kind, kb); err != nil {
+				util.HttpWriteResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+	}
+
+	retJSON, err := json.Marshal(RateLimitStats())
+	if err != nil {
+		logger.Debug(err)
 		util.HttpInternalServerError(w, "Internal Server Error.")
 		return
 	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
 
-	outFile, err := file.GetFile(filePath)
+// httpAntiEntropy shows the summary of last anti-entropy run on GET
+// and starts a new run in background on POST.
+//
+// POST responses 202 if the run is started,
+// or 409 if there is already a run in progress.
+func httpAntiEntropy(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedStorageConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		status = gox.TValue(StartAntiEntropy(), http.StatusAccepted, http.StatusConflict).(int)
+	}
+	report, running := LastAntiEntropyReport()
+
+	retJSON, err := json.Marshal(map[string]interface{}{
+		"running": running,
+		"report":  report,
+	})
 	if err != nil {
-		logger.Debug("error open file: ", info.Path, ": ", err)
-		util.HttpFileNotFoundError(w)
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
 		return
 	}
-	sr := io.NewSectionReader(outFile, 0, fileInfo.Size()-4)
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, status, string(retJSON))
+}
 
-	if fileName != "" {
-		headers.Set("Content-Disposition", "attachment;filename=\""+fileName+"\"")
-	} else if fileName == "" && ext != "" {
-		fileName = uuid.UUID() + "." + ext
+// uploadIdentity returns the identity of the upload given by http header "Identity",
+// which is trusted only if the request holds the secret as management requests do.
+//
+// The response is written if the identity is rejected.
+func uploadIdentity(w http.ResponseWriter, r *http.Request) (string, bool) {
+	identity := r.Header.Get("Identity")
+	if identity == "" {
+		return "", true
+	}
+	if !checkAdminSecret(r, common.InitializedStorageConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return "", false
+	}
+	if !validIdentity(identity) {
+		util.HttpWriteResponse(w, http.StatusBadRequest, "invalid identity \""+identity+
+			"\", identity must match pattern "+common.IDENTITY_PATTERN)
+		return "", false
+	}
+	return identity, true
+}
+
+// checkAdminSecret checks the secret of management requests,
+// which is provided by http header "Secret".
+//
+// Management requests are always rejected if the server has no secret.
+func checkAdminSecret(r *http.Request, secret string) bool {
+	s := r.Header.Get("Secret")
+	if secret == "" || s == "" {
+		return false
 	}
-	httpx.ServeContent(w, r, fileName, fileInfo.ModTime(), sr, fileInfo.Size()-4)
+	return subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1
 }
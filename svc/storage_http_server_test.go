@@ -0,0 +1,62 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAdminSecret(t *testing.T) {
+	cases := []struct {
+		secret string
+		header string
+		expect bool
+	}{
+		{"123456", "123456", true},
+		{"123456", "654321", false},
+		{"123456", "", false},
+		{"", "", false},
+		{"", "123456", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/bandwidth", nil)
+		if c.header != "" {
+			r.Header.Set("Secret", c.header)
+		}
+		if ret := checkAdminSecret(r, c.secret); ret != c.expect {
+			t.Errorf("checkAdminSecret(%q, %q) = %v, expect %v", c.header, c.secret, ret, c.expect)
+		}
+	}
+}
+
+func TestUploadIdentity(t *testing.T) {
+	defer func(c *common.StorageConfig) {
+		common.InitializedStorageConfiguration = c
+	}(common.InitializedStorageConfiguration)
+	common.InitializedStorageConfiguration = &common.StorageConfig{Secret: "123456"}
+
+	cases := []struct {
+		identity string
+		secret   string
+		expect   string
+		status   int
+	}{
+		{"", "", "", http.StatusOK},
+		{"alice", "123456", "alice", http.StatusOK},
+		// identities are trusted only from the requests holding the secret.
+		{"alice", "", "", http.StatusForbidden},
+		{"alice", "654321", "", http.StatusForbidden},
+		{"a b", "123456", "", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/upload", nil)
+		r.Header.Set("Identity", c.identity)
+		r.Header.Set("Secret", c.secret)
+		w := httptest.NewRecorder()
+		identity, ok := uploadIdentity(w, r)
+		if identity != c.expect || ok != (c.status == http.StatusOK) || w.Code != c.status {
+			t.Errorf("uploadIdentity(%q, %q) = %q, %v, status %d", c.identity, c.secret, identity, ok, w.Code)
+		}
+	}
+}
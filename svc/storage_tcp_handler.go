@@ -1,6 +1,8 @@
 package svc
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"errors"
 	"github.com/hetianyi/godfs/api"
 	"github.com/hetianyi/godfs/binlog"
@@ -30,6 +32,7 @@ func StartStorageTcpServer() {
 	if err != nil {
 		logger.Fatal(err)
 	}
+	coordinator.registerListener(listener)
 
 	time.Sleep(time.Millisecond * 50)
 
@@ -44,13 +47,15 @@ func StartStorageTcpServer() {
 	if common.InitializedStorageConfiguration.ParsedTrackers != nil &&
 		len(common.InitializedStorageConfiguration.ParsedTrackers) > 0 {
 		servers := make([]*common.Server, len(common.InitializedStorageConfiguration.ParsedTrackers))
-		for i, s := range common.InitializedStorageConfiguration.ParsedTrackers {
-			servers[i] = &s
+		for i := range common.InitializedStorageConfiguration.ParsedTrackers {
+			servers[i] = &common.InitializedStorageConfiguration.ParsedTrackers[i]
 		}
 		config := &api.Config{
 			MaxConnectionsPerServer: MaxConnPerServer,
 			SynchronizeOnce:         false,
 			TrackerServers:          servers,
+			Zone:                    common.InitializedStorageConfiguration.Zone,
+			Rack:                    common.InitializedStorageConfiguration.Rack,
 		}
 		InitializeClientAPI(config)
 		for _, s := range servers {
@@ -61,6 +66,10 @@ func StartStorageTcpServer() {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if coordinator.isShuttingDown() {
+				waitForShutdown()
+				return
+			}
 			logger.Error("error accepting new connection: ", err)
 			continue
 		}
@@ -74,12 +83,22 @@ func storageClientConnHandler(conn net.Conn) {
 		Conn: conn,
 	}
 	defer pip.Close()
+	if !coordinator.trackConn(conn) {
+		return
+	}
+	defer coordinator.untrackConn(conn)
 	authorized := false
+	// peer connections are counted as synchronization traffic.
+	peer := false
 	for {
 		err := pip.Receive(&common.Header{}, func(_header interface{}, bodyReader io.Reader, bodyLength int64) error {
 			if _header == nil {
 				return errors.New("invalid request: header is empty")
 			}
+			if !coordinator.beginRequest() {
+				return errors.New("server is shutting down")
+			}
+			defer coordinator.endRequest()
 			header := _header.(*common.Header)
 			bs, _ := json.Marshal(header)
 			logger.Debug("server got message:", string(bs))
@@ -93,6 +112,7 @@ func storageClientConnHandler(conn net.Conn) {
 					return errors.New("unauthorized connection, force disconnection by server")
 				} else {
 					authorized = true
+					peer = isStoragePeer(header)
 					return pip.Send(h, b, l)
 				}
 			}
@@ -110,7 +130,7 @@ func storageClientConnHandler(conn net.Conn) {
 				}
 				return pip.Send(h, b, l)
 			} else if header.Operation == common.OPERATION_DOWNLOAD {
-				h, b, l, err := downFileHandler(header)
+				h, b, l, err := downFileHandler(header, gox.TValue(peer, syncRateLimiter, downloadRateLimiter).(*util.RateLimiter))
 				if err != nil {
 					return err
 				}
@@ -127,6 +147,60 @@ func storageClientConnHandler(conn net.Conn) {
 					return err
 				}
 				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_FILEID_DIGEST {
+				h, b, l, err := fileIdDigestHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_FILEID_LIST {
+				h, b, l, err := fileIdListHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SNAPSHOT {
+				h, b, l, err := snapshotHandler(header, peer)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_REPLICATE_FILE {
+				h, b, l, err := replicateFileHandler(header, peer)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_DECOMMISSION {
+				h, b, l, err := decommissionHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_HEALTH_CHECK {
+				h, b, l, err := healthCheckHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_PROBE_FILE {
+				h, b, l, err := probeFileHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_LIST_FILES {
+				h, b, l, err := listFilesHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_GC {
+				h, b, l, err := gcHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
 			}
 			return pip.Send(&common.Header{
 				Result: common.UNKNOWN_OPERATION,
@@ -144,8 +218,43 @@ func storageClientConnHandler(conn net.Conn) {
 	}
 }
 
+// tcpUploadIdentity returns the identity of the upload given by attribute "identity",
+// or the response header if the identity is rejected.
+//
+// The identity is trusted only if the request carries the secret of the server in attribute "secret",
+// which is checked as the one of management requests and uploads over http,
+// so that the identity of uploads is trusted the same way over both.
+func tcpUploadIdentity(header *common.Header) (string, *common.Header) {
+	identity := header.Attributes["identity"]
+	if identity == "" {
+		return "", nil
+	}
+	secret := common.InitializedStorageConfiguration.Secret
+	s := header.Attributes["secret"]
+	if secret == "" || s == "" || subtle.ConstantTimeCompare([]byte(s), []byte(secret)) != 1 {
+		return "", &common.Header{
+			Result: common.UNAUTHORIZED,
+			Msg:    "identity is trusted only with the secret of the server",
+		}
+	}
+	if !validIdentity(identity) {
+		return "", &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid identity \"" + identity + "\", identity must match pattern " + common.IDENTITY_PATTERN,
+		}
+	}
+	return identity, nil
+}
+
 func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength int64) (*common.Header, io.Reader, int64, error) {
 
+	if isDraining() {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "server is draining",
+		}, nil, 0, nil
+	}
+
 	logger.Debug("receive file")
 
 	increaseCountForTheSecond()
@@ -179,6 +288,32 @@ func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength i
 		return nil, nil, 0, err
 	}
 
+	// the body is read before validating, so the connection is kept in a clean state.
+	expireTime, err := parseExpireTime(header.Attributes["ttl"], header.Attributes["expireAt"], time.Now())
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	attributes, err := customFileAttributes(header.Attributes)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	identity, h := tcpUploadIdentity(header)
+	if h != nil {
+		return h, nil, 0, nil
+	}
+	if u := reserveQuota(common.InitializedStorageConfiguration.Group, identity, bodyLength, time.Now()); u != nil {
+		return &common.Header{
+			Result: common.QUOTA_EXCEEDED,
+			Msg:    quotaExceededMessage(u),
+		}, nil, 0, nil
+	}
+
 	logger.Debug("write tail")
 	// write reference count mark.
 	_, err = out.Write(tailRefCount)
@@ -192,36 +327,43 @@ func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength i
 
 	targetDir := strings.ToUpper(strings.Join([]string{crc32String[len(crc32String)-4 : len(crc32String)-2], "/",
 		crc32String[len(crc32String)-2:]}, ""))
-	targetLoc := common.InitializedStorageConfiguration.DataDir + "/" + targetDir
-	targetFile := common.InitializedStorageConfiguration.DataDir + "/" + targetDir + "/" + md5String
 	_finalFileId := common.InitializedStorageConfiguration.Group + "/" + targetDir + "/" + md5String
 
 	logger.Debug("create alias")
 	now := time.Now()
 	finalFileId := util.CreateAlias(_finalFileId, common.InitializedStorageConfiguration.InstanceId, isPrivate, now)
-	if !file.Exists(targetLoc) {
-		if err := file.CreateDirs(targetLoc); err != nil {
-			return nil, nil, 0, err
-		}
+
+	meta := &common.FileMeta{
+		Name:        header.Attributes["name"],
+		ContentType: header.Attributes["contentType"],
+		Size:        bodyLength,
+		Md5:         md5String,
+		UploadTime:  now.Unix(),
+		Attributes:  attributes,
+		ExpireTime:  expireTime,
+		Owner:       identity,
+	}
+	if err := prepareFileMeta(meta, tmpFileName); err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
 	}
 
-	if !file.Exists(targetFile) {
-		logger.Debug("file not exists, move to target dir.")
-		if err := file.MoveFile(tmpFileName, targetFile); err != nil {
-			return nil, nil, 0, err
-		}
-	} else {
-		logger.Debug("file already exists, increasing reference count.")
-		// increase file reference count.
-		if err = updateFileReferenceCount(targetFile, 1); err != nil {
-			return nil, nil, 0, err
-		}
+	if err := storeBlob(tmpFileName, targetDir+"/"+md5String, meta.Name); err != nil {
+		return nil, nil, 0, err
+	}
+
+	if err := saveFileMeta(finalFileId, meta, true); err != nil {
+		return nil, nil, 0, errors.New("error writing file meta: " + err.Error())
 	}
 
 	// write binlog.
 	logger.Debug("write binlog...")
-	if err = writableBinlogManager.Write(binlog.CreateLocalBinlog(finalFileId,
-		bodyLength, common.InitializedStorageConfiguration.InstanceId)); err != nil {
+	bl := binlog.CreateLocalBinlog(finalFileId, bodyLength, common.InitializedStorageConfiguration.InstanceId)
+	bl.ExpireTime = expireTime
+	bl.Meta = meta
+	if err = writableBinlogManager.Write(bl); err != nil {
 		return nil, nil, 0, errors.New("error writing binlog: " + err.Error())
 	}
 
@@ -233,17 +375,21 @@ func uploadFileHandler(header *common.Header, bodyReader io.Reader, bodyLength i
 
 	logger.Debug("upload success")
 
-	return &common.Header{
+	ret := &common.Header{
 		Result: common.SUCCESS,
 		Attributes: map[string]string{
 			"fid":      finalFileId,
 			"group":    common.InitializedStorageConfiguration.Group,
 			"instance": common.InitializedStorageConfiguration.InstanceId,
 		},
-	}, nil, 0, nil
+	}
+	if expireTime > 0 {
+		ret.Attributes["expireTime"] = convert.Int64ToStr(expireTime)
+	}
+	return ret, nil, 0, nil
 }
 
-func downFileHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+func downFileHandler(header *common.Header, limiter *util.RateLimiter) (*common.Header, io.Reader, int64, error) {
 	var offset int64 = 0
 	var length int64 = -1
 	// TODO duplicate code
@@ -277,14 +423,15 @@ func downFileHandler(header *common.Header) (*common.Header, io.Reader, int64, e
 			Result: common.ERROR,
 		}, nil, 0, err
 	}
-	fileMeta := fileInfo.Group + "/" + fileInfo.Path
-	// group := common.FileIdPatternRegexp.ReplaceAllString(fileId, "$1")
-	p1 := common.FileMetaPatternRegexp.ReplaceAllString(fileMeta, "$2")
-	p2 := common.FileMetaPatternRegexp.ReplaceAllString(fileMeta, "$3")
-	md5 := common.FileMetaPatternRegexp.ReplaceAllString(fileMeta, "$4")
-	fullPath := strings.Join([]string{common.InitializedStorageConfiguration.DataDir, p1, p2, md5}, "/")
-
-	readyReader, realLen, err := seekRead(fullPath, offset, length)
+	if fileExpired(fileId) {
+		return &common.Header{
+			Result: common.NOT_FOUND,
+			Msg:    "file expired",
+		}, nil, 0, nil
+	}
+	// storage servers synchronize the stored form of files, such as compressed blobs.
+	raw := header.Attributes["raw"] == "true"
+	readyReader, realLen, err := seekRead(util.GetFileRelativePath(fileInfo), offset, length, raw, limiter)
 	if err != nil {
 		return &common.Header{
 			Result: common.ERROR,
@@ -312,30 +459,24 @@ func inspectFileHandler(header *common.Header) (*common.Header, io.Reader, int64
 			Result: common.ERROR,
 		}, nil, 0, err
 	}
-	fileMeta := fileInfo.Group + "/" + fileInfo.Path
-	// group := common.FileIdPatternRegexp.ReplaceAllString(fileId, "$1")
-	p1 := common.FileMetaPatternRegexp.ReplaceAllString(fileMeta, "$2")
-	p2 := common.FileMetaPatternRegexp.ReplaceAllString(fileMeta, "$3")
-	md5 := common.FileMetaPatternRegexp.ReplaceAllString(fileMeta, "$4")
-	fullPath := strings.Join([]string{common.InitializedStorageConfiguration.DataDir, p1, p2, md5}, "/")
-	if !file.Exists(fullPath) {
+	meta := getFileMeta(fileId)
+	if meta.Expired(time.Now()) {
 		return &common.Header{
 			Result: common.NOT_FOUND,
+			Msg:    "file expired",
 		}, nil, 0, nil
 	}
-	fi, err := file.GetFile(fullPath)
-	if !file.Exists(fullPath) {
+	err = inspectFile(fileInfo, fileId, meta)
+	if err == common.NotFoundErr {
 		return &common.Header{
-			Result: common.ERROR,
-		}, nil, 0, err
+			Result: common.NOT_FOUND,
+		}, nil, 0, nil
 	}
-	info, err := fi.Stat()
-	if !file.Exists(fullPath) {
+	if err != nil {
 		return &common.Header{
 			Result: common.ERROR,
 		}, nil, 0, err
 	}
-	fileInfo.FileLength = info.Size()
 	bs, _ := json.Marshal(fileInfo)
 	return &common.Header{
 		Result:     common.SUCCESS,
@@ -415,3 +556,151 @@ func syncBinlogHandler(header *common.Header) (*common.Header, io.Reader, int64,
 		},
 	}, nil, 0, nil
 }
+
+// fileIdDigestHandler returns digests of local fileId buckets under the prefix.
+//
+// The digests are too large for the header, so they are sent as body.
+func fileIdDigestHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	prefix := ""
+	if header.Attributes != nil {
+		prefix = header.Attributes["prefix"]
+	}
+	if len(prefix) > 1 {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid prefix",
+		}, nil, 0, nil
+	}
+	tree, err := getFileIdDigestTree(false)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error build digest: " + err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(tree.level(prefix))
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// fileIdListHandler lists local binlogs of the fileId buckets.
+func fileIdListHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	if header.Attributes == nil || header.Attributes["prefixes"] == "" {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	prefixes := strings.Split(header.Attributes["prefixes"], ",")
+	if len(prefixes) > maxListPrefixes {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(1)",
+		}, nil, 0, nil
+	}
+	for _, p := range prefixes {
+		if len(p) != 2 {
+			return &common.Header{
+				Result: common.ERROR,
+				Msg:    "invalid header(2)",
+			}, nil, 0, nil
+		}
+	}
+	bls, err := listLocalFileIds(prefixes)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error list fileIds: " + err.Error(),
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(bls)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
+
+// replicateFileHandler synchronizes a file from the requesting group member,
+// it responses after the file is stored.
+func replicateFileHandler(header *common.Header, peer bool) (*common.Header, io.Reader, int64, error) {
+	if !peer {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "replication is only available for group members",
+		}, nil, 0, nil
+	}
+	bl := &common.BingLogDTO{}
+	if header.Attributes == nil || json.UnmarshalFromString(header.Attributes["binlog"], bl) != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	if isDraining() {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "server is draining",
+		}, nil, 0, nil
+	}
+	instance := &common.Instance{}
+	var server *common.Server
+	if json.UnmarshalFromString(header.Attributes["instance"], instance) == nil {
+		if ins := api.FilterInstanceByInstanceId(instance.InstanceId); ins != nil {
+			server = &ins.Server
+		}
+	}
+	if err := repairFile(bl, server); err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "error synchronize file: " + err.Error(),
+		}, nil, 0, nil
+	}
+	if !localFileExists(bl.FileId) {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "file is not synchronized",
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, nil, 0, nil
+}
+
+// decommissionHandler starts decommission of this server if it is required,
+// and returns the decommission progress as body.
+func decommissionHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	var status *common.DecommissionStatus
+	if header.Attributes != nil && header.Attributes["start"] == "true" {
+		status = StartDecommission()
+	} else {
+		status = DecommissionStatus()
+	}
+	if status == nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "decommission is not started",
+		}, nil, 0, nil
+	}
+	bs, err := json.Marshal(status)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, bytes.NewReader(bs), int64(len(bs)), nil
+}
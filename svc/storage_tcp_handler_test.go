@@ -0,0 +1,39 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+func TestTcpUploadIdentity(t *testing.T) {
+	defer func(c *common.StorageConfig) {
+		common.InitializedStorageConfiguration = c
+	}(common.InitializedStorageConfiguration)
+	common.InitializedStorageConfiguration = &common.StorageConfig{Secret: "123456"}
+
+	cases := []struct {
+		identity string
+		secret   string
+		expect   string
+		result   common.OperationResult
+	}{
+		{"", "", "", common.SUCCESS},
+		{"alice", "123456", "alice", common.SUCCESS},
+		// identities are trusted only from the requests holding the secret.
+		{"alice", "", "", common.UNAUTHORIZED},
+		{"alice", "654321", "", common.UNAUTHORIZED},
+		{"a b", "123456", "", common.ERROR},
+	}
+	for _, c := range cases {
+		identity, h := tcpUploadIdentity(&common.Header{
+			Attributes: map[string]string{"identity": c.identity, "secret": c.secret},
+		})
+		result := common.SUCCESS
+		if h != nil {
+			result = h.Result
+		}
+		if identity != c.expect || result != c.result {
+			t.Errorf("tcpUploadIdentity(%q, %q) = %q, result %d", c.identity, c.secret, identity, result)
+		}
+	}
+}
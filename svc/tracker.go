@@ -2,6 +2,7 @@ package svc
 
 import (
 	"fmt"
+	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/reg"
 	"github.com/hetianyi/godfs/util"
@@ -17,6 +18,10 @@ func BootTrackerServer() {
 		fmt.Println("Err:", err)
 		os.Exit(1)
 	}
+	if err := util.InitTrackerConfig(common.InitializedTrackerConfiguration); err != nil {
+		fmt.Println("Err:", err)
+		os.Exit(1)
+	}
 
 	if true {
 		cbs, _ := json.MarshalIndent(common.InitializedTrackerConfiguration, "", "  ")
@@ -28,9 +33,37 @@ func BootTrackerServer() {
 
 	util.PrintLogo()
 
+	writableBinlogManager = binlog.NewXBinlogManager(binlog.TRACKER_BINLOG_MANAGER)
+	handleShutdownSignals(nil, flushTracker)
+	handleReloadSignal()
+
 	if common.InitializedTrackerConfiguration.EnableHttp {
 		StartTrackerHttpServer(common.InitializedTrackerConfiguration)
 	}
 	reg.InitRegistry()
+	// migrate the fileId index if the backend changes.
+	InitIndexMigration()
+	// start fileId replication from the other trackers.
+	InitTrackerReplication()
+	// start health check of storage servers.
+	InitHealthCheck()
+	// release the usage of expired files.
+	InitUsageReaper()
 	StartTrackerTcpServer()
 }
+
+// flushTracker persists the tracker states on shutdown.
+//
+// The shared stores are left to the process exit
+// if interrupted requests may still be writing to them.
+func flushTracker(drained bool) {
+	reg.Save()
+	if !drained {
+		return
+	}
+	if err := writableBinlogManager.Close(); err != nil {
+		logger.Error("error close binlog: ", err)
+	}
+	closeDataSet()
+	closeConfigMap()
+}
@@ -3,17 +3,27 @@ package svc
 import (
 	"github.com/gorilla/mux"
 	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/godfs/util"
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
 	"net/http"
+	"sort"
 	"time"
 )
 
 // StartTrackerHttpServer starts a tracker http server.
 func StartTrackerHttpServer(c *common.TrackerConfig) {
 	r := mux.NewRouter()
+	r.HandleFunc("/reload", httpReloadConfig).Methods("POST")
+	r.HandleFunc("/registry/history", httpRegistryHistory).Methods("GET")
+	r.HandleFunc("/instances", httpInstances).Methods("GET")
+	r.HandleFunc("/mirrors", httpMirrorStatus).Methods("GET")
+	r.HandleFunc("/files", httpListFiles).Methods("GET")
+	r.HandleFunc("/usage", httpUsage).Methods("GET")
 	srv := &http.Server{
-		Handler: r,
+		Handler: coordinator.trackHttp(r),
 		Addr:    c.BindAddress + ":" + convert.IntToStr(c.HttpPort),
 		// Good practice: enforce timeouts for servers you create!
 		ReadHeaderTimeout: time.Second * 15,
@@ -21,10 +31,77 @@ func StartTrackerHttpServer(c *common.TrackerConfig) {
 		ReadTimeout:       0,
 		MaxHeaderBytes:    1 << 20, // 1MB
 	}
+	coordinator.registerHttpServer(srv)
 	go func() {
 		logger.Info("http server listening on ", c.BindAddress, ":", c.HttpPort)
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logger.Fatal(err)
 		}
 	}()
 }
+
+// httpRegistryHistory responses the recent joins, leaves and conflicts
+// of the instance given by query parameter "instanceId", or all instances.
+func httpRegistryHistory(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedTrackerConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	retJSON, err := json.Marshal(reg.History(r.URL.Query().Get("instanceId")))
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
+
+// httpInstances responses the registered instances,
+// which can be filtered by query parameters "zone", "rack" and "role".
+func httpInstances(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedTrackerConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	query := r.URL.Query()
+	role := common.ROLE_ANY
+	if query.Get("role") != "" {
+		v, err := convert.StrToInt(query.Get("role"))
+		if err != nil {
+			util.HttpWriteResponse(w, http.StatusBadRequest, "invalid role: "+query.Get("role"))
+			return
+		}
+		role = common.Role(v)
+	}
+	snapshot := reg.InstanceSetSnapshot()
+	filterInstancesByLabels(snapshot, query.Get("zone"), query.Get("rack"))
+	instances := []common.Instance{}
+	for _, ins := range snapshot {
+		if role != common.ROLE_ANY && ins.Role != role {
+			continue
+		}
+		i := *ins
+		i.Secret = ""
+		i.HistorySecrets = nil
+		instances = append(instances, i)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].InstanceId < instances[j].InstanceId
+	})
+
+	retJSON, err := json.Marshal(instances)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, http.StatusOK, string(retJSON))
+}
@@ -0,0 +1,94 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"time"
+)
+
+const (
+	trackerReplicationInterval = time.Second * 10
+	trackerReplicationKey      = "trackerReplicationState:"
+)
+
+// InitTrackerReplication starts replicating fileIds from the other trackers,
+// so that every tracker holds the complete fileId dataset.
+//
+// A tracker replicates the binlog of its peers and writes the new fileIds
+// to its own binlog, fileIds pushed to any tracker reach the trackers
+// which are not configured with the source tracker as well.
+func InitTrackerReplication() {
+	timer.Start(trackerReplicationInterval, trackerReplicationInterval, 0, func(t *timer.Timer) {
+		if clientAPI == nil {
+			return
+		}
+		trackers := parsedTrackers()
+		for i := range trackers {
+			server := &trackers[i]
+			// waiting for instanceId.
+			if server.InstanceId == "" ||
+				server.InstanceId == common.InitializedTrackerConfiguration.InstanceId {
+				continue
+			}
+			replicateTracker(server)
+		}
+	})
+}
+
+// replicateTracker replicates fileIds from the tracker
+// until no new binlog available.
+func replicateTracker(server *common.Server) {
+	for true {
+		state, err := loadTrackerReplicationState(server.InstanceId)
+		if err != nil {
+			logger.Debug("error load tracker replication state: ", err)
+			return
+		}
+		ret, err := clientAPI.SyncBinlog(server, state)
+		if err != nil {
+			logger.Debug("error replicate binlog from tracker server: ",
+				server.ConnectionString(), "(", server.InstanceId, "): ", err)
+			return
+		}
+		if ret.FileIndex == state.FileIndex && ret.Offset == state.Offset {
+			return
+		}
+		added, err := addFileIds(ret.Logs)
+		if err != nil {
+			logger.Error("error replicate binlog from tracker server: ",
+				server.ConnectionString(), "(", server.InstanceId, "): ", err)
+			return
+		}
+		logger.Debug("replicate ", added, " fileIds from tracker ",
+			server.ConnectionString(), "(", server.InstanceId, ")")
+		if err := saveTrackerReplicationState(server.InstanceId, &common.BinlogQueryDTO{
+			FileIndex: ret.FileIndex,
+			Offset:    ret.Offset,
+		}); err != nil {
+			logger.Error("error save tracker replication state: ", err)
+			return
+		}
+	}
+}
+
+func loadTrackerReplicationState(instanceId string) (*common.BinlogQueryDTO, error) {
+	ret := &common.BinlogQueryDTO{}
+	bs, err := common.GetConfigMap().GetConfig(trackerReplicationKey + instanceId)
+	if err != nil || len(bs) == 0 {
+		return ret, err
+	}
+	if err := json.Unmarshal(bs, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func saveTrackerReplicationState(instanceId string, state *common.BinlogQueryDTO) error {
+	bs, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return common.GetConfigMap().PutConfig(trackerReplicationKey+instanceId, bs)
+}
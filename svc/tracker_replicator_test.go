@@ -0,0 +1,42 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAddFileIds(t *testing.T) {
+	dir, teardown := setupTestTracker(t, &common.TrackerConfig{})
+	defer teardown()
+	dataset = newTestSetIndex(t, dir)
+
+	id1, id2 := strings.Repeat("a", common.FILE_ID_SIZE), strings.Repeat("b", common.FILE_ID_SIZE)
+	added, err := addFileIds([]common.BingLogDTO{
+		{FileId: id1, SourceInstance: "storage1", FileLength: 1},
+		{FileId: id1, SourceInstance: "storage2", FileLength: 1},
+		{FileId: id2, SourceInstance: "bad", FileLength: 1},
+	})
+	if err != nil || added != 1 {
+		t.Fatal("unexpected added count: ", added, err)
+	}
+	// replicated fileIds are not added twice.
+	if added, _ = addFileIds([]common.BingLogDTO{{FileId: id1, SourceInstance: "storage1"}}); added != 0 {
+		t.Fatal("existing fileId is added again")
+	}
+
+	for id, expect := range map[string]string{id1: "true", id2: "false"} {
+		h, b, _, err := fileExistsHandler(&common.Header{Attributes: map[string]string{"fileId": id}})
+		if err != nil || h.Result != common.SUCCESS {
+			t.Fatal("error query fileId: ", h.Msg, err)
+		}
+		bs, _ := ioutil.ReadAll(b)
+		if string(bs) != expect {
+			t.Fatal("unexpected existence of fileId ", id, ": ", string(bs))
+		}
+	}
+	if h, _, _, _ := fileExistsHandler(&common.Header{}); h.Result != common.ERROR {
+		t.Fatal("empty fileId accepted")
+	}
+}
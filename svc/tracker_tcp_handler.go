@@ -3,8 +3,10 @@ package svc
 import (
 	"errors"
 	"github.com/hetianyi/godfs/api"
+	"github.com/hetianyi/godfs/binlog"
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/godfs/reg"
+	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/convert"
 	"github.com/hetianyi/gox/gpip"
 	"github.com/hetianyi/gox/logger"
@@ -12,6 +14,7 @@ import (
 	"github.com/logrusorgru/aurora"
 	"io"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -23,6 +26,7 @@ func StartTrackerTcpServer() {
 	if err != nil {
 		logger.Fatal(err)
 	}
+	coordinator.registerListener(listener)
 
 	time.Sleep(time.Millisecond * 50)
 
@@ -44,6 +48,8 @@ func StartTrackerTcpServer() {
 			MaxConnectionsPerServer: MaxConnPerServer,
 			SynchronizeOnce:         false,
 			TrackerServers:          servers,
+			Zone:                    common.InitializedTrackerConfiguration.Zone,
+			Rack:                    common.InitializedTrackerConfiguration.Rack,
 		}
 		InitializeClientAPI(config)
 	}
@@ -51,6 +57,10 @@ func StartTrackerTcpServer() {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if coordinator.isShuttingDown() {
+				waitForShutdown()
+				return
+			}
 			logger.Error("error accepting new connection: ", err)
 			continue
 		}
@@ -64,6 +74,10 @@ func trackerClientConnHandler(conn net.Conn) {
 		Conn: conn,
 	}
 	defer pip.Close()
+	if !coordinator.trackConn(conn) {
+		return
+	}
+	defer coordinator.untrackConn(conn)
 
 	authorized := false
 
@@ -81,6 +95,10 @@ func trackerClientConnHandler(conn net.Conn) {
 			if _header == nil {
 				return errors.New("invalid request: header is empty")
 			}
+			if !coordinator.beginRequest() {
+				return errors.New("server is shutting down")
+			}
+			defer coordinator.endRequest()
 			header := _header.(*common.Header)
 			bs, _ := json.Marshal(header)
 
@@ -110,7 +128,7 @@ func trackerClientConnHandler(conn net.Conn) {
 			}
 
 			if header.Operation == common.OPERATION_SYNC_INSTANCES {
-				h, b, l, err := synchronizeInstancesHandler(header)
+				h, b, l, err := synchronizeInstancesHandler(header, registeredInstance)
 				if err != nil {
 					return err
 				}
@@ -121,6 +139,43 @@ func trackerClientConnHandler(conn net.Conn) {
 					return err
 				}
 				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_SYNC_BINLOGS {
+				h, b, l, err := syncBinlogHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_QUERY {
+				h, b, l, err := fileExistsHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_LIST_FILES {
+				h, b, l, err := listFilesHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_INSTANCE_INFO {
+				h, b, l, err := updateInstanceHandler(header, registeredInstance)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_USAGE {
+				h, b, l, err := usageHandler(header)
+				if err != nil {
+					return err
+				}
+				return pip.Send(h, b, l)
+			} else if header.Operation == common.OPERATION_DEREGISTER {
+				if registeredInstance != nil {
+					reg.Remove(registeredInstance)
+				}
+				return pip.Send(&common.Header{
+					Result: common.SUCCESS,
+				}, nil, 0)
 			}
 			return pip.Send(&common.Header{
 				Result: common.UNKNOWN_OPERATION,
@@ -135,9 +190,26 @@ func trackerClientConnHandler(conn net.Conn) {
 	}
 }
 
-// inspectFileHandler inspects file's information
-func synchronizeInstancesHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+// synchronizeInstancesHandler returns the registered instances.
+//
+// Instances registered to the other trackers are included for non-tracker clients,
+// trackers get local registrations only so that expired instances
+// are not circulated among trackers.
+func synchronizeInstancesHandler(header *common.Header, registeredInstance *common.Instance) (*common.Header, io.Reader, int64, error) {
 	snapshot := reg.InstanceSetSnapshot()
+	if registeredInstance == nil || registeredInstance.Role != common.ROLE_TRACKER {
+		gox.WalkList(api.FilterInstances(common.ROLE_ANY), func(item interface{}) bool {
+			ins := item.(*common.Instance)
+			// local registration wins.
+			if snapshot[ins.InstanceId] == nil {
+				snapshot[ins.InstanceId] = ins
+			}
+			return false
+		})
+	}
+	if header.Attributes != nil {
+		filterInstancesByLabels(snapshot, header.Attributes["zone"], header.Attributes["rack"])
+	}
 	ret, _ := json.Marshal(snapshot)
 	return &common.Header{
 		Result: common.SUCCESS,
@@ -148,6 +220,44 @@ func synchronizeInstancesHandler(header *common.Header) (*common.Header, io.Read
 	}, nil, 0, nil
 }
 
+// filterInstancesByLabels removes the instances whose zone or rack label does not match,
+// empty labels match all instances.
+func filterInstancesByLabels(instances map[string]*common.Instance, zone, rack string) {
+	for k, ins := range instances {
+		if (zone != "" && ins.Attributes["zone"] != zone) ||
+			(rack != "" && ins.Attributes["rack"] != rack) {
+			delete(instances, k)
+		}
+	}
+}
+
+// updateInstanceHandler updates the instance info of the registered client.
+func updateInstanceHandler(header *common.Header, registeredInstance *common.Instance) (*common.Header, io.Reader, int64, error) {
+	instance := &common.Instance{}
+	if header.Attributes == nil || json.UnmarshalFromString(header.Attributes["instance"], instance) != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	if registeredInstance == nil || registeredInstance.InstanceId != instance.InstanceId {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "instance is not registered by this connection",
+		}, nil, 0, nil
+	}
+	if err := registerInstance(instance); err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	logger.Debug("instance updated: ", instance.InstanceId, "@", instance.Server.ConnectionString())
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, nil, 0, nil
+}
+
 // syncStorageBinLog saves storage server binlog.
 func pushStorageBinLogHandler(header *common.Header, clientId string) (*common.Header, io.Reader, int64, error) {
 
@@ -170,41 +280,79 @@ func pushStorageBinLogHandler(header *common.Header, clientId string) (*common.H
 		}, nil, 0, nil
 	}
 
-	/*configMap := common.GetConfigMap()
-	if err := configMap.PutFile(ret); err != nil {
+	if _, err := addFileIds(ret); err != nil {
 		return &common.Header{
 			Result: common.ERROR,
 			Msg:    err.Error(),
 		}, nil, 0, nil
-	}*/
-
-	if len(ret) > 0 {
-		for _, f := range ret {
-			c, err := Contains(f.FileId)
-			if err != nil {
-				return &common.Header{
-					Result: common.ERROR,
-					Msg:    err.Error(),
-				}, nil, 0, nil
-			}
-			if c {
-				logger.Debug("fileId already exists: ", f.FileId)
-				return &common.Header{
-					Result: common.SUCCESS,
-				}, nil, 0, nil
+	}
+
+	logger.Debug("binlog write success: ", len(ret))
+
+	return &common.Header{
+		Result: common.SUCCESS,
+	}, nil, 0, nil
+}
+
+// addFileIds adds the fileIds which not exist to dataset,
+// binlogs are written for them so that the other trackers can replicate them,
+// and the files are charged to the usage of their groups and owners.
+//
+// It returns the count of fileIds added.
+func addFileIds(bls []common.BingLogDTO) (int, error) {
+	added := 0
+	for _, f := range bls {
+		if f.FileId == "" || len(f.SourceInstance) < 8 {
+			logger.Debug("skip invalid binlog: ", f.FileId)
+			continue
+		}
+		err := DoIfNotExist(f.FileId, func() error {
+			if writableBinlogManager != nil {
+				bl := binlog.CreateLocalBinlog(f.FileId, f.FileLength, f.SourceInstance)
+				bl.ExpireTime = f.ExpireTime
+				bl.Meta = f.Meta
+				if err := writableBinlogManager.Write(bl); err != nil {
+					return err
+				}
 			}
 			if err := Add(f.FileId); err != nil {
-				return &common.Header{
-					Result: common.ERROR,
-					Msg:    err.Error(),
-				}, nil, 0, nil
+				return err
 			}
+			added++
+			// usage drifts rather than the push is retried, for the fileId is added.
+			if err := chargeUsage(&f, time.Now()); err != nil {
+				logger.Error("error charge usage of file ", f.FileId, ": ", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return added, err
 		}
 	}
+	return added, nil
+}
 
-	logger.Debug("binlog write success: ", len(ret))
-
+// fileExistsHandler checks whether the fileId exists in dataset.
+func fileExistsHandler(header *common.Header) (*common.Header, io.Reader, int64, error) {
+	fileId := ""
+	if header.Attributes != nil {
+		fileId = header.Attributes["fileId"]
+	}
+	if fileId == "" {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    "invalid header(0)",
+		}, nil, 0, nil
+	}
+	exists, err := Contains(fileId)
+	if err != nil {
+		return &common.Header{
+			Result: common.ERROR,
+			Msg:    err.Error(),
+		}, nil, 0, nil
+	}
+	body := gox.TValue(exists, "true", "false").(string)
 	return &common.Header{
 		Result: common.SUCCESS,
-	}, nil, 0, nil
+	}, strings.NewReader(body), int64(len(body)), nil
 }
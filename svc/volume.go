@@ -0,0 +1,101 @@
+package svc
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/godfs/util"
+	"github.com/hetianyi/gox"
+	"github.com/hetianyi/gox/logger"
+	"github.com/hetianyi/gox/timer"
+	json "github.com/json-iterator/go"
+	"net/http"
+	"sync"
+)
+
+var (
+	volumeCompacting     bool
+	volumeCompactingLock = new(sync.Mutex)
+)
+
+// InitVolumeCompaction starts a timer job which compacts the volumes
+// whose ratio of deleted space reaches common.VOLUME_COMPACT_RATIO.
+func InitVolumeCompaction() {
+	if !util.VolumesEnabled() {
+		return
+	}
+	timer.Start(common.VOLUME_COMPACT_INTERVAL, common.VOLUME_COMPACT_INTERVAL, 0, func(t *timer.Timer) {
+		if coordinator.isShuttingDown() || !beginVolumeCompaction() {
+			return
+		}
+		compactVolumes()
+	})
+}
+
+// StartVolumeCompaction starts a compaction in background,
+// it returns false if there is already a compaction in progress.
+func StartVolumeCompaction() bool {
+	if !beginVolumeCompaction() {
+		return false
+	}
+	go compactVolumes()
+	return true
+}
+
+func beginVolumeCompaction() bool {
+	volumeCompactingLock.Lock()
+	defer volumeCompactingLock.Unlock()
+	if volumeCompacting {
+		return false
+	}
+	volumeCompacting = true
+	return true
+}
+
+func compactVolumes() {
+	defer func() {
+		volumeCompactingLock.Lock()
+		volumeCompacting = false
+		volumeCompactingLock.Unlock()
+	}()
+	reclaimed, err := util.CompactVolumes(common.VOLUME_COMPACT_RATIO)
+	if err != nil {
+		logger.Error("error compact volumes: ", err)
+		return
+	}
+	if reclaimed > 0 {
+		logger.Info("volume compaction finished, ", reclaimed, " bytes reclaimed")
+	}
+}
+
+// httpVolumes responses the state of each volume on GET
+// and starts a compaction in background on POST.
+//
+// POST responses 202 if the compaction is started,
+// or 409 if there is already a compaction in progress.
+func httpVolumes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if !checkAdminSecret(r, common.InitializedStorageConfiguration.Secret) {
+		util.HttpForbiddenError(w, "Forbidden.")
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		if !util.VolumesEnabled() {
+			util.HttpWriteResponse(w, http.StatusBadRequest, "volumes are not enabled")
+			return
+		}
+		status = gox.TValue(StartVolumeCompaction(), http.StatusAccepted, http.StatusConflict).(int)
+	}
+
+	ret := []common.VolumeStatus{}
+	ret = append(ret, util.VolumeStatus()...)
+	retJSON, err := json.Marshal(ret)
+	if err != nil {
+		logger.Debug(err)
+		util.HttpInternalServerError(w, "Internal Server Error.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	util.HttpWriteResponse(w, status, string(retJSON))
+}
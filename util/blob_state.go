@@ -0,0 +1,105 @@
+package util
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"os"
+)
+
+// blobState returns the state of the standalone blob,
+// or nil if the blob keeps its reference count in the tail.
+func blobState(rel string) (*common.BlobState, error) {
+	cm := common.GetConfigMap()
+	if cm == nil {
+		return nil, nil
+	}
+	return cm.GetBlobState(rel)
+}
+
+// readTail reads the reference count tail of the file,
+// and returns it with the size of the file without the tail.
+func readTail(f *os.File) (int64, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Size() < 4 {
+		return 0, 0, errors.New("invalid format file")
+	}
+	tailRefBytes := make([]byte, 8)
+	if _, err := f.ReadAt(tailRefBytes[4:], info.Size()-4); err != nil {
+		return 0, 0, err
+	}
+	return convert.Bytes2Length(tailRefBytes), info.Size() - 4, nil
+}
+
+// moveTailToState moves the reference count tail of the file into the state of the blob,
+// the file keeps the tail if there is no config map to keep the state.
+//
+// The state is saved before the file is truncated,
+// the size in the state bounds the content so the tail left by an interruption is never read.
+func moveTailToState(fullPath, rel string) error {
+	cm := common.GetConfigMap()
+	if cm == nil {
+		return nil
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	refCount, size, err := readTail(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := cm.PutBlobState(rel, &common.BlobState{RefCount: refCount, Size: size}); err != nil {
+		return err
+	}
+	return os.Truncate(fullPath, size)
+}
+
+// StripBlobTail moves the reference count tail of the standalone blob of old versions into its state,
+// it returns false if the blob has no tail.
+func StripBlobTail(rel string) (bool, error) {
+	fullPath, exists := LocateBlob(rel)
+	if !exists {
+		return false, common.NotFoundErr
+	}
+	state, err := blobState(rel)
+	if err != nil {
+		return false, err
+	}
+	if state == nil {
+		return true, moveTailToState(fullPath, rel)
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() <= state.Size {
+		return false, nil
+	}
+	// the strip is interrupted after the state is saved.
+	return true, os.Truncate(fullPath, state.Size)
+}
+
+// UpdateBlobReferenceCount changes the reference count in the state of the standalone blob,
+// it returns false if the blob keeps its reference count in the tail.
+func UpdateBlobReferenceCount(rel string, value int64) (bool, error) {
+	cm := common.GetConfigMap()
+	if cm == nil {
+		return false, nil
+	}
+	state, err := cm.AddBlobRefCount(rel, value)
+	return state != nil, err
+}
+
+// deleteBlobState deletes the state of the standalone blob which is removed from the data dir.
+func deleteBlobState(rel string) error {
+	cm := common.GetConfigMap()
+	if cm == nil {
+		return nil
+	}
+	return cm.DeleteBlobState(rel)
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/file"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlobState(t *testing.T) {
+	dir, teardown := setupTestStorage(t)
+	defer teardown()
+	cm, err := common.NewConfigMap(dir + "/cfg.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	common.SetConfigMap(cm)
+
+	// blob of old versions with the tail.
+	legacy := "0A/0B/0123456789abcdef0123456789abcdef"
+	if err := file.CreateDirs(dir + "/0A/0B"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/"+legacy, []byte{'a', 'b', 0, 0, 0, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertBlob := func(rel, content string, refCount int64) {
+		b, err := OpenBlob(rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		bs, err := ioutil.ReadAll(b)
+		if err != nil || string(bs) != content || b.RefCount != refCount {
+			t.Fatal("unexpected blob ", rel, ": ", string(bs), ", ", b.RefCount, ", ", err)
+		}
+	}
+	assertBlob(legacy, "ab", 2)
+	if stated, err := UpdateBlobReferenceCount(legacy, 1); stated || err != nil {
+		t.Fatal("blob of old versions has no state: ", err)
+	}
+
+	if stripped, err := StripBlobTail(legacy); !stripped || err != nil {
+		t.Fatal("tail is not stripped: ", err)
+	}
+	if info, _ := os.Stat(dir + "/" + legacy); info.Size() != 2 {
+		t.Fatal("file is not truncated: ", info.Size())
+	}
+	assertBlob(legacy, "ab", 2)
+	if stripped, _ := StripBlobTail(legacy); stripped {
+		t.Fatal("tail is stripped twice")
+	}
+	if stated, err := UpdateBlobReferenceCount(legacy, -1); !stated || err != nil {
+		t.Fatal("reference count is not updated: ", err)
+	}
+	assertBlob(legacy, "ab", 1)
+
+	// the tail left by an interrupted strip is never read.
+	if err := ioutil.WriteFile(dir+"/"+legacy, []byte{'a', 'b', 0, 0, 0, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertBlob(legacy, "ab", 1)
+	if stripped, err := StripBlobTail(legacy); !stripped || err != nil {
+		t.Fatal("interrupted strip is not finished: ", err)
+	}
+
+	// new blobs are placed without the tail.
+	tmp := dir + "/tmp"
+	if err := ioutil.WriteFile(tmp, []byte{'c', 0, 0, 0, 1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rel := "0C/0D/0123456789abcdef0123456789abcdef"
+	p, err := PlaceBlob(tmp, rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(p); info.Size() != 1 {
+		t.Fatal("tail is placed: ", info.Size())
+	}
+	assertBlob(rel, "c", 1)
+	if b := StatBlob(p, rel); b.RefCount != 1 || b.Size != 1 {
+		t.Fatal("unexpected stat: ", b)
+	}
+
+	if err := RemoveBlob(rel); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := cm.GetBlobState(rel); s != nil || err != nil {
+		t.Fatal("state of the removed blob is kept: ", err)
+	}
+
+	// no state is saved for the blob which is not placed.
+	if err := ioutil.WriteFile(tmp, []byte{'e', 0, 0, 0, 1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/0E", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	failed := "0E/0F/0123456789abcdef0123456789abcdef"
+	if _, err := PlaceBlob(tmp, failed); err == nil {
+		t.Fatal("expect error of placing the blob")
+	}
+	if s, err := cm.GetBlobState(failed); s != nil || err != nil {
+		t.Fatal("state of the blob which is not placed is saved: ", err)
+	}
+}
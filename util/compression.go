@@ -0,0 +1,367 @@
+package util
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/file"
+	"github.com/pierrec/lz4"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// layout of a compressed blob:
+//
+//	header: magic(4) version(1) codec(1) reserved(2) frameSize(4) rawSize(8) frames(4) crc32(4)
+//	frame table: compressed length(4) of each frame, the highest bit marks a frame stored raw
+//	frames
+//
+// Frames are compressed independently so that range reads only decompress the frames they touch,
+// crc32 covers the header before it and the frame table.
+const (
+	compressMagic      = "GDFZ"
+	compressVersion    = 1
+	compressHeaderSize = 28
+	compressFrameSize  = 64 << 10
+	maxFrameSize       = 16 << 20
+	frameRawFlag       = 1 << 31
+	// compressed size must be less than 7/8 of the raw size to be kept.
+	compressWorthRatio = 0.875
+)
+
+// codec ids in the header.
+const (
+	codecNone byte = iota
+	codecLz4
+	codecDeflate
+)
+
+var (
+	codecIds = map[string]byte{
+		common.COMPRESSION_NONE:    codecNone,
+		common.COMPRESSION_LZ4:     codecLz4,
+		common.COMPRESSION_DEFLATE: codecDeflate,
+	}
+	InvalidCompressedBlobErr = errors.New("invalid compressed blob")
+)
+
+// compressHeader is the parsed header of a compressed blob.
+type compressHeader struct {
+	codec     byte
+	frameSize int64
+	rawSize   int64
+	offsets   []int64 // offsets of frames in the blob, with the end of the last frame
+	raw       []bool
+}
+
+// CompressBlob compresses the blob file in place by the compression policy of the group,
+// the blob file contains the content followed by the reference count tail.
+//
+// Files smaller than the threshold or of compressed mime types, which are detected
+// by the file name or the content, are kept as they are,
+// unless the content looks like a compressed or encrypted blob, which is wrapped
+// so that it is not mistaken for one.
+func CompressBlob(path, group, fileName string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size() - 4
+	if size < 0 {
+		return errors.New("invalid format file")
+	}
+	// the head is used for detecting mime type.
+	head := make([]byte, 512)
+	if size < int64(len(head)) {
+		head = head[:size]
+	}
+	if _, err := in.ReadAt(head, 0); err != nil {
+		return err
+	}
+	wrap := bytes.HasPrefix(head, []byte(compressMagic)) || bytes.HasPrefix(head, []byte(encryptMagic))
+
+	codecName, threshold := compressionPolicy(group)
+	codec := codecIds[codecName]
+	if size < int64(threshold)*1024 || common.IsCompressedMimeType(common.DetectMimeType(fileName, head)) {
+		codec = codecNone
+	}
+	if codec == codecNone && !wrap {
+		return nil
+	}
+
+	tmp := path + ".z"
+	defer file.Delete(tmp)
+	compressed, err := encodeBlob(in, size, tmp, codec)
+	if err != nil {
+		return err
+	}
+	if codec != codecNone && float64(compressed) >= float64(size)*compressWorthRatio {
+		if !wrap {
+			return nil
+		}
+		if _, err = encodeBlob(in, size, tmp, codecNone); err != nil {
+			return err
+		}
+	}
+	in.Close()
+	return os.Rename(tmp, path)
+}
+
+// compressionPolicy returns the codec and the threshold(KB) of compressing files of the group,
+// groups without their own policy follow compression and compressionThreshold.
+func compressionPolicy(group string) (string, int) {
+	c := common.InitializedStorageConfiguration
+	for _, p := range c.CompressionPolicies {
+		if p.Group == group {
+			return p.Codec, p.Threshold
+		}
+	}
+	return c.Compression, c.CompressionThreshold
+}
+
+// encodeBlob writes the compressed blob with the reference count tail to the target,
+// and returns the size of the compressed blob without the tail.
+func encodeBlob(in io.ReaderAt, size int64, target string, codec byte) (int64, error) {
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	frames := (size + compressFrameSize - 1) / compressFrameSize
+	table := make([]byte, frames*4)
+	dataStart := compressHeaderSize + int64(len(table))
+	if _, err := out.Seek(dataStart, 0); err != nil {
+		return 0, err
+	}
+
+	raw := make([]byte, compressFrameSize)
+	var buf []byte
+	var hashTable []int
+	var fw *flate.Writer
+	var fbuf bytes.Buffer
+	switch codec {
+	case codecLz4:
+		buf = make([]byte, lz4.CompressBlockBound(compressFrameSize))
+		hashTable = make([]int, 1<<16)
+	case codecDeflate:
+		if fw, err = flate.NewWriter(&fbuf, flate.DefaultCompression); err != nil {
+			return 0, err
+		}
+	}
+	written := dataStart
+	for i := int64(0); i < frames; i++ {
+		l := compressFrameSize
+		if rest := size - i*compressFrameSize; rest < int64(l) {
+			l = int(rest)
+		}
+		if _, err := in.ReadAt(raw[:l], i*compressFrameSize); err != nil && err != io.EOF {
+			return 0, err
+		}
+		var frame []byte
+		switch codec {
+		case codecLz4:
+			for j := range hashTable {
+				hashTable[j] = 0
+			}
+			n, err := lz4.CompressBlock(raw[:l], buf, hashTable)
+			if err != nil {
+				return 0, err
+			}
+			frame = buf[:n]
+		case codecDeflate:
+			fbuf.Reset()
+			fw.Reset(&fbuf)
+			if _, err := fw.Write(raw[:l]); err != nil {
+				return 0, err
+			}
+			if err := fw.Close(); err != nil {
+				return 0, err
+			}
+			frame = fbuf.Bytes()
+		}
+		entry := uint32(len(frame))
+		if len(frame) == 0 || len(frame) >= l {
+			frame, entry = raw[:l], uint32(l)|frameRawFlag
+		}
+		binary.BigEndian.PutUint32(table[i*4:], entry)
+		if _, err := out.Write(frame); err != nil {
+			return 0, err
+		}
+		written += int64(len(frame))
+	}
+
+	// write reference count tail.
+	tail := make([]byte, 4)
+	if _, err := in.ReadAt(tail, size); err != nil {
+		return 0, err
+	}
+	if _, err := out.Write(tail); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, compressHeaderSize)
+	copy(header, compressMagic)
+	header[4] = compressVersion
+	header[5] = codec
+	binary.BigEndian.PutUint32(header[8:], compressFrameSize)
+	binary.BigEndian.PutUint64(header[12:], uint64(size))
+	binary.BigEndian.PutUint32(header[20:], uint32(frames))
+	h := crc32.NewIEEE()
+	h.Write(header[:24])
+	h.Write(table)
+	binary.BigEndian.PutUint32(header[24:], h.Sum32())
+	if _, err := out.WriteAt(header, 0); err != nil {
+		return 0, err
+	}
+	if _, err := out.WriteAt(table, compressHeaderSize); err != nil {
+		return 0, err
+	}
+	return written, out.Close()
+}
+
+// readCompressHeader parses the header of a compressed blob,
+// it returns nil if the blob is not compressed.
+func readCompressHeader(r io.ReaderAt, size int64) *compressHeader {
+	if size < compressHeaderSize {
+		return nil
+	}
+	header := make([]byte, compressHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil || string(header[:4]) != compressMagic ||
+		header[4] != compressVersion || header[5] > codecDeflate {
+		return nil
+	}
+	ch := &compressHeader{
+		codec:     header[5],
+		frameSize: int64(binary.BigEndian.Uint32(header[8:])),
+		rawSize:   int64(binary.BigEndian.Uint64(header[12:])),
+	}
+	frames := int64(binary.BigEndian.Uint32(header[20:]))
+	if ch.frameSize <= 0 || ch.frameSize > maxFrameSize || ch.rawSize < 0 ||
+		frames != (ch.rawSize+ch.frameSize-1)/ch.frameSize || compressHeaderSize+frames*4 > size {
+		return nil
+	}
+	table := make([]byte, frames*4)
+	if _, err := r.ReadAt(table, compressHeaderSize); err != nil {
+		return nil
+	}
+	h := crc32.NewIEEE()
+	h.Write(header[:24])
+	h.Write(table)
+	if h.Sum32() != binary.BigEndian.Uint32(header[24:]) {
+		return nil
+	}
+	ch.offsets = make([]int64, frames+1)
+	ch.raw = make([]bool, frames)
+	ch.offsets[0] = compressHeaderSize + frames*4
+	for i := int64(0); i < frames; i++ {
+		entry := binary.BigEndian.Uint32(table[i*4:])
+		ch.raw[i] = entry&frameRawFlag != 0
+		ch.offsets[i+1] = ch.offsets[i] + int64(entry&^frameRawFlag)
+	}
+	if ch.offsets[frames] != size {
+		return nil
+	}
+	return ch
+}
+
+// frameReader reads the content of a compressed blob,
+// the last decompressed frame is cached for sequential reads.
+type frameReader struct {
+	r      io.ReaderAt
+	header *compressHeader
+	lock   sync.Mutex
+	cached int64
+	frame  []byte
+	src    []byte
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *frameReader) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	read := 0
+	for read < len(p) {
+		if off >= f.header.rawSize {
+			return read, io.EOF
+		}
+		i := off / f.header.frameSize
+		if err := f.loadFrame(i); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], f.frame[off-i*f.header.frameSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+// loadFrame decompresses the frame into the cache.
+func (f *frameReader) loadFrame(i int64) error {
+	if f.cached == i && f.frame != nil {
+		return nil
+	}
+	h := f.header
+	l := h.frameSize
+	if rest := h.rawSize - i*h.frameSize; rest < l {
+		l = rest
+	}
+	srcLen := h.offsets[i+1] - h.offsets[i]
+	if int64(cap(f.src)) < srcLen {
+		f.src = make([]byte, srcLen)
+	}
+	src := f.src[:srcLen]
+	if _, err := f.r.ReadAt(src, h.offsets[i]); err != nil && err != io.EOF {
+		return err
+	}
+	if int64(cap(f.frame)) < l {
+		f.frame = make([]byte, h.frameSize)
+	}
+	frame := f.frame[:l]
+	f.cached = -1
+	if h.raw[i] || h.codec == codecNone {
+		if srcLen != l {
+			return InvalidCompressedBlobErr
+		}
+		copy(frame, src)
+	} else if h.codec == codecLz4 {
+		n, err := lz4.UncompressBlock(src, frame)
+		if err != nil {
+			return err
+		}
+		if int64(n) != l {
+			return InvalidCompressedBlobErr
+		}
+	} else {
+		if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(src)), frame); err != nil {
+			return err
+		}
+	}
+	f.frame = frame
+	f.cached = i
+	return nil
+}
+
+// OpenContent returns a reader of the content of the blob,
+// compressed blobs are decompressed transparently.
+func OpenContent(blob *Blob) *io.SectionReader {
+	h := readCompressHeader(blob, blob.Size())
+	if h == nil {
+		return blob.SectionReader
+	}
+	return io.NewSectionReader(&frameReader{
+		r:      blob,
+		header: h,
+		cached: -1,
+	}, 0, h.rawSize)
+}
@@ -0,0 +1,97 @@
+package util
+
+import (
+	"bytes"
+	"github.com/hetianyi/godfs/common"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompressBlob(t *testing.T) {
+	dir, teardown := setupTestStorage(t)
+	defer teardown()
+
+	text := []byte(strings.Repeat("godfs compresses text at rest. ", 10000))
+	png := append([]byte("\x89PNG\r\n\x1a\n"), text...)
+	wrapped := append([]byte(compressMagic), text[:100]...)
+	cases := []struct {
+		codec      string
+		fileName   string
+		content    []byte
+		compressed bool
+	}{
+		{common.COMPRESSION_LZ4, "", text, true},
+		{common.COMPRESSION_DEFLATE, "a.log", text, true},
+		{common.COMPRESSION_LZ4, "a.png", text, false},
+		{common.COMPRESSION_LZ4, "", png, false},
+		{common.COMPRESSION_NONE, "", text, false},
+		{common.COMPRESSION_NONE, "", wrapped, false},
+	}
+	for i, c := range cases {
+		common.InitializedStorageConfiguration = &common.StorageConfig{
+			Compression:          c.codec,
+			CompressionThreshold: 1,
+		}
+		path := dir + "/blob"
+		if err := ioutil.WriteFile(path, append(c.content, 0, 0, 0, 2), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := CompressBlob(path, "G01", c.fileName); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := f.Stat()
+		if compressed := info.Size() < int64(len(c.content)); compressed != c.compressed {
+			t.Fatal("case ", i, ": expect compressed ", c.compressed, ", got size ", info.Size())
+		}
+		tail := make([]byte, 4)
+		f.ReadAt(tail, info.Size()-4)
+		if !bytes.Equal(tail, []byte{0, 0, 0, 2}) {
+			t.Fatal("case ", i, ": reference count tail is lost")
+		}
+
+		blob := &Blob{SectionReader: io.NewSectionReader(f, 0, info.Size()-4), f: f}
+		content := OpenContent(blob)
+		all, err := ioutil.ReadAll(content)
+		if err != nil || !bytes.Equal(all, c.content) {
+			t.Fatal("case ", i, ": content mismatch: ", err)
+		}
+		// range read across frames.
+		if len(c.content) > compressFrameSize {
+			off := int64(compressFrameSize - 10)
+			part := make([]byte, 100)
+			if _, err := content.ReadAt(part, off); err != nil || !bytes.Equal(part, c.content[off:off+100]) {
+				t.Fatal("case ", i, ": range content mismatch: ", err)
+			}
+		}
+		blob.Close()
+	}
+
+	// groups follow their own policies.
+	common.InitializedStorageConfiguration = &common.StorageConfig{
+		Compression:         common.COMPRESSION_LZ4,
+		CompressionPolicies: []common.CompressionPolicy{{Group: "G02", Codec: common.COMPRESSION_NONE}},
+	}
+	for group, compressed := range map[string]bool{"G01": true, "G02": false} {
+		path := dir + "/blob"
+		if err := ioutil.WriteFile(path, append(text, 0, 0, 0, 1), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := CompressBlob(path, group, ""); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() < int64(len(text)) != compressed {
+			t.Fatal("compression policy of group ", group, " is not followed")
+		}
+	}
+}
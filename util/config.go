@@ -13,6 +13,7 @@ import (
 	json "github.com/json-iterator/go"
 	"github.com/mitchellh/go-homedir"
 	"io"
+	"reflect"
 	"runtime"
 	"strings"
 )
@@ -53,6 +54,7 @@ func LoadConfig(c string, mode common.BootMode, container interface{}) error {
 	if err != nil {
 		return err
 	}
+	defer cf.Close()
 	var buffer bytes.Buffer
 	_, err = io.Copy(&buffer, cf)
 	if err != nil {
@@ -61,6 +63,38 @@ func LoadConfig(c string, mode common.BootMode, container interface{}) error {
 	return json.Unmarshal(buffer.Bytes(), container)
 }
 
+// DiffConfig compares the json fields of two configs of the same type,
+// derived fields without json tag are ignored and secrets are masked.
+func DiffConfig(oldConfig interface{}, newConfig interface{}) []common.ConfigChange {
+	ov := reflect.Indirect(reflect.ValueOf(oldConfig))
+	nv := reflect.Indirect(reflect.ValueOf(newConfig))
+	t := ov.Type()
+	var ret []common.ConfigChange
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		of, nf := ov.Field(i), nv.Field(i)
+		if of.Kind() == reflect.Slice && of.Len() == 0 && nf.Len() == 0 {
+			continue
+		}
+		if reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			continue
+		}
+		change := common.ConfigChange{
+			Field:    tag,
+			OldValue: fmt.Sprint(of.Interface()),
+			NewValue: fmt.Sprint(nf.Interface()),
+		}
+		if tag == "secret" {
+			change.OldValue, change.NewValue = "******", "******"
+		}
+		ret = append(ret, change)
+	}
+	return ret
+}
+
 // WriteConfig writes config to file.
 func WriteConfig(c string, container interface{}) error {
 	cf, err := file.CreateFile(c)
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"testing"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := &common.StorageConfig{
+		LogLevel:   "info",
+		Secret:     "123",
+		InstanceId: "aaaa",
+	}
+	c := &common.StorageConfig{
+		LogLevel:       "debug",
+		Secret:         "456",
+		AllowedDomains: []string{},
+		Trackers:       []string{"127.0.0.1:1022"},
+		InstanceId:     "bbbb",
+	}
+	changes := DiffConfig(old, c)
+	if len(changes) != 3 {
+		t.Fatal("expect 3 changes, got ", changes)
+	}
+	for _, ch := range changes {
+		switch ch.Field {
+		case "logLevel":
+			if ch.OldValue != "info" || ch.NewValue != "debug" {
+				t.Fatal("wrong change: ", ch)
+			}
+		case "secret":
+			if ch.NewValue == "456" {
+				t.Fatal("secret is not masked")
+			}
+		case "trackers":
+		default:
+			t.Fatal("unexpected change: ", ch.Field)
+		}
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := ParseQuotas("group:G01=1024/0, identity:alice@example.com=0/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 2 || quotas[0] != (common.Quota{Group: "G01", MaxBytes: 1024}) ||
+		quotas[1] != (common.Quota{Identity: "alice@example.com", MaxFiles: 10}) {
+		t.Fatal("unexpected quotas: ", quotas)
+	}
+	if err := validateQuotas(&quotas); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"G01=1024/0", "user:alice=1/1", "group:G01=1024", "group:G01=a/0"} {
+		if _, err := ParseQuotas(s); err == nil {
+			t.Fatal("invalid quota is parsed: ", s)
+		}
+	}
+	for _, q := range []common.Quota{{MaxBytes: 1}, {Group: "G01", Identity: "alice"}, {Identity: "a b"}, {Group: "G01", MaxFiles: -1}} {
+		if err := validateQuotas(&[]common.Quota{q}); err == nil {
+			t.Fatal("invalid quota is accepted: ", q)
+		}
+	}
+}
+
+func TestParseCompressionPolicies(t *testing.T) {
+	policies, err := ParseCompressionPolicies("G01=lz4/64, G02=none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0] != (common.CompressionPolicy{Group: "G01", Codec: "lz4", Threshold: 64}) ||
+		policies[1] != (common.CompressionPolicy{Group: "G02", Codec: "none"}) {
+		t.Fatal("unexpected compression policies: ", policies)
+	}
+	if err := validateCompressionPolicies(&policies); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"G01", "G01=lz4/a"} {
+		if _, err := ParseCompressionPolicies(s); err == nil {
+			t.Fatal("invalid compression policy is parsed: ", s)
+		}
+	}
+	for _, p := range [][]common.CompressionPolicy{
+		{{Group: "G 01", Codec: "lz4"}},
+		{{Group: "G01", Codec: "zip"}},
+		{{Group: "G01", Codec: "lz4", Threshold: -1}},
+		{{Group: "G01", Codec: "lz4"}, {Group: "G01", Codec: "none"}},
+	} {
+		if err := validateCompressionPolicies(&p); err == nil {
+			t.Fatal("invalid compression policies are accepted: ", p)
+		}
+	}
+}
@@ -18,19 +18,234 @@ func init() {
 	storeSecretLock = new(sync.Mutex)
 }
 
-// ValidateStorageConfig validates storage config.
+// validateLabels checks zone and rack labels of the server.
+func validateLabels(zone, rack *string) error {
+	ExchangeEnvValue("zone", func(envValue string) {
+		*zone = envValue
+	})
+	ExchangeEnvValue("rack", func(envValue string) {
+		*rack = envValue
+	})
+	for _, l := range []string{*zone, *rack} {
+		if m, err := regexp.MatchString(common.LABEL_PATTERN, l); err != nil || !m {
+			return errors.New("invalid label \"" + l +
+				"\", label must match pattern " + common.LABEL_PATTERN)
+		}
+	}
+	return nil
+}
+
+// validateIndexBackend checks the backend of the fileId index.
+func validateIndexBackend(backend *string) error {
+	ExchangeEnvValue("indexBackend", func(envValue string) {
+		*backend = envValue
+	})
+	if *backend == "" {
+		*backend = common.INDEX_BACKEND_SET
+	}
+	if *backend != common.INDEX_BACKEND_SET && *backend != common.INDEX_BACKEND_BOLT {
+		return errors.New("invalid index backend \"" + *backend + "\", available options: " +
+			common.INDEX_BACKEND_SET + ", " + common.INDEX_BACKEND_BOLT)
+	}
+	return nil
+}
+
+// validateGc checks the interval and thresholds of garbage collection,
+// thresholds which are not set take the defaults.
+func validateGc(c *common.StorageConfig) error {
+	for k, v := range map[string]*int{
+		"gcInterval":    &c.GcInterval,
+		"gcTmpFileAge":  &c.GcTmpFileAge,
+		"gcGracePeriod": &c.GcGracePeriod,
+	} {
+		if err := overlayEnvValue(k, func(envValue string) error {
+			s, err := convert.StrToInt(envValue)
+			if err != nil {
+				return errors.New("invalid " + k + " \"" + envValue + "\": " + err.Error())
+			}
+			*v = s
+			return nil
+		}); err != nil {
+			return err
+		}
+		if *v < 0 {
+			return errors.New("invalid " + k + " \"" + convert.IntToStr(*v) + "\", it must not be negative")
+		}
+	}
+	if c.GcTmpFileAge == 0 {
+		c.GcTmpFileAge = common.DEFAULT_GC_TMP_FILE_AGE
+	}
+	if c.GcGracePeriod == 0 {
+		c.GcGracePeriod = common.DEFAULT_GC_GRACE_PERIOD
+	}
+	return nil
+}
+
+// ParseQuotas parses the quotas of groups and identities,
+// for example: group:G01=10737418240/0,identity:alice=0/1000
+// limits the bytes of group G01 and the file count of identity alice, 0 means no limit.
+func ParseQuotas(s string) ([]common.Quota, error) {
+	var ret []common.Quota
+	for _, q := range strings.Split(s, ",") {
+		q = strings.TrimSpace(q)
+		if q == "" {
+			continue
+		}
+		invalid := errors.New("invalid quota \"" + q + "\", example: group:G01=10737418240/0")
+		kv := strings.SplitN(q, "=", 2)
+		target := strings.SplitN(kv[0], ":", 2)
+		if len(kv) != 2 || len(target) != 2 {
+			return nil, invalid
+		}
+		limits := strings.Split(kv[1], "/")
+		if len(limits) != 2 {
+			return nil, invalid
+		}
+		quota := common.Quota{}
+		switch target[0] {
+		case "group":
+			quota.Group = target[1]
+		case "identity":
+			quota.Identity = target[1]
+		default:
+			return nil, invalid
+		}
+		var err error
+		if quota.MaxBytes, err = convert.StrToInt64(limits[0]); err != nil {
+			return nil, invalid
+		}
+		if quota.MaxFiles, err = convert.StrToInt64(limits[1]); err != nil {
+			return nil, invalid
+		}
+		ret = append(ret, quota)
+	}
+	return ret, nil
+}
+
+// ParseCompressionPolicies parses the compression policies of groups,
+// for example: G01=lz4/64,G02=none
+// compresses files of group G01 larger than 64KB with lz4, the threshold is optional.
+func ParseCompressionPolicies(s string) ([]common.CompressionPolicy, error) {
+	var ret []common.CompressionPolicy
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		invalid := errors.New("invalid compression policy \"" + p + "\", example: G01=lz4/64")
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, invalid
+		}
+		policy := common.CompressionPolicy{Group: kv[0]}
+		codec := strings.SplitN(kv[1], "/", 2)
+		policy.Codec = codec[0]
+		if len(codec) == 2 {
+			t, err := convert.StrToInt(codec[1])
+			if err != nil {
+				return nil, invalid
+			}
+			policy.Threshold = t
+		}
+		ret = append(ret, policy)
+	}
+	return ret, nil
+}
+
+// validateCompressionPolicies checks the compression policies, each group has at most one.
+func validateCompressionPolicies(policies *[]common.CompressionPolicy) error {
+	if err := overlayEnvValue("compressionPolicies", func(envValue string) error {
+		p, err := ParseCompressionPolicies(envValue)
+		if err != nil {
+			return err
+		}
+		*policies = p
+		return nil
+	}); err != nil {
+		return err
+	}
+	groups := make(map[string]bool)
+	for _, p := range *policies {
+		if m, err := regexp.MatchString(common.GROUP_PATTERN, p.Group); err != nil || !m {
+			return errors.New("invalid compression policy group \"" + p.Group +
+				"\", group must match pattern " + common.GROUP_PATTERN)
+		}
+		if groups[p.Group] {
+			return errors.New("duplicate compression policy of group \"" + p.Group + "\"")
+		}
+		groups[p.Group] = true
+		if err := validateCodec(p.Codec); err != nil {
+			return err
+		}
+		if p.Threshold < 0 {
+			return errors.New("invalid compression threshold \"" +
+				convert.IntToStr(p.Threshold) + "\", threshold must not be negative")
+		}
+	}
+	return nil
+}
+
+func validateCodec(codec string) error {
+	if codec != common.COMPRESSION_NONE && codec != common.COMPRESSION_LZ4 &&
+		codec != common.COMPRESSION_DEFLATE {
+		return errors.New("invalid compression \"" + codec + "\", available options: " +
+			common.COMPRESSION_NONE + ", " + common.COMPRESSION_LZ4 + ", " + common.COMPRESSION_DEFLATE)
+	}
+	return nil
+}
+
+// validateQuotas checks the quotas, each of which limits either a group or an identity.
+func validateQuotas(quotas *[]common.Quota) error {
+	if err := overlayEnvValue("quotas", func(envValue string) error {
+		q, err := ParseQuotas(envValue)
+		if err != nil {
+			return err
+		}
+		*quotas = q
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, q := range *quotas {
+		if (q.Group == "") == (q.Identity == "") {
+			return errors.New("invalid quota, either group or identity must be set")
+		}
+		if q.Group != "" {
+			if m, err := regexp.MatchString(common.GROUP_PATTERN, q.Group); err != nil || !m {
+				return errors.New("invalid quota group \"" + q.Group +
+					"\", group must match pattern " + common.GROUP_PATTERN)
+			}
+		}
+		if q.Identity != "" {
+			if m, err := regexp.MatchString(common.IDENTITY_PATTERN, q.Identity); err != nil || !m {
+				return errors.New("invalid quota identity \"" + q.Identity +
+					"\", identity must match pattern " + common.IDENTITY_PATTERN)
+			}
+		}
+		if q.MaxBytes < 0 || q.MaxFiles < 0 {
+			return errors.New("invalid quota, limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// ValidateStorageConfig validates storage config and applies environment overlays,
+// it does not touch the running server so that reloaded configs are validated as well.
 func ValidateStorageConfig(c *common.StorageConfig) error {
 	if c == nil {
 		return errors.New("no config provided")
 	}
 
-	ExchangeEnvValue("port", func(envValue string) {
+	if err := overlayEnvValue("port", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.Port = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check port range
 	if c.Port < 0 || c.Port > 65535 {
@@ -38,13 +253,16 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 			convert.IntToStr(c.Port) + "\", port number must in the range of 0 to 65535")
 	}
 
-	ExchangeEnvValue("advertisePort", func(envValue string) {
+	if err := overlayEnvValue("advertisePort", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.AdvertisePort = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check advertise port range
 	if c.AdvertisePort < 0 || c.AdvertisePort > 65535 {
@@ -52,13 +270,16 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 			convert.IntToStr(c.Port) + "\", port number must in the range of 0 to 65535")
 	}
 
-	ExchangeEnvValue("httpPort", func(envValue string) {
+	if err := overlayEnvValue("httpPort", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.HttpPort = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check http port range
 	if c.HttpPort < 0 || c.HttpPort > 65535 {
@@ -78,6 +299,26 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 			"\", group must match pattern " + common.GROUP_PATTERN)
 	}
 
+	ExchangeEnvValue("mirrorGroups", func(envValue string) {
+		c.MirrorGroups = strings.Split(envValue, ",")
+	})
+	// check mirror groups
+	var mirrorGroups []string
+	seen := make(map[string]bool)
+	for _, g := range c.MirrorGroups {
+		g = strings.TrimSpace(g)
+		if g == "" || g == c.Group || seen[g] {
+			continue
+		}
+		seen[g] = true
+		if m, err := regexp.MatchString(common.GROUP_PATTERN, g); err != nil || !m {
+			return errors.New("invalid mirror group \"" + g +
+				"\", group must match pattern " + common.GROUP_PATTERN)
+		}
+		mirrorGroups = append(mirrorGroups, g)
+	}
+	c.MirrorGroups = mirrorGroups
+
 	ExchangeEnvValue("secret", func(envValue string) {
 		c.Secret = envValue
 	})
@@ -112,13 +353,16 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 		c.LogRotationInterval = "y"
 	}
 
-	ExchangeEnvValue("maxRollingLogfileSize", func(envValue string) {
+	if err := overlayEnvValue("maxRollingLogfileSize", func(envValue string) error {
 		s, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid size number \"", envValue, "\": ", err)
+			return errors.New("invalid size number \"" + envValue + "\": " + err.Error())
 		}
 		c.MaxRollingLogfileSize = s
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check rolling log file size
 	if c.MaxRollingLogfileSize != 64 && c.MaxRollingLogfileSize != 128 &&
@@ -131,56 +375,174 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 		c.LogDir = envValue
 	})
 
-	ExchangeEnvValue("disableLogfile", func(envValue string) {
+	if err := overlayEnvValue("disableLogfile", func(envValue string) error {
 		b, err := convert.StrToBool(envValue)
 		if err != nil {
-			logger.Fatal("invalid bool value \"", envValue, "\": ", err)
+			return errors.New("invalid bool value \"" + envValue + "\": " + err.Error())
 		}
 		c.SaveLog2File = !b
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
-	// prepare log directory
-	if c.SaveLog2File {
-		if !file.Exists(c.LogDir) {
-			if err := file.CreateDirs(c.LogDir); err != nil {
-				return err
-			}
+	if err := overlayEnvValue("syncRateLimit", func(envValue string) error {
+		s, err := convert.StrToInt(envValue)
+		if err != nil {
+			return errors.New("invalid rate limit \"" + envValue + "\": " + err.Error())
+		}
+		c.SyncRateLimit = s
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := overlayEnvValue("downloadRateLimit", func(envValue string) error {
+		s, err := convert.StrToInt(envValue)
+		if err != nil {
+			return errors.New("invalid rate limit \"" + envValue + "\": " + err.Error())
+		}
+		c.DownloadRateLimit = s
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := overlayEnvValue("httpDownloadRateLimit", func(envValue string) error {
+		s, err := convert.StrToInt(envValue)
+		if err != nil {
+			return errors.New("invalid rate limit \"" + envValue + "\": " + err.Error())
+		}
+		c.HttpDownloadRateLimit = s
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// check bandwidth limits
+	if c.SyncRateLimit < 0 || c.DownloadRateLimit < 0 || c.HttpDownloadRateLimit < 0 {
+		return errors.New("invalid rate limit, rate limit must not be negative")
+	}
+
+	if err := overlayEnvValue("antiEntropyInterval", func(envValue string) error {
+		s, err := convert.StrToInt(envValue)
+		if err != nil {
+			return errors.New("invalid anti-entropy interval \"" + envValue + "\": " + err.Error())
 		}
+		c.AntiEntropyInterval = s
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// check anti-entropy interval
+	if c.AntiEntropyInterval < 0 {
+		return errors.New("invalid anti-entropy interval \"" +
+			convert.IntToStr(c.AntiEntropyInterval) + "\", interval must not be negative")
 	}
 
+	if err := validateGc(c); err != nil {
+		return err
+	}
+
+	ExchangeEnvValue("bootstrap", func(envValue string) {
+		c.Bootstrap = envValue == "true" || envValue == "1"
+	})
+
 	ExchangeEnvValue("dataDir", func(envValue string) {
 		c.DataDir = envValue
 	})
 
 	c.DataDir = file.FixPath(c.DataDir)
-	if !file.Exists(c.DataDir) {
-		if err := file.CreateDirs(c.DataDir); err != nil {
-			return err
+
+	ExchangeEnvValue("dataDirs", func(envValue string) {
+		c.DataDirs = strings.Split(envValue, ",")
+	})
+	// check data dirs
+	var dataDirs []string
+	seenDirs := map[string]bool{c.DataDir: true}
+	for _, d := range c.DataDirs {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
 		}
+		d = file.FixPath(d)
+		if seenDirs[d] {
+			continue
+		}
+		seenDirs[d] = true
+		dataDirs = append(dataDirs, d)
 	}
+	c.DataDirs = dataDirs
 
-	// initialize logger
-	logConfig := &logger.Config{
-		Level:              ConvertLogLevel(c.LogLevel),
-		RollingPolicy:      []int{ConvertRollInterval(c.LogRotationInterval), ConvertLogFileSize(c.MaxRollingLogfileSize)},
-		Write2File:         c.SaveLog2File,
-		AlwaysWriteConsole: true,
-		RollingFileDir:     c.LogDir,
-		RollingFileName:    "godfs-storage",
+	ExchangeEnvValue("blobPlacement", func(envValue string) {
+		c.BlobPlacement = envValue
+	})
+	// check blob placement
+	if c.BlobPlacement == "" {
+		c.BlobPlacement = common.PLACEMENT_FREE_SPACE
+	}
+	if c.BlobPlacement != common.PLACEMENT_FREE_SPACE && c.BlobPlacement != common.PLACEMENT_HASH {
+		return errors.New("invalid blob placement \"" + c.BlobPlacement +
+			"\", available options: " + common.PLACEMENT_FREE_SPACE + ", " + common.PLACEMENT_HASH)
 	}
 
-	logger.Init(logConfig)
+	if err := overlayEnvValue("volumeThreshold", func(envValue string) error {
+		s, err := convert.StrToInt(envValue)
+		if err != nil {
+			return errors.New("invalid volume threshold \"" + envValue + "\": " + err.Error())
+		}
+		c.VolumeThreshold = s
+		return nil
+	}); err != nil {
+		return err
+	}
+	// check volume threshold
+	if c.VolumeThreshold < 0 || c.VolumeThreshold > common.VOLUME_MAX_THRESHOLD {
+		return errors.New("invalid volume threshold \"" + convert.IntToStr(c.VolumeThreshold) +
+			"\", volume threshold must be between 0 and " + convert.IntToStr(common.VOLUME_MAX_THRESHOLD) + "KB")
+	}
 
-	InitialConfigMap(c.DataDir + "/cfg.dat")
+	ExchangeEnvValue("compression", func(envValue string) {
+		c.Compression = envValue
+	})
+	// check compression
+	if c.Compression == "" {
+		c.Compression = common.COMPRESSION_NONE
+	}
+	if err := validateCodec(c.Compression); err != nil {
+		return err
+	}
 
-	c.InstanceId = LoadInstanceData()
+	if err := overlayEnvValue("compressionThreshold", func(envValue string) error {
+		s, err := convert.StrToInt(envValue)
+		if err != nil {
+			return errors.New("invalid compression threshold \"" + envValue + "\": " + err.Error())
+		}
+		c.CompressionThreshold = s
+		return nil
+	}); err != nil {
+		return err
+	}
+	if c.CompressionThreshold < 0 {
+		return errors.New("invalid compression threshold \"" +
+			convert.IntToStr(c.CompressionThreshold) + "\", threshold must not be negative")
+	}
 
-	historySecret, err := loadHistorySecret(true, c.InstanceId, c.Secret)
-	if err != nil {
-		logger.Fatal(err)
+	if err := validateCompressionPolicies(&c.CompressionPolicies); err != nil {
+		return err
+	}
+
+	ExchangeEnvValue("encryptionKeyFile", func(envValue string) {
+		c.EncryptionKeyFile = envValue
+	})
+
+	if err := validateLabels(&c.Zone, &c.Rack); err != nil {
+		return err
+	}
+	if err := validateIndexBackend(&c.IndexBackend); err != nil {
+		return err
 	}
-	c.HistorySecrets = historySecret
-	GenerateDecKey(c.Secret)
 
 	// parse tracker servers
 	if c.Trackers != nil {
@@ -199,19 +561,23 @@ func ValidateStorageConfig(c *common.StorageConfig) error {
 	return nil
 }
 
-// ValidateAgentConfig validates agent config.
+// ValidateAgentConfig validates agent config and applies environment overlays,
+// it does not touch the running server so that reloaded configs are validated as well.
 func ValidateAgentConfig(c *common.AgentConfig) error {
 	if c == nil {
 		return errors.New("no config provided")
 	}
 
-	ExchangeEnvValue("port", func(envValue string) {
+	if err := overlayEnvValue("port", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.Port = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check port range
 	if c.Port < 0 || c.Port > 65535 {
@@ -219,13 +585,16 @@ func ValidateAgentConfig(c *common.AgentConfig) error {
 			convert.IntToStr(c.Port) + "\", port number must in the range of 0 to 65535")
 	}
 
-	ExchangeEnvValue("httpPort", func(envValue string) {
+	if err := overlayEnvValue("httpPort", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.HttpPort = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check http port range
 	if c.HttpPort < 0 || c.HttpPort > 65535 {
@@ -267,13 +636,16 @@ func ValidateAgentConfig(c *common.AgentConfig) error {
 		c.LogRotationInterval = "y"
 	}
 
-	ExchangeEnvValue("maxRollingLogfileSize", func(envValue string) {
+	if err := overlayEnvValue("maxRollingLogfileSize", func(envValue string) error {
 		s, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid size number \"", envValue, "\": ", err)
+			return errors.New("invalid size number \"" + envValue + "\": " + err.Error())
 		}
 		c.MaxRollingLogfileSize = s
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check rolling log file size
 	if c.MaxRollingLogfileSize != 64 && c.MaxRollingLogfileSize != 128 &&
@@ -286,21 +658,15 @@ func ValidateAgentConfig(c *common.AgentConfig) error {
 		c.LogDir = envValue
 	})
 
-	ExchangeEnvValue("disableLogfile", func(envValue string) {
+	if err := overlayEnvValue("disableLogfile", func(envValue string) error {
 		b, err := convert.StrToBool(envValue)
 		if err != nil {
-			logger.Fatal("invalid bool value \"", envValue, "\": ", err)
+			return errors.New("invalid bool value \"" + envValue + "\": " + err.Error())
 		}
 		c.SaveLog2File = !b
-	})
-
-	// prepare log directory
-	if c.SaveLog2File {
-		if !file.Exists(c.LogDir) {
-			if err := file.CreateDirs(c.LogDir); err != nil {
-				return err
-			}
-		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	ExchangeEnvValue("dataDir", func(envValue string) {
@@ -308,34 +674,30 @@ func ValidateAgentConfig(c *common.AgentConfig) error {
 	})
 
 	c.DataDir = file.FixPath(c.DataDir)
-	if !file.Exists(c.DataDir) {
-		if err := file.CreateDirs(c.DataDir); err != nil {
-			return err
-		}
-	}
 
-	// initialize logger
-	logConfig := &logger.Config{
-		Level:              ConvertLogLevel(c.LogLevel),
-		RollingPolicy:      []int{ConvertRollInterval(c.LogRotationInterval), ConvertLogFileSize(c.MaxRollingLogfileSize)},
-		Write2File:         c.SaveLog2File,
-		AlwaysWriteConsole: true,
-		RollingFileDir:     c.LogDir,
-		RollingFileName:    "godfs-agent",
+	if err := validateLabels(&c.Zone, &c.Rack); err != nil {
+		return err
 	}
 
-	logger.Init(logConfig)
-
-	InitialConfigMap(c.DataDir + "/cfg.dat")
-
-	c.InstanceId = LoadInstanceData()
+	ExchangeEnvValue("uploadBalancer", func(envValue string) {
+		c.UploadBalancer = envValue
+	})
+	ExchangeEnvValue("downloadBalancer", func(envValue string) {
+		c.DownloadBalancer = envValue
+	})
 
-	historySecret, err := loadHistorySecret(true, c.InstanceId, c.Secret)
-	if err != nil {
-		logger.Fatal(err)
+	// check balancers
+	for _, b := range []*string{&c.UploadBalancer, &c.DownloadBalancer} {
+		*b = strings.ToLower(*b)
+		if *b == "" {
+			*b = common.BALANCER_ROUND_ROBIN
+		}
+		if *b != common.BALANCER_ROUND_ROBIN && *b != common.BALANCER_LEAST_INFLIGHT &&
+			*b != common.BALANCER_LATENCY_EWMA && *b != common.BALANCER_CAPACITY_WEIGHTED &&
+			*b != common.BALANCER_CONSISTENT_HASH {
+			return errors.New("invalid balancer \"" + *b + "\"")
+		}
 	}
-	c.HistorySecrets = historySecret
-	GenerateDecKey(c.Secret)
 
 	// parse tracker servers
 	if c.Trackers != nil {
@@ -354,19 +716,23 @@ func ValidateAgentConfig(c *common.AgentConfig) error {
 	return nil
 }
 
-// ValidateTrackerConfig validates tracker config.
+// ValidateTrackerConfig validates tracker config and applies environment overlays,
+// it does not touch the running server so that reloaded configs are validated as well.
 func ValidateTrackerConfig(c *common.TrackerConfig) error {
 	if c == nil {
 		return errors.New("no config provided")
 	}
 
-	ExchangeEnvValue("port", func(envValue string) {
+	if err := overlayEnvValue("port", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.Port = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check port range
 	if c.Port < 0 || c.Port > 65535 {
@@ -374,13 +740,16 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 			convert.IntToStr(c.Port) + ", port number must in the range of 0 to 65535")
 	}
 
-	ExchangeEnvValue("advertisePort", func(envValue string) {
+	if err := overlayEnvValue("advertisePort", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.AdvertisePort = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check advertise port range
 	if c.AdvertisePort < 0 || c.AdvertisePort > 65535 {
@@ -388,13 +757,16 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 			convert.IntToStr(c.Port) + ", port number must in the range of 0 to 65535")
 	}
 
-	ExchangeEnvValue("httpPort", func(envValue string) {
+	if err := overlayEnvValue("httpPort", func(envValue string) error {
 		p, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid port number \"", envValue, "\": ", err)
+			return errors.New("invalid port number \"" + envValue + "\": " + err.Error())
 		}
 		c.HttpPort = p
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check http port range
 	if c.HttpPort < 0 || c.HttpPort > 65535 {
@@ -436,13 +808,16 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 		c.LogRotationInterval = "y"
 	}
 
-	ExchangeEnvValue("maxRollingLogfileSize", func(envValue string) {
+	if err := overlayEnvValue("maxRollingLogfileSize", func(envValue string) error {
 		s, err := convert.StrToInt(envValue)
 		if err != nil {
-			logger.Fatal("invalid size number \"", envValue, "\": ", err)
+			return errors.New("invalid size number \"" + envValue + "\": " + err.Error())
 		}
 		c.MaxRollingLogfileSize = s
-	})
+		return nil
+	}); err != nil {
+		return err
+	}
 
 	// check rolling log file size
 	if c.MaxRollingLogfileSize != 64 && c.MaxRollingLogfileSize != 128 &&
@@ -455,21 +830,15 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 		c.LogDir = envValue
 	})
 
-	ExchangeEnvValue("disableLogfile", func(envValue string) {
+	if err := overlayEnvValue("disableLogfile", func(envValue string) error {
 		b, err := convert.StrToBool(envValue)
 		if err != nil {
-			logger.Fatal("invalid bool value \"", envValue, "\": ", err)
+			return errors.New("invalid bool value \"" + envValue + "\": " + err.Error())
 		}
 		c.SaveLog2File = !b
-	})
-
-	// prepare log directory
-	if c.SaveLog2File {
-		if !file.Exists(c.LogDir) {
-			if err := file.CreateDirs(c.LogDir); err != nil {
-				return err
-			}
-		}
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	ExchangeEnvValue("dataDir", func(envValue string) {
@@ -477,24 +846,89 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 	})
 
 	c.DataDir = file.FixPath(c.DataDir)
-	if !file.Exists(c.DataDir) {
-		if err := file.CreateDirs(c.DataDir); err != nil {
-			return err
+
+	if err := validateLabels(&c.Zone, &c.Rack); err != nil {
+		return err
+	}
+	if err := validateIndexBackend(&c.IndexBackend); err != nil {
+		return err
+	}
+	if err := validateQuotas(&c.Quotas); err != nil {
+		return err
+	}
+
+	// parse tracker servers
+	if c.Trackers != nil {
+		if c.ParsedTrackers == nil {
+			c.ParsedTrackers = make([]common.Server, len(c.Trackers))
 		}
+		for i, t := range c.Trackers {
+			server, err := ParseServer(t)
+			if err != nil {
+				return err
+			}
+			c.ParsedTrackers[i] = *server
+		}
+	}
+	// done!
+	return nil
+}
+
+// InitStorageConfig prepares directories, logger and instance data
+// of a validated storage config, it is called once on boot.
+func InitStorageConfig(c *common.StorageConfig) error {
+	if err := prepareServerDirs(c.SaveLog2File, c.LogDir, c.DataDir); err != nil {
+		return err
 	}
 
-	// initialize logger
-	logConfig := &logger.Config{
-		Level:              ConvertLogLevel(c.LogLevel),
-		RollingPolicy:      []int{ConvertRollInterval(c.LogRotationInterval), ConvertLogFileSize(c.MaxRollingLogfileSize)},
-		Write2File:         c.SaveLog2File,
-		AlwaysWriteConsole: true,
-		RollingFileDir:     c.LogDir,
-		RollingFileName:    "godfs-tracker",
+	InitLogger("godfs-storage", c.LogLevel, c.LogRotationInterval, c.MaxRollingLogfileSize, c.SaveLog2File, c.LogDir)
+
+	InitialConfigMap(c.DataDir + "/cfg.dat")
+
+	c.InstanceId = LoadInstanceData()
+
+	historySecret, err := loadHistorySecret(true, c.InstanceId, c.Secret)
+	if err != nil {
+		logger.Fatal(err)
 	}
-	logger.Init(logConfig)
+	c.HistorySecrets = historySecret
+	GenerateDecKey(c.Secret)
+	return nil
+}
+
+// InitAgentConfig prepares directories, logger and instance data
+// of a validated agent config, it is called once on boot.
+func InitAgentConfig(c *common.AgentConfig) error {
+	if err := prepareServerDirs(c.SaveLog2File, c.LogDir, c.DataDir); err != nil {
+		return err
+	}
+
+	InitLogger("godfs-agent", c.LogLevel, c.LogRotationInterval, c.MaxRollingLogfileSize, c.SaveLog2File, c.LogDir)
 
 	InitialConfigMap(c.DataDir + "/cfg.dat")
+
+	c.InstanceId = LoadInstanceData()
+
+	historySecret, err := loadHistorySecret(true, c.InstanceId, c.Secret)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	c.HistorySecrets = historySecret
+	GenerateDecKey(c.Secret)
+	return nil
+}
+
+// InitTrackerConfig prepares directories, logger and instance data
+// of a validated tracker config, it is called once on boot.
+func InitTrackerConfig(c *common.TrackerConfig) error {
+	if err := prepareServerDirs(c.SaveLog2File, c.LogDir, c.DataDir); err != nil {
+		return err
+	}
+
+	InitLogger("godfs-tracker", c.LogLevel, c.LogRotationInterval, c.MaxRollingLogfileSize, c.SaveLog2File, c.LogDir)
+
+	InitialConfigMap(c.DataDir + "/cfg.dat")
+
 	c.InstanceId = LoadInstanceData()
 
 	historySecret, err := loadHistorySecret(false, c.InstanceId, c.Secret)
@@ -503,24 +937,39 @@ func ValidateTrackerConfig(c *common.TrackerConfig) error {
 	}
 	c.HistorySecrets = historySecret
 	GenerateDecKey(c.Secret)
+	return nil
+}
 
-	// parse tracker servers
-	if c.Trackers != nil {
-		if c.ParsedTrackers == nil {
-			c.ParsedTrackers = make([]common.Server, len(c.Trackers))
-		}
-		for i, t := range c.Trackers {
-			server, err := ParseServer(t)
-			if err != nil {
+// prepareServerDirs creates the log directory and data directory.
+func prepareServerDirs(saveLog2File bool, logDir string, dataDir string) error {
+	if saveLog2File {
+		if !file.Exists(logDir) {
+			if err := file.CreateDirs(logDir); err != nil {
 				return err
 			}
-			c.ParsedTrackers[i] = *server
 		}
 	}
-	// done!
+	if !file.Exists(dataDir) {
+		if err := file.CreateDirs(dataDir); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// InitLogger initializes the logger of servers.
+func InitLogger(name string, level string, rotationInterval string, maxLogfileSize int, saveLog2File bool, logDir string) {
+	logConfig := &logger.Config{
+		Level:              ConvertLogLevel(level),
+		RollingPolicy:      []int{ConvertRollInterval(rotationInterval), ConvertLogFileSize(maxLogfileSize)},
+		Write2File:         saveLog2File,
+		AlwaysWriteConsole: true,
+		RollingFileDir:     logDir,
+		RollingFileName:    name,
+	}
+	logger.Init(logConfig)
+}
+
 // ValidateStorageConfig validates storage config.
 func ValidateClientConfig(c *common.ClientConfig) error {
 	if c == nil {
@@ -0,0 +1,368 @@
+package util
+
+import (
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+var (
+	// patterns of blob files and the dirs containing them, relative to a data dir.
+	blobPathRegexp    = regexp.MustCompile("^(mirror/[0-9a-zA-Z-_]{1,30}/)?[0-9A-F]{2}/[0-9A-F]{2}/[0-9a-f]{32}$")
+	blobDirPathRegexp = regexp.MustCompile("^(mirror(/[0-9a-zA-Z-_]{1,30}(/[0-9A-F]{2}(/[0-9A-F]{2})?)?)?|[0-9A-F]{2}(/[0-9A-F]{2})?)$")
+
+	NoDataDirErr = errors.New("no data dir available")
+)
+
+// lostFoundDir is the dir of quarantined blobs relative to a data dir,
+// which is skipped by scanning.
+const lostFoundDir = "lost+found"
+
+// dataDir is a disk for blobs.
+type dataDir struct {
+	path   string
+	online bool
+	blobs  int
+}
+
+var (
+	dataDirs      []*dataDir
+	blobPlacement string
+	// blobIndex maps relative paths of blobs to their data dirs.
+	blobIndex   = make(map[string]int)
+	dataDirLock = new(sync.RWMutex)
+)
+
+// InitDataDirs scans blobs of the data dirs and builds the index,
+// a data dir which fails to scan is marked offline.
+func InitDataDirs(c *common.StorageConfig) {
+	dirs := make([]*dataDir, 0, len(c.DataDirs)+1)
+	index := make(map[string]int)
+	for i, p := range append([]string{c.DataDir}, c.DataDirs...) {
+		d := &dataDir{path: p}
+		dirs = append(dirs, d)
+		blobs, err := scanDataDir(p)
+		if err != nil {
+			logger.Error("error scan data dir ", p, ", mark it offline: ", err)
+			continue
+		}
+		d.online = true
+		d.blobs = addToIndex(index, blobs, i)
+		logger.Info("data dir ", p, " has ", d.blobs, " blobs")
+	}
+
+	dataDirLock.Lock()
+	defer dataDirLock.Unlock()
+	blobPlacement = c.BlobPlacement
+	dataDirs = dirs
+	blobIndex = index
+}
+
+// scanDataDir returns relative paths of the blobs in the data dir.
+func scanDataDir(dir string) ([]string, error) {
+	if !file.Exists(dir) {
+		if err := file.CreateDirs(dir); err != nil {
+			return nil, err
+		}
+	}
+	var ret []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if !blobDirPathRegexp.MatchString(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if blobPathRegexp.MatchString(rel) {
+			ret = append(ret, rel)
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// addToIndex adds the blobs of the data dir to the index,
+// the first copy of a blob wins.
+func addToIndex(index map[string]int, blobs []string, i int) int {
+	added := 0
+	for _, rel := range blobs {
+		if _, ok := index[rel]; !ok {
+			index[rel] = i
+			added++
+		}
+	}
+	return added
+}
+
+// LocateBlob returns the full path of the blob by its path relative to the data dir.
+func LocateBlob(rel string) (string, bool) {
+	dataDirLock.RLock()
+	defer dataDirLock.RUnlock()
+
+	if len(dataDirs) == 0 {
+		// data dirs are not initialized.
+		path := common.InitializedStorageConfiguration.DataDir + "/" + rel
+		return path, file.Exists(path)
+	}
+	if i, ok := blobIndex[rel]; ok {
+		return dataDirs[i].path + "/" + rel, true
+	}
+	return dataDirs[0].path + "/" + rel, false
+}
+
+// PlaceBlob moves the file to a data dir chosen by the placement strategy,
+// and adds it to the index.
+//
+// The file is encrypted first if encryption is enabled,
+// and small files are packed into volumes if volumes are enabled,
+// in which case the returned path is empty.
+//
+// The reference count tail is moved into the state of the blob after the file is placed,
+// so that no state is left for a blob which is not placed,
+// and the blob keeps its tail if the state is not saved.
+func PlaceBlob(src, rel string) (string, error) {
+	if EncryptionEnabled() {
+		if err := encryptBlob(src, blobGroup(rel)); err != nil {
+			return "", err
+		}
+	}
+	if packed, err := placeVolumeBlob(src, rel); packed {
+		return "", err
+	}
+	dataDirLock.RLock()
+	if len(dataDirs) == 0 {
+		dataDirLock.RUnlock()
+		target := common.InitializedStorageConfiguration.DataDir + "/" + rel
+		if err := moveBlob(src, target); err != nil {
+			return "", err
+		}
+		return target, moveTailToState(target, rel)
+	}
+	i := selectDataDir(rel)
+	var target string
+	if i >= 0 {
+		target = dataDirs[i].path + "/" + rel
+	}
+	dataDirLock.RUnlock()
+
+	if i < 0 {
+		return "", NoDataDirErr
+	}
+	// moving may copy the file, so it is done without the lock.
+	if err := moveBlob(src, target); err != nil {
+		return "", err
+	}
+
+	dataDirLock.Lock()
+	if _, ok := blobIndex[rel]; !ok && dataDirs[i].online {
+		blobIndex[rel] = i
+		dataDirs[i].blobs++
+	}
+	dataDirLock.Unlock()
+	// the tail is moved into the state as it is into the volume index.
+	return target, moveTailToState(target, rel)
+}
+
+// selectDataDir chooses an online data dir for the blob,
+// it returns -1 if all data dirs are offline.
+func selectDataDir(rel string) int {
+	var online []int
+	for i, d := range dataDirs {
+		if d.online {
+			online = append(online, i)
+		}
+	}
+	if len(online) == 0 {
+		return -1
+	}
+	if blobPlacement == common.PLACEMENT_HASH {
+		return online[crc32.ChecksumIEEE([]byte(rel))%uint32(len(online))]
+	}
+	selected := online[0]
+	var max int64 = -1
+	for _, i := range online {
+		if free, err := DiskFreeSpace(dataDirs[i].path); err == nil && free > max {
+			selected, max = i, free
+		}
+	}
+	return selected
+}
+
+// moveBlob moves the file to the target path,
+// it copies the file if they are on different disks.
+func moveBlob(src, target string) error {
+	dir := filepath.Dir(target)
+	if !file.Exists(dir) {
+		if err := file.CreateDirs(dir); err != nil {
+			return err
+		}
+	}
+	if err := file.MoveFile(src, target); err == nil {
+		return nil
+	}
+	tmp := target + ".tmp"
+	if err := copyBlob(src, tmp); err != nil {
+		file.Delete(tmp)
+		return err
+	}
+	if err := file.MoveFile(tmp, target); err != nil {
+		file.Delete(tmp)
+		return err
+	}
+	file.Delete(src)
+	return nil
+}
+
+func copyBlob(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// RemoveBlob deletes the standalone blob and removes it from the index,
+// blobs packed in volumes are reclaimed by compaction instead.
+func RemoveBlob(rel string) error {
+	dataDirLock.Lock()
+	defer dataDirLock.Unlock()
+
+	if len(dataDirs) == 0 {
+		err := os.Remove(common.InitializedStorageConfiguration.DataDir + "/" + rel)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return deleteBlobState(rel)
+	}
+	i, ok := blobIndex[rel]
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(dataDirs[i].path + "/" + rel); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(blobIndex, rel)
+	dataDirs[i].blobs--
+	return deleteBlobState(rel)
+}
+
+// QuarantineBlob moves the standalone blob into the lost+found dir of its data dir
+// and removes it from the index, it returns the new path of the blob.
+func QuarantineBlob(rel string) (string, error) {
+	dataDirLock.Lock()
+	defer dataDirLock.Unlock()
+
+	root := common.InitializedStorageConfiguration.DataDir
+	i, indexed := blobIndex[rel]
+	if len(dataDirs) > 0 {
+		if !indexed {
+			return "", common.NotFoundErr
+		}
+		root = dataDirs[i].path
+	}
+	target := root + "/" + lostFoundDir + "/" + rel
+	if err := file.CreateDirs(filepath.Dir(target)); err != nil {
+		return "", err
+	}
+	if err := os.Rename(root+"/"+rel, target); err != nil {
+		return "", err
+	}
+	if indexed {
+		delete(blobIndex, rel)
+		dataDirs[i].blobs--
+	}
+	return target, deleteBlobState(rel)
+}
+
+// SetDataDirOnline marks the data dir online or offline,
+// blobs of an offline data dir are removed from the index
+// and the data dir is scanned again when it comes back.
+//
+// It returns true if the state changes.
+func SetDataDirOnline(path string, online bool) bool {
+	var blobs []string
+	if online {
+		var err error
+		if blobs, err = scanDataDir(path); err != nil {
+			logger.Error("error scan data dir ", path, ": ", err)
+			return false
+		}
+	}
+
+	dataDirLock.Lock()
+	defer dataDirLock.Unlock()
+	for i, d := range dataDirs {
+		if d.path != path || d.online == online {
+			continue
+		}
+		d.online = online
+		if online {
+			d.blobs = addToIndex(blobIndex, blobs, i)
+			return true
+		}
+		for k, v := range blobIndex {
+			if v == i {
+				delete(blobIndex, k)
+			}
+		}
+		d.blobs = 0
+		return true
+	}
+	return false
+}
+
+// DataDirStatus returns the state of each data dir.
+func DataDirStatus() []common.DataDirStatus {
+	dataDirLock.RLock()
+	defer dataDirLock.RUnlock()
+
+	ret := make([]common.DataDirStatus, len(dataDirs))
+	for i, d := range dataDirs {
+		ret[i] = common.DataDirStatus{
+			Path:   d.path,
+			Online: d.online,
+			Blobs:  d.blobs,
+		}
+		if d.online {
+			ret[i].FreeSpace, _ = DiskFreeSpace(d.path)
+		}
+	}
+	return ret
+}
+
+// DataDirsFreeSpace returns the total free space of the online data dirs.
+func DataDirsFreeSpace() (int64, error) {
+	status := DataDirStatus()
+	if len(status) == 0 {
+		return DiskFreeSpace(common.InitializedStorageConfiguration.DataDir)
+	}
+	var total int64
+	for _, st := range status {
+		total += st.FreeSpace
+	}
+	return total, nil
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/file"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDataDirs(t *testing.T) {
+	dir, teardown := setupTestStorage(t)
+	defer teardown()
+
+	c := &common.StorageConfig{
+		Group:         "G01",
+		DataDir:       dir + "/disk0",
+		DataDirs:      []string{dir + "/disk1"},
+		BlobPlacement: common.PLACEMENT_HASH,
+	}
+	common.InitializedStorageConfiguration = c
+	existing := "0A/0B/0123456789abcdef0123456789abcdef"
+	if err := file.CreateDirs(dir + "/disk1/0A/0B"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/disk1/"+existing, []byte("blob"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	InitDataDirs(c)
+
+	if p, ok := LocateBlob(existing); !ok || p != dir+"/disk1/"+existing {
+		t.Fatal("existing blob is not indexed: ", p)
+	}
+	if !ExistsFile(&common.FileInfo{Group: "G01", Path: existing}) {
+		t.Fatal("existing blob is not found")
+	}
+
+	// new blobs are placed on both disks.
+	placed := make(map[string]int)
+	for i := 0; i < 16; i++ {
+		tmp := dir + "/tmp"
+		if err := ioutil.WriteFile(tmp, []byte("blob"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rel := "mirror/G02/0C/0D/0123456789abcdef0123456789abcd" + FixZeros(i, 2)
+		p, err := PlaceBlob(tmp, rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, ok := LocateBlob(rel); !ok || l != p || !file.Exists(p) {
+			t.Fatal("placed blob is not indexed: ", rel)
+		}
+		placed[p[:len(dir)+6]]++
+	}
+	if len(placed) != 2 {
+		t.Fatal("unexpected placement: ", placed)
+	}
+
+	// blobs of an offline disk are gone, and come back with the disk.
+	if !SetDataDirOnline(dir+"/disk1", false) {
+		t.Fatal("data dir is not marked offline")
+	}
+	if _, ok := LocateBlob(existing); ok {
+		t.Fatal("blob of offline data dir is found")
+	}
+	tmp := dir + "/tmp"
+	ioutil.WriteFile(tmp, []byte("blob"), 0644)
+	if p, err := PlaceBlob(tmp, "0E/0F/0123456789abcdef0123456789abcdef"); err != nil || p[:len(dir)+6] != dir+"/disk0" {
+		t.Fatal("blob is placed on offline data dir: ", p, err)
+	}
+	if !SetDataDirOnline(dir+"/disk1", true) {
+		t.Fatal("data dir is not marked online")
+	}
+	if _, ok := LocateBlob(existing); !ok {
+		t.Fatal("blob of online data dir is not found")
+	}
+	st := DataDirStatus()
+	if len(st) != 2 || !st[1].Online || st[0].Blobs+st[1].Blobs != 18 {
+		t.Fatal("unexpected data dir status: ", st)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package util
+
+import "syscall"
+
+// DiskFreeSpace returns the available space in bytes of the disk where the path is.
+func DiskFreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,8 @@
+package util
+
+import "errors"
+
+// DiskFreeSpace returns the available space in bytes of the disk where the path is.
+func DiskFreeSpace(path string) (int64, error) {
+	return 0, errors.New("disk free space is not supported on windows")
+}
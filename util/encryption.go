@@ -0,0 +1,502 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	json "github.com/json-iterator/go"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layout of an encrypted blob:
+//
+//	header: magic(4) version(1) reserved(3) keyId(4) chunkSize(4) plainSize(8) salt(32)
+//	chunks: AES-256-GCM sealed chunk with 16 bytes tag
+//
+// Each blob is encrypted by its own key derived from the data key of the group and the salt,
+// the nonce of a chunk is its index and the header is authenticated with every chunk,
+// so chunks can be decrypted independently for range reads.
+const (
+	encryptMagic      = "GDFE"
+	encryptVersion    = 1
+	encryptHeaderSize = 56
+	encryptChunkSize  = 64 << 10
+	encryptTagSize    = 16
+	keyringFile       = "keyring.json"
+)
+
+var (
+	InvalidEncryptedBlobErr = errors.New("invalid encrypted blob")
+	UnknownDataKeyErr       = errors.New("unknown data key")
+)
+
+// keyEntry is a data key of a group wrapped by the master key.
+type keyEntry struct {
+	Id      uint32 `json:"id"`
+	Group   string `json:"group"`
+	Key     string `json:"key"` // base64 encoded nonce and sealed data key
+	Created int64  `json:"created"`
+}
+
+var (
+	masterKey   []byte
+	keyringPath string
+	keyEntries  []*keyEntry
+	dataKeys    = make(map[uint32][]byte)
+	groupKeys   = make(map[string]uint32) // data key of each group for new blobs
+	keyLock     = new(sync.RWMutex)
+)
+
+// InitEncryption loads the master key and the data keys of the groups stored on this server,
+// missing data keys are generated.
+//
+// The keyring is kept in the data dir, and a keyring without
+// the master key is an error because the encrypted blobs cannot be read.
+func InitEncryption(c *common.StorageConfig) error {
+	path := c.DataDir + "/" + keyringFile
+	if c.EncryptionKeyFile == "" {
+		if file.Exists(path) {
+			return errors.New("keyring exists in data dir, encryption key file is required")
+		}
+		return nil
+	}
+	master, err := loadMasterKey(c.EncryptionKeyFile, true)
+	if err != nil {
+		return err
+	}
+	entries, err := readKeyring(path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[uint32][]byte)
+	groups := make(map[string]uint32)
+	for _, e := range entries {
+		key, err := unwrapKey(master, e)
+		if err != nil {
+			return errors.New("cannot unwrap data key " + convert.Uint32ToStr(e.Id) + ": " + err.Error())
+		}
+		keys[e.Id] = key
+		if e.Id > groups[e.Group] {
+			groups[e.Group] = e.Id
+		}
+	}
+
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	masterKey, keyringPath, keyEntries, dataKeys, groupKeys = master, path, entries, keys, groups
+	for _, g := range append([]string{c.Group}, c.MirrorGroups...) {
+		if _, _, err := newGroupKey(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptionEnabled judges whether new blobs are encrypted.
+func EncryptionEnabled() bool {
+	keyLock.RLock()
+	defer keyLock.RUnlock()
+	return masterKey != nil
+}
+
+// loadMasterKey reads the hex encoded 32 bytes master key from the key file,
+// a new key is generated if the file does not exist and create is true.
+func loadMasterKey(path string, create bool) ([]byte, error) {
+	if !file.Exists(path) {
+		if !create {
+			return nil, errors.New("key file not found: " + path)
+		}
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		logger.Warn("new master key is generated: ", path, ", back it up or the encrypted files are lost with it")
+		return key, nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(bs)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid key file " + path + ": 32 bytes hex encoded key is required")
+	}
+	return key, nil
+}
+
+func readKeyring(path string) ([]*keyEntry, error) {
+	if !file.Exists(path) {
+		return nil, nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*keyEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return nil, errors.New("invalid keyring " + path + ": " + err.Error())
+	}
+	return entries, nil
+}
+
+// writeKeyring replaces the keyring atomically.
+func writeKeyring(path string, entries []*keyEntry) error {
+	bs, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey seals the data key by the master key, the group and id are authenticated.
+func wrapKey(master, key []byte, group string, id uint32) (string, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, key, []byte(group+"/"+convert.Uint32ToStr(id)))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unwrapKey(master []byte, e *keyEntry) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(e.Key)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("invalid wrapped key")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():],
+		[]byte(e.Group+"/"+convert.Uint32ToStr(e.Id)))
+}
+
+// newGroupKey returns the data key of the group,
+// a new data key is generated and saved if the group has none.
+//
+// It must be called with the key lock held.
+func newGroupKey(group string) (uint32, []byte, error) {
+	if id, ok := groupKeys[group]; ok {
+		return id, dataKeys[id], nil
+	}
+	var id uint32 = 1
+	for _, e := range keyEntries {
+		if e.Id >= id {
+			id = e.Id + 1
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return 0, nil, err
+	}
+	wrapped, err := wrapKey(masterKey, key, group, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	entries := append(keyEntries, &keyEntry{
+		Id:      id,
+		Group:   group,
+		Key:     wrapped,
+		Created: time.Now().Unix(),
+	})
+	if err := writeKeyring(keyringPath, entries); err != nil {
+		return 0, nil, err
+	}
+	logger.Info("new data key ", id, " is generated for group ", group)
+	keyEntries = entries
+	dataKeys[id] = key
+	groupKeys[group] = id
+	return id, key, nil
+}
+
+// groupDataKey returns the data key for new blobs of the group.
+func groupDataKey(group string) (uint32, []byte, error) {
+	keyLock.RLock()
+	id, ok := groupKeys[group]
+	key := dataKeys[id]
+	keyLock.RUnlock()
+	if ok {
+		return id, key, nil
+	}
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	return newGroupKey(group)
+}
+
+// RotateMasterKey re-wraps the data keys in the keyring of the data dir by a new master key,
+// blobs are not rewritten because their data keys do not change.
+//
+// A new master key is generated if the new key file does not exist,
+// and it returns the number of data keys re-wrapped.
+func RotateMasterKey(dataDir, oldKeyFile, newKeyFile string) (int, error) {
+	oldKey, err := loadMasterKey(oldKeyFile, false)
+	if err != nil {
+		return 0, err
+	}
+	newKey, err := loadMasterKey(newKeyFile, true)
+	if err != nil {
+		return 0, err
+	}
+	path := dataDir + "/" + keyringFile
+	entries, err := readKeyring(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, errors.New("no keyring found in data dir " + dataDir)
+	}
+	for _, e := range entries {
+		key, err := unwrapKey(oldKey, e)
+		if err != nil {
+			return 0, errors.New("cannot unwrap data key " + convert.Uint32ToStr(e.Id) + " by the old master key: " + err.Error())
+		}
+		if e.Key, err = wrapKey(newKey, key, e.Group, e.Id); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeKeyring(path, entries); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// blobKey derives the key of a blob from the data key and the salt of the blob.
+func blobKey(dataKey, salt []byte) []byte {
+	h := hmac.New(sha256.New, dataKey)
+	h.Write(salt)
+	return h.Sum(nil)
+}
+
+func chunkNonce(gcm cipher.AEAD, i int64) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(i))
+	return nonce
+}
+
+// blobGroup returns the group of the blob by its path relative to the data dir.
+func blobGroup(rel string) string {
+	if strings.HasPrefix(rel, "mirror/") {
+		return strings.Split(rel, "/")[1]
+	}
+	return common.InitializedStorageConfiguration.Group
+}
+
+// encryptBlob encrypts the blob file in place by the data key of the group,
+// the reference count tail is kept in plaintext.
+func encryptBlob(path, group string) error {
+	id, dataKey, err := groupDataKey(group)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size() - 4
+	if size < 0 {
+		return errors.New("invalid format file")
+	}
+
+	header := make([]byte, encryptHeaderSize)
+	copy(header, encryptMagic)
+	header[4] = encryptVersion
+	binary.BigEndian.PutUint32(header[8:], id)
+	binary.BigEndian.PutUint32(header[12:], encryptChunkSize)
+	binary.BigEndian.PutUint64(header[16:], uint64(size))
+	if _, err := io.ReadFull(rand.Reader, header[24:]); err != nil {
+		return err
+	}
+	gcm, err := newGCM(blobKey(dataKey, header[24:]))
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".e"
+	defer file.Delete(tmp)
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	plain := make([]byte, encryptChunkSize)
+	sealed := make([]byte, 0, encryptChunkSize+encryptTagSize)
+	for i := int64(0); i*encryptChunkSize < size; i++ {
+		l := int64(encryptChunkSize)
+		if rest := size - i*encryptChunkSize; rest < l {
+			l = rest
+		}
+		if _, err := in.ReadAt(plain[:l], i*encryptChunkSize); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := out.Write(gcm.Seal(sealed[:0], chunkNonce(gcm, i), plain[:l], header)); err != nil {
+			return err
+		}
+	}
+	tail := make([]byte, 4)
+	if _, err := in.ReadAt(tail, size); err != nil {
+		return err
+	}
+	if _, err := out.Write(tail); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Rename(tmp, path)
+}
+
+// chunkReader decrypts an encrypted blob,
+// the last decrypted chunk is cached for sequential reads.
+type chunkReader struct {
+	r         io.ReaderAt
+	gcm       cipher.AEAD
+	header    []byte
+	chunkSize int64
+	plainSize int64
+	lock      sync.Mutex
+	cached    int64
+	chunk     []byte
+	src       []byte
+}
+
+// openEncryptedBlob returns a reader of the plaintext of the blob,
+// it returns nil if the blob is not encrypted.
+func openEncryptedBlob(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	if size < encryptHeaderSize {
+		return nil, nil
+	}
+	header := make([]byte, encryptHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil || !bytes.HasPrefix(header, []byte(encryptMagic)) ||
+		header[4] != encryptVersion {
+		return nil, nil
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[12:]))
+	plainSize := int64(binary.BigEndian.Uint64(header[16:]))
+	if chunkSize <= 0 || chunkSize > maxFrameSize || plainSize < 0 ||
+		encryptHeaderSize+plainSize+(plainSize+chunkSize-1)/chunkSize*encryptTagSize != size {
+		return nil, nil
+	}
+	id := binary.BigEndian.Uint32(header[8:])
+	keyLock.RLock()
+	dataKey := dataKeys[id]
+	keyLock.RUnlock()
+	if dataKey == nil {
+		return nil, UnknownDataKeyErr
+	}
+	gcm, err := newGCM(blobKey(dataKey, header[24:]))
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(&chunkReader{
+		r:         r,
+		gcm:       gcm,
+		header:    header,
+		chunkSize: chunkSize,
+		plainSize: plainSize,
+		cached:    -1,
+	}, 0, plainSize), nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (c *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	read := 0
+	for read < len(p) {
+		if off >= c.plainSize {
+			return read, io.EOF
+		}
+		i := off / c.chunkSize
+		if err := c.loadChunk(i); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], c.chunk[off-i*c.chunkSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+// loadChunk decrypts the chunk into the cache.
+func (c *chunkReader) loadChunk(i int64) error {
+	if c.cached == i {
+		return nil
+	}
+	l := c.chunkSize
+	if rest := c.plainSize - i*c.chunkSize; rest < l {
+		l = rest
+	}
+	if int64(cap(c.src)) < l+encryptTagSize {
+		c.src = make([]byte, c.chunkSize+encryptTagSize)
+	}
+	src := c.src[:l+encryptTagSize]
+	if _, err := c.r.ReadAt(src, encryptHeaderSize+i*(c.chunkSize+encryptTagSize)); err != nil && err != io.EOF {
+		return err
+	}
+	c.cached = -1
+	chunk, err := c.gcm.Open(c.chunk[:0], chunkNonce(c.gcm, i), src, c.header)
+	if err != nil {
+		return InvalidEncryptedBlobErr
+	}
+	c.chunk = chunk
+	c.cached = i
+	return nil
+}
+
+// decryptBlob replaces the reader of the blob by a decrypting one if the blob is encrypted.
+func decryptBlob(b *Blob) (*Blob, error) {
+	r, err := openEncryptedBlob(b.SectionReader, b.Size())
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	if r != nil {
+		b.SectionReader = r
+	}
+	return b, nil
+}
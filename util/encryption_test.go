@@ -0,0 +1,103 @@
+package util
+
+import (
+	"bytes"
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, teardown := setupTestStorage(t)
+	defer teardown()
+
+	c := &common.StorageConfig{
+		DataDir:           dir,
+		Group:             "G01",
+		MirrorGroups:      []string{"G02"},
+		EncryptionKeyFile: dir + "/master.key",
+	}
+	common.InitializedStorageConfiguration = c
+	if err := InitEncryption(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(keyEntries) != 2 {
+		t.Fatal("expect data keys of 2 groups, got ", len(keyEntries))
+	}
+
+	content := []byte(strings.Repeat("godfs encrypts files at rest. ", 10000))
+	rel := "0A/0B/0123456789abcdef0123456789abcdef"
+	tmp := dir + "/tmp"
+	if err := ioutil.WriteFile(tmp, append(content, 0, 0, 0, 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target, err := PlaceBlob(tmp, rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadFile(target)
+	if !bytes.HasPrefix(stored, []byte(encryptMagic)) || bytes.Contains(stored, content[:100]) {
+		t.Fatal("file is not encrypted")
+	}
+	if !bytes.HasSuffix(stored, []byte{0, 0, 0, 1}) {
+		t.Fatal("reference count tail is lost")
+	}
+
+	read := func() {
+		blob, err := OpenBlob(rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blob.Close()
+		if blob.Size() != int64(len(content)) || blob.RefCount != 1 {
+			t.Fatal("unexpected blob size ", blob.Size(), " or reference count ", blob.RefCount)
+		}
+		all, err := ioutil.ReadAll(blob)
+		if err != nil || !bytes.Equal(all, content) {
+			t.Fatal("content mismatch: ", err)
+		}
+		// range read across chunks.
+		off := int64(encryptChunkSize - 10)
+		part := make([]byte, 100)
+		if _, err := blob.ReadAt(part, off); err != nil || !bytes.Equal(part, content[off:off+100]) {
+			t.Fatal("range content mismatch: ", err)
+		}
+	}
+	read()
+
+	// tampered chunks are rejected.
+	tampered := append([]byte{}, stored...)
+	tampered[encryptHeaderSize+10] ^= 1
+	ioutil.WriteFile(target, tampered, 0644)
+	if blob, err := OpenBlob(rel); err == nil {
+		if _, err := ioutil.ReadAll(blob); err != InvalidEncryptedBlobErr {
+			t.Fatal("expect tampered chunk rejected, got ", err)
+		}
+		blob.Close()
+	}
+	ioutil.WriteFile(target, stored, 0644)
+
+	// rotation re-wraps data keys and blobs are still readable by the new master key.
+	n, err := RotateMasterKey(dir, c.EncryptionKeyFile, dir+"/new.key")
+	if err != nil || n != 2 {
+		t.Fatal("cannot rotate master key: ", n, err)
+	}
+	if err := InitEncryption(c); err == nil {
+		t.Fatal("old master key should not unwrap rotated data keys")
+	}
+	c.EncryptionKeyFile = dir + "/new.key"
+	if err := InitEncryption(c); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	after, _ := ioutil.ReadFile(target)
+	if !bytes.Equal(after, stored) {
+		t.Fatal("blob is rewritten by rotation")
+	}
+
+	c.EncryptionKeyFile = ""
+	if err := InitEncryption(c); err == nil {
+		t.Fatal("expect error without master key")
+	}
+}
@@ -18,3 +18,13 @@ func ExchangeEnvValue(key string, then func(envValue string)) {
 		then(envVal)
 	}
 }
+
+// overlayEnvValue is ExchangeEnvValue whose overlay may fail,
+// the error is returned instead of exiting so that a reloaded config can be rejected.
+func overlayEnvValue(key string, then func(envValue string) error) error {
+	var err error
+	ExchangeEnvValue(key, func(envValue string) {
+		err = then(envValue)
+	})
+	return err
+}
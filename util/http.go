@@ -8,6 +8,11 @@ func HttpFileNotFoundError(w http.ResponseWriter) {
 	HttpWriteResponse(w, http.StatusNotFound, "Not Found.")
 }
 
+// HttpFileGoneError responses 410 for expired files.
+func HttpFileGoneError(w http.ResponseWriter) {
+	HttpWriteResponse(w, http.StatusGone, "Gone.")
+}
+
 func HttpInternalServerError(w http.ResponseWriter, message string) {
 	HttpWriteResponse(w, http.StatusInternalServerError, message)
 }
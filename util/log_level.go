@@ -0,0 +1,14 @@
+package util
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// SetLogLevel changes the level of the initialized gox logger.
+//
+// The gox logger writes through the logrus standard logger and filters entries by its level,
+// whose levels are defined in the same order, but it has no setter after Init.
+// This is the only place touching logrus, other code logs through the gox logger.
+func SetLogLevel(level string) {
+	logrus.SetLevel(logrus.Level(ConvertLogLevel(level)))
+}
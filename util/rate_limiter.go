@@ -0,0 +1,147 @@
+package util
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket which limits the byte rate of streams.
+//
+// Tokens are refilled continuously at the configured rate and the bucket
+// holds at most one second of tokens. A reader may take more tokens than
+// the bucket holds, in which case the bucket goes into debt and the
+// following readers wait until the debt is paid off.
+type RateLimiter struct {
+	lock           *sync.Mutex
+	rate           int64 // bytes per second, 0 means unlimited
+	tokens         float64
+	last           time.Time
+	transferred    int64
+	throttledTime  time.Duration
+	throttledCount int64
+}
+
+// RateLimiterStats is a snapshot of the rate limiter state.
+type RateLimiterStats struct {
+	Rate           int64 `json:"rate"`           // bytes per second, 0 means unlimited
+	Transferred    int64 `json:"transferred"`    // bytes passed through the limiter
+	ThrottledTime  int64 `json:"throttledTime"`  // total throttled time in milliseconds
+	ThrottledCount int64 `json:"throttledCount"` // times the limiter blocked a reader
+}
+
+// NewRateLimiter creates a new RateLimiter, rate is in bytes per second.
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{
+		lock: new(sync.Mutex),
+	}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate of the limiter at runtime,
+// rate less than or equal to 0 disables the limiter.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.last = time.Now()
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// Rate returns current rate of the limiter in bytes per second.
+func (l *RateLimiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// Wait blocks until n bytes are allowed to pass.
+func (l *RateLimiter) Wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.lock.Lock()
+	l.transferred += int64(n)
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+		l.throttledTime += delay
+		l.throttledCount++
+	}
+	l.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Stats returns a snapshot of the limiter.
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return RateLimiterStats{
+		Rate:           l.rate,
+		Transferred:    l.transferred,
+		ThrottledTime:  int64(l.throttledTime / time.Millisecond),
+		ThrottledCount: l.throttledCount,
+	}
+}
+
+// NewReader wraps a reader whose read rate is limited by this limiter.
+func (l *RateLimiter) NewReader(r io.Reader) io.Reader {
+	return &RateLimitedReader{
+		limiter: l,
+		r:       r,
+	}
+}
+
+// NewReadSeeker wraps a read seeker whose read rate is limited by this limiter.
+func (l *RateLimiter) NewReadSeeker(rs io.ReadSeeker) io.ReadSeeker {
+	return &RateLimitedReadSeeker{
+		RateLimitedReader: RateLimitedReader{
+			limiter: l,
+			r:       rs,
+		},
+		s: rs,
+	}
+}
+
+// RateLimitedReader is a reader proxy which limits the read rate.
+type RateLimitedReader struct {
+	limiter *RateLimiter
+	r       io.Reader
+}
+
+func (r *RateLimitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.limiter.Wait(n)
+	return
+}
+
+// RateLimitedReadSeeker is a read seeker proxy which limits the read rate.
+type RateLimitedReadSeeker struct {
+	RateLimitedReader
+	s io.Seeker
+}
+
+func (r *RateLimitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.s.Seek(offset, whence)
+}
@@ -0,0 +1,47 @@
+package util_test
+
+import (
+	"bytes"
+	"github.com/hetianyi/godfs/util"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := util.NewRateLimiter(1 << 20) // 1MB/s
+	src := bytes.NewReader(make([]byte, 1<<19))
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, limiter.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if n != 1<<19 {
+		t.Fatal("expect ", 1<<19, " bytes, got ", n)
+	}
+	if elapsed < time.Millisecond*400 {
+		t.Fatal("limiter does not throttle: ", elapsed)
+	}
+	stats := limiter.Stats()
+	if stats.ThrottledCount == 0 || stats.Transferred != n {
+		t.Fatal("unexpected stats: ", stats)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := util.NewRateLimiter(1024)
+	limiter.SetRate(0)
+	src := bytes.NewReader(make([]byte, 1<<20))
+	start := time.Now()
+	if _, err := io.Copy(ioutil.Discard, limiter.NewReadSeeker(src)); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Millisecond*200 {
+		t.Fatal("unlimited limiter should not throttle")
+	}
+	if limiter.Stats().ThrottledCount != 0 {
+		t.Fatal("unlimited limiter should not throttle")
+	}
+}
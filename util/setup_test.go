@@ -0,0 +1,44 @@
+package util
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// setupTestStorage sets up a storage server with a temporary data dir,
+// the config can be replaced and the config map can be set by the test.
+//
+// The returned function closes the volumes, removes the dir and restores every global
+// changed by the test, including the data dirs, volumes and keys of this package.
+func setupTestStorage(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "godfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := func(bm common.BootMode, c *common.StorageConfig, cm *common.ConfigMap, decKey []byte) func() {
+		return func() {
+			CloseVolumes()
+			nextVolume, activeVolume, activeSize = 1, 0, 0
+			dataDirs = nil
+			blobIndex = make(map[string]int)
+			keyLock.Lock()
+			masterKey, keyEntries = nil, nil
+			dataKeys, groupKeys = make(map[uint32][]byte), make(map[string]uint32)
+			keyLock.Unlock()
+			common.BootAs = bm
+			common.InitializedStorageConfiguration = c
+			common.SetConfigMap(cm)
+			aesEncDecKey = decKey
+		}
+	}(common.BootAs, common.InitializedStorageConfiguration, common.GetConfigMap(), aesEncDecKey)
+
+	common.BootAs = common.BOOT_STORAGE
+	common.InitializedStorageConfiguration = &common.StorageConfig{DataDir: dir}
+	GenerateDecKey("123456")
+	return dir, func() {
+		restore()
+		os.RemoveAll(dir)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/hetianyi/godfs/common"
 	"github.com/hetianyi/gox"
 	"github.com/hetianyi/gox/convert"
-	"github.com/hetianyi/gox/file"
 	"math/rand"
 	"time"
 )
@@ -44,11 +43,29 @@ func GenerateToken(fileId, secret string, expireTimestamp string) string {
 
 func ExistsFile(fInfo *common.FileInfo) bool {
 	if common.BootAs == common.BOOT_STORAGE {
-		return file.Exists(common.InitializedStorageConfiguration.DataDir + "/" + fInfo.Path)
+		return BlobExists(GetFileRelativePath(fInfo))
 	}
 	return false
 }
 
+// GetFileRelativePath returns the path of the file relative to the data dir,
+// files of the groups mirrored by this server are stored under "mirror/<group>".
+func GetFileRelativePath(fInfo *common.FileInfo) string {
+	for _, g := range common.InitializedStorageConfiguration.MirrorGroups {
+		if g == fInfo.Group {
+			return "mirror/" + fInfo.Group + "/" + fInfo.Path
+		}
+	}
+	return fInfo.Path
+}
+
+// GetFilePath returns the full path of the file on this storage server,
+// the path is on the first data dir if the file does not exist.
+func GetFilePath(fInfo *common.FileInfo) string {
+	path, _ := LocateBlob(GetFileRelativePath(fInfo))
+	return path
+}
+
 // ClearList clears the list elements.
 func ClearList(l *list.List) {
 	if l == nil {
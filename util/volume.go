@@ -0,0 +1,683 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/hetianyi/godfs/common"
+	"github.com/hetianyi/gox/convert"
+	"github.com/hetianyi/gox/file"
+	"github.com/hetianyi/gox/logger"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// buckets of the volume index:
+//
+//	volumeIndex:   md5 -> volume(4) offset(8) length(8) refCount(8) modTime(8)
+//	volumeEntries: volume(4) offset(8) -> md5
+//	volumes:       volume(4) -> live bytes(8)
+const (
+	bucketVolumeIndex   = "volumeIndex"
+	bucketVolumeEntries = "volumeEntries"
+	bucketVolumes       = "volumes"
+	volumeEntrySize     = 36
+)
+
+// volumeEntry is the location and reference count of a file packed in a volume.
+type volumeEntry struct {
+	volume   uint32
+	offset   int64
+	length   int64
+	refCount int64
+	modTime  int64 // in seconds
+}
+
+func (e *volumeEntry) encode() []byte {
+	bs := make([]byte, volumeEntrySize)
+	binary.BigEndian.PutUint32(bs, e.volume)
+	binary.BigEndian.PutUint64(bs[4:], uint64(e.offset))
+	binary.BigEndian.PutUint64(bs[12:], uint64(e.length))
+	binary.BigEndian.PutUint64(bs[20:], uint64(e.refCount))
+	binary.BigEndian.PutUint64(bs[28:], uint64(e.modTime))
+	return bs
+}
+
+func decodeVolumeEntry(bs []byte) *volumeEntry {
+	if len(bs) != volumeEntrySize {
+		return nil
+	}
+	return &volumeEntry{
+		volume:   binary.BigEndian.Uint32(bs),
+		offset:   int64(binary.BigEndian.Uint64(bs[4:])),
+		length:   int64(binary.BigEndian.Uint64(bs[12:])),
+		refCount: int64(binary.BigEndian.Uint64(bs[20:])),
+		modTime:  int64(binary.BigEndian.Uint64(bs[28:])),
+	}
+}
+
+// entryKey is the key of the entry in bucket volumeEntries,
+// keys of a volume are sorted by offset.
+func entryKey(volume uint32, offset int64) []byte {
+	bs := make([]byte, 12)
+	binary.BigEndian.PutUint32(bs, volume)
+	binary.BigEndian.PutUint64(bs[4:], uint64(offset))
+	return bs
+}
+
+func volumeKey(volume uint32) []byte {
+	bs := make([]byte, 4)
+	binary.BigEndian.PutUint32(bs, volume)
+	return bs
+}
+
+var (
+	volumeDB        *bolt.DB
+	volumeDir       string
+	volumeThreshold int64 // in bytes
+	// the volume which new files are appended to.
+	activeVolume uint32
+	activeFile   *os.File
+	activeSize   int64
+	nextVolume   uint32 = 1
+	volumeLock          = new(sync.Mutex)
+	compactLock         = new(sync.Mutex)
+)
+
+// InitVolumes opens the volume index under the data dir,
+// the index is opened if volumes are enabled or have been used before,
+// so that packed files are still readable after volumes are disabled.
+func InitVolumes(c *common.StorageConfig) error {
+	dir := c.DataDir + "/volume"
+	if c.VolumeThreshold == 0 && !file.Exists(dir+"/index.db") {
+		return nil
+	}
+	if !file.Exists(dir) {
+		if err := file.CreateDirs(dir); err != nil {
+			return err
+		}
+	}
+	db, err := bolt.Open(dir+"/index.db", 0600, nil)
+	if err != nil {
+		return err
+	}
+	var last uint32
+	var lastLive int64
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{bucketVolumeIndex, bucketVolumeEntries, bucketVolumes} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		if k, v := tx.Bucket([]byte(bucketVolumes)).Cursor().Last(); k != nil {
+			last = binary.BigEndian.Uint32(k)
+			lastLive = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	volumeLock.Lock()
+	defer volumeLock.Unlock()
+	volumeDB = db
+	volumeDir = dir
+	volumeThreshold = int64(c.VolumeThreshold) * 1024
+	nextVolume = last + 1
+	// continue appending to the last volume if it is not full.
+	if last > 0 {
+		if info, err := os.Stat(volumePath(last)); err == nil && info.Size() < common.VOLUME_SIZE {
+			if f, err := os.OpenFile(volumePath(last), os.O_RDWR, 0644); err == nil {
+				activeVolume, activeFile, activeSize = last, f, info.Size()
+			}
+		}
+	}
+	logger.Info("volume index is opened, last volume: ", last, ", live bytes: ", lastLive)
+	return nil
+}
+
+// CloseVolumes closes the active volume and the volume index.
+func CloseVolumes() error {
+	volumeLock.Lock()
+	defer volumeLock.Unlock()
+	if activeFile != nil {
+		activeFile.Close()
+		activeFile = nil
+	}
+	if volumeDB == nil {
+		return nil
+	}
+	err := volumeDB.Close()
+	volumeDB = nil
+	return err
+}
+
+func volumePath(volume uint32) string {
+	return fmt.Sprintf("%s/%08d.vol", volumeDir, volume)
+}
+
+// newVolume creates an empty volume file.
+func newVolume() (uint32, *os.File, error) {
+	id := nextVolume
+	f, err := os.OpenFile(volumePath(id), os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = volumeDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketVolumes)).Put(volumeKey(id), make([]byte, 8))
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return 0, nil, err
+	}
+	nextVolume++
+	return id, f, nil
+}
+
+// addLive changes the live bytes of the volume.
+func addLive(tx *bolt.Tx, volume uint32, value int64) error {
+	b := tx.Bucket([]byte(bucketVolumes))
+	v := b.Get(volumeKey(volume))
+	if len(v) != 8 {
+		return nil
+	}
+	bs := make([]byte, 8)
+	binary.BigEndian.PutUint64(bs, uint64(int64(binary.BigEndian.Uint64(v))+value))
+	return b.Put(volumeKey(volume), bs)
+}
+
+// lookupVolumeEntry returns the entry of the file packed in volumes,
+// it returns nil if the file is not packed or deleted.
+func lookupVolumeEntry(md5 string) *volumeEntry {
+	if volumeDB == nil {
+		return nil
+	}
+	var e *volumeEntry
+	volumeDB.View(func(tx *bolt.Tx) error {
+		e = decodeVolumeEntry(tx.Bucket([]byte(bucketVolumeIndex)).Get([]byte(md5)))
+		return nil
+	})
+	if e == nil || e.refCount <= 0 {
+		return nil
+	}
+	return e
+}
+
+// placeVolumeBlob packs the file into the active volume if it is smaller than the threshold,
+// the reference count tail of the file is moved into the index.
+//
+// It returns false if the file is not packed.
+func placeVolumeBlob(src, rel string) (bool, error) {
+	if volumeDB == nil || volumeThreshold == 0 {
+		return false, nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+	length := info.Size() - 4
+	if length < 0 || length >= volumeThreshold {
+		return false, nil
+	}
+	tailRefBytes := make([]byte, 8)
+	if _, err := in.ReadAt(tailRefBytes[4:], length); err != nil {
+		return true, err
+	}
+	if err := appendVolumeBlob(in, path.Base(rel), length, convert.Bytes2Length(tailRefBytes)); err != nil {
+		return true, err
+	}
+	in.Close()
+	file.Delete(src)
+	return true, nil
+}
+
+// appendVolumeBlob appends the content to the active volume and indexes it,
+// the reference count is increased instead if the file is packed already.
+func appendVolumeBlob(in io.ReaderAt, md5 string, length, refCount int64) error {
+	volumeLock.Lock()
+	if activeFile == nil || activeSize+length > common.VOLUME_SIZE {
+		if activeFile != nil {
+			activeFile.Close()
+			activeFile = nil
+		}
+		id, f, err := newVolume()
+		if err != nil {
+			volumeLock.Unlock()
+			return err
+		}
+		activeVolume, activeFile, activeSize = id, f, 0
+	}
+	volume, offset := activeVolume, activeSize
+	if _, err := activeFile.Seek(offset, 0); err != nil {
+		volumeLock.Unlock()
+		return err
+	}
+	if _, err := io.Copy(activeFile, io.NewSectionReader(in, 0, length)); err != nil {
+		activeFile.Truncate(offset)
+		volumeLock.Unlock()
+		return err
+	}
+	activeSize += length
+	volumeLock.Unlock()
+
+	// the index is updated without the lock so that concurrent updates are batched,
+	// bytes of a duplicate append are reclaimed by compaction.
+	return volumeDB.Batch(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(bucketVolumeIndex))
+		if e := decodeVolumeEntry(index.Get([]byte(md5))); e != nil && e.refCount > 0 {
+			e.refCount += refCount
+			return index.Put([]byte(md5), e.encode())
+		}
+		e := &volumeEntry{
+			volume:   volume,
+			offset:   offset,
+			length:   length,
+			refCount: refCount,
+			modTime:  time.Now().Unix(),
+		}
+		if err := index.Put([]byte(md5), e.encode()); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketVolumeEntries)).Put(entryKey(volume, offset), []byte(md5)); err != nil {
+			return err
+		}
+		return addLive(tx, volume, length)
+	})
+}
+
+// UpdateVolumeReferenceCount changes the reference count of the file packed in volumes,
+// a file whose reference count drops to zero is deleted and its space is reclaimed by compaction.
+//
+// It returns false if the file is not packed.
+func UpdateVolumeReferenceCount(rel string, value int64) (bool, error) {
+	if volumeDB == nil {
+		return false, nil
+	}
+	md5 := []byte(path.Base(rel))
+	found := false
+	err := volumeDB.Batch(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(bucketVolumeIndex))
+		e := decodeVolumeEntry(index.Get(md5))
+		found = e != nil && e.refCount > 0
+		if !found {
+			return nil
+		}
+		logger.Debug("file referenced count: ", e.refCount)
+		e.refCount += value
+		if e.refCount <= 0 {
+			if err := addLive(tx, e.volume, -e.length); err != nil {
+				return err
+			}
+		}
+		return index.Put(md5, e.encode())
+	})
+	return found, err
+}
+
+// Blob is a stored file opened for reading,
+// the content excludes the reference count tail.
+type Blob struct {
+	*io.SectionReader
+	RefCount int64
+	ModTime  time.Time
+	f        *os.File
+}
+
+// Close closes the underlying file.
+func (b *Blob) Close() error {
+	return b.f.Close()
+}
+
+// BlobExists checks if the blob is stored in the data dirs or packed in volumes.
+func BlobExists(rel string) bool {
+	if _, exists := LocateBlob(rel); exists {
+		return true
+	}
+	return lookupVolumeEntry(path.Base(rel)) != nil
+}
+
+// BlobRef is a stored blob and its reference count,
+// Rel of a file packed in volumes is its md5.
+type BlobRef struct {
+	Rel      string
+	Packed   bool
+	RefCount int64 // -1 if the reference count is unreadable
+	Size     int64 // stored size in bytes
+	ModTime  int64 // in seconds
+}
+
+// ListBlobs scans the standalone blobs of the online data dirs
+// and returns them with the files packed in volumes which are not deleted.
+func ListBlobs() ([]BlobRef, error) {
+	var roots []string
+	dataDirLock.RLock()
+	for _, d := range dataDirs {
+		if d.online {
+			roots = append(roots, d.path)
+		}
+	}
+	if len(dataDirs) == 0 {
+		// data dirs are not initialized.
+		roots = append(roots, common.InitializedStorageConfiguration.DataDir)
+	}
+	dataDirLock.RUnlock()
+
+	var ret []BlobRef
+	found := make(map[string]bool)
+	for _, root := range roots {
+		rels, err := scanDataDir(root)
+		if err != nil {
+			return nil, err
+		}
+		for _, rel := range rels {
+			// the first copy wins as it does in the index.
+			if found[rel] {
+				continue
+			}
+			found[rel] = true
+			ret = append(ret, StatBlob(root+"/"+rel, rel))
+		}
+	}
+	if volumeDB == nil {
+		return ret, nil
+	}
+	err := volumeDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketVolumeIndex)).ForEach(func(k, v []byte) error {
+			if e := decodeVolumeEntry(v); e != nil && e.refCount > 0 {
+				ret = append(ret, BlobRef{
+					Rel:      string(k),
+					Packed:   true,
+					RefCount: e.refCount,
+					Size:     e.length,
+					ModTime:  e.modTime,
+				})
+			}
+			return nil
+		})
+	})
+	return ret, err
+}
+
+// StatBlob reads the reference count and the file info of the standalone blob,
+// the reference count is -1 if it is unreadable.
+func StatBlob(fullPath, rel string) BlobRef {
+	ret := BlobRef{Rel: rel, RefCount: -1}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return ret
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ret
+	}
+	ret.Size = info.Size()
+	ret.ModTime = info.ModTime().Unix()
+	state, err := blobState(rel)
+	if err != nil {
+		return ret
+	}
+	if state != nil {
+		ret.RefCount = state.RefCount
+		ret.Size = state.Size
+		return ret
+	}
+	if refCount, size, err := readTail(f); err == nil {
+		ret.RefCount = refCount
+		ret.Size = size
+	}
+	return ret
+}
+
+// LookupVolumeBlob returns the packed blob by its md5, or nil if it does not exist.
+func LookupVolumeBlob(md5 string) *BlobRef {
+	e := lookupVolumeEntry(md5)
+	if e == nil {
+		return nil
+	}
+	return &BlobRef{
+		Rel:      md5,
+		Packed:   true,
+		RefCount: e.refCount,
+		Size:     e.length,
+		ModTime:  e.modTime,
+	}
+}
+
+// OpenBlob opens the blob by its path relative to the data dir,
+// the blob is either a standalone file or a file packed in a volume,
+// encrypted blobs are decrypted transparently.
+func OpenBlob(rel string) (*Blob, error) {
+	if fullPath, exists := LocateBlob(rel); exists {
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		// blobs of old versions keep the reference count in the tail.
+		state, err := blobState(rel)
+		if err == nil && state == nil {
+			state = &common.BlobState{}
+			state.RefCount, state.Size, err = readTail(f)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return decryptBlob(&Blob{
+			SectionReader: io.NewSectionReader(f, 0, state.Size),
+			RefCount:      state.RefCount,
+			ModTime:       info.ModTime(),
+			f:             f,
+		})
+	}
+	// the volume may be removed by compaction after lookup, so lookup again.
+	for i := 0; i < 2; i++ {
+		e := lookupVolumeEntry(path.Base(rel))
+		if e == nil {
+			break
+		}
+		f, err := os.Open(volumePath(e.volume))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return decryptBlob(&Blob{
+			SectionReader: io.NewSectionReader(f, e.offset, e.length),
+			RefCount:      e.refCount,
+			ModTime:       time.Unix(e.modTime, 0),
+			f:             f,
+		})
+	}
+	return nil, common.NotFoundErr
+}
+
+// VolumesEnabled judges whether the volume index is opened.
+func VolumesEnabled() bool {
+	return volumeDB != nil
+}
+
+// VolumeStatus returns the state of each volume.
+func VolumeStatus() []common.VolumeStatus {
+	if volumeDB == nil {
+		return nil
+	}
+	var ret []common.VolumeStatus
+	volumeDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketVolumes)).ForEach(func(k, v []byte) error {
+			ret = append(ret, common.VolumeStatus{
+				Id:   binary.BigEndian.Uint32(k),
+				Live: int64(binary.BigEndian.Uint64(v)),
+			})
+			return nil
+		})
+	})
+	volumeLock.Lock()
+	active := activeVolume
+	volumeLock.Unlock()
+	for i := range ret {
+		if info, err := os.Stat(volumePath(ret[i].Id)); err == nil {
+			ret[i].Size = info.Size()
+		}
+		ret[i].Active = ret[i].Id == active
+	}
+	return ret
+}
+
+// CompactVolumes rewrites the sealed volumes whose ratio of deleted space reaches the ratio,
+// it returns the number of bytes reclaimed.
+func CompactVolumes(ratio float64) (int64, error) {
+	compactLock.Lock()
+	defer compactLock.Unlock()
+
+	var reclaimed int64
+	status := VolumeStatus()
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Id < status[j].Id
+	})
+	for _, st := range status {
+		if st.Active || st.Size == 0 || float64(st.Size-st.Live)/float64(st.Size) < ratio {
+			continue
+		}
+		n, err := compactVolume(st.Id)
+		if err != nil {
+			return reclaimed, err
+		}
+		logger.Info("volume ", st.Id, " is compacted, ", n, " bytes reclaimed")
+		reclaimed += n
+	}
+	return reclaimed, nil
+}
+
+// liveEntry is a file in a volume being compacted.
+type liveEntry struct {
+	md5       []byte
+	offset    int64
+	length    int64
+	newOffset int64
+}
+
+// compactVolume copies the files which are not deleted to a new volume,
+// and removes the old volume.
+func compactVolume(volume uint32) (int64, error) {
+	var lives []*liveEntry
+	prefix := volumeKey(volume)
+	err := volumeDB.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(bucketVolumeIndex))
+		c := tx.Bucket([]byte(bucketVolumeEntries)).Cursor()
+		for k, v := c.Seek(prefix); k != nil && string(k[:4]) == string(prefix); k, v = c.Next() {
+			offset := int64(binary.BigEndian.Uint64(k[4:]))
+			e := decodeVolumeEntry(index.Get(v))
+			if e == nil || e.refCount <= 0 || e.volume != volume || e.offset != offset {
+				continue
+			}
+			lives = append(lives, &liveEntry{
+				md5:    append([]byte{}, v...),
+				offset: offset,
+				length: e.length,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	old, err := os.Open(volumePath(volume))
+	if err != nil {
+		return 0, err
+	}
+	defer old.Close()
+	info, err := old.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var target uint32
+	var size int64
+	if len(lives) > 0 {
+		volumeLock.Lock()
+		id, f, err := newVolume()
+		volumeLock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		target = id
+		for _, l := range lives {
+			l.newOffset = size
+			if _, err := io.Copy(f, io.NewSectionReader(old, l.offset, l.length)); err != nil {
+				f.Close()
+				return 0, err
+			}
+			size += l.length
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = volumeDB.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(bucketVolumeIndex))
+		entries := tx.Bucket([]byte(bucketVolumeEntries))
+		for _, l := range lives {
+			e := decodeVolumeEntry(index.Get(l.md5))
+			if e == nil || e.volume != volume || e.offset != l.offset || e.refCount <= 0 {
+				continue
+			}
+			e.volume, e.offset = target, l.newOffset
+			if err := index.Put(l.md5, e.encode()); err != nil {
+				return err
+			}
+			if err := entries.Put(entryKey(target, l.newOffset), l.md5); err != nil {
+				return err
+			}
+			if err := addLive(tx, target, l.length); err != nil {
+				return err
+			}
+		}
+		// remove entries of the old volume, and index of the deleted files in it.
+		var keys [][]byte
+		c := entries.Cursor()
+		for k, v := c.Seek(prefix); k != nil && string(k[:4]) == string(prefix); k, v = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+			if e := decodeVolumeEntry(index.Get(v)); e != nil && e.volume == volume {
+				if err := index.Delete(v); err != nil {
+					return err
+				}
+			}
+		}
+		for _, k := range keys {
+			if err := entries.Delete(k); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(bucketVolumes)).Delete(prefix)
+	})
+	if err != nil {
+		return 0, err
+	}
+	old.Close()
+	if err := os.Remove(volumePath(volume)); err != nil {
+		logger.Error("error remove volume ", volume, ": ", err)
+	}
+	return info.Size() - size, nil
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"github.com/hetianyi/godfs/common"
+	"io/ioutil"
+	"testing"
+)
+
+func TestVolumes(t *testing.T) {
+	dir, teardown := setupTestStorage(t)
+	defer teardown()
+
+	c := &common.StorageConfig{
+		DataDir:         dir,
+		VolumeThreshold: 1,
+	}
+	common.InitializedStorageConfiguration = c
+	if err := InitVolumes(c); err != nil {
+		t.Fatal(err)
+	}
+
+	place := func(rel string, content []byte) string {
+		tmp := dir + "/tmp"
+		if err := ioutil.WriteFile(tmp, append(content, 0, 0, 0, 1), 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := PlaceBlob(tmp, rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	read := func(rel string) (string, int64) {
+		blob, err := OpenBlob(rel)
+		if err != nil {
+			t.Fatal(rel, ": ", err)
+		}
+		defer blob.Close()
+		bs, err := ioutil.ReadAll(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bs), blob.RefCount
+	}
+
+	small1 := "0A/0B/0123456789abcdef0123456789abcde1"
+	small2 := "0A/0B/0123456789abcdef0123456789abcde2"
+	large := "0A/0B/0123456789abcdef0123456789abcde3"
+	if p := place(small1, []byte("small1")); p != "" {
+		t.Fatal("small file is not packed: ", p)
+	}
+	place(small2, []byte("small2"))
+	if p := place(large, make([]byte, 1024)); p != dir+"/"+large {
+		t.Fatal("large file is packed: ", p)
+	}
+	for _, rel := range []string{small1, small2, large} {
+		if !BlobExists(rel) {
+			t.Fatal("blob is not found: ", rel)
+		}
+	}
+	if s, n := read(small2); s != "small2" || n != 1 {
+		t.Fatal("unexpected content of packed file: ", s, n)
+	}
+
+	// reference count is kept in the index.
+	if packed, err := UpdateVolumeReferenceCount(small1, 1); !packed || err != nil {
+		t.Fatal("cannot update reference count: ", err)
+	}
+	if _, n := read(small1); n != 2 {
+		t.Fatal("expect reference count 2, got ", n)
+	}
+	if packed, _ := UpdateVolumeReferenceCount(large, 1); packed {
+		t.Fatal("large file is updated in volume index")
+	}
+	UpdateVolumeReferenceCount(small1, -2)
+	if BlobExists(small1) {
+		t.Fatal("deleted file still exists")
+	}
+
+	// compaction reclaims the deleted file and keeps the live one readable.
+	if _, err := CompactVolumes(0.1); err != nil {
+		t.Fatal(err)
+	}
+	if st := VolumeStatus(); len(st) != 1 || !st[0].Active || st[0].Size != 12 {
+		t.Fatal("active volume should not be compacted: ", st)
+	}
+	// seal the active volume.
+	volumeLock.Lock()
+	activeFile.Close()
+	activeFile, activeVolume = nil, 0
+	volumeLock.Unlock()
+	reclaimed, err := CompactVolumes(0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != 6 {
+		t.Fatal("expect 6 bytes reclaimed, got ", reclaimed)
+	}
+	st := VolumeStatus()
+	if len(st) != 1 || st[0].Id != 2 || st[0].Size != 6 || st[0].Live != 6 {
+		t.Fatal("unexpected volume status after compaction: ", st)
+	}
+	if s, n := read(small2); s != "small2" || n != 1 {
+		t.Fatal("unexpected content after compaction: ", s, n)
+	}
+	if _, err := OpenBlob(small1); err != common.NotFoundErr {
+		t.Fatal("expect deleted file not found, got ", err)
+	}
+}